@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lktr/internal/bench"
+	"lktr/internal/dns"
+	"os"
+	"strings"
+	"time"
+)
+
+// runBench implements the `lktr bench` subcommand
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	cfg := bench.Config{}
+	var domains, blocked, qtype string
+	var matcherRules, wildcardEvery int
+
+	fs.StringVar(&cfg.Target, "target", "127.0.0.1:53", "DNS server to send load to")
+	fs.IntVar(&cfg.QPS, "qps", 1000, "Target queries per second, up to 1e9 (0 for unlimited)")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 16, "Number of concurrent workers")
+	fs.DurationVar(&cfg.Duration, "duration", 10*time.Second, "How long to generate load")
+	fs.DurationVar(&cfg.Timeout, "timeout", 2*time.Second, "Per-query timeout")
+	fs.StringVar(&domains, "domains", "example.com,example.org,example.net", "Comma-separated domains to query")
+	fs.StringVar(&blocked, "blocked", "", "Comma-separated domains expected to be blocked")
+	fs.Float64Var(&cfg.BlockedRatio, "blocked-ratio", 0, "Fraction of queries (0-1) drawn from the blocked domains")
+	fs.StringVar(&qtype, "qtype", "A", "Query type to send")
+	fs.IntVar(&matcherRules, "matcher-rules", 0, "Measure matcher memory for this many synthetic rules instead of sending load")
+	fs.IntVar(&wildcardEvery, "matcher-wildcard-every", 10, "Make every Nth synthetic rule a wildcard")
+	fs.Parse(args)
+
+	if matcherRules > 0 {
+		bench.MeasureMatcher(matcherRules, wildcardEvery).Report(os.Stdout)
+		return 0
+	}
+
+	t, ok := dns.ParseQType(qtype)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown query type: %s\n", qtype)
+		return 2
+	}
+	cfg.QType = t
+	cfg.Domains = splitList(domains)
+	cfg.Blocked = splitList(blocked)
+
+	fmt.Printf("Benchmarking %s for %v (qps=%d, concurrency=%d)\n", cfg.Target, cfg.Duration, cfg.QPS, cfg.Concurrency)
+
+	res, err := bench.Run(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench failed: %v\n", err)
+		return 1
+	}
+	res.Report(os.Stdout)
+	return 0
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
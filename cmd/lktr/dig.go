@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"lktr/internal/dns"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Header flag bits printed by dig, in dig's order
+var digFlags = []struct {
+	bit  uint16
+	name string
+}{
+	{1 << 15, "qr"}, {1 << 10, "aa"}, {1 << 9, "tc"}, {1 << 8, "rd"}, {1 << 7, "ra"}, {1 << 5, "ad"}, {1 << 4, "cd"},
+}
+
+// runDig implements the `lktr dig` subcommand, a minimal dig for images
+// that ship without one
+func runDig(args []string) int {
+	fs := flag.NewFlagSet("dig", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: lktr dig [flags] <name> [type] [@server[:port]]")
+		fs.PrintDefaults()
+	}
+	useTCP := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for the answer")
+	edns := fs.Int("edns", 1232, "EDNS UDP payload size to advertise (0 sends no OPT record)")
+	noRecurse := fs.Bool("norecurse", false, "Clear the recursion desired bit")
+	fs.Parse(args)
+
+	name, qtype, server := "", dns.TypeA, "127.0.0.1:53"
+	for _, arg := range fs.Args() {
+		if s, ok := strings.CutPrefix(arg, "@"); ok {
+			server = s
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+			}
+			continue
+		}
+		if t, ok := dns.ParseQType(arg); ok && name != "" {
+			qtype = t
+			continue
+		}
+		if name != "" {
+			fs.Usage()
+			return 2
+		}
+		name = arg
+	}
+	if name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	query := &dns.Message{
+		ID:        uint16(rand.UintN(1 << 16)),
+		Questions: []dns.Question{{Name: name, Type: qtype, Class: dns.ClassINET}},
+	}
+	if !*noRecurse {
+		query.Flags |= 1 << 8
+	}
+	if *edns > 0 {
+		query.Additional = []dns.RR{{Type: dns.TypeOPT, Class: uint16(min(*edns, 65535))}}
+	}
+	packed := query.Pack()
+
+	start := time.Now()
+	response, err := digExchange(server, packed, *useTCP, *timeout)
+	if err == nil && !*useTCP {
+		if m, perr := dns.ParseMessage(response); perr == nil && m.Truncated() {
+			fmt.Println(";; Truncated, retrying in TCP mode.")
+			*useTCP = true
+			response, err = digExchange(server, packed, true, *timeout)
+		}
+	}
+	protocol := "udp"
+	if *useTCP {
+		protocol = "tcp"
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ";; communications error to %s: %v\n", server, err)
+		return 1
+	}
+
+	m, err := dns.ParseMessage(response)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ";; malformed response from %s: %v\n", server, err)
+		return 1
+	}
+	if m.ID != query.ID {
+		fmt.Fprintf(os.Stderr, ";; response ID %d does not match query ID %d\n", m.ID, query.ID)
+		return 1
+	}
+	printMessage(os.Stdout, m)
+	fmt.Printf(";; Query time: %d msec\n", elapsed.Milliseconds())
+	fmt.Printf(";; SERVER: %s (%s)\n", server, protocol)
+	fmt.Printf(";; WHEN: %s\n", time.Now().Format(time.RFC1123))
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n", len(response))
+	return 0
+}
+
+// digExchange sends one query and returns the raw response
+func digExchange(server string, query []byte, useTCP bool, timeout time.Duration) ([]byte, error) {
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if !useTCP {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, buf)
+	return buf, err
+}
+
+// printMessage writes m in the layout of dig's default output
+func printMessage(w io.Writer, m *dns.Message) {
+	var flags []string
+	for _, f := range digFlags {
+		if m.Flags&f.bit != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	var opt *dns.RR
+	var additional []dns.RR
+	for i, rr := range m.Additional {
+		if rr.Type == dns.TypeOPT {
+			opt = &m.Additional[i]
+			continue
+		}
+		additional = append(additional, rr)
+	}
+
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: QUERY, status: %s, id: %d\n", dns.RcodeName(m.Rcode()), m.ID)
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additional))
+	if opt != nil {
+		fmt.Fprintf(w, "\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d; udp: %d\n", opt.TTL>>16&0xFF, opt.Class)
+	}
+	fmt.Fprintln(w, "\n;; QUESTION SECTION:")
+	for _, q := range m.Questions {
+		fmt.Fprintf(w, ";%s.\t\t%s\t%s\n", strings.TrimSuffix(q.Name, "."), dns.ClassName(q.Class), dns.TypeName(q.Type))
+	}
+	for _, section := range []struct {
+		title string
+		rrs   []dns.RR
+	}{{"ANSWER", m.Answers}, {"AUTHORITY", m.Authority}, {"ADDITIONAL", additional}} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", section.title)
+		for _, rr := range section.rrs {
+			fmt.Fprintln(w, rr.String())
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+)
+
+//go:embed fallback_blocklist.txt
+var embeddedFallback string
+
+// loadFallbackBlocklist reads the fallback rules from path, or from the list
+// compiled into the binary when path is empty
+func loadFallbackBlocklist(path string) ([]string, error) {
+	if path == "" {
+		return parseRuleList(strings.NewReader(embeddedFallback))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRuleList(f)
+}
+
+// parseRuleList reads one rule per line, skipping blank lines and # comments
+func parseRuleList(r io.Reader) ([]string, error) {
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules, scanner.Err()
+}
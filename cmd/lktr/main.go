@@ -1,22 +1,68 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"lktr/internal/anomaly"
+	"lktr/internal/bootstrap"
 	"lktr/internal/client"
 	"lktr/internal/config"
+	"lktr/internal/dashboard"
 	"lktr/internal/dns"
+	"lktr/internal/geoip"
+	"lktr/internal/grpcapi"
+	"lktr/internal/history"
 	"lktr/internal/metrics"
+	"lktr/internal/querylog"
+	"lktr/internal/redirect"
+	"lktr/internal/regopolicy"
+	"lktr/internal/secrets"
 	"lktr/internal/server"
+	"lktr/internal/spiffe"
+	"lktr/internal/telemetry"
+	"lktr/internal/threatintel"
+	"lktr/internal/tuning"
+	"lktr/internal/wasmhook"
 	"lktr/pkg/matcher"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// version is reported to the controller; release builds set it with
+// -ldflags "-X main.version=..."
+var version = "0.0.3-rc"
+
+// spiffeStartTimeout bounds the wait for the first SVID at startup
+const spiffeStartTimeout = 30 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dig" {
+		os.Exit(runDig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "pihole" {
+		os.Exit(runPihole(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelfTest(os.Args[2:]))
+	}
+
 	cfg := config.Load()
 
-	log.Info().Msg("DNS Proxy v0.0.3-rc (Sidecar Mode)\n")
+	log.Info().Msgf("DNS Proxy v%s (Sidecar Mode)\n", version)
 	log.Info().Msgf("Listening on: %s\n", cfg.ListenAddr)
 	log.Info().Msgf("Upstream DNS: %s\n", cfg.UpstreamDNS)
 	if cfg.HTTPSModeEnabled {
@@ -39,6 +85,12 @@ func main() {
 	log.Info().Msgf("Metrics endpoint: http://%s/metrics\n", cfg.MetricsAddr)
 	log.Info().Msg("Starting DNS proxy...")
 
+	tuning.Apply(tuning.Options{
+		GCPercent:        cfg.GCPercent,
+		MemoryLimitMB:    cfg.MemoryLimitMB,
+		MemoryLimitRatio: cfg.MemoryLimitRatio,
+	})
+
 	// Start metrics server in background
 	go func() {
 		if err := metrics.StartMetricsServer(cfg.MetricsAddr); err != nil {
@@ -46,7 +98,45 @@ func main() {
 		}
 	}()
 
-	blocklist := []string{}
+	if cfg.PushURL != "" {
+		labels, err := metrics.ParsePushLabels(cfg.PushLabels)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid push labels")
+		}
+		if cfg.PushInterval <= 0 {
+			log.Fatal().Msg("Push interval must be positive")
+		}
+		go metrics.StartPusher(metrics.PushConfig{
+			URL:      cfg.PushURL,
+			Job:      cfg.PushJob,
+			Interval: cfg.PushInterval,
+			Labels:   labels,
+		})
+	}
+
+	if cfg.StatsDAddr != "" {
+		if cfg.StatsDInterval <= 0 {
+			log.Fatal().Msg("StatsD interval must be positive")
+		}
+		err := metrics.StartStatsD(metrics.StatsDConfig{
+			Addr:     cfg.StatsDAddr,
+			Prefix:   cfg.StatsDPrefix,
+			Interval: cfg.StatsDInterval,
+			Tags:     cfg.StatsDTags,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start StatsD emitter")
+		}
+	}
+
+	// The fallback blocklist protects the sidecar until the first policy arrives
+	blocklist, err := loadFallbackBlocklist(cfg.FallbackBlocklist)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load fallback blocklist")
+	}
+	if len(blocklist) > 0 {
+		log.Info().Msgf("Fallback blocklist: %d rules\n", len(blocklist))
+	}
 
 	m := matcher.BuildMatcher(blocklist)
 	dnsMeshDohTimeout, err := strconv.Atoi(os.Getenv("DNS_MESH_DOH_TIMEOUT"))
@@ -54,22 +144,529 @@ func main() {
 		dnsMeshDohTimeout = 10
 	}
 
+	// Secrets are loaded before the components using them are built
+	store := &secretStore{}
+	secretsWatcher, err := newSecretsWatcher(cfg, store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid secrets configuration")
+	}
+	if secretsWatcher != nil {
+		if err := secretsWatcher.Load(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load secrets")
+		}
+	}
+
 	// Create a function to get TLS cert data from config
 	getTLSCertData := func() ([]byte, []byte, []byte) {
 		return cfg.GetTLSClientCertData(), cfg.GetTLSClientKeyData(), cfg.GetTLSCACertData()
 	}
 	dnsHandler := dns.NewHandler(cfg.UpstreamDNS, cfg.Verbose, m, cfg.HTTPSModeEnabled, cfg.HTTPSUpstream, dnsMeshDohTimeout, cfg.TLSCACert, cfg.TLSClientCert, cfg.TLSClientKey, cfg.TLSInsecureSkipVerify, getTLSCertData)
+	bootstrapDNS := bootstrapResolver(cfg)
+	if bootstrapDNS != nil {
+		dnsHandler.Bootstrap = bootstrapDNS
+		dnsHandler.UpdateTLSConfig()
+	}
+
+	if secretsWatcher != nil {
+		secretsWatcher.Apply = func(s secrets.Secrets) {
+			applySecrets(cfg, store, s)
+			dnsHandler.UpdateTLSConfig()
+		}
+		go secretsWatcher.Run(context.Background())
+	}
+
+	// SVIDs replace the static client certificates once the first one arrived
+	var spiffeSource *spiffe.Source
+	if cfg.SPIFFESocket != "" {
+		spiffeSource, err = spiffe.NewSource(cfg.SPIFFESocket)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid SPIFFE configuration")
+		}
+		if err := spiffeSource.Start(spiffeStartTimeout); err != nil {
+			log.Fatal().Err(err).Msg("Failed to obtain a SPIFFE identity")
+		}
+		dnsHandler.SPIFFE = spiffeSource
+		dnsHandler.UpdateTLSConfig()
+	}
+
+	if cfg.DNS64Enabled {
+		dns64, err := dns.NewDNS64(cfg.DNS64Prefix, strings.Split(cfg.DNS64Exclude, ",")...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid DNS64 configuration")
+		}
+		dnsHandler.DNS64 = dns64
+		log.Info().Msgf("DNS64 synthesis: ENABLED (prefix %s)\n", cfg.DNS64Prefix)
+	}
+
+	ttlClamp, err := dns.NewTTLClamp(cfg.MinTTL, cfg.MaxTTL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TTL bounds")
+	}
+	if ttlClamp != nil {
+		dnsHandler.TTLClamp = ttlClamp
+		log.Info().Msgf("Upstream TTLs clamped to %d-%ds (0 is no bound)\n", ttlClamp.Min, ttlClamp.Max)
+	}
+
+	if cfg.RewriteRules != "" {
+		rewriter, err := dns.ParseRewriteRules(cfg.RewriteRules)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid rewrite rules")
+		}
+		dnsHandler.Rewriter = rewriter
+		log.Info().Msgf("Query rewrite rules: %d\n", rewriter.Len())
+	}
+
+	if cfg.CNAMEFlatten {
+		dnsHandler.CNAMEFlattener = dns.NewCNAMEFlattener(cfg.CNAMEFlattenDepth)
+		log.Info().Msgf("CNAME flattening: ENABLED (max depth %d)\n", dnsHandler.CNAMEFlattener.MaxDepth)
+	}
+
+	if cfg.SearchDomains != "" {
+		searchDomains, err := dns.ParseSearchDomains(cfg.SearchDomains)
+		if err != nil {
+			log.Err(err).Msg("Failed to read search domains, matching without them")
+		}
+		dnsHandler.SearchDomains = searchDomains
+		log.Info().Msgf("Search domains stripped before matching: %v\n", searchDomains)
+	}
+
+	var routeUpstreams []string
+	for _, upstream := range strings.Split(cfg.RouteUpstreams, ",") {
+		if upstream = strings.TrimSpace(upstream); upstream != "" {
+			routeUpstreams = append(routeUpstreams, upstream)
+		}
+	}
+
+	// The controller and upstreams stay resolvable whatever the blocklist says
+	if critical := dns.CriticalNames(cfg.ControllerURL, cfg.ClusterDomain, append([]string{cfg.UpstreamDNS, cfg.HTTPSUpstream, cfg.SpillUpstream, cfg.HedgeUpstream}, routeUpstreams...)...); len(critical) > 0 {
+		dnsHandler.Critical = matcher.BuildMatcher(critical)
+		log.Info().Msgf("Critical names never blocked: %v\n", critical)
+	}
+
+	padding, err := dns.ParsePadding(cfg.Padding, cfg.PaddingBlock)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid EDNS padding")
+	}
+	dnsHandler.Padding = padding
+	if cfg.CaseRandomization {
+		dnsHandler.CaseRandomization = true
+		log.Info().Msg("Upstream 0x20 case randomization: ENABLED\n")
+	}
+	if cfg.UpstreamCookies {
+		dnsHandler.Cookies = dns.NewCookieJar()
+		log.Info().Msg("Upstream DNS cookies: ENABLED\n")
+	}
+
+	if cfg.QueryIDOption != 0 && (cfg.QueryIDOption < 65001 || cfg.QueryIDOption > 65534) {
+		log.Fatal().Msgf("Invalid query ID option code %d, expected 0 or 65001-65534", cfg.QueryIDOption)
+	}
+	dnsHandler.QueryIDOption = uint16(cfg.QueryIDOption)
+
+	if dns.FaultInjectionBuilt {
+		faults, err := dns.ParseFaults(cfg.FaultInject)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid fault injection")
+		}
+		if faults != nil {
+			dnsHandler.SetFaults(faults)
+		}
+		http.Handle("/api/faults", &dns.FaultControl{Handler: dnsHandler})
+	} else if cfg.FaultInject != "" {
+		log.Fatal().Msg("-fault-inject requires a binary built with -tags faultinject")
+	}
+
+	// Authorization runs first so that no plugin can allow what it denies
+	var hooks []dns.QueryHooks
+	if cfg.AuthzURL != "" {
+		if cfg.AuthzTimeout <= 0 {
+			log.Fatal().Msg("-authz-timeout-ms must be positive")
+		}
+		authz, err := dns.NewAuthorizer(cfg.AuthzURL, strings.Split(cfg.AuthzSuffixes, ","), cfg.AuthzTimeout, cfg.AuthzCacheTTL, cfg.AuthzFailureMode)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid external authorization")
+		}
+		hooks = append(hooks, authz)
+		log.Info().Msgf("External authorization of %s via %s", cfg.AuthzSuffixes, cfg.AuthzURL)
+	}
+	// Rego policies arrive with the DnsPolicy, so the evaluator is chained
+	// whenever it is built in and decides nothing until one does
+	if cfg.RegoTimeout <= 0 {
+		log.Fatal().Msg("-rego-timeout-ms must be positive")
+	}
+	regoEval := regopolicy.New(cfg.RegoTimeout)
+	if regopolicy.Built {
+		hooks = append(hooks, regoEval)
+	}
+	if cfg.WasmPlugin != "" {
+		if cfg.WasmPluginTimeout <= 0 {
+			log.Fatal().Msg("-wasm-plugin-timeout-ms must be positive")
+		}
+		plugin, err := wasmhook.Load(cfg.WasmPlugin, runtime.GOMAXPROCS(0), cfg.WasmPluginTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load WASM plugin")
+		}
+		hooks = append(hooks, plugin)
+	}
+	if len(hooks) > 0 {
+		dnsHandler.Hooks = dns.ChainHooks(hooks...)
+	}
+
+	if cfg.MaxNamespaces > 0 {
+		dnsHandler.NamespaceLabels = dns.NewNamespaceLabels(cfg.MaxNamespaces)
+	}
+
+	if cfg.LoopDetection {
+		if err := dns.CheckLoop(cfg.ListenAddr, append([]string{cfg.UpstreamDNS, cfg.SpillUpstream, cfg.HedgeUpstream}, routeUpstreams...)...); err != nil {
+			log.Fatal().Err(err).Msg("Upstream configuration forms a DNS loop")
+		}
+		dnsHandler.LoopGuard = dns.NewLoopGuard()
+	}
+
+	if cfg.HappyEyeballsDelay < 0 {
+		log.Fatal().Msg("Happy Eyeballs delay must not be negative")
+	}
+	if cfg.HappyEyeballsDelay > 0 {
+		dnsHandler.HappyEyeballs = dns.NewHappyEyeballs(cfg.HappyEyeballsDelay)
+	}
+
+	failureMode, err := dns.ParseFailureMode(cfg.UpstreamFailureMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid upstream failure mode")
+	}
+	dnsHandler.SetUpstreamFailureMode(failureMode)
+	log.Info().Msgf("Upstream failure mode: %s\n", failureMode)
+
+	if cfg.BreakerThreshold > 0 {
+		dnsHandler.Breaker = dns.NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+		log.Info().Msgf("Upstream circuit breaker: ENABLED (%d failures, %s cool-down)\n", cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+
+	if cfg.UpstreamMaxInflight > 0 {
+		dnsHandler.Limiter = dns.NewInflightLimiter(cfg.UpstreamMaxInflight, cfg.SpillUpstream)
+		log.Info().Msgf("Upstream in-flight limit: %d per upstream\n", cfg.UpstreamMaxInflight)
+		if cfg.SpillUpstream != "" {
+			log.Info().Msgf("Spill upstream: %s\n", cfg.SpillUpstream)
+		}
+	}
+
+	if cfg.SpecialUse != "off" {
+		// The cluster domain is often cluster.local and must keep reaching the cluster DNS
+		specialUse, err := dns.ParseSpecialUse(cfg.SpecialUse, append([]string{cfg.ClusterDomain}, dnsHandler.SearchDomains...)...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid special-use domain configuration")
+		}
+		dnsHandler.SpecialUse = specialUse
+	}
+	// CHAOS queries are never forwarded: upstreams would answer for themselves
+	dnsHandler.Chaos = &dns.Chaos{Version: cfg.ChaosVersion, Hostname: cfg.ChaosHostname}
+
+	if cfg.HedgeUpstream != "" {
+		hedge, err := dns.NewHedge(cfg.HedgeUpstream, cfg.HedgeAfter)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid hedge configuration")
+		}
+		dnsHandler.Hedge = hedge
+		log.Info().Msgf("Hedging queries to %s after %s\n", hedge.Upstream, hedge.Delay)
+	}
+	if len(routeUpstreams) > 0 {
+		router, err := dns.NewRouter(append([]string{cfg.UpstreamDNS}, routeUpstreams...), cfg.RouteMargin, cfg.RouteHold)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid adaptive routing configuration")
+		}
+		dnsHandler.Router = router
+		log.Info().Msgf("Routing queries among %v by latency and errors\n", router.Upstreams)
+	}
+	if cfg.MirrorTarget != "" {
+		mirror, err := dns.NewMirror(cfg.MirrorTarget, cfg.MirrorRate, cfg.MirrorResponses)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid mirror configuration")
+		}
+		dnsHandler.Mirror = mirror
+		log.Info().Msgf("Mirroring %g of forwarded queries to %s\n", mirror.Rate, mirror.Target)
+	}
+
+	switch cfg.LogMode {
+	case dns.LogAll:
+	case dns.LogBlocked:
+		log.Info().Msg("Query logging: blocked and failed queries only\n")
+	default:
+		log.Fatal().Msgf("Invalid log mode %q, expected %q or %q", cfg.LogMode, dns.LogAll, dns.LogBlocked)
+	}
+	dnsHandler.LogMode = cfg.LogMode
+
+	if cfg.EDNSMaxPayload != 0 {
+		if cfg.EDNSMaxPayload < 512 || cfg.EDNSMaxPayload > 65535 {
+			log.Fatal().Msgf("Invalid EDNS payload size %d, expected 0 or 512-65535", cfg.EDNSMaxPayload)
+		}
+		dnsHandler.MaxUDPPayload = cfg.EDNSMaxPayload
+	}
+	if cfg.EDNSUDPSize < 512 || cfg.EDNSUDPSize > dns.MaxEDNSUDPSize {
+		log.Fatal().Msgf("Invalid EDNS UDP size %d, expected 512-%d", cfg.EDNSUDPSize, dns.MaxEDNSUDPSize)
+	}
+	dnsHandler.UDPSize = cfg.EDNSUDPSize
+	if cfg.ScrubOptions != "" {
+		scrub, err := dns.ParseScrubOptions(cfg.ScrubOptions)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid EDNS options to scrub")
+		}
+		dnsHandler.ScrubOptions = scrub
+		log.Info().Msgf("EDNS options removed from responses: %v\n", scrub)
+	}
+
+	if cfg.ClientStatsMax > 0 {
+		dnsHandler.ClientStats = dns.NewClientStats(cfg.ClientStatsMax)
+		// Served next to /metrics by the metrics server
+		http.Handle("/api/stats/clients", dnsHandler.ClientStats)
+	}
+
+	if cfg.DryRunReportMax > 0 {
+		dnsHandler.DryRunReport = dns.NewDryRunReport(cfg.DryRunReportMax)
+		http.Handle("/api/dryrun/report", dnsHandler.DryRunReport)
+	}
+
+	if cfg.CaptureDir != "" {
+		if cfg.CaptureMaxSeconds <= 0 || cfg.CaptureMaxPackets <= 0 {
+			log.Fatal().Msg("-capture-max-seconds and -capture-max-packets must be positive")
+		}
+		if err := os.MkdirAll(cfg.CaptureDir, 0o700); err != nil {
+			log.Fatal().Err(err).Msg("Failed to create capture directory")
+		}
+		dnsHandler.Capture = dns.NewCapture(cfg.CaptureDir, cfg.ListenAddr, time.Duration(cfg.CaptureMaxSeconds)*time.Second, cfg.CaptureMaxPackets)
+		http.Handle("/api/capture", dashboard.RequireToken(adminToken("-capture-dir"), dnsHandler.Capture))
+	}
+
+	if cfg.StatsDB != "" {
+		if cfg.StatsRetention <= 0 || cfg.StatsMaxKeys <= 0 || cfg.StatsFlush <= 0 {
+			log.Fatal().Msg("Statistics retention, key limit and flush interval must be positive")
+		}
+		store, err := history.Open(cfg.StatsDB, cfg.StatsRetention, cfg.StatsMaxKeys)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the statistics store")
+		}
+		dnsHandler.Tap = dns.NewQueryTap()
+		events, _ := dnsHandler.Tap.Subscribe(history.EventBuffer)
+		go store.Run(events, cfg.StatsFlush)
+		http.Handle("/api/stats/history", store)
+		log.Info().Msgf("Query statistics stored in %s for %s\n", cfg.StatsDB, cfg.StatsRetention)
+	}
+
+	if cfg.QueryLogDir != "" {
+		if cfg.QueryLogMaxAge < 0 || cfg.QueryLogMaxSizeMB < 0 {
+			log.Fatal().Msg("Query log maximum age and size must not be negative")
+		}
+		queryLog, err := querylog.Open(cfg.QueryLogDir, cfg.QueryLogMaxAge, int64(cfg.QueryLogMaxSizeMB)<<20, strings.Split(cfg.QueryLogVerdicts, ","))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the query log")
+		}
+		if dnsHandler.Tap == nil {
+			dnsHandler.Tap = dns.NewQueryTap()
+		}
+		events, _ := dnsHandler.Tap.Subscribe(querylog.EventBuffer)
+		go queryLog.Run(events)
+		http.Handle("/api/querylog", dashboard.RequireToken(adminToken("-query-log-dir"), queryLog))
+		log.Info().Msgf("Query log written to %s, kept for %s and up to %d MiB\n", cfg.QueryLogDir, cfg.QueryLogMaxAge, cfg.QueryLogMaxSizeMB)
+	}
+
+	if cfg.AnomalyWindow > 0 {
+		if cfg.AnomalyMaxQPS < 0 || cfg.AnomalyMaxBlockRate < 0 || cfg.AnomalyMaxBlockRate > 1 || cfg.AnomalyCooldown < 0 {
+			log.Fatal().Msg("Anomaly thresholds and cooldown must not be negative, and the block rate must be at most 1")
+		}
+		monitor := anomaly.New(cfg.AnomalyWindow)
+		monitor.MaxQPS = cfg.AnomalyMaxQPS
+		monitor.MaxBlockRate = cfg.AnomalyMaxBlockRate
+		monitor.MinQueries = cfg.AnomalyMinQueries
+		monitor.Cooldown = cfg.AnomalyCooldown
+		if cfg.AnomalyWebhook != "" {
+			webhook, err := anomaly.NewWebhook(cfg.AnomalyWebhook, cfg.AnomalyWebhookFormat)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid anomaly webhook")
+			}
+			monitor.Webhook = webhook
+		}
+		if dnsHandler.Tap == nil {
+			dnsHandler.Tap = dns.NewQueryTap()
+		}
+		events, _ := dnsHandler.Tap.Subscribe(anomaly.EventBuffer)
+		go monitor.Run(events)
+		log.Info().Msgf("Anomaly detection over %s: max %.1f queries/s, max block rate %.2f\n", monitor.Window, cfg.AnomalyMaxQPS, cfg.AnomalyMaxBlockRate)
+	} else if cfg.AnomalyWebhook != "" {
+		log.Fatal().Msg("-anomaly-webhook requires -anomaly-window-sec")
+	}
+
+	if cfg.ThreatFeeds != "" {
+		feeds, err := threatintel.LoadFeeds(cfg.ThreatFeeds)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load threat feeds")
+		}
+		for _, f := range feeds {
+			if f.Name == threatintel.NRDFeed && cfg.NRDFeed != "" {
+				log.Fatal().Msgf("Threat feed name %s is taken by -nrd-feed", f.Name)
+			}
+		}
+		intel := threatintel.New(feeds, dnsHandler.UpdateThreatFeed)
+		http.Handle("/api/threatintel", intel)
+		intel.Run()
+		log.Info().Msgf("Threat feeds: %d\n", len(feeds))
+	}
+
+	var nrd *threatintel.NRD
+	if cfg.NRDFeed != "" {
+		var err error
+		nrd, err = threatintel.NewNRD(cfg.NRDFeed, cfg.NRDMaxAge, dnsHandler.UpdateThreatFeed)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid newly registered domain feed")
+		}
+		nrd.Run()
+		log.Info().Msgf("Newly registered domain blocking: %s, up to %d days old\n", cfg.NRDFeed, int(cfg.NRDMaxAge.Hours()/24))
+	}
+
+	if cfg.SinkholeIPv4 != "" || cfg.SinkholeIPv6 != "" {
+		sinkhole, err := dns.NewSinkhole(cfg.SinkholeIPv4, cfg.SinkholeIPv6, cfg.SinkholeName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid sinkhole configuration")
+		}
+		if cfg.SinkholeTTL < 0 {
+			log.Fatal().Msg("Sinkhole TTL must not be negative")
+		}
+		sinkhole.TTL = uint32(cfg.SinkholeTTL)
+		dnsHandler.Sinkhole = sinkhole
+	}
+	if cfg.BlockResponse != "" {
+		mode, err := dns.ParseBlockResponseMode(cfg.BlockResponse)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid block response mode")
+		}
+		if (mode == dns.BlockSinkhole) != (dnsHandler.Sinkhole != nil) {
+			log.Fatal().Msg("-block-response sinkhole requires -sinkhole-ipv4 or -sinkhole-ipv6, which no other mode uses")
+		}
+		dnsHandler.BlockResponseMode = mode
+	}
+	extendedError, err := dns.ParseExtendedError(cfg.ExtendedError, cfg.ExtendedErrorRule)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid extended DNS error")
+	}
+	dnsHandler.ExtendedError = extendedError
+	if dnsHandler.Sinkhole != nil {
+		log.Info().Msgf("Blocked queries answered with sinkhole %s %s (%s)\n", cfg.SinkholeIPv4, cfg.SinkholeIPv6, dnsHandler.Sinkhole.Name)
+	} else if dnsHandler.BlockResponseMode != "" {
+		log.Info().Msgf("Blocked queries answered with %s\n", dnsHandler.BlockResponseMode)
+	}
+
+	if cfg.FilterAnswers {
+		dnsHandler.AnswerFilter = &dns.AnswerFilter{BlockEmpty: cfg.FilterAnswersBlock}
+		log.Info().Msg("Answer filtering: ENABLED\n")
+	}
+	if cfg.CNAMEInspection {
+		dnsHandler.InspectCNAMEs = true
+		log.Info().Msg("CNAME inspection: ENABLED\n")
+	}
+	if cfg.SVCBInspection {
+		dnsHandler.InspectSVCB = true
+		log.Info().Msg("SVCB/HTTPS inspection: ENABLED\n")
+	}
+	if cfg.StripECH {
+		dnsHandler.StripECH = true
+		log.Info().Msg("ECH stripping: ENABLED\n")
+	}
+	if cfg.GeoIPDB != "" {
+		geo, err := geoip.Open(strings.Split(cfg.GeoIPDB, ",")...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open GeoIP databases")
+		}
+		dnsHandler.GeoIP = geo
+		log.Info().Msgf("GeoIP databases: %s\n", strings.Join(geo.Types(), ", "))
+	}
+
+	if cfg.Recursive {
+		resolver, err := dns.NewResolver(cfg.RootHints, cfg.QNAMEMinimization)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid root hints")
+		}
+		resolver.Verbose = cfg.Verbose
+		dnsHandler.Recursor = resolver
+		log.Info().Msgf("Recursive resolution: ENABLED, %d root servers, QNAME minimisation %v\n", len(resolver.Roots), resolver.Minimize)
+	}
+
+	dnsHandler.TCPIdleTimeout = cfg.TCPIdleTimeout
+	if cfg.UpstreamTCPIdleConns > 0 {
+		dnsHandler.UpstreamPool = dns.NewTCPPool(cfg.UpstreamTCPIdleConns)
+	}
+
+	if cfg.CanaryPercent > 0 {
+		if cfg.CanaryPercent > 100 || cfg.CanarySoak <= 0 {
+			log.Fatal().Msg("Canary percent must be 1-100 and the soak period positive")
+		}
+		dnsHandler.Canary = &dns.CanaryRollout{Percent: cfg.CanaryPercent, Soak: cfg.CanarySoak}
+		log.Info().Msgf("Blocklist canary: ENABLED (%d%% of queries for %s)\n", cfg.CanaryPercent, cfg.CanarySoak)
+	}
+
+	fileZones, err := dns.LoadZoneFiles(cfg.ZoneFiles)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load zone files")
+	}
+	if len(fileZones) > 0 {
+		dnsHandler.UpdateLocalZones(fileZones)
+		log.Info().Msgf("Local zones loaded: %d\n", len(fileZones))
+	}
+
+	var fileOverrides []dns.Override
+	if cfg.OverridesFile != "" {
+		fileOverrides, err = dns.LoadOverridesFile(cfg.OverridesFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load answer overrides")
+		}
+		dnsHandler.UpdateOverrides(fileOverrides)
+		log.Info().Msgf("Answer overrides loaded: %d\n", len(fileOverrides))
+	}
+
+	// Served next to /metrics by the metrics server
+	blocklistReport := &dns.BlocklistReport{}
+	blocklistReport.Update(blocklist)
+	http.Handle("/api/blocklist/report", blocklistReport)
+	http.HandleFunc("/api/blocklist/export", blocklistReport.ServeExport)
+
+	// policyVersion fingerprints the enforced blocklist for the dashboard
+	var policyVersion atomic.Value
+	policyVersion.Store(blocklistFingerprint(blocklist))
+
+	// drift compares the enforced blocklist with the controller's blockListHash
+	var drift *client.DriftDetector
+	if cfg.ControllerURL != "" && cfg.DriftCheckInterval > 0 {
+		drift = &client.DriftDetector{}
+		drift.Applied(blocklist)
+		go drift.Run(cfg.DriftCheckInterval)
+	}
 
 	updateChannel := make(chan []string, 10)
+	// dryRun is applied with each blocklist; the fetcher and gRPC pushes set it
+	var dryRun atomic.Bool
+	dryRun.Store(cfg.DryRun)
+
+	// policyGenerated holds the controller timestamp of the oldest policy not
+	// yet activated, so coalesced updates report their full delay
+	var policyGenerated atomic.Pointer[time.Time]
 
 	go func() {
 		for newBlocklist := range updateChannel {
+			newBlocklist = coalesceUpdates(updateChannel, newBlocklist, cfg.UpdateDebounce, cfg.Verbose)
 			if cfg.Verbose {
 				log.Info().Msgf("Received blocklist update with %d entries", len(newBlocklist))
 			}
+			generated := policyGenerated.Swap(nil)
 			newMatcher := matcher.BuildMatcher(newBlocklist)
-			dnsHandler.DryRun = cfg.DryRun
-			dnsHandler.UpdateMatcher(newMatcher)
+			blocklistReport.Update(newBlocklist)
+			policyVersion.Store(blocklistFingerprint(newBlocklist))
+			if drift != nil {
+				drift.Applied(newBlocklist)
+			}
+			dnsHandler.UpdateMatcher(newMatcher, dryRun.Load())
+			if generated != nil {
+				delay := time.Since(*generated)
+				metrics.PolicyPropagation.Observe(max(delay.Seconds(), 0))
+				if cfg.Verbose {
+					log.Info().Msgf("Policy generated at %s activated after %s", generated.Format(time.RFC3339), delay.Round(time.Millisecond))
+				}
+			}
 
 			if cfg.Verbose {
 				log.Info().Msgf("Blocklist updated successfully with %d entries\n", len(newBlocklist))
@@ -110,22 +707,570 @@ func main() {
 			}
 		}
 
-		fetcher := client.NewFetcher(cfg.ControllerURL, &cfg.FetchInterval, cfg.Verbose, updateChannel, &cfg.DryRun, operationalMode, tlsCallback, dohCallback)
+		// Create policy sets callback to swap per-client blocklists
+		policySetsCallback := func(sets []client.PolicySet) {
+			dnsHandler.UpdatePolicySets(buildPolicySets(sets))
+		}
+
+		// Create namespaces callback to label query metrics by client namespace
+		namespacesCallback := func(namespaces []client.ClientNamespace) {
+			dnsHandler.UpdateNamespaces(buildNamespaces(namespaces))
+		}
+
+		// Create local zones callback; policy zones are served alongside zone files
+		localZonesCallback := func(policyZones []client.LocalZone) {
+			zones := append([]*dns.Zone{}, fileZones...)
+			for _, lz := range policyZones {
+				zone, err := buildLocalZone(lz)
+				if err != nil {
+					log.Err(err).Msgf("Ignoring invalid local zone %s from controller", lz.Origin)
+					continue
+				}
+				zones = append(zones, zone)
+			}
+			dnsHandler.UpdateLocalZones(zones)
+		}
+
+		// Upstreams from the controller must be IP addresses, and not the proxy
+		checkUpstream := func(addr string) (string, error) {
+			addr, err := dns.ParseUpstreamAddr(addr)
+			if err == nil && cfg.LoopDetection {
+				err = dns.CheckLoop(cfg.ListenAddr, addr)
+			}
+			return addr, err
+		}
+
+		// Create spec callback for policy-controlled switches
+		specCallback := func(spec client.DnsPolicySpec) {
+			mode := failureMode
+			if spec.UpstreamFailureMode != "" {
+				if m, err := dns.ParseFailureMode(spec.UpstreamFailureMode); err == nil {
+					mode = m
+				} else {
+					log.Err(err).Msg("Ignoring upstream failure mode from controller")
+				}
+			}
+			dnsHandler.SetUpstreamFailureMode(mode)
+
+			upstream := ""
+			if spec.Upstream != "" {
+				if addr, err := checkUpstream(spec.Upstream); err == nil {
+					upstream = addr
+				} else {
+					log.Err(err).Msg("Ignoring upstream from controller")
+				}
+			}
+			dnsHandler.SetUpstream(upstream)
+			dnsHandler.UpdateForwardZones(buildForwardZones(spec.ForwardZones, checkUpstream))
+
+			blockResponse := ""
+			if spec.BlockResponse != "" {
+				if m, err := dns.ParseBlockResponseMode(spec.BlockResponse); err == nil {
+					blockResponse = m
+				} else {
+					log.Err(err).Msg("Ignoring block response mode from controller")
+				}
+			}
+			if err := dnsHandler.SetBlockResponseMode(blockResponse); err != nil {
+				log.Err(err).Msg("Ignoring block response mode from controller")
+			}
+
+			var shadow *matcher.Matcher
+			if len(spec.ShadowBlockList) > 0 {
+				// Evaluated with the allowList, as the enforced blocklist is
+				shadow = matcher.BuildMatcher(append(slices.Clip(spec.ShadowBlockList), matcher.Exceptions(spec.AllowList)...))
+			}
+			dnsHandler.UpdateShadowMatcher(shadow)
+
+			var blockedIPs *matcher.IPMatcher
+			if len(spec.BlockCIDRs) > 0 {
+				blockedIPs = matcher.BuildIPMatcher(spec.BlockCIDRs)
+			}
+			dnsHandler.UpdateBlockedCIDRs(blockedIPs)
+			dnsHandler.UpdateTypeRules(buildTypeRules(spec.QueryTypeRules))
+			if len(spec.GeoRules) > 0 && dnsHandler.GeoIP == nil {
+				log.Warn().Msgf("Ignoring %d GeoIP rules, -geoip-db is not set", len(spec.GeoRules))
+			}
+			dnsHandler.UpdateGeoRules(buildGeoRules(spec.GeoRules))
+			if nrd != nil {
+				nrd.SetEnabled(spec.BlockNewlyRegistered == nil || *spec.BlockNewlyRegistered)
+			} else if spec.BlockNewlyRegistered != nil && *spec.BlockNewlyRegistered {
+				log.Warn().Msg("Ignoring blockNewlyRegistered, -nrd-feed is not set")
+			}
+
+			var filterAAAA *matcher.Matcher
+			if len(spec.FilterAAAA) > 0 {
+				filterAAAA = matcher.BuildMatcher(spec.FilterAAAA)
+			}
+			dnsHandler.UpdateAAAAFilter(filterAAAA)
+			// Policy overrides are served alongside the file, and win for the same name
+			dnsHandler.UpdateOverrides(append(append([]dns.Override{}, fileOverrides...), buildOverrides(spec.Overrides)...))
+
+			if err := regoEval.Update(spec.Rego); err != nil {
+				log.Err(err).Msg("Ignoring Rego policy from controller")
+			}
+		}
+
+		// Create generated callback to measure policy propagation delay
+		generatedCallback := func(generatedAt time.Time) {
+			policyGenerated.CompareAndSwap(nil, &generatedAt)
+		}
+
+		fetcher := client.NewFetcher(client.FetcherOptions{
+			ControllerURL:      cfg.ControllerURL,
+			FetchInterval:      &cfg.FetchInterval,
+			Verbose:            cfg.Verbose,
+			Updates:            updateChannel,
+			DryRun:             &dryRun,
+			OperationalMode:    operationalMode,
+			TLSDataCallback:    tlsCallback,
+			DoHCallback:        dohCallback,
+			PolicySetsCallback: policySetsCallback,
+			NamespacesCallback: namespacesCallback,
+			LocalZonesCallback: localZonesCallback,
+			SpecCallback:       specCallback,
+			GeneratedCallback:  generatedCallback,
+		})
+		fetcher.UseFallback(blocklist, cfg.FallbackAfter)
+		if bootstrapDNS != nil {
+			fetcher.UseResolver(bootstrapDNS)
+		}
+		if secretsWatcher != nil {
+			fetcher.UseToken(func() string { return *store.controllerToken.Load() })
+		}
+		if spiffeSource != nil {
+			tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+			spiffeSource.ConfigureClient(tlsConfig)
+			fetcher.UseTLSConfig(tlsConfig)
+		}
+		switch cfg.PolicyEncoding {
+		case "json":
+		case "cbor":
+			fetcher.UseCBOR()
+		default:
+			log.Fatal().Msgf("Invalid policy encoding %q, expected \"json\" or \"cbor\"", cfg.PolicyEncoding)
+		}
+		if cfg.DeltaUpdates {
+			fetcher.UseDeltaProtocol()
+			log.Info().Msg("Incremental policy delivery: ENABLED\n")
+		}
+		if drift != nil {
+			fetcher.UseDriftDetection(drift)
+		}
+		if cfg.HeartbeatInterval > 0 {
+			fetcher.UseHeartbeat(sidecarRegistration(), cfg.HeartbeatInterval, func() string { return policyVersion.Load().(string) })
+		}
+		if cfg.TelemetryInterval > 0 {
+			if cfg.TelemetrySample < 0 || cfg.TelemetrySample > 1 || cfg.TelemetryTop < 0 {
+				log.Fatal().Msg("-telemetry-sample must be between 0 and 1 and -telemetry-top at least 0")
+			}
+			collector := telemetry.New(cfg.TelemetrySample, cfg.TelemetryTop)
+			if dnsHandler.Tap == nil {
+				dnsHandler.Tap = dns.NewQueryTap()
+			}
+			events, _ := dnsHandler.Tap.Subscribe(telemetry.EventBuffer)
+			go collector.Run(events)
+			fetcher.UseTelemetry(sidecarRegistration().PodUID, cfg.TelemetryInterval, collector.Report)
+			log.Info().Msgf("Telemetry uploads every %s, sampling %.2f of queries\n", cfg.TelemetryInterval, cfg.TelemetrySample)
+		}
 		go fetcher.Start()
 	} else {
 		log.Info().Msgf("Warning: No controller URL specified, running without policy updates")
 	}
+	if cfg.ControllerURL == "" && cfg.TelemetryInterval > 0 {
+		log.Fatal().Msg("-telemetry-interval requires -controller")
+	}
+
+	if cfg.DisableUDP && cfg.DisableTCP {
+		log.Fatal().Msg("Both UDP and TCP listeners are disabled, nothing to serve")
+	}
+
+	if cfg.SelfTest && !selfTest(dnsHandler, cfg.SelfTestName) && cfg.SelfTestExit {
+		log.Error().Msg("Startup self-test failed, exiting")
+		os.Exit(1)
+	}
 
+	if cfg.EBPFRedirect {
+		target, err := redirect.ListenTarget(cfg.ListenAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot redirect DNS traffic to the listen address")
+		}
+		// The programs stay attached until the process exits
+		uid := uint32(os.Getuid())
+		if _, err := redirect.Attach(redirect.Options{CgroupPath: cfg.EBPFRedirectCgroup, Target: target, ExcludeUID: uid}); err != nil {
+			log.Fatal().Err(err).Msg("Failed to attach the eBPF DNS redirection")
+		}
+		log.Info().Msgf("eBPF redirection: ENABLED (port %d in %s to %s, except UID %d)\n", redirect.DNSPort, cfg.EBPFRedirectCgroup, target, uid)
+	}
+
+	// Run each enabled listener; the process exits once all of them have stopped
+	done := make(chan struct{})
+	listeners := 0
 	udpServer := server.NewUDPServer(cfg.ListenAddr, dnsHandler, cfg.Verbose)
 	tcpServer := server.NewTCPServer(cfg.ListenAddr, dnsHandler, cfg.Verbose)
 
-	go func() {
-		if err := udpServer.Start(); err != nil {
-			log.Err(err).Msg("UDP server error:")
+	if cfg.GRPCListenAddr != "" {
+		if dnsHandler.Tap == nil {
+			dnsHandler.Tap = dns.NewQueryTap()
 		}
-	}()
+		// A certificate from the secrets overrides -grpc-tls-cert
+		var grpcCertificate func() *tls.Certificate
+		if store.grpcCert.Load() != nil {
+			grpcCertificate = store.grpcCert.Load
+		}
+		grpcServer, err := grpcapi.NewServer(grpcapi.Config{
+			ListenAddr:  cfg.GRPCListenAddr,
+			CertFile:    cfg.GRPCTLSCert,
+			KeyFile:     cfg.GRPCTLSKey,
+			ClientCA:    cfg.GRPCClientCA,
+			Certificate: grpcCertificate,
+			Handler:     dnsHandler,
+			UpdatePolicy: func(blockList []string, pushedDryRun bool) {
+				if cfg.ControllerURL != "" {
+					log.Info().Msg("Policy pushed over gRPC is in force until the next controller fetch replaces it")
+				}
+				dryRun.Store(pushedDryRun)
+				updateChannel <- blockList
+			},
+			Drain: func() {
+				udpServer.Stop()
+				tcpServer.Stop()
+			},
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid gRPC control API configuration")
+		}
+		go func() {
+			if err := grpcServer.Start(); err != nil {
+				log.Err(err).Msg("gRPC server error:")
+			}
+		}()
+	}
+
+	if cfg.Dashboard {
+		token := os.Getenv("DNS_MESH_DASHBOARD_TOKEN")
+		if token == "" {
+			log.Fatal().Msg("The dashboard requires DNS_MESH_DASHBOARD_TOKEN to be set")
+		}
+		if dnsHandler.Tap == nil {
+			dnsHandler.Tap = dns.NewQueryTap()
+		}
+		http.Handle("/dashboard/", dashboard.New(dashboard.Config{
+			Token:         token,
+			Handler:       dnsHandler,
+			PolicyVersion: func() string { return policyVersion.Load().(string) },
+		}))
+		log.Info().Msgf("Dashboard: http://%s/dashboard/\n", cfg.MetricsAddr)
+	}
 
-	if err := tcpServer.Start(); err != nil {
-		log.Err(err).Msg("TCP server error:")
+	if !cfg.DisableUDP {
+		listeners++
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := udpServer.Start(); err != nil {
+				log.Err(err).Msg("UDP server error:")
+			}
+		}()
+	} else {
+		log.Info().Msg("UDP listener disabled")
+	}
+
+	if !cfg.DisableTCP {
+		listeners++
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := tcpServer.Start(); err != nil {
+				log.Err(err).Msg("TCP server error:")
+			}
+		}()
+	} else {
+		log.Info().Msg("TCP listener disabled")
+	}
+
+	for ; listeners > 0; listeners-- {
+		<-done
+	}
+}
+
+// adminToken returns DNS_MESH_DASHBOARD_TOKEN, which guards the admin APIs
+// on the metrics address as it does the dashboard. The sidecar refuses to
+// start the feature, named by its flag, without it.
+func adminToken(flag string) string {
+	token := os.Getenv("DNS_MESH_DASHBOARD_TOKEN")
+	if token == "" {
+		log.Fatal().Msgf("%s requires DNS_MESH_DASHBOARD_TOKEN to be set", flag)
+	}
+	return token
+}
+
+// blocklistFingerprint identifies a blocklist independently of rule order
+func blocklistFingerprint(rules []string) string {
+	return client.BlocklistHash(rules)[:12]
+}
+
+// coalesceUpdates keeps reading from updates until no new blocklist has
+// arrived for the quiet period, then returns the most recent one. This turns
+// a burst of updates into a single matcher rebuild. The wait is capped at ten
+// quiet periods so a constantly flapping source still gets applied.
+func coalesceUpdates(updates <-chan []string, latest []string, quiet time.Duration, verbose bool) []string {
+	if quiet <= 0 {
+		return latest
+	}
+
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	deadline := time.After(10 * quiet)
+	dropped := 0
+
+	for {
+		select {
+		case next, ok := <-updates:
+			if !ok {
+				return latest
+			}
+			latest = next
+			dropped++
+			timer.Reset(quiet)
+		case <-timer.C:
+			if verbose && dropped > 0 {
+				log.Info().Msgf("Coalesced %d superseded blocklist updates", dropped)
+			}
+			return latest
+		case <-deadline:
+			if verbose && dropped > 0 {
+				log.Info().Msgf("Coalesced %d superseded blocklist updates", dropped)
+			}
+			return latest
+		}
+	}
+}
+
+// sidecarRegistration describes this sidecar to the controller. The pod
+// identity comes from the downward API; without it the host name, which is
+// the pod name in Kubernetes, stands in.
+func sidecarRegistration() client.Registration {
+	hostname, _ := os.Hostname()
+	reg := client.Registration{
+		PodUID:    os.Getenv("DNS_MESH_POD_UID"),
+		PodName:   os.Getenv("DNS_MESH_POD_NAME"),
+		Namespace: os.Getenv("DNS_MESH_POD_NAMESPACE"),
+		Version:   version,
+	}
+	if reg.PodName == "" {
+		reg.PodName = hostname
+	}
+	if reg.PodUID == "" {
+		reg.PodUID = reg.PodName
+	}
+	return reg
+}
+
+// buildNamespaces converts the controller's client namespace attribution,
+// skipping client selectors that do not parse.
+func buildNamespaces(namespaces []client.ClientNamespace) []dns.ClientNamespace {
+	out := make([]dns.ClientNamespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		cn := dns.ClientNamespace{Namespace: ns.Namespace}
+		for _, c := range ns.Clients {
+			prefix, err := dns.ParseClientSelector(c)
+			if err != nil {
+				log.Err(err).Msgf("Ignoring invalid client selector %q in namespace %s", c, ns.Namespace)
+				continue
+			}
+			cn.Clients = append(cn.Clients, prefix)
+		}
+		out = append(out, cn)
+	}
+	return out
+}
+
+// buildLocalZone parses a local zone from the controller, its record set
+// written out as zone-file lines after the zone text
+func buildLocalZone(lz client.LocalZone) (*dns.Zone, error) {
+	var text strings.Builder
+	text.WriteString(lz.Zone)
+	for _, r := range lz.Records {
+		if strings.ContainsAny(r.Name+r.Type+r.Value, "\r\n") {
+			return nil, fmt.Errorf("record %s %s spans several lines", r.Name, r.Type)
+		}
+		name := r.Name
+		if name == "" {
+			name = "@"
+		}
+		text.WriteString("\n" + name)
+		if r.TTL > 0 {
+			fmt.Fprintf(&text, " %d", r.TTL)
+		}
+		fmt.Fprintf(&text, " IN %s %s", r.Type, r.Value)
+	}
+	return dns.ParseZone(lz.Origin, strings.NewReader(text.String()))
+}
+
+// buildOverrides converts the controller's answer overrides, skipping those
+// that are invalid.
+func buildOverrides(overrides []client.AnswerOverride) []dns.Override {
+	out := make([]dns.Override, 0, len(overrides))
+	for _, o := range overrides {
+		override, err := dns.NewOverride(o.Name, o.Addresses, o.CNAME, o.TTL)
+		if err != nil {
+			log.Err(err).Msg("Ignoring answer override from controller")
+			continue
+		}
+		out = append(out, override)
+	}
+	return out
+}
+
+// buildTypeRules compiles the controller's query-type rules, skipping those
+// with an unknown type or action. It returns nil when no rule is left.
+func buildTypeRules(rules []client.QueryTypeRule) *matcher.TypeMatcher {
+	var out []matcher.TypeRule
+	for _, r := range rules {
+		rule := matcher.TypeRule{Domains: r.Domains}
+		switch strings.ToLower(r.Action) {
+		case "", "block":
+		case "refuse":
+			rule.Refuse = true
+		default:
+			log.Error().Msgf("Ignoring query type rule with unknown action %q", r.Action)
+			continue
+		}
+		valid := len(r.Types) > 0
+		for _, t := range r.Types {
+			qtype, ok := dns.ParseQType(t)
+			if !ok {
+				valid = false
+				break
+			}
+			rule.Types = append(rule.Types, qtype)
+		}
+		if !valid {
+			log.Error().Msgf("Ignoring query type rule with invalid types %v", r.Types)
+			continue
+		}
+		rule.Text = "qtype:" + strings.ToUpper(strings.Join(r.Types, ","))
+		if len(r.Domains) > 0 {
+			rule.Text += " " + strings.Join(r.Domains, ",")
+		}
+		out = append(out, rule)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return matcher.BuildTypeMatcher(out)
+}
+
+// bootstrapResolver returns the resolver of the controller's and the DoH
+// upstream's host names, nil to leave them to the system resolver. In auto
+// mode -upstream is asked when the system resolver would ask the sidecar.
+func bootstrapResolver(cfg *config.Config) *net.Resolver {
+	spec := cfg.BootstrapDNS
+	if spec == "auto" {
+		if !bootstrap.SelfResolving(cfg.ListenAddr) {
+			return nil
+		}
+		if _, err := netip.ParseAddrPort(cfg.UpstreamDNS); err != nil {
+			log.Warn().Msgf("The system resolver leads back to the sidecar, but -upstream %s is no IP address to resolve the controller and DoH upstream with; set -bootstrap-dns", cfg.UpstreamDNS)
+			return nil
+		}
+		spec = cfg.UpstreamDNS
+	}
+	servers, err := bootstrap.ParseServers(spec)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid bootstrap DNS configuration")
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	log.Info().Msgf("Resolving the controller and DoH upstream with %v\n", servers)
+	return bootstrap.Resolver(servers)
+}
+
+// buildGeoRules compiles the controller's GeoIP rules, skipping those with
+// an unknown action or without a valid country or ASN
+func buildGeoRules(rules []client.GeoRule) []dns.GeoRule {
+	var out []dns.GeoRule
+	for _, r := range rules {
+		var rule dns.GeoRule
+		switch strings.ToLower(r.Action) {
+		case "", "block":
+		case "flag":
+			rule.Flag = true
+		default:
+			log.Error().Msgf("Ignoring GeoIP rule with unknown action %q", r.Action)
+			continue
+		}
+		valid := len(r.Countries) > 0 || len(r.ASNs) > 0
+		for _, c := range r.Countries {
+			if len(c) != 2 || strings.Trim(strings.ToUpper(c), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+				valid = false
+				break
+			}
+			rule.Countries = append(rule.Countries, strings.ToUpper(c))
+		}
+		if slices.Contains(r.ASNs, 0) {
+			valid = false
+		}
+		if !valid {
+			log.Error().Msgf("Ignoring GeoIP rule with invalid countries %v or ASNs %v", r.Countries, r.ASNs)
+			continue
+		}
+		rule.ASNs = r.ASNs
+		var parts []string
+		if len(rule.Countries) > 0 {
+			parts = append(parts, "country="+strings.Join(rule.Countries, ","))
+		}
+		if len(rule.ASNs) > 0 {
+			asns := make([]string, len(rule.ASNs))
+			for i, asn := range rule.ASNs {
+				asns[i] = strconv.FormatUint(uint64(asn), 10)
+			}
+			parts = append(parts, "asn="+strings.Join(asns, ","))
+		}
+		if len(r.Domains) > 0 {
+			rule.Domains = matcher.BuildMatcher(r.Domains)
+			parts = append(parts, strings.Join(r.Domains, ","))
+		}
+		rule.Text = "geo:" + strings.Join(parts, " ")
+		out = append(out, rule)
+	}
+	return out
+}
+
+// buildForwardZones converts the controller's forwarding zones, skipping
+// those without a zone or with a server checkUpstream rejects.
+func buildForwardZones(zones []client.ForwardZone, checkUpstream func(string) (string, error)) []dns.ForwardZone {
+	out := make([]dns.ForwardZone, 0, len(zones))
+	for _, z := range zones {
+		if strings.Trim(z.Zone, ".") == "" {
+			log.Error().Msgf("Ignoring forward zone without a zone name (server %s)", z.Upstream)
+			continue
+		}
+		upstream, err := checkUpstream(z.Upstream)
+		if err != nil {
+			log.Err(err).Msgf("Ignoring forward zone %s", z.Zone)
+			continue
+		}
+		out = append(out, dns.ForwardZone{Zone: z.Zone, Upstream: upstream})
+	}
+	return out
+}
+
+// buildPolicySets compiles controller policy sets into handler policy sets,
+// skipping client selectors that do not parse.
+func buildPolicySets(sets []client.PolicySet) []dns.PolicySet {
+	out := make([]dns.PolicySet, 0, len(sets))
+	for _, set := range sets {
+		ps := dns.PolicySet{Name: set.Name, Matcher: matcher.BuildMatcher(set.BlockList)}
+		for _, c := range set.Clients {
+			prefix, err := dns.ParseClientSelector(c)
+			if err != nil {
+				log.Err(err).Msgf("Ignoring invalid client selector %q in policy set %s", c, set.Name)
+				continue
+			}
+			ps.Clients = append(ps.Clients, prefix)
+		}
+		out = append(out, ps)
 	}
+	return out
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"lktr/pkg/matcher"
+	"os"
+)
+
+// runPihole implements the `lktr pihole` subcommand, which converts
+// blocklists between Pi-hole's formats and the sidecar's rule syntax
+func runPihole(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: lktr pihole import [-allow] [file]  convert a Pi-hole list to rules, one per line")
+		fmt.Fprintln(os.Stderr, "       lktr pihole export [file]           convert rules to a Pi-hole adlist")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("pihole "+args[0], flag.ExitOnError)
+	allow := fs.Bool("allow", false, "Import a Pi-hole allowlist: every entry becomes an exception")
+	fs.Parse(args[1:])
+	if fs.NArg() > 1 {
+		usage()
+		return 2
+	}
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	switch args[0] {
+	case "import":
+		list, err := matcher.ImportPihole(in, *allow)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, rule := range list.Rules {
+			fmt.Println(rule)
+		}
+		for _, entry := range list.Skipped {
+			fmt.Fprintf(os.Stderr, "skipped: %s\n", entry)
+		}
+		fmt.Fprintf(os.Stderr, "%d rules imported, %d entries skipped\n", len(list.Rules), len(list.Skipped))
+	case "export":
+		rules, err := parseRuleList(in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := matcher.ExportPihole(os.Stdout, rules); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
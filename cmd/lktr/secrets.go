@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync/atomic"
+
+	"lktr/internal/config"
+	"lktr/internal/secrets"
+
+	"github.com/rs/zerolog/log"
+)
+
+// secretStore holds the secrets that are not kept in the config
+type secretStore struct {
+	grpcCert        atomic.Pointer[tls.Certificate]
+	controllerToken atomic.Pointer[string]
+}
+
+// newSecretsWatcher returns a watcher for the configured secrets provider,
+// nil when none is configured
+func newSecretsWatcher(cfg *config.Config, store *secretStore) (*secrets.Watcher, error) {
+	var provider secrets.Provider
+	switch {
+	case cfg.VaultAddr != "" && cfg.SecretsURL != "":
+		return nil, errors.New("-vault-addr and -secrets-url are mutually exclusive")
+	case cfg.VaultAddr != "":
+		vault, err := secrets.NewVault(cfg.VaultAddr, cfg.VaultPath, os.Getenv("VAULT_TOKEN"), cfg.VaultTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		provider = vault
+	case cfg.SecretsURL != "":
+		provider = secrets.NewEndpoint(cfg.SecretsURL)
+	default:
+		return nil, nil
+	}
+	if cfg.SecretsRefresh <= 0 {
+		return nil, errors.New("-secrets-refresh must be positive")
+	}
+	return &secrets.Watcher{
+		Provider: provider,
+		Interval: cfg.SecretsRefresh,
+		Apply: func(s secrets.Secrets) {
+			applySecrets(cfg, store, s)
+		},
+	}, nil
+}
+
+// applySecrets stores the secrets where the components using them look for
+// them; invalid values are logged and the previous ones kept
+func applySecrets(cfg *config.Config, store *secretStore, s secrets.Secrets) {
+	cfg.SetTLSData([]byte(s[secrets.DoHClientCert]), []byte(s[secrets.DoHClientKey]), []byte(s[secrets.DoHCACert]))
+
+	if s[secrets.GRPCTLSCert] != "" || s[secrets.GRPCTLSKey] != "" {
+		cert, err := tls.X509KeyPair([]byte(s[secrets.GRPCTLSCert]), []byte(s[secrets.GRPCTLSKey]))
+		if err != nil {
+			log.Err(err).Msg("Ignoring invalid gRPC server certificate from secrets")
+		} else {
+			store.grpcCert.Store(&cert)
+		}
+	}
+
+	token := s[secrets.ControllerToken]
+	store.controllerToken.Store(&token)
+}
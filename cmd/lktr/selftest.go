@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"lktr/internal/dns"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// selfTestTimeout bounds a self-test, upstream resolution included
+const selfTestTimeout = 10 * time.Second
+
+// runSelfTest implements the `lktr selftest` subcommand, which runs the
+// startup self-test against the given upstream and block response settings
+// and exits with 1 when a check fails
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	upstream := fs.String("upstream", "1.1.1.1:53", "Upstream DNS server")
+	httpsMode := fs.Bool("https-mode", false, "Resolve over DNS-over-HTTPS")
+	httpsUpstream := fs.String("https-upstream", "https://1.1.1.1/dns-query", "DNS-over-HTTPS upstream server")
+	caCert := fs.String("tls-ca-cert", "", "Path to CA certificate for verifying the DoH server")
+	clientCert := fs.String("tls-client-cert", "", "Path to client certificate for mTLS")
+	clientKey := fs.String("tls-client-key", "", "Path to client private key for mTLS")
+	insecure := fs.Bool("tls-insecure-skip-verify", false, "Skip TLS certificate verification")
+	name := fs.String("name", "example.com", "Canary name resolved through the upstream")
+	blockResponse := fs.String("block-response", "", "Expected answer to blocked queries, as for the proxy")
+	sinkholeIPv4 := fs.String("sinkhole-ipv4", "", "Sinkhole address for blocked A queries")
+	sinkholeIPv6 := fs.String("sinkhole-ipv6", "", "Sinkhole address for blocked AAAA queries")
+	fs.Parse(args)
+
+	h := dns.NewHandler(*upstream, false, nil, *httpsMode, *httpsUpstream, int(selfTestTimeout/time.Second), *caCert, *clientCert, *clientKey, *insecure, nil)
+	if *sinkholeIPv4 != "" || *sinkholeIPv6 != "" {
+		sinkhole, err := dns.NewSinkhole(*sinkholeIPv4, *sinkholeIPv6, "blocked.dns-mesh.local")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid sinkhole: %v\n", err)
+			return 2
+		}
+		h.Sinkhole = sinkhole
+	}
+	if *blockResponse != "" {
+		mode, err := dns.ParseBlockResponseMode(*blockResponse)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		h.BlockResponseMode = mode
+	}
+
+	if !selfTest(h, *name) {
+		return 1
+	}
+	return 0
+}
+
+// selfTest runs the self-test checks, logs their results and reports
+// whether all of them passed
+func selfTest(h *dns.Handler, canary string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	passed := true
+	for _, r := range h.SelfTest(ctx, canary) {
+		if r.OK {
+			log.Info().Msgf("Self-test %s passed in %v: %s", r.Check, r.Duration.Round(time.Microsecond), r.Detail)
+			continue
+		}
+		passed = false
+		log.Error().Msgf("Self-test %s failed after %v: %s", r.Check, r.Duration.Round(time.Microsecond), r.Detail)
+	}
+	return passed
+}
@@ -0,0 +1,155 @@
+// Package anomaly computes the query rate and block rate of the sidecar over
+// a rolling window and alerts a webhook when either crosses its threshold,
+// as a spike in blocked queries may indicate malware on a pod.
+package anomaly
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EventBuffer is the query tap buffer to subscribe a monitor with; events
+// beyond it are dropped while the monitor is busy
+const EventBuffer = 4096
+
+// Alerts, as in dns_anomaly_alerts_total
+const (
+	AlertQPS       = "qps"
+	AlertBlockRate = "block_rate"
+)
+
+// Monitor keeps per-second query and block counts for the rolling window
+type Monitor struct {
+	Window       time.Duration
+	MaxQPS       float64 // alert above this many queries per second, 0 disables
+	MaxBlockRate float64 // alert above this fraction of blocked queries, 0 disables
+	MinQueries   int     // queries the window needs before the block rate is judged
+	Cooldown     time.Duration
+	Webhook      *Webhook // nil only exports the gauges
+
+	mu      sync.Mutex
+	queries []uint64 // per second of the window, a ring
+	blocked []uint64
+	current int       // index of the running second
+	since   time.Time // start of the running second
+
+	lastAlert map[string]time.Time
+}
+
+// New returns a monitor over window, rounded up to whole seconds
+func New(window time.Duration) *Monitor {
+	seconds := max(1, int((window+time.Second-1)/time.Second))
+	return &Monitor{
+		Window:    time.Duration(seconds) * time.Second,
+		queries:   make([]uint64, seconds),
+		blocked:   make([]uint64, seconds),
+		since:     time.Now().Truncate(time.Second),
+		lastAlert: make(map[string]time.Time),
+	}
+}
+
+// Run counts the events until the channel is closed, and updates the gauges
+// and checks the thresholds every second
+func (m *Monitor) Run(events <-chan dns.QueryEvent) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			m.check(now)
+		}
+	}()
+	for ev := range events {
+		m.record(ev, time.Now())
+	}
+}
+
+// record counts one answered query
+func (m *Monitor) record(ev dns.QueryEvent, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	m.queries[m.current]++
+	if ev.Verdict == dns.VerdictBlocked {
+		m.blocked[m.current]++
+	}
+}
+
+// advance moves the ring to the second of now, clearing the seconds that
+// passed without queries
+func (m *Monitor) advance(now time.Time) {
+	elapsed := int(now.Sub(m.since) / time.Second)
+	if elapsed <= 0 {
+		return
+	}
+	for i := 0; i < min(elapsed, len(m.queries)); i++ {
+		m.current = (m.current + 1) % len(m.queries)
+		m.queries[m.current], m.blocked[m.current] = 0, 0
+	}
+	m.since = m.since.Add(time.Duration(elapsed) * time.Second)
+}
+
+// Rates returns the queries per second and the fraction of them blocked
+// over the window, and the number of queries it holds
+func (m *Monitor) Rates(now time.Time) (qps, blockRate float64, queries uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	var blocked uint64
+	for i := range m.queries {
+		queries += m.queries[i]
+		blocked += m.blocked[i]
+	}
+	qps = float64(queries) / m.Window.Seconds()
+	if queries > 0 {
+		blockRate = float64(blocked) / float64(queries)
+	}
+	return qps, blockRate, queries
+}
+
+// check exports the rates and alerts on those over their threshold
+func (m *Monitor) check(now time.Time) {
+	qps, blockRate, queries := m.Rates(now)
+	metrics.QueryRate.Set(qps)
+	metrics.BlockRate.Set(blockRate)
+
+	if m.MaxQPS > 0 && qps > m.MaxQPS {
+		m.alert(now, Alert{
+			Name:      AlertQPS,
+			Value:     qps,
+			Threshold: m.MaxQPS,
+			Queries:   queries,
+			Message:   fmt.Sprintf("Query rate %.1f/s over the last %s exceeds %.1f/s", qps, m.Window, m.MaxQPS),
+		})
+	}
+	if m.MaxBlockRate > 0 && queries >= uint64(m.MinQueries) && blockRate > m.MaxBlockRate {
+		m.alert(now, Alert{
+			Name:      AlertBlockRate,
+			Value:     blockRate,
+			Threshold: m.MaxBlockRate,
+			Queries:   queries,
+			Message:   fmt.Sprintf("%.1f%% of %d queries over the last %s were blocked, above %.1f%%", 100*blockRate, queries, m.Window, 100*m.MaxBlockRate),
+		})
+	}
+}
+
+// alert logs a and sends it to the webhook, unless the same alert fired
+// within the cooldown
+func (m *Monitor) alert(now time.Time, a Alert) {
+	if last, ok := m.lastAlert[a.Name]; ok && now.Sub(last) < m.Cooldown {
+		metrics.AnomalyAlerts.WithLabelValues(a.Name, "suppressed").Inc()
+		return
+	}
+	m.lastAlert[a.Name] = now
+	a.Window = m.Window
+	a.Time = now
+	log.Warn().Msgf("Anomaly: %s", a.Message)
+	if m.Webhook != nil {
+		go m.Webhook.Send(a)
+	}
+}
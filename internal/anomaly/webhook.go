@@ -0,0 +1,122 @@
+package anomaly
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// webhookTimeout bounds one webhook request
+const webhookTimeout = 5 * time.Second
+
+// Webhook formats
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+)
+
+// Alert is a threshold crossed by the rates of the window
+type Alert struct {
+	Name      string
+	Value     float64
+	Threshold float64
+	Queries   uint64
+	Window    time.Duration
+	Time      time.Time
+	Message   string
+}
+
+// genericPayload is the body of generic webhooks
+type genericPayload struct {
+	Alert         string    `json:"alert"`
+	Value         float64   `json:"value"`
+	Threshold     float64   `json:"threshold"`
+	WindowSeconds float64   `json:"window_seconds"`
+	Queries       uint64    `json:"queries"`
+	Pod           string    `json:"pod"`
+	Message       string    `json:"message"`
+	Time          time.Time `json:"time"`
+}
+
+// slackPayload is the body of Slack incoming webhooks
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// Webhook posts alerts as JSON to a URL
+type Webhook struct {
+	URL    string
+	Format string
+
+	pod    string
+	client *http.Client
+}
+
+// NewWebhook returns a webhook posting to endpoint in format, FormatGeneric
+// or FormatSlack
+func NewWebhook(endpoint, format string) (*Webhook, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", endpoint)
+	}
+	if format != FormatGeneric && format != FormatSlack {
+		return nil, fmt.Errorf("unknown webhook format %q (expected %s or %s)", format, FormatGeneric, FormatSlack)
+	}
+	// The hostname is the pod name in Kubernetes
+	pod, _ := os.Hostname()
+	return &Webhook{
+		URL:    endpoint,
+		Format: format,
+		pod:    pod,
+		client: &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// Send posts a, logging failures; alerts are not retried
+func (w *Webhook) Send(a Alert) {
+	if err := w.post(a); err != nil {
+		metrics.AnomalyAlerts.WithLabelValues(a.Name, "failed").Inc()
+		log.Warn().Err(err).Msgf("Failed to send the %s anomaly alert", a.Name)
+		return
+	}
+	metrics.AnomalyAlerts.WithLabelValues(a.Name, "sent").Inc()
+}
+
+func (w *Webhook) post(a Alert) error {
+	var payload any
+	if w.Format == FormatSlack {
+		payload = slackPayload{Text: fmt.Sprintf("DNS anomaly on %s: %s", w.pod, a.Message)}
+	} else {
+		payload = genericPayload{
+			Alert:         a.Name,
+			Value:         a.Value,
+			Threshold:     a.Threshold,
+			WindowSeconds: a.Window.Seconds(),
+			Queries:       a.Queries,
+			Pod:           w.pod,
+			Message:       a.Message,
+			Time:          a.Time.UTC(),
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
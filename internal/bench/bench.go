@@ -0,0 +1,234 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/dns"
+)
+
+// Config describes the load to generate against a DNS server
+type Config struct {
+	Target       string
+	QPS          int
+	Concurrency  int
+	Duration     time.Duration
+	Timeout      time.Duration
+	QType        uint16
+	Domains      []string
+	Blocked      []string
+	BlockedRatio float64
+}
+
+// maxQPS is the highest rate that can be paced at one query per nanosecond
+const maxQPS = 1_000_000_000
+
+// Result holds the outcome of a benchmark run
+type Result struct {
+	TargetQPS int           // requested rate, 0 for unlimited
+	Sending   time.Duration // time queries were sent for
+	Sent      int64
+	Received  int64
+	Errors    int64
+	Timeouts  int64
+	NXDomain  int64
+	Elapsed   time.Duration
+	latencies []time.Duration
+}
+
+// Run generates load according to cfg and blocks until the run completes
+func Run(cfg Config) (*Result, error) {
+	if cfg.Target == "" {
+		return nil, errors.New("bench target is required")
+	}
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("at least one domain is required")
+	}
+	if cfg.BlockedRatio > 0 && len(cfg.Blocked) == 0 {
+		return nil, errors.New("blocked ratio set but no blocked domains given")
+	}
+	if cfg.QPS < 0 || cfg.QPS > maxQPS {
+		return nil, fmt.Errorf("qps must be between 1 and %d, or 0 for unlimited", maxQPS)
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target: %w", err)
+	}
+
+	// Tokens are handed out on a schedule of the requested rate, or as fast
+	// as workers can take them when no rate is set; the channel closes at
+	// the deadline. A token waits for a free worker rather than being
+	// dropped, and the schedule then catches up, so that falling short of
+	// the rate shows in the rate achieved.
+	res := &Result{TargetQPS: cfg.QPS}
+	tokens := make(chan struct{}, cfg.Concurrency)
+	stop := make(chan struct{})
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+
+	go func() {
+		defer close(tokens)
+		defer func() { res.Sending = time.Since(start) }()
+		// A schedule fallen behind ends at the deadline too
+		expired := time.After(cfg.Duration)
+		for n := int64(0); ; n++ {
+			next := time.Now()
+			if cfg.QPS > 0 {
+				next = start.Add(time.Duration(float64(n) * float64(time.Second) / float64(cfg.QPS)))
+			}
+			if !next.Before(deadline) {
+				return
+			}
+			if d := time.Until(next); d > 0 {
+				time.Sleep(d)
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-expired:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var nextID atomic.Uint32
+
+	for i := 0; i < cfg.Concurrency; i++ {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			close(stop)
+			wg.Wait()
+			return nil, fmt.Errorf("failed to dial target: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			buffer := make([]byte, 4096)
+			local := make([]time.Duration, 0, 1024)
+
+			for range tokens {
+				domain := pick(cfg)
+				id := uint16(nextID.Add(1))
+				query := dns.BuildQuery(id, domain, cfg.QType)
+
+				sent := time.Now()
+				conn.SetDeadline(sent.Add(cfg.Timeout))
+				atomic.AddInt64(&res.Sent, 1)
+
+				if _, err := conn.Write(query); err != nil {
+					atomic.AddInt64(&res.Errors, 1)
+					continue
+				}
+
+				n, err := readReply(conn, buffer, id)
+				if err != nil {
+					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						atomic.AddInt64(&res.Timeouts, 1)
+					} else {
+						atomic.AddInt64(&res.Errors, 1)
+					}
+					continue
+				}
+
+				local = append(local, time.Since(sent))
+				atomic.AddInt64(&res.Received, 1)
+				if n >= 4 && buffer[3]&0x0F == 3 {
+					atomic.AddInt64(&res.NXDomain, 1)
+				}
+			}
+
+			mu.Lock()
+			res.latencies = append(res.latencies, local...)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+
+	return res, nil
+}
+
+// readReply reads datagrams until one matches the query ID
+func readReply(conn *net.UDPConn, buffer []byte, id uint16) (int, error) {
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 2 && uint16(buffer[0])<<8|uint16(buffer[1]) == id {
+			return n, nil
+		}
+	}
+}
+
+func pick(cfg Config) string {
+	if cfg.BlockedRatio > 0 && rand.Float64() < cfg.BlockedRatio {
+		return cfg.Blocked[rand.IntN(len(cfg.Blocked))]
+	}
+	return cfg.Domains[rand.IntN(len(cfg.Domains))]
+}
+
+// Percentile returns the latency at quantile p (0-100) of successful queries
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[idx]
+}
+
+// rate returns n per second of d, 0 for a run cancelled before it started
+// timing
+func rate(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// Report writes a human-readable summary of the run
+func (r *Result) Report(w io.Writer) {
+	fmt.Fprintf(w, "Duration:   %v\n", r.Elapsed.Round(time.Millisecond))
+	sent := rate(r.Sent, r.Sending)
+	switch {
+	case r.Sent == 0:
+		fmt.Fprintf(w, "Sent:       0\n")
+	case r.TargetQPS > 0:
+		fmt.Fprintf(w, "Sent:       %d (%.1f qps of %d targeted)\n", r.Sent, sent, r.TargetQPS)
+		if sent < 0.95*float64(r.TargetQPS) {
+			fmt.Fprintf(w, "Warning:    the target rate was not reached; raise -concurrency or lower -qps\n")
+		}
+	default:
+		fmt.Fprintf(w, "Sent:       %d (%.1f qps)\n", r.Sent, sent)
+	}
+	fmt.Fprintf(w, "Received:   %d (%.1f qps)\n", r.Received, rate(r.Received, r.Elapsed))
+	fmt.Fprintf(w, "NXDOMAIN:   %d\n", r.NXDomain)
+	fmt.Fprintf(w, "Timeouts:   %d\n", r.Timeouts)
+	fmt.Fprintf(w, "Errors:     %d\n", r.Errors)
+	fmt.Fprintf(w, "Latency p50: %v\n", r.Percentile(50))
+	fmt.Fprintf(w, "Latency p90: %v\n", r.Percentile(90))
+	fmt.Fprintf(w, "Latency p99: %v\n", r.Percentile(99))
+	fmt.Fprintf(w, "Latency max: %v\n", r.Percentile(100))
+}
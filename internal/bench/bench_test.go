@@ -0,0 +1,41 @@
+package bench
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReportNothingSent reports a run cancelled before any query was sent,
+// which must not print a NaN or infinite rate nor warn about the target
+func TestReportNothingSent(t *testing.T) {
+	for _, r := range []*Result{
+		{},
+		{TargetQPS: 100},
+		{TargetQPS: 100, Elapsed: time.Millisecond},
+	} {
+		var out strings.Builder
+		r.Report(&out)
+		report := out.String()
+		for _, bad := range []string{"NaN", "Inf", "Warning"} {
+			if strings.Contains(report, bad) {
+				t.Errorf("target %d: report contains %s:\n%s", r.TargetQPS, bad, report)
+			}
+		}
+		if !strings.Contains(report, "Sent:       0\n") {
+			t.Errorf("target %d: no sent count in the report:\n%s", r.TargetQPS, report)
+		}
+	}
+}
+
+func TestReportRates(t *testing.T) {
+	r := &Result{TargetQPS: 100, Sending: 2 * time.Second, Sent: 100, Received: 90, Elapsed: 3 * time.Second}
+	var out strings.Builder
+	r.Report(&out)
+	report := out.String()
+	for _, want := range []string{"Sent:       100 (50.0 qps of 100 targeted)\n", "Received:   90 (30.0 qps)\n", "Warning:"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+}
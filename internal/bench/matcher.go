@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"lktr/pkg/matcher"
+)
+
+// MatcherResult reports the cost of building a matcher from synthetic rules
+type MatcherResult struct {
+	Rules     int
+	HeapBytes uint64
+	BuildTime time.Duration
+}
+
+// MeasureMatcher builds a matcher from n synthetic rules, one in every
+// wildcardEvery of them a wildcard, and reports the retained heap size.
+func MeasureMatcher(n, wildcardEvery int) *MatcherResult {
+	before := heapInUse()
+
+	rules := make([]string, n)
+	for i := range rules {
+		// Share a small set of registrable suffixes the way real feeds do
+		rules[i] = fmt.Sprintf("h%d.d%d.example%d.com", i, i%1000, i%97)
+		if wildcardEvery > 0 && i%wildcardEvery == 0 {
+			rules[i] = "*." + rules[i]
+		}
+	}
+
+	start := time.Now()
+	m := matcher.BuildMatcher(rules)
+	elapsed := time.Since(start)
+
+	// Drop the input so only the matcher's own footprint remains
+	rules = nil
+	after := heapInUse()
+	runtime.KeepAlive(m)
+
+	res := &MatcherResult{Rules: n, BuildTime: elapsed}
+	if after > before {
+		res.HeapBytes = after - before
+	}
+	return res
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// Report writes a human-readable summary of the measurement
+func (r *MatcherResult) Report(w io.Writer) {
+	fmt.Fprintf(w, "Rules:      %d\n", r.Rules)
+	fmt.Fprintf(w, "Build time: %v\n", r.BuildTime.Round(time.Millisecond))
+	fmt.Fprintf(w, "Heap:       %.1f MiB\n", float64(r.HeapBytes)/(1<<20))
+	if r.Rules > 0 {
+		fmt.Fprintf(w, "Per rule:   %.1f bytes\n", float64(r.HeapBytes)/float64(r.Rules))
+	}
+}
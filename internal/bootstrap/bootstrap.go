@@ -0,0 +1,95 @@
+// Package bootstrap resolves the host names the sidecar itself depends on,
+// such as the controller's and the DoH upstream's, by asking DNS servers
+// directly. Under DNS interception the system resolver may send these
+// lookups back to the sidecar, which cannot answer them before it has a
+// policy and an upstream.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resolvConf is the system resolver configuration looked at by SelfResolving
+const resolvConf = "/etc/resolv.conf"
+
+// ParseServers parses a comma-separated list of DNS server addresses. A
+// server without a port is reached on port 53. Only IP addresses are
+// accepted, as there is nothing to resolve host names with yet.
+func ParseServers(spec string) ([]string, error) {
+	var servers []string
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			s = netip.AddrPortFrom(addr, 53).String()
+		}
+		ap, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap server %q is not an IP address", s)
+		}
+		servers = append(servers, ap.String())
+	}
+	return servers, nil
+}
+
+// Resolver returns a resolver sending its queries to servers instead of
+// those of the system configuration, whose search domains, options and
+// hosts file still apply. Each attempt goes to the next server.
+func Resolver(servers []string) *net.Resolver {
+	var next atomic.Uint32
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Dialer returns a dialer like the one of http.DefaultTransport that
+// resolves host names with r
+func Dialer(r *net.Resolver) *net.Dialer {
+	return &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: r}
+}
+
+// SelfResolving reports whether the system resolver would send queries to
+// the sidecar listening on listen: it listens on the DNS port of every
+// address, or of the one a nameserver of /etc/resolv.conf has
+func SelfResolving(listen string) bool {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || port != "53" {
+		return false
+	}
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return false
+	}
+	listenAddr, _ := netip.ParseAddr(host)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		if host == "" || listenAddr.IsUnspecified() {
+			if addr.IsLoopback() {
+				return true
+			}
+		} else if addr.Unmap() == listenAddr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deltaState tracks the blocklist assembled from incremental responses
+type deltaState struct {
+	version string              // last applied version, sent back as the ACK
+	rules   map[string]struct{} // blocklist at that version
+	nack    string              // nonce of a rejected response, "" when none
+	nackErr string              // why it was rejected
+}
+
+// UseDeltaProtocol switches the fetcher to incremental policy delivery. Each
+// poll sends the last applied version; the controller answers 304 when
+// nothing changed, or with the rules added and removed since that version.
+// A response that does not apply cleanly is rejected (NACK) and the sidecar
+// keeps its current blocklist until the controller sends a consistent one.
+func (f *Fetcher) UseDeltaProtocol() {
+	f.delta = &deltaState{rules: make(map[string]struct{})}
+}
+
+// resyncDelta makes the next delta request ask for the full policy, once
+// the sidecar enforces something else than the version it acknowledged:
+// the block-all rule of strict mode, dry-run in balance mode or the merged
+// fallback blocklist. A 304 for that version would leave them in force.
+func (f *Fetcher) resyncDelta() {
+	if f.delta != nil {
+		f.delta.version = ""
+	}
+}
+
+func (f *Fetcher) fetchDelta(configHash string) {
+	d := f.delta
+	query := url.Values{"hash": {configHash}, "version": {d.version}}
+	if d.nack != "" {
+		query.Set("nack", d.nack)
+		query.Set("error", d.nackErr)
+	}
+	reqURL := fmt.Sprintf("%s/api/policies/delta?%s", f.controllerURL, query.Encode())
+
+	if f.verbose {
+		log.Info().Msgf("Fetching policy delta from controller: %s (version %q)", f.controllerURL, d.version)
+	}
+	resp, err := f.get(reqURL)
+	if err != nil {
+		log.Err(err).Msg("Error fetching policy delta:")
+		f.applyOperationalMode()
+		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream").Inc()
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		f.controllerReachable()
+		metrics.PolicyDeltas.WithLabelValues("not_modified").Inc()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream_http_err").Inc()
+		log.Error().Msgf("Unexpected status code from controller: %d", resp.StatusCode)
+		f.applyOperationalMode()
+		return
+	}
+
+	var delta DeltaResponse
+	if err := decodeResponse(resp, &delta); err != nil {
+		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream_decode_err").Inc()
+		log.Err(err).Msg("Error decoding policy delta:")
+		f.applyOperationalMode()
+		return
+	}
+
+	if err := d.merge(&delta); err != nil {
+		log.Err(err).Msgf("Rejecting policy version %q", delta.Version)
+		d.nack, d.nackErr = delta.Nonce, err.Error()
+		f.controllerReachable()
+		f.reportFailed()
+		metrics.PolicyDeltas.WithLabelValues("nack").Inc()
+		return
+	}
+	d.version = delta.Version
+	d.nack, d.nackErr = "", ""
+	if delta.Full {
+		metrics.PolicyDeltas.WithLabelValues("full").Inc()
+	} else {
+		metrics.PolicyDeltas.WithLabelValues("delta").Inc()
+	}
+	if f.verbose {
+		log.Info().Msgf("Policy version %q applied: +%d -%d rules, %d total", delta.Version, len(delta.Added), len(delta.Removed), len(d.rules))
+	}
+
+	// The state is updated by the next delta, so the matcher gets a sorted
+	// snapshot of it, which apply shares rather than copies
+	delta.Policy.Spec.BlockList = slices.Sorted(maps.Keys(d.rules))
+	f.apply(&delta.ControllerResponse)
+}
+
+// merge applies delta to the blocklist in place. A delta that does not apply
+// to the current version, or holds an invalid rule, is rejected with the
+// blocklist left as it was.
+func (d *deltaState) merge(delta *DeltaResponse) error {
+	if delta.Version == "" {
+		return errors.New("response has no version")
+	}
+	if !delta.Full && d.version == "" {
+		return errors.New("incremental response without a base version")
+	}
+
+	// Check everything before changing anything, as if the removals were
+	// applied first and then the additions one by one
+	var removed, added map[string]struct{}
+	if !delta.Full {
+		removed = make(map[string]struct{}, len(delta.Removed))
+		added = make(map[string]struct{}, len(delta.Added))
+		for _, rule := range delta.Removed {
+			_, present := d.rules[rule]
+			if _, dup := removed[rule]; !present || dup {
+				return fmt.Errorf("removed rule %q is not present", rule)
+			}
+			removed[rule] = struct{}{}
+		}
+	}
+	for _, rule := range delta.Added {
+		if rule == "" || strings.ContainsAny(rule, " \t\r\n") {
+			return fmt.Errorf("invalid rule %q", rule)
+		}
+		if delta.Full {
+			continue
+		}
+		_, present := d.rules[rule]
+		_, gone := removed[rule]
+		if _, dup := added[rule]; dup || (present && !gone) {
+			return fmt.Errorf("added rule %q is already present", rule)
+		}
+		added[rule] = struct{}{}
+	}
+
+	if delta.Full {
+		clear(d.rules)
+	} else {
+		for rule := range removed {
+			delete(d.rules, rule)
+		}
+	}
+	for _, rule := range delta.Added {
+		d.rules[rule] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestDeltaMergeInPlace(t *testing.T) {
+	d := &deltaState{rules: make(map[string]struct{})}
+	state := reflect.ValueOf(d.rules).Pointer()
+	rules := func() []string { return slices.Sorted(maps.Keys(d.rules)) }
+	apply := func(delta DeltaResponse) error {
+		err := d.merge(&delta)
+		if err == nil {
+			d.version = delta.Version
+		}
+		return err
+	}
+
+	if err := apply(DeltaResponse{Version: "1", Full: true, Added: []string{"a.example.com", "b.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(DeltaResponse{Version: "2", Added: []string{"c.example.com", "a.example.com"}, Removed: []string{"a.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rules(), []string{"a.example.com", "b.example.com", "c.example.com"}; !slices.Equal(got, want) {
+		t.Fatalf("after version 2: got %v, want %v", got, want)
+	}
+
+	// Rejected deltas leave the blocklist as it was, even when part of
+	// them would apply
+	for name, delta := range map[string]DeltaResponse{
+		"no version":      {Added: []string{"d.example.com"}},
+		"removed absent":  {Version: "3", Added: []string{"d.example.com"}, Removed: []string{"b.example.com", "x.example.com"}},
+		"removed twice":   {Version: "3", Removed: []string{"b.example.com", "b.example.com"}},
+		"added present":   {Version: "3", Added: []string{"d.example.com", "c.example.com"}},
+		"added twice":     {Version: "3", Added: []string{"d.example.com", "d.example.com"}},
+		"invalid rule":    {Version: "3", Added: []string{"d.example.com", "bad rule"}, Removed: []string{"b.example.com"}},
+		"invalid in full": {Version: "3", Full: true, Added: []string{"d.example.com", ""}},
+	} {
+		if err := apply(delta); err == nil {
+			t.Errorf("%s: delta applied", name)
+		}
+		if got, want := rules(), []string{"a.example.com", "b.example.com", "c.example.com"}; !slices.Equal(got, want) {
+			t.Fatalf("%s: blocklist changed to %v", name, got)
+		}
+	}
+
+	if err := apply(DeltaResponse{Version: "4", Full: true, Added: []string{"z.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rules(), []string{"z.example.com"}; !slices.Equal(got, want) {
+		t.Fatalf("after a full response: got %v, want %v", got, want)
+	}
+	if reflect.ValueOf(d.rules).Pointer() != state {
+		t.Fatal("the blocklist was copied instead of updated in place")
+	}
+}
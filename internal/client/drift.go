@@ -0,0 +1,97 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BlocklistHash is the hex SHA-256 of a blocklist's rules, sorted and joined
+// by newlines. A controller sets the policy status blockListHash to this
+// value for the sidecar to detect drift, hashing the blockList together with
+// the allowList entries written as "@@" exceptions when there are any.
+func BlocklistHash(rules []string) string {
+	sorted := slices.Sorted(slices.Values(rules))
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// DriftDetector compares the blocklist the sidecar enforces with the one the
+// controller expects, as given by the blockListHash of the last policy applied.
+// A difference that persists across two consecutive checks counts as drift,
+// so an update still being debounced or rebuilt is not reported.
+type DriftDetector struct {
+	mu       sync.Mutex
+	expected string // blockListHash of the last policy, "" when unknown
+	active   string // hash of the blocklist handed to the matcher
+	mismatch bool   // the previous check saw a difference
+	drifted  bool
+}
+
+// UseDriftDetection makes the fetcher report the blockListHash of every
+// policy it applies to d
+func (f *Fetcher) UseDriftDetection(d *DriftDetector) {
+	f.drift = d
+}
+
+// Expect records the blockListHash of a policy applied from the controller.
+// "" suspends the comparison, as during a controller outage the sidecar
+// enforces fallback rules or blocks everything on purpose.
+func (d *DriftDetector) Expect(blockListHash string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expected = strings.ToLower(blockListHash)
+}
+
+// Applied records the blocklist handed to the matcher
+func (d *DriftDetector) Applied(rules []string) {
+	hash := BlocklistHash(rules)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active = hash
+}
+
+// Drifted reports whether the last check found drift
+func (d *DriftDetector) Drifted() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.drifted
+}
+
+// Check compares the enforced blocklist with the expected one, logging and
+// exporting a change of state
+func (d *DriftDetector) Check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	differs := d.expected != "" && d.expected != d.active
+	drifted := differs && d.mismatch
+	d.mismatch = differs
+
+	if drifted && !d.drifted {
+		log.Error().Msgf("Policy drift: the enforced blocklist (hash %s) is not the one the controller expects (blockListHash %s)", d.active, d.expected)
+	} else if !drifted && d.drifted {
+		log.Info().Msg("Policy drift resolved, the enforced blocklist matches the controller's")
+	}
+	d.drifted = drifted
+	if drifted {
+		metrics.PolicyDrift.Set(1)
+	} else {
+		metrics.PolicyDrift.Set(0)
+	}
+}
+
+// Run checks for drift every interval until the process exits
+func (d *DriftDetector) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.Check()
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlocklistHash(t *testing.T) {
+	// printf 'ads.example.com\ntracker.example.com' | sha256sum
+	want := "b03d25f01db0bf405763943471babb8299b0d30dbe445afcc2bff206afd0a1c1"
+	if got := BlocklistHash([]string{"tracker.example.com", "ads.example.com"}); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// TestDriftBlockListHash applies a policy with an allowList and compares
+// the enforced rules with its blockListHash, leaving specHash alone
+func TestDriftBlockListHash(t *testing.T) {
+	// printf '*.example.com\n@@good.example.com' | sha256sum
+	const enforced = "a51e552f05b0482e4946385d5b6bb423d2242050dcfa5bcecc5fc94d74f99f1c"
+	var blockListHash atomic.Value
+	blockListHash.Store(enforced)
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"policy":{"spec":{"blockList":["*.example.com"],"allowList":["good.example.com"]},"status":{"specHash":"a5e1","blockListHash":"` + blockListHash.Load().(string) + `"}}}`))
+	}))
+	defer controller.Close()
+
+	updates := make(chan []string, 1)
+	interval := time.Hour
+	var dryRun atomic.Bool
+	f := NewFetcher(FetcherOptions{ControllerURL: controller.URL, FetchInterval: &interval, Updates: updates, DryRun: &dryRun})
+	d := &DriftDetector{}
+	f.UseDriftDetection(d)
+
+	f.fetchPolicies("")
+	d.Applied(<-updates)
+	d.Check()
+	d.Check()
+	if d.Drifted() {
+		t.Fatal("drift reported for the blocklist the controller expects")
+	}
+
+	// The controller now expects another blocklist than the one enforced
+	blockListHash.Store("b03d25f01db0bf405763943471babb8299b0d30dbe445afcc2bff206afd0a1c1")
+	f.fetchPolicies("")
+	<-updates
+	d.Check()
+	if d.Drifted() {
+		t.Fatal("drift reported on the first check, the update may still be applied")
+	}
+	d.Check()
+	if !d.Drifted() {
+		t.Fatal("no drift reported after two checks")
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+	json "github.com/goccy/go-json"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+)
+
+// cborDecoder decodes CBOR policies using the types' json tags. The default
+// limits of the library are far below the size of large blocklists.
+var cborDecoder = func() cbor.DecMode {
+	dm, err := cbor.DecOptions{
+		MaxArrayElements: math.MaxInt32,
+		MaxMapPairs:      math.MaxInt32,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}()
+
+// UseCBOR makes the fetcher ask the controller for CBOR-encoded policies,
+// which are smaller and decode faster than JSON for large blocklists.
+// Responses are decoded according to their Content-Type, so a controller
+// that only speaks JSON keeps working.
+func (f *Fetcher) UseCBOR() {
+	f.accept = contentTypeCBOR + ", " + contentTypeJSON + ";q=0.5"
+}
+
+// get requests a policy document from the controller. Accept-Encoding is left
+// to the transport, which asks for gzip and decompresses the body itself.
+func (f *Fetcher) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	accept := f.accept
+	if accept == "" {
+		accept = contentTypeJSON
+	}
+	req.Header.Set("Accept", accept)
+	f.authorize(req)
+	return f.httpClient.Do(req)
+}
+
+// decodeResponse decodes a policy response body into v by its Content-Type,
+// treating a missing or unknown type as JSON
+func decodeResponse(resp *http.Response, v any) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeCBOR:
+		if err := cborDecoder.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("decoding CBOR policy: %w", err)
+		}
+		return nil
+	default:
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+}
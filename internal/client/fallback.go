@@ -0,0 +1,56 @@
+package client
+
+import (
+	"slices"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fallbackState holds the baseline blocklist used during controller outages
+type fallbackState struct {
+	rules  []string
+	after  time.Duration // outage length before the fallback is merged in
+	active bool
+}
+
+// UseFallback sets a baseline blocklist merged into the last fetched policy
+// once the controller has been unreachable for longer than after. The outage
+// clock starts now, so a controller that never answers also triggers it.
+func (f *Fetcher) UseFallback(rules []string, after time.Duration) {
+	f.fallback = &fallbackState{rules: rules, after: after}
+	f.lastSuccess = time.Now()
+}
+
+// controllerReachable records a successful exchange with the controller,
+// ending fallback enforcement. The next policy sent replaces the merged list.
+func (f *Fetcher) controllerReachable() {
+	f.lastSuccess = time.Now()
+	if f.fallback != nil && f.fallback.active {
+		f.fallback.active = false
+		metrics.FallbackActive.Set(0)
+		log.Info().Msg("Controller reachable again, fallback blocklist lifted")
+	}
+}
+
+// applyFallback merges the fallback rules into the last fetched blocklist
+// when the current outage has lasted longer than the fallback threshold
+func (f *Fetcher) applyFallback() {
+	if f.fallback == nil || f.fallback.active || len(f.fallback.rules) == 0 {
+		return
+	}
+	outage := time.Since(f.lastSuccess)
+	if outage < f.fallback.after {
+		return
+	}
+	f.fallback.active = true
+	metrics.FallbackActive.Set(1)
+	if f.drift != nil {
+		f.drift.Expect("")
+	}
+	log.Warn().Msgf("Controller unreachable for %s, enforcing fallback blocklist (%d rules) on top of the last policy", outage.Round(time.Second), len(f.fallback.rules))
+	f.updateChannel <- slices.Concat(f.lastBlockList, f.fallback.rules)
+	f.resyncDelta()
+}
@@ -1,33 +1,79 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"lktr/internal/bootstrap"
 	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
-	json "github.com/goccy/go-json"
 	"github.com/rs/zerolog/log"
 )
 
-func NewFetcher(controllerURL string, fetchInterval *time.Duration, verbose bool, updateChannel chan []string, dryRun *bool, operationalMode string, tlsDataCallback func(*TLSData), dohCallback func(bool)) *Fetcher {
+func NewFetcher(opts FetcherOptions) *Fetcher {
 	return &Fetcher{
-		controllerURL:   controllerURL,
-		fetchInterval:   fetchInterval,
-		verbose:         verbose,
-		dryRun:          dryRun,
-		operationalMode: operationalMode,
-		updateChannel:   updateChannel,
-		tlsDataCallback: tlsDataCallback,
-		dohCallback:     dohCallback,
+		controllerURL:      opts.ControllerURL,
+		fetchInterval:      opts.FetchInterval,
+		verbose:            opts.Verbose,
+		dryRun:             opts.DryRun,
+		operationalMode:    opts.OperationalMode,
+		updateChannel:      opts.Updates,
+		tlsDataCallback:    opts.TLSDataCallback,
+		dohCallback:        opts.DoHCallback,
+		policySetsCallback: opts.PolicySetsCallback,
+		namespacesCallback: opts.NamespacesCallback,
+		localZonesCallback: opts.LocalZonesCallback,
+		specCallback:       opts.SpecCallback,
+		generatedCallback:  opts.GeneratedCallback,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 }
 
+// UseTLSConfig makes controller requests use tlsConfig, for example to
+// authenticate the sidecar with a client certificate
+func (f *Fetcher) UseTLSConfig(tlsConfig *tls.Config) {
+	f.transport().TLSClientConfig = tlsConfig
+}
+
+// UseResolver makes controller requests resolve the controller's host name
+// with r instead of the system resolver
+func (f *Fetcher) UseResolver(r *net.Resolver) {
+	f.transport().DialContext = bootstrap.Dialer(r).DialContext
+}
+
+// transport returns the transport of controller requests, which starts as
+// a copy of the default one on first use
+func (f *Fetcher) transport() *http.Transport {
+	if f.httpClient.Transport == nil {
+		f.httpClient.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return f.httpClient.Transport.(*http.Transport)
+}
+
+// UseToken makes controller requests carry the bearer token returned by
+// token, which is called for every request so that it can change; an empty
+// token sends none
+func (f *Fetcher) UseToken(token func() string) {
+	f.token = token
+}
+
+// authorize adds the controller token, if any, to req
+func (f *Fetcher) authorize(req *http.Request) {
+	if f.token == nil {
+		return
+	}
+	if token := f.token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
 func (f *Fetcher) Start() {
 	if f.verbose {
 		log.Info().Msgf("Starting policy fetcher, controller: %s, interval: %v", f.controllerURL, f.fetchInterval)
@@ -39,14 +85,26 @@ func (f *Fetcher) Start() {
 		log.Err(err).Msg("The config hash cannot be blank")
 	}
 
+	if f.heartbeat != nil {
+		go f.runHeartbeat(configHash)
+	}
+	if f.telemetry != nil {
+		go f.runTelemetry()
+	}
+
 	ticker := time.NewTicker(*f.fetchInterval)
 	defer ticker.Stop()
 
+	fetch := f.fetchPolicies
+	if f.delta != nil {
+		fetch = f.fetchDelta
+	}
+
 	// Fetch immediately on start
-	f.fetchPolicies(configHash)
+	fetch(configHash)
 
 	for range ticker.C {
-		f.fetchPolicies(configHash)
+		fetch(configHash)
 	}
 }
 
@@ -55,16 +113,11 @@ func (f *Fetcher) fetchPolicies(configHash string) {
 		log.Info().Msgf("Fetching policies from controller: %s", f.controllerURL)
 	}
 	url := fmt.Sprintf("%s/api/policies?hash=%s", f.controllerURL, configHash)
-	resp, err := f.httpClient.Get(url)
+	resp, err := f.get(url)
 	if err != nil {
 		log.Err(err).Msg("Error fetching policies:")
 		log.Info().Msgf("The operational mode is %s error while fetching policies", f.operationalMode)
-		switch f.operationalMode {
-		case "strict":
-			f.updateChannel <- []string{"*"}
-		case "balance":
-			*f.dryRun = true
-		}
+		f.applyOperationalMode()
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream").Inc()
 		return
 	}
@@ -73,30 +126,26 @@ func (f *Fetcher) fetchPolicies(configHash string) {
 		err := errors.New("HTTP status error")
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream_http_err").Inc()
 		log.Info().Msgf("The operational mode is %s error on HTTP Status", f.operationalMode)
-		switch f.operationalMode {
-		case "strict":
-			f.updateChannel <- []string{"*"}
-		case "balance":
-			*f.dryRun = true
-		}
+		f.applyOperationalMode()
 		log.Err(err).Msgf("Unexpected status code from controller: %d", resp.StatusCode)
 		log.Info().Msg("THE END")
 		return
 	}
 	var controllerResp ControllerResponse
-	if err := json.NewDecoder(resp.Body).Decode(&controllerResp); err != nil {
+	if err := decodeResponse(resp, &controllerResp); err != nil {
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypePolicyFetch, "policy_upstream_decode_err").Inc()
 		log.Info().Msgf("The operational mode is %s error on decoding", f.operationalMode)
-		switch f.operationalMode {
-		case "strict":
-			f.updateChannel <- []string{"*"}
-		case "balance":
-			*f.dryRun = true
-		}
+		f.applyOperationalMode()
 		log.Err(err).Msg("Error decoding policy response:")
 		return
 	}
 
+	f.apply(&controllerResp)
+}
+
+// apply hands a fetched policy to the registered callbacks and the matcher
+// update channel
+func (f *Fetcher) apply(controllerResp *ControllerResponse) {
 	// Handle DoH status update
 	if f.dohCallback != nil {
 		if f.verbose {
@@ -116,12 +165,51 @@ func (f *Fetcher) fetchPolicies(configHash string) {
 		log.Info().Msg("DoH disabled, skipping TLS data processing")
 	}
 
+	if f.policySetsCallback != nil {
+		if f.verbose {
+			log.Info().Msgf("Fetched %d policy sets from controller", len(controllerResp.PolicySets))
+		}
+		f.policySetsCallback(controllerResp.PolicySets)
+	}
+
+	if f.namespacesCallback != nil {
+		f.namespacesCallback(controllerResp.Namespaces)
+	}
+
+	if f.localZonesCallback != nil {
+		f.localZonesCallback(controllerResp.Policy.Spec.LocalZones)
+	}
+
+	if f.specCallback != nil {
+		f.specCallback(controllerResp.Policy.Spec)
+	}
+
 	policyCount := len(controllerResp.Policy.Spec.BlockList)
 	if f.verbose {
 		log.Info().Msgf("Fetched %d policy entries from controller", policyCount)
 	}
-	f.updateChannel <- controllerResp.Policy.Spec.BlockList
-	*f.dryRun = controllerResp.Policy.Spec.DryRun
+	// Report the timestamp before sending the blocklist so it is known when
+	// the matcher is activated; a policy re-served unchanged keeps its stamp
+	if f.generatedCallback != nil && !controllerResp.GeneratedAt.IsZero() && !controllerResp.GeneratedAt.Equal(f.generatedAt) {
+		f.generatedAt = controllerResp.GeneratedAt
+		f.generatedCallback(controllerResp.GeneratedAt)
+	}
+	// AllowList entries are exceptions to the blocklist, overriding broader
+	// rules such as a wildcard above them. The response is not kept, so its
+	// blocklist becomes the one copy the fetcher and the update loop share.
+	rules := controllerResp.Policy.Spec.BlockList
+	if len(controllerResp.Policy.Spec.AllowList) > 0 {
+		rules = append(rules, matcher.Exceptions(controllerResp.Policy.Spec.AllowList)...)
+	}
+	f.lastBlockList = rules
+	f.controllerReachable()
+	if f.drift != nil {
+		f.drift.Expect(controllerResp.Policy.Status.BlockListHash)
+	}
+	// Stored first, the update loop reads it with the blocklist
+	f.dryRun.Store(controllerResp.Policy.Spec.DryRun)
+	f.updateChannel <- rules
+	f.reportApplied(&controllerResp.Policy)
 	*f.fetchInterval = time.Duration(controllerResp.Policy.Spec.Interval)
 	metrics.InfoTotal.WithLabelValues(metrics.InformalMetric, "number_of_policies").Set(float64(policyCount))
 
@@ -129,3 +217,27 @@ func (f *Fetcher) fetchPolicies(configHash string) {
 		log.Info().Msgf("Policies fetched successfully: %d entries\n", policyCount)
 	}
 }
+
+// applyOperationalMode reacts to a failed policy fetch: "strict" blocks every
+// query (dropping per-client policy sets so nothing bypasses the block-all
+// rule) and "balance" switches to dry-run. Outside strict mode a long outage
+// also brings in the fallback blocklist.
+func (f *Fetcher) applyOperationalMode() {
+	f.reportFailed()
+	switch f.operationalMode {
+	case "strict":
+		if f.policySetsCallback != nil {
+			f.policySetsCallback(nil)
+		}
+		if f.drift != nil {
+			f.drift.Expect("")
+		}
+		f.updateChannel <- []string{"*"}
+		f.resyncDelta()
+		return
+	case "balance":
+		f.dryRun.Store(true)
+		f.resyncDelta()
+	}
+	f.applyFallback()
+}
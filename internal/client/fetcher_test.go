@@ -0,0 +1,58 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lktr/pkg/matcher"
+)
+
+// TestAllowListOverridesBlockList fetches a policy whose allowList exempts
+// one name below a blocked wildcard, in full and as a delta
+func TestAllowListOverridesBlockList(t *testing.T) {
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/policies":
+			w.Write([]byte(`{"policy":{"spec":{"blockList":["*.example.com"],"allowList":["good.example.com"]}}}`))
+		case "/api/policies/delta":
+			w.Write([]byte(`{"version":"1","nonce":"a","full":true,"added":["*.example.com"],"policy":{"spec":{"allowList":["good.example.com"]}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer controller.Close()
+
+	for _, delta := range []bool{false, true} {
+		updates := make(chan []string, 1)
+		interval := time.Hour
+		var dryRun atomic.Bool
+		f := NewFetcher(FetcherOptions{ControllerURL: controller.URL, FetchInterval: &interval, Updates: updates, DryRun: &dryRun})
+		if delta {
+			f.UseDeltaProtocol()
+			f.fetchDelta("")
+		} else {
+			f.fetchPolicies("")
+		}
+
+		var rules []string
+		select {
+		case rules = <-updates:
+		default:
+			t.Fatalf("delta %v: no blocklist sent", delta)
+		}
+		m := matcher.BuildMatcher(rules)
+		if !m.Match("bad.example.com").Matched {
+			t.Errorf("delta %v: bad.example.com not blocked by *.example.com", delta)
+		}
+		if result := m.Match("good.example.com"); result.Matched {
+			t.Errorf("delta %v: good.example.com blocked by %q despite the allowList", delta, result.Rule)
+		}
+		if result := m.Match("www.good.example.com"); !result.Matched {
+			t.Errorf("delta %v: www.good.example.com not blocked, the allowList entry is exact", delta)
+		}
+	}
+}
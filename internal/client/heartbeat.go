@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// Registration identifies the sidecar to the controller. It is posted to
+// /api/sidecars/register when the fetcher starts, and again whenever the
+// controller answers a heartbeat with 404 because it no longer knows the
+// sidecar, for example after a controller restart.
+type Registration struct {
+	PodUID       string   `json:"podUID"`
+	PodName      string   `json:"podName,omitempty"`
+	Namespace    string   `json:"namespace,omitempty"`
+	Version      string   `json:"version"`
+	ConfigHash   string   `json:"configHash"`
+	Capabilities []string `json:"capabilities"` // policy features the sidecar understands
+}
+
+// Heartbeat tells the controller the sidecar is alive and which policy it
+// enforces. It is posted to /api/sidecars/heartbeat.
+type Heartbeat struct {
+	PodUID        string    `json:"podUID"`
+	PolicyVersion string    `json:"policyVersion"`
+	Drift         bool      `json:"drift,omitempty"` // the enforced blocklist is not the one the controller expects
+	Time          time.Time `json:"time"`
+}
+
+// baseCapabilities are the policy features every sidecar build understands
+var baseCapabilities = []string{"policySets", "namespaces", "localZones", "shadowBlockList", "upstreamFailureMode"}
+
+type heartbeatState struct {
+	registration  Registration
+	interval      time.Duration
+	policyVersion func() string
+	registered    bool
+	failing       bool
+}
+
+// UseHeartbeat registers the sidecar with the controller when the fetcher
+// starts and then sends a heartbeat every interval. policyVersion reports
+// the version of the enforced policy.
+func (f *Fetcher) UseHeartbeat(registration Registration, interval time.Duration, policyVersion func() string) {
+	f.heartbeat = &heartbeatState{registration: registration, interval: interval, policyVersion: policyVersion}
+}
+
+// capabilities lists the policy features of this fetcher's configuration
+func (f *Fetcher) capabilities() []string {
+	capabilities := append([]string{}, baseCapabilities...)
+	if f.delta != nil {
+		capabilities = append(capabilities, "delta")
+	}
+	if f.accept != "" {
+		capabilities = append(capabilities, "cbor")
+	}
+	if f.drift != nil {
+		capabilities = append(capabilities, "blockListHash")
+	}
+	return capabilities
+}
+
+// runHeartbeat registers and sends heartbeats until the process exits.
+// Registration is retried on every tick until the controller accepts it.
+func (f *Fetcher) runHeartbeat(configHash string) {
+	hb := f.heartbeat
+	hb.registration.ConfigHash = configHash
+	hb.registration.Capabilities = f.capabilities()
+
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+	for {
+		f.beat()
+		<-ticker.C
+	}
+}
+
+// beat sends the registration if the controller does not know the sidecar
+// yet, and a heartbeat otherwise
+func (f *Fetcher) beat() {
+	hb := f.heartbeat
+	var err error
+	if !hb.registered {
+		if _, err = f.post("/api/sidecars/register", hb.registration); err == nil {
+			hb.registered = true
+			metrics.ControllerRegistered.Set(1)
+			log.Info().Msgf("Registered with controller as %s", hb.registration.PodUID)
+		}
+	} else {
+		var status int
+		status, err = f.post("/api/sidecars/heartbeat", Heartbeat{
+			PodUID:        hb.registration.PodUID,
+			PolicyVersion: hb.policyVersion(),
+			Drift:         f.drift != nil && f.drift.Drifted(),
+			Time:          time.Now(),
+		})
+		if status == http.StatusNotFound {
+			// Register again on the next tick
+			hb.registered = false
+			metrics.ControllerRegistered.Set(0)
+			err = errors.New("controller does not know this sidecar, registering again")
+		}
+	}
+
+	if err != nil {
+		metrics.ControllerHeartbeats.WithLabelValues("error").Inc()
+		// Log the first failure only, not every tick of an outage
+		if !hb.failing {
+			log.Warn().Err(err).Msg("Controller heartbeat failed")
+		}
+		hb.failing = true
+		return
+	}
+	metrics.ControllerHeartbeats.WithLabelValues("ok").Inc()
+	if hb.failing {
+		log.Info().Msg("Controller heartbeat recovered")
+	}
+	hb.failing = false
+}
+
+// post sends v as JSON to a controller endpoint, returning the status code
+func (f *Fetcher) post(path string, v any) (int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.controllerURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	f.authorize(req)
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code from controller %s: %d", path, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
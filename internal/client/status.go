@@ -0,0 +1,50 @@
+package client
+
+import (
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// PolicySourceController labels the status metrics of the policy fetched
+// from the controller
+const PolicySourceController = "controller"
+
+// policyName identifies a DnsPolicy in the status metrics
+func policyName(p *DnsPolicy) string {
+	if p.Namespace == "" {
+		return p.Name
+	}
+	return p.Namespace + "/" + p.Name
+}
+
+// policyGeneration is the generation the controller observed for p, or the
+// spec generation when the controller does not report one
+func policyGeneration(p *DnsPolicy) int64 {
+	if p.Status.ObservedGeneration != 0 {
+		return p.Status.ObservedGeneration
+	}
+	return p.Generation
+}
+
+// reportApplied exports the generation of the policy just applied
+func (f *Fetcher) reportApplied(p *DnsPolicy) {
+	name := policyName(p)
+	if f.policyName != name {
+		// The sidecar was retargeted to another policy, or failures were
+		// reported before the first one arrived
+		metrics.PolicyGeneration.DeleteLabelValues(PolicySourceController, f.policyName)
+		metrics.PolicyApplyStatus.DeleteLabelValues(PolicySourceController, f.policyName)
+		metrics.PolicyLastApplied.DeleteLabelValues(PolicySourceController, f.policyName)
+	}
+	f.policyName = name
+	metrics.PolicyGeneration.WithLabelValues(PolicySourceController, name).Set(float64(policyGeneration(p)))
+	metrics.PolicyApplyStatus.WithLabelValues(PolicySourceController, name).Set(1)
+	metrics.PolicyLastApplied.WithLabelValues(PolicySourceController, name).Set(float64(time.Now().Unix()))
+}
+
+// reportFailed marks the last policy update from the controller as failed.
+// The generation still enforced is left as it is.
+func (f *Fetcher) reportFailed() {
+	metrics.PolicyApplyStatus.WithLabelValues(PolicySourceController, f.policyName).Set(0)
+}
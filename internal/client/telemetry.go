@@ -0,0 +1,79 @@
+package client
+
+import (
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Telemetry is a summary of the queries a sidecar answered over one period,
+// for fleet-wide views and rule suggestions on the controller. It carries
+// counts and the busiest names, never individual queries or client
+// addresses. It is posted to /api/sidecars/telemetry.
+type Telemetry struct {
+	PodUID   string            `json:"podUID"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Queries  uint64            `json:"queries"`
+	Verdicts map[string]uint64 `json:"verdicts"` // queries by verdict: blocked, allowed, local, failed
+	// SampleRate is the fraction of queries counted in the tables below;
+	// the totals above count every query
+	SampleRate float64       `json:"sampleRate"`
+	TopQueried []DomainCount `json:"topQueried,omitempty"`
+	TopBlocked []DomainCount `json:"topBlocked,omitempty"`
+	TopRules   []RuleCount   `json:"topRules,omitempty"` // blocking rules by hits
+}
+
+// DomainCount is one line of a top-domains table
+type DomainCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// RuleCount is one line of the top-rules table
+type RuleCount struct {
+	Rule  string `json:"rule"`
+	Count uint64 `json:"count"`
+}
+
+type telemetryState struct {
+	podUID   string
+	interval time.Duration
+	report   func() Telemetry
+	failing  bool
+}
+
+// UseTelemetry posts a summary of the answered queries every interval.
+// report returns the summary since its last call.
+func (f *Fetcher) UseTelemetry(podUID string, interval time.Duration, report func() Telemetry) {
+	f.telemetry = &telemetryState{podUID: podUID, interval: interval, report: report}
+}
+
+// runTelemetry uploads a summary every tick until the process exits. A
+// summary that fails to upload is dropped, so that an outage does not pile
+// up reports; the next one covers its own period only.
+func (f *Fetcher) runTelemetry() {
+	tel := f.telemetry
+	ticker := time.NewTicker(tel.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report := tel.report()
+		report.PodUID = tel.podUID
+		if _, err := f.post("/api/sidecars/telemetry", report); err != nil {
+			metrics.TelemetryUploads.WithLabelValues("error").Inc()
+			// Log the first failure only, not every tick of an outage
+			if !tel.failing {
+				log.Warn().Err(err).Msg("Telemetry upload failed")
+			}
+			tel.failing = true
+			continue
+		}
+		metrics.TelemetryUploads.WithLabelValues("ok").Inc()
+		if tel.failing {
+			log.Info().Msg("Telemetry upload recovered")
+		}
+		tel.failing = false
+	}
+}
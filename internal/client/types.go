@@ -2,6 +2,7 @@ package client
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -22,6 +23,92 @@ type DnsPolicySpec struct {
 	DryRun         bool              `json:"dryrun,omitempty"`
 	Doh            bool              `json:"doh,omitempty"`
 	Interval       int               `json:"interval,omitempty"`
+	LocalZones     []LocalZone       `json:"localZones,omitempty"`
+	// ShadowBlockList is a candidate blocklist evaluated but not enforced
+	ShadowBlockList []string `json:"shadowBlockList,omitempty"`
+	// UpstreamFailureMode is "open" or "closed"; empty keeps the sidecar default
+	UpstreamFailureMode string `json:"upstreamFailureMode,omitempty"`
+	// Rego is a policy evaluated locally for every query, nil for none
+	Rego *RegoPolicy `json:"rego,omitempty"`
+	// Upstream is the plain DNS server ("ip:port") replacing -upstream;
+	// empty keeps the sidecar default
+	Upstream string `json:"upstream,omitempty"`
+	// ForwardZones send the queries for some zones to their own servers
+	ForwardZones []ForwardZone `json:"forwardZones,omitempty"`
+	// BlockResponse is the answer to blocked queries, as for -block-response;
+	// empty keeps the sidecar default
+	BlockResponse string `json:"blockResponse,omitempty"`
+	// BlockCIDRs are address ranges whose appearance in an A or AAAA answer
+	// blocks the query, e.g. known command-and-control networks
+	BlockCIDRs []string `json:"blockCIDRs,omitempty"`
+	// Overrides answer some names with fixed records instead of the upstream
+	Overrides []AnswerOverride `json:"overrides,omitempty"`
+	// QueryTypeRules block or refuse queries of some record types
+	QueryTypeRules []QueryTypeRule `json:"queryTypeRules,omitempty"`
+	// FilterAAAA are blocklist-style rules for names that get no IPv6
+	// addresses, e.g. "*" for workloads without IPv6 egress
+	FilterAAAA []string `json:"filterAAAA,omitempty"`
+	// GeoRules block or flag answers by the location of their addresses;
+	// they need the sidecar's GeoIP databases
+	GeoRules []GeoRule `json:"geoRules,omitempty"`
+	// BlockNewlyRegistered switches blocking the domains of the sidecar's
+	// -nrd-feed on or off; nil keeps the sidecar default, on
+	BlockNewlyRegistered *bool `json:"blockNewlyRegistered,omitempty"`
+}
+
+// GeoRule acts on answers with an address in one of its countries or
+// autonomous systems, for every name or for the names of its domains
+type GeoRule struct {
+	Countries []string `json:"countries,omitempty"` // ISO 3166-1 alpha-2 codes
+	ASNs      []uint32 `json:"asns,omitempty"`
+	Domains   []string `json:"domains,omitempty"` // blocklist-style rules, empty for every name
+	Action    string   `json:"action,omitempty"`  // "block" (the default) or "flag"
+}
+
+// QueryTypeRule blocks queries of some record types, e.g. ANY or TXT, for
+// every name or for the names of its domains
+type QueryTypeRule struct {
+	Types   []string `json:"types"`             // mnemonics such as "TXT", or "TYPE65"
+	Domains []string `json:"domains,omitempty"` // blocklist-style rules, empty for every name
+	Action  string   `json:"action,omitempty"`  // "block" (the default) or "refuse"
+}
+
+// AnswerOverride answers a name, or every name below a "*." base, with
+// addresses or as an alias of another name
+type AnswerOverride struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses,omitempty"` // A and AAAA answers
+	CNAME     string   `json:"cname,omitempty"`     // alias target, instead of addresses
+	TTL       uint32   `json:"ttl,omitempty"`       // seconds, 60 when unset
+}
+
+// ForwardZone is a zone whose queries go to a server of its own rather than
+// the upstream
+type ForwardZone struct {
+	Zone     string `json:"zone"`
+	Upstream string `json:"upstream"` // ip:port of a plain DNS server
+}
+
+// RegoPolicy is an OPA bundle evaluated against the attributes of each query
+type RegoPolicy struct {
+	Bundle []byte `json:"bundle"`          // bundle tarball (.tar.gz), base64 in JSON
+	Query  string `json:"query,omitempty"` // rule deciding the query, "data.dns.deny" when empty
+}
+
+// LocalZone is a stub zone answered authoritatively by the sidecar
+type LocalZone struct {
+	Origin  string       `json:"origin"`
+	Zone    string       `json:"zone"`              // zone-file snippet in RFC 1035 master format
+	Records []ZoneRecord `json:"records,omitempty"` // added to the records of Zone
+}
+
+// ZoneRecord is a record of a local zone given as fields rather than as
+// zone-file text
+type ZoneRecord struct {
+	Name  string `json:"name"` // relative to the origin, "@" for the origin itself
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl,omitempty"` // 0 for the zone's default
+	Value string `json:"value"`         // record data as in a zone file, e.g. "10 mail" for MX
 }
 
 type DnsPolicyStatus struct {
@@ -29,6 +116,9 @@ type DnsPolicyStatus struct {
 	SpecHash           string             `json:"specHash,omitempty"`
 	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
 	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	// BlockListHash is the BlocklistHash of the rules the policy enforces,
+	// for the sidecar to detect drift; "" when the controller sets none
+	BlockListHash string `json:"blockListHash,omitempty"`
 }
 
 type TLSData struct {
@@ -37,19 +127,87 @@ type TLSData struct {
 	CACertificate string `json:"caCertificate"` // base64-encoded CA certificate
 }
 
+// PolicySet is a named blocklist enforced for a subset of clients sharing the
+// proxy. Pod identities are resolved to pod IPs by the controller.
+type PolicySet struct {
+	Name      string   `json:"name"`
+	Clients   []string `json:"clients"`   // client IPs or CIDRs
+	BlockList []string `json:"blockList"` // rules, same syntax as the policy blockList
+}
+
+// ClientNamespace attributes client pod IPs to their Kubernetes namespace,
+// for the namespace label of the query metrics. The controller resolves pods
+// to IPs, as for policy sets.
+type ClientNamespace struct {
+	Namespace string   `json:"namespace"`
+	Clients   []string `json:"clients"` // client IPs or CIDRs
+}
+
 type ControllerResponse struct {
-	Policy  DnsPolicy `json:"policy"`
-	TLSData *TLSData  `json:"tlsData,omitempty"`
+	Policy     DnsPolicy         `json:"policy"`
+	TLSData    *TLSData          `json:"tlsData,omitempty"`
+	PolicySets []PolicySet       `json:"policySets,omitempty"`
+	Namespaces []ClientNamespace `json:"namespaces,omitempty"`
+	// GeneratedAt is when the controller produced this policy
+	GeneratedAt time.Time `json:"generatedAt,omitempty"`
+}
+
+// FetcherOptions configures a Fetcher. The callbacks are optional, each is
+// called with its part of every policy applied.
+type FetcherOptions struct {
+	ControllerURL   string
+	FetchInterval   *time.Duration // set to the interval of each policy applied
+	Verbose         bool
+	Updates         chan []string // receives the blocklist of every policy applied
+	DryRun          *atomic.Bool  // set to the dryRun switch of each policy applied
+	OperationalMode string
+
+	TLSDataCallback    func(*TLSData)          // TLS data from the controller
+	DoHCallback        func(bool)              // whether DoH upstreams are enabled
+	PolicySetsCallback func([]PolicySet)       // per-client policy sets
+	NamespacesCallback func([]ClientNamespace) // client namespace attribution
+	LocalZonesCallback func([]LocalZone)       // local stub zones
+	SpecCallback       func(DnsPolicySpec)     // full spec, for settings without a dedicated callback
+	GeneratedCallback  func(time.Time)         // controller timestamp of each new policy
 }
 
 type Fetcher struct {
-	controllerURL   string
-	fetchInterval   *time.Duration
-	verbose         bool
-	dryRun          *bool
-	operationalMode string
-	updateChannel   chan []string
-	httpClient      *http.Client
-	tlsDataCallback func(*TLSData) // callback to update TLS data when fetched
-	dohCallback     func(bool)     // callback to update DoH status when fetched
+	controllerURL      string
+	fetchInterval      *time.Duration
+	verbose            bool
+	dryRun             *atomic.Bool // read by the update loop with each blocklist
+	operationalMode    string
+	updateChannel      chan []string
+	httpClient         *http.Client
+	accept             string                  // Accept header of policy requests, JSON when empty
+	token              func() string           // bearer token of controller requests, nil when none
+	tlsDataCallback    func(*TLSData)          // callback to update TLS data when fetched
+	dohCallback        func(bool)              // callback to update DoH status when fetched
+	policySetsCallback func([]PolicySet)       // callback to update per-client policy sets when fetched
+	namespacesCallback func([]ClientNamespace) // callback to update the client namespace attribution when fetched
+	localZonesCallback func([]LocalZone)       // callback to update local stub zones when fetched
+	specCallback       func(DnsPolicySpec)     // callback with the full policy spec for settings without a dedicated callback
+	generatedCallback  func(time.Time)         // callback with the controller timestamp of each new policy
+	generatedAt        time.Time               // controller timestamp of the last policy applied
+	delta              *deltaState             // incremental delivery state, nil when fetching full policies
+	fallback           *fallbackState          // baseline blocklist for controller outages, nil when none
+	heartbeat          *heartbeatState         // registration and heartbeats, nil when disabled
+	telemetry          *telemetryState         // query summary uploads, nil when disabled
+	drift              *DriftDetector          // told the blockListHash of each policy applied, nil when disabled
+	lastSuccess        time.Time               // last time the controller answered
+	lastBlockList      []string                // blocklist of the last policy applied, as sent and never modified
+	policyName         string                  // namespace/name of the last policy applied, for the status metrics
+}
+
+// DeltaResponse is the controller's answer to an incremental policy request.
+// Everything but the blocklist is sent in full, as in ControllerResponse; the
+// blocklist is sent as the rules added and removed since the version the
+// sidecar last acknowledged, or in full when Full is set.
+type DeltaResponse struct {
+	ControllerResponse
+	Version string   `json:"version"`           // version of the policy described by this response
+	Nonce   string   `json:"nonce"`             // identifies this response in a NACK
+	Full    bool     `json:"full,omitempty"`    // Added holds the complete blocklist
+	Added   []string `json:"added,omitempty"`   // rules added since the acknowledged version
+	Removed []string `json:"removed,omitempty"` // rules removed since the acknowledged version
 }
@@ -24,6 +24,138 @@ type Config struct {
 	TLSClientCert         string
 	TLSClientKey          string
 	TLSInsecureSkipVerify bool
+	UpdateDebounce        time.Duration
+	GCPercent             int
+	MemoryLimitMB         int
+	MemoryLimitRatio      float64
+	DNS64Enabled          bool
+	DNS64Prefix           string
+	DNS64Exclude          string
+	MinTTL                int
+	MaxTTL                int
+	RewriteRules          string
+	CNAMEFlatten          bool
+	CNAMEFlattenDepth     int
+	DisableUDP            bool
+	DisableTCP            bool
+	ZoneFiles             string
+	OverridesFile         string
+	SearchDomains         string
+	UpstreamFailureMode   string
+	BreakerThreshold      int
+	BreakerCooldown       time.Duration
+	PushURL               string
+	PushJob               string
+	PushInterval          time.Duration
+	PushLabels            string
+	StatsDAddr            string
+	StatsDPrefix          string
+	StatsDInterval        time.Duration
+	StatsDTags            bool
+	CanaryPercent         int
+	CanarySoak            time.Duration
+	UpstreamMaxInflight   int
+	SpillUpstream         string
+	GRPCListenAddr        string
+	GRPCTLSCert           string
+	GRPCTLSKey            string
+	GRPCClientCA          string
+	DeltaUpdates          bool
+	ClusterDomain         string
+	TCPIdleTimeout        time.Duration
+	UpstreamTCPIdleConns  int
+	ScrubOptions          string
+	EDNSMaxPayload        int
+	EDNSUDPSize           int
+	LogMode               string
+	ClientStatsMax        int
+	FallbackBlocklist     string
+	FallbackAfter         time.Duration
+	SinkholeIPv4          string
+	SinkholeIPv6          string
+	SinkholeName          string
+	SinkholeTTL           int
+	BlockResponse         string
+	ExtendedError         string
+	ExtendedErrorRule     bool
+	SelfTest              bool
+	SelfTestName          string
+	SelfTestExit          bool
+	FilterAnswers         bool
+	FilterAnswersBlock    bool
+	CNAMEInspection       bool
+	SVCBInspection        bool
+	StripECH              bool
+	GeoIPDB               string
+	PolicyEncoding        string
+	Recursive             bool
+	RootHints             string
+	QNAMEMinimization     bool
+	HedgeUpstream         string
+	HedgeAfter            time.Duration
+	RouteUpstreams        string
+	RouteMargin           float64
+	RouteHold             time.Duration
+	SpecialUse            string
+	ChaosVersion          string
+	ChaosHostname         string
+	DryRunReportMax       int
+	MirrorTarget          string
+	MirrorRate            float64
+	MirrorResponses       bool
+	StatsDB               string
+	StatsRetention        time.Duration
+	StatsMaxKeys          int
+	StatsFlush            time.Duration
+	QueryLogDir           string
+	QueryLogMaxAge        time.Duration
+	QueryLogMaxSizeMB     int
+	QueryLogVerdicts      string
+	AnomalyWindow         time.Duration
+	AnomalyWebhook        string
+	ThreatFeeds           string
+	NRDFeed               string
+	NRDMaxAge             time.Duration
+	AnomalyWebhookFormat  string
+	AnomalyMaxQPS         float64
+	AnomalyMaxBlockRate   float64
+	AnomalyMinQueries     int
+	AnomalyCooldown       time.Duration
+	Dashboard             bool
+	LoopDetection         bool
+	HappyEyeballsDelay    time.Duration
+	EBPFRedirect          bool
+	EBPFRedirectCgroup    string
+	BootstrapDNS          string
+	Padding               string
+	PaddingBlock          int
+	QueryIDOption         int
+	CaseRandomization     bool
+	UpstreamCookies       bool
+	MaxNamespaces         int
+	HeartbeatInterval     time.Duration
+	TelemetryInterval     time.Duration
+	TelemetrySample       float64
+	TelemetryTop          int
+	DriftCheckInterval    time.Duration
+	FaultInject           string
+	CaptureDir            string
+	CaptureMaxSeconds     int
+	CaptureMaxPackets     int
+	WasmPlugin            string
+	WasmPluginTimeout     time.Duration
+	AuthzURL              string
+	AuthzSuffixes         string
+	AuthzTimeout          time.Duration
+	AuthzCacheTTL         time.Duration
+	AuthzFailureMode      string
+	RegoTimeout           time.Duration
+	SPIFFESocket          string
+	VaultAddr             string
+	VaultPath             string
+	VaultTokenFile        string
+	SecretsURL            string
+	SecretsRefresh        time.Duration
 
 	// Runtime TLS data fetched from controller (decoded from base64)
 	tlsClientCertData []byte
@@ -35,6 +167,30 @@ type Config struct {
 func Load() *Config {
 	cfg := &Config{}
 	fetchIntervalSec := 0
+	updateDebounceMs := 0
+	breakerCooldownMs := 0
+	pushIntervalSec := 0
+	statsdIntervalSec := 0
+	queryLogMaxAgeHours := 0
+	anomalyWindowSec := 0
+	anomalyCooldownSec := 0
+	canarySoakSec := 0
+	tcpIdleTimeoutMs := 0
+	fallbackAfterSec := 0
+	hedgeAfterMs := 0
+	routeHoldSec := 0
+	statsRetentionHours := 0
+	statsFlushSec := 0
+	heartbeatIntervalSec := 0
+	telemetryIntervalSec := 0
+	driftCheckIntervalSec := 0
+	wasmPluginTimeoutMs := 0
+	authzTimeoutMs := 0
+	regoTimeoutMs := 0
+	happyEyeballsDelayMs := 0
+	secretsRefreshSec := 0
+	authzCacheTTLSec := 0
+	nrdMaxAgeDays := 0
 
 	flag.StringVar(&cfg.ListenAddr, "listen", ":53", "Address to listen on (default :53)")
 	flag.StringVar(&cfg.UpstreamDNS, "upstream", "1.1.1.1:53", "Upstream DNS server (default 1.1.1.1:53)")
@@ -48,9 +204,165 @@ func Load() *Config {
 	flag.StringVar(&cfg.TLSClientCert, "tls-client-cert", "", "Path to client certificate for mTLS")
 	flag.StringVar(&cfg.TLSClientKey, "tls-client-key", "", "Path to client private key for mTLS")
 	flag.BoolVar(&cfg.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "Skip TLS certificate verification (insecure, for testing only)")
+	flag.IntVar(&updateDebounceMs, "update-debounce-ms", 250, "Quiet period in milliseconds used to coalesce bursts of policy updates (0 disables)")
+	flag.IntVar(&cfg.GCPercent, "gc-percent", 0, "Go GC target percentage (0 keeps GOGC/runtime default)")
+	flag.IntVar(&cfg.MemoryLimitMB, "memory-limit-mb", 0, "Soft memory limit in MiB (0 derives it from the container limit)")
+	flag.Float64Var(&cfg.MemoryLimitRatio, "memory-limit-ratio", 0.9, "Fraction of the container memory limit used as the soft limit (0 disables)")
+	flag.BoolVar(&cfg.DNS64Enabled, "dns64", false, "Synthesize AAAA records from A records for IPv6-only clients")
+	flag.StringVar(&cfg.DNS64Prefix, "dns64-prefix", "64:ff9b::/96", "NAT64 prefix used for DNS64 synthesis")
+	flag.StringVar(&cfg.DNS64Exclude, "dns64-exclude", "", "Comma-separated IPv6 prefixes whose AAAA records DNS64 treats as absent, e.g. unreachable ULA addresses")
+	flag.IntVar(&cfg.MinTTL, "min-ttl", 0, "Raise the TTLs of upstream answers to at least this many seconds (0 disables)")
+	flag.IntVar(&cfg.MaxTTL, "max-ttl", 0, "Lower the TTLs of upstream answers to at most this many seconds (0 disables)")
+	flag.StringVar(&cfg.RewriteRules, "rewrite", "", "Comma-separated query-name rewrite rules, e.g. \"old.internal->new.internal,*.legacy.svc->*.svc.cluster.local\"")
+	flag.BoolVar(&cfg.CNAMEFlatten, "cname-flatten", false, "Return the final A/AAAA records of a CNAME chain under the queried name")
+	flag.IntVar(&cfg.CNAMEFlattenDepth, "cname-flatten-depth", 8, "Maximum number of CNAMEs followed when flattening")
+	flag.BoolVar(&cfg.DisableUDP, "disable-udp", false, "Do not open the UDP listener")
+	flag.BoolVar(&cfg.DisableTCP, "disable-tcp", false, "Do not open the TCP listener")
+	flag.StringVar(&cfg.ZoneFiles, "zone-file", "", "Comma-separated origin=path zone files answered authoritatively")
+	flag.StringVar(&cfg.OverridesFile, "overrides-file", "", "File of answer overrides, one \"name [ttl] address...\" or \"name [ttl] CNAME target\" per line, answered authoritatively")
+	flag.StringVar(&cfg.SearchDomains, "search-domains", "", "Comma-separated search suffixes stripped before matching, or \"auto\" to read /etc/resolv.conf")
+	flag.StringVar(&cfg.UpstreamFailureMode, "upstream-failure-mode", "closed", "Behaviour when the upstream is unreachable: \"closed\" (SERVFAIL) or \"open\" (serve stale/fall back to plain DNS)")
+	flag.IntVar(&cfg.BreakerThreshold, "breaker-threshold", 5, "Consecutive upstream failures that open the circuit breaker (0 disables)")
+	flag.IntVar(&breakerCooldownMs, "breaker-cooldown-ms", 10000, "Milliseconds the circuit breaker stays open before probing the upstream again")
+	flag.StringVar(&cfg.PushURL, "push-url", "", "Pushgateway URL to push metrics to (empty disables)")
+	flag.StringVar(&cfg.PushJob, "push-job", "dns-mesh-sidecar", "Job name used when pushing metrics")
+	flag.IntVar(&pushIntervalSec, "push-interval", 15, "Metrics push interval in seconds (default 15)")
+	flag.StringVar(&cfg.PushLabels, "push-labels", "", "Comma-separated key=value grouping labels added to pushed metrics")
+	flag.StringVar(&cfg.StatsDAddr, "statsd-addr", "", "StatsD/DogStatsD agent address, e.g. 127.0.0.1:8125 (empty disables)")
+	flag.StringVar(&cfg.StatsDPrefix, "statsd-prefix", "", "Prefix prepended to StatsD metric names")
+	flag.IntVar(&statsdIntervalSec, "statsd-interval", 10, "StatsD counter and gauge flush interval in seconds (default 10)")
+	flag.BoolVar(&cfg.StatsDTags, "statsd-tags", true, "Send labels as DogStatsD tags (false appends label values to metric names)")
+	flag.IntVar(&cfg.CanaryPercent, "canary-percent", 0, "Percentage of queries a new blocklist is applied to before full enforcement (0 disables)")
+	flag.IntVar(&canarySoakSec, "canary-soak", 300, "Seconds a new blocklist is soaked as a canary before full enforcement (default 300)")
+	flag.IntVar(&cfg.UpstreamMaxInflight, "upstream-max-inflight", 1000, "Maximum queries outstanding per upstream (0 disables the limit)")
+	flag.StringVar(&cfg.SpillUpstream, "spill-upstream", "", "Plain DNS upstream receiving queries over the in-flight limit (empty fails them fast)")
+	flag.StringVar(&cfg.GRPCListenAddr, "grpc-listen", "", "Address of the gRPC control API, e.g. :9443 (empty disables)")
+	flag.StringVar(&cfg.GRPCTLSCert, "grpc-tls-cert", "", "Server certificate for the gRPC control API")
+	flag.StringVar(&cfg.GRPCTLSKey, "grpc-tls-key", "", "Server private key for the gRPC control API")
+	flag.StringVar(&cfg.GRPCClientCA, "grpc-client-ca", "", "CA bundle used to require and verify client certificates (mTLS) on the gRPC control API")
+	flag.BoolVar(&cfg.DeltaUpdates, "delta-updates", false, "Fetch policies incrementally (versioned deltas with ACK/NACK) instead of in full")
+	flag.StringVar(&cfg.ClusterDomain, "cluster-domain", "cluster.local", "Cluster DNS domain, never blocked so in-cluster services stay reachable (empty disables)")
+	flag.IntVar(&tcpIdleTimeoutMs, "tcp-idle-timeout-ms", 10000, "Milliseconds a client TCP connection is kept open between queries, announced via edns-tcp-keepalive (0 closes after one query)")
+	flag.IntVar(&cfg.UpstreamTCPIdleConns, "upstream-tcp-idle-conns", 4, "Idle TCP connections kept per upstream for reuse when it supports edns-tcp-keepalive (0 opens one per query)")
+	flag.StringVar(&cfg.ScrubOptions, "scrub-options", "", "Comma-separated EDNS options removed from responses: \"ecs\", \"nsid\" or option codes")
+	flag.IntVar(&cfg.EDNSMaxPayload, "edns-max-payload", 1232, "Largest EDNS UDP payload size forwarded in queries and advertised in responses (0 leaves it unchanged)")
+	flag.IntVar(&cfg.EDNSUDPSize, "edns-udp-size", 1232, "Largest UDP message accepted from and sent to clients (512-4096); larger answers are truncated so the client retries over TCP")
+	flag.StringVar(&cfg.LogMode, "log-mode", "all", "Per-query logging: \"all\" or \"blocked\" (only blocked and failed queries)")
+	flag.IntVar(&cfg.ClientStatsMax, "client-stats-max", 0, "Client IPs tracked for /api/stats/clients on the metrics server, which exposes per-client query counts without authentication (0 disables)")
+	flag.StringVar(&cfg.FallbackBlocklist, "fallback-blocklist", "", "File with the fallback blocklist, one rule per line (empty uses the list compiled into the binary)")
+	flag.IntVar(&fallbackAfterSec, "fallback-after", 300, "Seconds the controller must be unreachable before the fallback blocklist is enforced")
+	flag.StringVar(&cfg.SinkholeIPv4, "sinkhole-ipv4", "", "Answer blocked A queries with this address instead of NXDOMAIN")
+	flag.StringVar(&cfg.SinkholeIPv6, "sinkhole-ipv6", "", "Answer blocked AAAA queries with this address instead of NXDOMAIN")
+	flag.BoolVar(&cfg.FilterAnswers, "filter-answers", false, "Remove answer records whose owner or target name is blocked, e.g. CNAMEs to blocked trackers")
+	flag.BoolVar(&cfg.FilterAnswersBlock, "filter-answers-block-empty", false, "Answer as blocked when answer filtering removes every record")
+	flag.BoolVar(&cfg.CNAMEInspection, "cname-inspection", false, "Answer as blocked when the CNAME chain of an upstream answer leads to a blocked name")
+	flag.BoolVar(&cfg.SVCBInspection, "svcb-inspection", false, "Answer as blocked when an SVCB or HTTPS record of an upstream answer targets a blocked name")
+	flag.BoolVar(&cfg.StripECH, "strip-ech", false, "Remove the ech parameter from SVCB and HTTPS records of upstream answers")
+	flag.StringVar(&cfg.GeoIPDB, "geoip-db", "", "Comma-separated MaxMind DB files (e.g. GeoLite2 Country and ASN) the controller's GeoIP rules look answer addresses up in (empty ignores the rules)")
+	flag.StringVar(&cfg.SinkholeName, "sinkhole-name", "blocked.dns-mesh.local", "Name returned for reverse (PTR) lookups of the sinkhole addresses")
+	flag.IntVar(&cfg.SinkholeTTL, "sinkhole-ttl", 60, "TTL in seconds of the sinkhole records synthesized for blocked queries")
+	flag.StringVar(&cfg.BlockResponse, "block-response", "", "Answer to blocked queries: \"nxdomain\", \"nodata\" (empty NOERROR), \"refused\" or \"sinkhole\" (empty picks sinkhole when a sinkhole address is set, nxdomain otherwise)")
+	flag.StringVar(&cfg.ExtendedError, "ede", "blocked", "Extended DNS Error (RFC 8914) on blocked responses to EDNS clients: \"blocked\", \"filtered\" or \"none\"")
+	flag.BoolVar(&cfg.ExtendedErrorRule, "ede-rule", false, "Name the matching rule in the text of the Extended DNS Error, which tells clients the policy")
+	flag.BoolVar(&cfg.SelfTest, "selftest", true, "Check at startup that the upstream resolves -selftest-name and that a synthetic rule gets the block response")
+	flag.StringVar(&cfg.SelfTestName, "selftest-name", "example.com", "Canary name the startup self-test resolves through the upstream")
+	flag.BoolVar(&cfg.SelfTestExit, "selftest-exit", false, "Exit with status 1 when the startup self-test fails, instead of serving regardless")
+	flag.BoolVar(&cfg.Recursive, "recursive", false, "Resolve queries iteratively from the root servers instead of forwarding them to the upstream")
+	flag.StringVar(&cfg.RootHints, "root-hints", "", "Comma-separated root server addresses for -recursive (empty uses the built-in root hints)")
+	flag.BoolVar(&cfg.QNAMEMinimization, "qname-minimization", true, "Send authoritative servers only the labels they need to see when resolving recursively (RFC 9156)")
+	flag.StringVar(&cfg.HedgeUpstream, "hedge-upstream", "", "Plain DNS upstream receiving a copy of queries the primary upstream is slow to answer (empty disables)")
+	flag.IntVar(&hedgeAfterMs, "hedge-after-ms", 50, "Milliseconds without an answer before a query is also sent to -hedge-upstream, e.g. the upstream's p95 latency")
+	flag.StringVar(&cfg.RouteUpstreams, "route-upstreams", "", "Comma-separated plain DNS upstreams queries are routed among together with -upstream, to whichever shows the lowest latency and error rate (empty disables)")
+	flag.Float64Var(&cfg.RouteMargin, "route-margin", 0.2, "Fraction by which another upstream's score must beat the current one before -route-upstreams routing moves to it")
+	flag.IntVar(&routeHoldSec, "route-hold-sec", 60, "Seconds after -route-upstreams routing moved to an upstream before it may move again")
+	flag.StringVar(&cfg.ChaosVersion, "chaos-version", "", "TXT answer to CHAOS queries for version.bind and version.server; empty answers REFUSED")
+	flag.StringVar(&cfg.ChaosHostname, "chaos-hostname", "", "TXT answer to CHAOS queries for hostname.bind and id.server; empty answers REFUSED")
+	flag.StringVar(&cfg.SpecialUse, "special-use", "", "Comma-separated domain=action overrides for special-use domains (loopback, nxdomain, refused, forward), or \"off\"")
+	flag.IntVar(&cfg.DryRunReportMax, "dryrun-report-max", 0, "Distinct rules, names and clients tracked each for /api/dryrun/report on the metrics server, which exposes the names clients queried without authentication (0 disables)")
+	flag.StringVar(&cfg.MirrorTarget, "mirror-target", "", "UDP address receiving a copy of sampled forwarded queries, such as a shadow upstream or collector (empty disables)")
+	flag.Float64Var(&cfg.MirrorRate, "mirror-rate", 1, "Fraction of forwarded queries copied to -mirror-target")
+	flag.BoolVar(&cfg.MirrorResponses, "mirror-responses", false, "Also copy the responses of mirrored queries to -mirror-target")
+	flag.StringVar(&cfg.StatsDB, "stats-db", "", "File persisting hourly per-domain and per-client query statistics (empty disables)")
+	flag.IntVar(&statsRetentionHours, "stats-retention-hours", 720, "Hours of statistics kept in -stats-db")
+	flag.IntVar(&cfg.StatsMaxKeys, "stats-max-keys", 10000, "Distinct domains and clients each stored per hour in -stats-db")
+	flag.IntVar(&statsFlushSec, "stats-flush-sec", 60, "Seconds between writes of the collected statistics to -stats-db")
+	flag.StringVar(&cfg.QueryLogDir, "query-log-dir", "", "Directory receiving a JSON lines log of every answered query, rotated hourly (empty disables)")
+	flag.IntVar(&queryLogMaxAgeHours, "query-log-max-age-hours", 168, "Hours query log entries are kept in -query-log-dir (0 keeps them regardless of age)")
+	flag.IntVar(&cfg.QueryLogMaxSizeMB, "query-log-max-size-mb", 1024, "Size in MiB beyond which the oldest query log segments are deleted (0 disables)")
+	flag.StringVar(&cfg.QueryLogVerdicts, "query-log-verdicts", "", "Comma-separated verdicts written to the query log: blocked, allowed, local, failed (empty writes all)")
+	flag.IntVar(&anomalyWindowSec, "anomaly-window-sec", 0, "Seconds of queries the dns_query_rate and dns_block_rate gauges and the anomaly alerts are computed over (0 disables)")
+	flag.StringVar(&cfg.AnomalyWebhook, "anomaly-webhook", "", "URL anomaly alerts are posted to as JSON (empty only logs them)")
+	flag.StringVar(&cfg.AnomalyWebhookFormat, "anomaly-webhook-format", "generic", "Body of anomaly alerts: \"generic\" JSON or a \"slack\" incoming webhook message")
+	flag.Float64Var(&cfg.AnomalyMaxQPS, "anomaly-max-qps", 0, "Queries per second over the anomaly window above which an alert fires (0 disables)")
+	flag.Float64Var(&cfg.AnomalyMaxBlockRate, "anomaly-max-block-rate", 0, "Fraction of queries blocked over the anomaly window, between 0 and 1, above which an alert fires (0 disables)")
+	flag.IntVar(&cfg.AnomalyMinQueries, "anomaly-min-queries", 100, "Queries the anomaly window needs before its block rate can fire an alert")
+	flag.IntVar(&anomalyCooldownSec, "anomaly-cooldown-sec", 900, "Seconds after an anomaly alert during which the same alert is not sent again")
+	flag.StringVar(&cfg.ThreatFeeds, "threat-feeds", "", "JSON file of TAXII 2.1 collections or STIX 2.1 bundle URLs whose domain indicators are blocked (empty disables)")
+	flag.StringVar(&cfg.NRDFeed, "nrd-feed", "", "URL of a list of newly registered domains, polled daily, whose domains are blocked until -nrd-max-age-days old (empty disables)")
+	flag.IntVar(&nrdMaxAgeDays, "nrd-max-age-days", 30, "Days after registration a domain of the -nrd-feed list stays blocked")
+	flag.BoolVar(&cfg.Dashboard, "dashboard", false, "Serve a web dashboard at /dashboard/ on the metrics address, protected by DNS_MESH_DASHBOARD_TOKEN")
+	flag.BoolVar(&cfg.LoopDetection, "loop-detection", true, "Refuse to start when an upstream is the proxy's own listen address, and answer queries looping back from the upstream with SERVFAIL")
+	flag.IntVar(&happyEyeballsDelayMs, "happy-eyeballs-delay-ms", 250, "Head start in milliseconds of the preferred address family when dialing an upstream given by a host name with both IPv6 and IPv4 addresses, before the other one is tried too (0 dials the addresses in turn)")
+	flag.BoolVar(&cfg.EBPFRedirect, "ebpf-redirect", false, "Steer the pod's IPv4 queries to port 53 to the listener with eBPF programs attached to -ebpf-redirect-cgroup, instead of iptables rules")
+	flag.StringVar(&cfg.EBPFRedirectCgroup, "ebpf-redirect-cgroup", "/sys/fs/cgroup", "cgroup v2 directory of the pod the -ebpf-redirect programs are attached to")
+	flag.StringVar(&cfg.BootstrapDNS, "bootstrap-dns", "auto", "Comma-separated DNS servers the controller and DoH upstream host names are resolved with instead of the system resolver, which interception may lead back to the sidecar; \"auto\" uses -upstream when /etc/resolv.conf names the sidecar itself, empty always uses the system resolver")
+	flag.StringVar(&cfg.Padding, "edns-padding", "block", "EDNS padding of queries sent over DNS-over-HTTPS (RFC 8467): \"none\", \"block\" or \"random-block\"")
+	flag.IntVar(&cfg.PaddingBlock, "edns-padding-block", 128, "Block length queries are padded to with -edns-padding")
+	flag.IntVar(&cfg.QueryIDOption, "query-id-option", 0, "EDNS option code (65001-65534) carrying each query's ID to the upstream, 0 to not send it")
+	flag.BoolVar(&cfg.CaseRandomization, "upstream-0x20", false, "Randomize the case of question names sent to plain UDP upstreams and drop answers that do not echo it, against cache poisoning; needs upstreams that preserve case")
+	flag.BoolVar(&cfg.UpstreamCookies, "upstream-cookies", false, "Send DNS cookies (RFC 7873) to plain UDP upstreams and, once one returns them, drop its answers not echoing the sidecar's cookie")
+	flag.IntVar(&cfg.MaxNamespaces, "metrics-max-namespaces", 50, "Namespaces given their own label on the query counters when the controller attributes clients to namespaces; further ones are counted as \"other\" (0 disables the label)")
+	flag.IntVar(&heartbeatIntervalSec, "heartbeat-interval", 30, "Seconds between heartbeats to the controller, after registering with it at startup (0 disables both)")
+	flag.IntVar(&telemetryIntervalSec, "telemetry-interval", 0, "Seconds between uploads of query summaries (counts and top domains, not individual queries) to the controller (0 disables)")
+	flag.Float64Var(&cfg.TelemetrySample, "telemetry-sample", 1, "Fraction of queries counted in the top-domain tables of telemetry uploads, between 0 and 1; totals count every query")
+	flag.IntVar(&cfg.TelemetryTop, "telemetry-top", 20, "Domains and rules listed per table of a telemetry upload (0 sends totals only)")
+	flag.IntVar(&driftCheckIntervalSec, "drift-check-interval", 60, "Seconds between comparisons of the enforced blocklist with the policy blockListHash sent by the controller (0 disables)")
+	flag.StringVar(&cfg.FaultInject, "fault-inject", "", "Faults injected into forwarded queries, e.g. \"latency=200ms:0.5,drop=0.05,servfail=0.01\"; requires a binary built with -tags faultinject")
+	flag.StringVar(&cfg.CaptureDir, "capture-dir", "", "Directory /api/capture writes pcap captures of DNS traffic to (empty disables captures)")
+	flag.IntVar(&cfg.CaptureMaxSeconds, "capture-max-seconds", 300, "Longest capture /api/capture accepts, in seconds")
+	flag.IntVar(&cfg.CaptureMaxPackets, "capture-max-packets", 100000, "Most packets a capture from /api/capture may record")
+	flag.StringVar(&cfg.WasmPlugin, "wasm-plugin", "", "WebAssembly module providing pre_match and pre_response query hooks; requires a binary built with -tags wasmhooks")
+	flag.IntVar(&wasmPluginTimeoutMs, "wasm-plugin-timeout-ms", 20, "Longest a WASM plugin hook may run before the query goes on without its decision")
+	flag.StringVar(&cfg.AuthzURL, "authz-url", "", "External authorization service (OPA data API style) asked about queries below -authz-suffixes (empty disables)")
+	flag.StringVar(&cfg.AuthzSuffixes, "authz-suffixes", "", "Comma-separated domain suffixes whose queries need external authorization")
+	flag.IntVar(&authzTimeoutMs, "authz-timeout-ms", 200, "Timeout of an external authorization request in milliseconds")
+	flag.IntVar(&authzCacheTTLSec, "authz-cache-ttl", 60, "Seconds an external authorization decision is reused for the same name, type and client (0 disables caching)")
+	flag.StringVar(&cfg.AuthzFailureMode, "authz-failure-mode", "closed", "Answer to queries the authorization service cannot decide: \"closed\" blocks them, \"open\" allows them")
+	flag.IntVar(&regoTimeoutMs, "rego-timeout-ms", 10, "Longest the evaluation of the controller's Rego policy may take before the query goes on without its decision")
+	flag.StringVar(&cfg.SPIFFESocket, "spiffe-socket", "", "SPIFFE Workload API socket whose X.509 SVIDs are used for mTLS to the controller and DoH upstream instead of certificate files (empty disables)")
+	flag.StringVar(&cfg.VaultAddr, "vault-addr", "", "HashiCorp Vault address to read TLS material and the controller token from (empty disables)")
+	flag.StringVar(&cfg.VaultPath, "vault-path", "", "Path of the Vault key/value secret holding them, e.g. secret/data/dns-sidecar")
+	flag.StringVar(&cfg.VaultTokenFile, "vault-token-file", "", "File with the Vault token, re-read on every refresh (empty uses VAULT_TOKEN)")
+	flag.StringVar(&cfg.SecretsURL, "secrets-url", "", "Generic secrets endpoint returning TLS material and the controller token as a JSON object (empty disables)")
+	flag.IntVar(&secretsRefreshSec, "secrets-refresh", 300, "Seconds between refreshes of the secrets from Vault or -secrets-url")
+	flag.StringVar(&cfg.PolicyEncoding, "policy-encoding", "json", "Policy encoding requested from the controller: \"json\" or \"cbor\"")
 	flag.Parse()
 
 	cfg.FetchInterval = time.Duration(fetchIntervalSec) * time.Second
+	cfg.UpdateDebounce = time.Duration(updateDebounceMs) * time.Millisecond
+	cfg.BreakerCooldown = time.Duration(breakerCooldownMs) * time.Millisecond
+	cfg.PushInterval = time.Duration(pushIntervalSec) * time.Second
+	cfg.StatsDInterval = time.Duration(statsdIntervalSec) * time.Second
+	cfg.CanarySoak = time.Duration(canarySoakSec) * time.Second
+	cfg.TCPIdleTimeout = time.Duration(tcpIdleTimeoutMs) * time.Millisecond
+	cfg.FallbackAfter = time.Duration(fallbackAfterSec) * time.Second
+	cfg.HedgeAfter = time.Duration(hedgeAfterMs) * time.Millisecond
+	cfg.RouteHold = time.Duration(routeHoldSec) * time.Second
+	cfg.StatsRetention = time.Duration(statsRetentionHours) * time.Hour
+	cfg.StatsFlush = time.Duration(statsFlushSec) * time.Second
+	cfg.QueryLogMaxAge = time.Duration(queryLogMaxAgeHours) * time.Hour
+	cfg.AnomalyWindow = time.Duration(anomalyWindowSec) * time.Second
+	cfg.AnomalyCooldown = time.Duration(anomalyCooldownSec) * time.Second
+	cfg.HeartbeatInterval = time.Duration(heartbeatIntervalSec) * time.Second
+	cfg.TelemetryInterval = time.Duration(telemetryIntervalSec) * time.Second
+	cfg.DriftCheckInterval = time.Duration(driftCheckIntervalSec) * time.Second
+	cfg.WasmPluginTimeout = time.Duration(wasmPluginTimeoutMs) * time.Millisecond
+	cfg.AuthzTimeout = time.Duration(authzTimeoutMs) * time.Millisecond
+	cfg.AuthzCacheTTL = time.Duration(authzCacheTTLSec) * time.Second
+	cfg.RegoTimeout = time.Duration(regoTimeoutMs) * time.Millisecond
+	cfg.HappyEyeballsDelay = time.Duration(happyEyeballsDelayMs) * time.Millisecond
+	cfg.SecretsRefresh = time.Duration(secretsRefreshSec) * time.Second
+	cfg.NRDMaxAge = time.Duration(nrdMaxAgeDays) * 24 * time.Hour
 
 	return cfg
 }
@@ -99,6 +411,23 @@ func (c *Config) UpdateTLSData(certBase64, keyBase64, caCertBase64 string) error
 	return nil
 }
 
+// SetTLSData replaces the TLS certificate, key and CA data with PEM data;
+// empty values leave the current data
+func (c *Config) SetTLSData(cert, key, caCert []byte) {
+	c.tlsMutex.Lock()
+	defer c.tlsMutex.Unlock()
+
+	if len(cert) > 0 {
+		c.tlsClientCertData = cert
+	}
+	if len(key) > 0 {
+		c.tlsClientKeyData = key
+	}
+	if len(caCert) > 0 {
+		c.tlsCACertData = caCert
+	}
+}
+
 // GetTLSClientCertData returns the decoded TLS client certificate data
 func (c *Config) GetTLSClientCertData() []byte {
 	c.tlsMutex.RLock()
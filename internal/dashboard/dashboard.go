@@ -0,0 +1,250 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+const (
+	tailSize     = 100  // recent queries shown
+	rateWindow   = 60   // seconds of query and block rates kept
+	topDomains   = 10   // domains listed per table
+	trackDomains = 5000 // distinct domains counted before further ones go to "(other)"
+	eventBuffer  = 1024 // tap buffer; events beyond it are dropped while the dashboard is busy
+)
+
+// Config configures the dashboard
+type Config struct {
+	Token   string // password for HTTP basic auth or bearer token; required
+	Handler *dns.Handler
+	// PolicyVersion identifies the enforced policy
+	PolicyVersion func() string
+}
+
+// Dashboard is a small web UI showing live query and block rates, the top
+// domains, the enforced policy and the latest queries of this sidecar. It
+// is meant for debugging one instance, not as a fleet view.
+type Dashboard struct {
+	cfg     Config
+	started time.Time
+
+	mu      sync.Mutex
+	tail    []dns.QueryEvent // ring of the latest events
+	next    int
+	queries map[string]uint64
+	blocked map[string]uint64
+	rates   []RatePoint
+}
+
+// RatePoint is the query and block rate of one second
+type RatePoint struct {
+	Time    time.Time `json:"time"`
+	Queries float64   `json:"qps"`
+	Blocked float64   `json:"blockedPerSec"`
+}
+
+// DomainCount is one line of a top-domains table
+type DomainCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// New starts collecting from the handler's query tap, which must be set
+func New(cfg Config) *Dashboard {
+	d := &Dashboard{
+		cfg:     cfg,
+		started: time.Now(),
+		queries: make(map[string]uint64),
+		blocked: make(map[string]uint64),
+	}
+	events, _ := cfg.Handler.Tap.Subscribe(eventBuffer)
+	go d.collect(events)
+	go d.sample()
+	return d
+}
+
+func (d *Dashboard) collect(events <-chan dns.QueryEvent) {
+	for ev := range events {
+		d.mu.Lock()
+		if len(d.tail) < tailSize {
+			d.tail = append(d.tail, ev)
+		} else {
+			d.tail[d.next] = ev
+		}
+		d.next = (d.next + 1) % tailSize
+		count(d.queries, ev.Name)
+		if ev.Verdict == dns.VerdictBlocked {
+			count(d.blocked, ev.Name)
+		}
+		d.mu.Unlock()
+	}
+}
+
+func count(counts map[string]uint64, name string) {
+	if _, ok := counts[name]; !ok && len(counts) >= trackDomains {
+		name = "(other)"
+	}
+	counts[name]++
+}
+
+// sample derives per-second rates from the query counters, so they match
+// the metrics regardless of dropped tap events
+func (d *Dashboard) sample() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastQueries, lastBlocked, last := metrics.Total("dns_queries_total"), metrics.Total("dns_queries_blocked_total"), time.Now()
+	for now := range ticker.C {
+		queries, blocked := metrics.Total("dns_queries_total"), metrics.Total("dns_queries_blocked_total")
+		elapsed := now.Sub(last).Seconds()
+		point := RatePoint{Time: now, Queries: (queries - lastQueries) / elapsed, Blocked: (blocked - lastBlocked) / elapsed}
+		lastQueries, lastBlocked, last = queries, blocked, now
+
+		d.mu.Lock()
+		d.rates = append(d.rates, point)
+		if len(d.rates) > rateWindow {
+			d.rates = d.rates[len(d.rates)-rateWindow:]
+		}
+		d.mu.Unlock()
+	}
+}
+
+// ServeHTTP serves the page at /dashboard/ and its data at
+// /dashboard/api/summary, both behind the configured token
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, d.cfg.Token) {
+		unauthorized(w)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/dashboard") {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	case "/api/summary":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.summary())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// RequireToken guards the admin APIs served next to the dashboard on the
+// metrics address: next only serves requests carrying token as the
+// dashboard accepts it
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized accepts the token as the basic auth password, with any user
+// name, or as a bearer token
+func authorized(r *http.Request, want string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	return ok && want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="lktr dashboard"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// tailEvent is a query as listed in the summary
+type tailEvent struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Protocol string    `json:"protocol"`
+	Verdict  string    `json:"verdict"`
+	Rule     string    `json:"rule,omitempty"`
+}
+
+func (d *Dashboard) summary() any {
+	queries := metrics.Total("dns_queries_total")
+	blocked := metrics.Total("dns_queries_blocked_total")
+	var blockRate float64
+	if queries > 0 {
+		blockRate = blocked / queries
+	}
+	version := ""
+	if d.cfg.PolicyVersion != nil {
+		version = d.cfg.PolicyVersion()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tail := make([]tailEvent, 0, len(d.tail))
+	for i := 1; i <= len(d.tail); i++ {
+		// Newest first
+		ev := d.tail[(d.next-i+len(d.tail))%len(d.tail)]
+		tail = append(tail, tailEvent{ev.ID, ev.Time, ev.Client, ev.Name, ev.Type, ev.Protocol, ev.Verdict, ev.Rule})
+	}
+	return struct {
+		Started       time.Time     `json:"started"`
+		Queries       float64       `json:"queries"`
+		Blocked       float64       `json:"blocked"`
+		BlockRate     float64       `json:"blockRate"`
+		Rates         []RatePoint   `json:"rates"`
+		PolicyVersion string        `json:"policyVersion"`
+		Rules         int           `json:"rules"`
+		DryRun        bool          `json:"dryRun"`
+		TopQueried    []DomainCount `json:"topQueried"`
+		TopBlocked    []DomainCount `json:"topBlocked"`
+		Tail          []tailEvent   `json:"tail"`
+	}{
+		Started:       d.started,
+		Queries:       queries,
+		Blocked:       blocked,
+		BlockRate:     blockRate,
+		Rates:         slices.Clone(d.rates),
+		PolicyVersion: version,
+		Rules:         d.cfg.Handler.Rules(),
+		DryRun:        d.cfg.Handler.DryRun(),
+		TopQueried:    top(d.queries),
+		TopBlocked:    top(d.blocked),
+		Tail:          tail,
+	}
+}
+
+// top returns the most frequent domains, ties in name order
+func top(counts map[string]uint64) []DomainCount {
+	out := make([]DomainCount, 0, len(counts))
+	for name, n := range counts {
+		out = append(out, DomainCount{name, n})
+	}
+	slices.SortFunc(out, func(a, b DomainCount) int {
+		if a.Count != b.Count {
+			if a.Count > b.Count {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return out[:min(topDomains, len(out))]
+}
@@ -0,0 +1,97 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/querylog"
+)
+
+func TestRequireTokenCapture(t *testing.T) {
+	capture := dns.NewCapture(t.TempDir(), "127.0.0.1:53", time.Minute, 10)
+	h := RequireToken("s3cret", capture)
+
+	tests := []struct {
+		name   string
+		method string
+		auth   func(*http.Request)
+		want   int
+	}{
+		{"no token", http.MethodPost, func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong bearer", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"wrong password", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized},
+		{"bearer", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"basic auth", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("admin", "s3cret") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/capture?seconds=5", nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tt.name)
+		}
+	}
+	if capture.Status().Active {
+		t.Fatal("a capture was started without the token")
+	}
+}
+
+// TestRequireTokenQueryLog expects neither the size of the query log nor a
+// purge served without the token
+func TestRequireTokenQueryLog(t *testing.T) {
+	dir := t.TempDir()
+	segment := filepath.Join(dir, "queries-20260115T100000.000000000Z.jsonl")
+	entry := `{"id":"829fcfdf3f3b460b","time":"2026-01-15T10:00:00.1Z","client":"10.0.0.12:41530","name":"ads.example.com","type":"A","protocol":"udp","verdict":"blocked"}` + "\n"
+	if err := os.WriteFile(segment, []byte(entry), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	queryLog, err := querylog.Open(dir, time.Hour, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RequireToken("s3cret", queryLog)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/api/querylog", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without the token: got status %d, want %d", method, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if data, err := os.ReadFile(segment); err != nil || string(data) != entry {
+		t.Fatalf("query log purged without the token: %q, %v", data, err)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/querylog?client=10.0.0.12", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("purge with the token: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if data, _ := os.ReadFile(segment); len(data) != 0 {
+		t.Fatalf("entry kept after an authorized purge: %q", data)
+	}
+}
+
+func TestRequireTokenEmpty(t *testing.T) {
+	h := RequireToken("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request served with no token configured")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/api/capture", nil)
+	r.SetBasicAuth("admin", "")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpdateAAAAFilter replaces the names that get no IPv6 addresses, for
+// workloads whose IPv6 egress is not allowed. A nil matcher removes the
+// filter.
+func (h *Handler) UpdateAAAAFilter(m *matcher.Matcher) {
+	if m != nil && m.Len() == 0 {
+		m = nil
+	}
+	if st := h.snapshot(); (st.filterAAAA == nil && m == nil) || (st.filterAAAA != nil && m != nil && st.filterAAAA.Equal(m)) {
+		return
+	}
+	h.update(func(st *handlerState) {
+		st.filterAAAA = m
+	})
+	if m != nil {
+		log.Info().Msgf("AAAA filter loaded: %d rules", m.Len())
+	} else {
+		log.Info().Msg("AAAA filter cleared")
+	}
+}
+
+// filtersAAAA reports whether name gets no IPv6 addresses
+func (st *handlerState) filtersAAAA(name string) bool {
+	return st.filterAAAA != nil && st.filterAAAA.Match(name).Matched
+}
+
+// answerFilteredAAAA answers an AAAA query for a filtered name with an empty
+// NOERROR response, without asking the upstream, so that clients fall back
+// to IPv4 at once
+func (h *Handler) answerFilteredAAAA(ctx context.Context, st *handlerState, query []byte) ([]byte, bool) {
+	if st.filterAAAA == nil {
+		return nil, false
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Type != TypeAAAA || !st.filtersAAAA(q.Questions[0].Name) {
+		return nil, false
+	}
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Answered AAAA query for %s with no addresses (AAAA filter)", q.Questions[0].Name)
+	}
+	return resp.Pack(), true
+}
+
+// dropAAAA removes the AAAA records, and the ipv6hint parameter of SVCB and
+// HTTPS records, from a forwarded answer to a question for a filtered name,
+// such as an ANY query. The response is returned unchanged when it carries
+// no IPv6 address.
+func (h *Handler) dropAAAA(st *handlerState, response []byte) []byte {
+	if st.filterAAAA == nil {
+		return response
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Questions) != 1 || !st.filtersAAAA(msg.Questions[0].Name) {
+		return response
+	}
+	changed := false
+	strip := func(rrs []RR) []RR {
+		kept := rrs[:0:0]
+		for _, rr := range rrs {
+			if rr.Type == TypeAAAA {
+				changed = true
+				continue
+			}
+			if data, ok := withoutSvcParam(rr, svcParamIPv6Hint); ok {
+				rr.Data = data
+				changed = true
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	msg.Answers = strip(msg.Answers)
+	msg.Additional = strip(msg.Additional)
+	if !changed {
+		return response
+	}
+	metrics.AAAAStripped.Inc()
+	return msg.Pack()
+}
@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AnswerFilter removes answer records that point at blocked names, such as an
+// allowed name whose CNAME chain leads to a blocked tracker.
+type AnswerFilter struct {
+	BlockEmpty bool // answer as blocked when no answer record remains
+}
+
+// recordTarget returns the name an answer record points to, if its type
+// carries one
+func recordTarget(rr RR) string {
+	var data []byte
+	switch rr.Type {
+	case TypeCNAME, TypeNS, TypePTR:
+		data = rr.Data
+	case TypeMX:
+		if len(rr.Data) > 2 {
+			data = rr.Data[2:]
+		}
+	case TypeSRV:
+		if len(rr.Data) > 6 {
+			data = rr.Data[6:]
+		}
+	case TypeSVCB, TypeHTTPS:
+		if len(rr.Data) > 2 {
+			data = rr.Data[2:]
+		}
+	}
+	if data == nil {
+		return ""
+	}
+	name, err := ReadName(data)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// filterAnswers strips answer records whose owner or target name m blocks.
+// In dry-run mode the records are only logged. The response is returned
+// unchanged when nothing matches.
+func (h *Handler) filterAnswers(st *handlerState, m *matcher.Matcher, query, response []byte) []byte {
+	if h.AnswerFilter == nil || m == nil {
+		return response
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Answers) == 0 {
+		return response
+	}
+
+	kept := msg.Answers[:0:0]
+	rule := "" // of the first record removed
+	for _, rr := range msg.Answers {
+		name := rr.Name
+		result := h.match(m, name)
+		if target := recordTarget(rr); !result.Matched && target != "" {
+			name, result = target, h.match(m, target)
+		}
+		if !result.Matched {
+			kept = append(kept, rr)
+			continue
+		}
+		if st.dryRun {
+			log.Info().Msgf("DryRun Mode enabled not removing answer for %s (rule %q)", name, result.Rule)
+			kept = append(kept, rr)
+			continue
+		}
+		if h.Verbose {
+			log.Info().Msgf("Removing answer record for %s (rule %q)", name, result.Rule)
+		}
+		if rule == "" {
+			rule = result.Rule
+		}
+	}
+	if len(kept) == len(msg.Answers) {
+		return response
+	}
+
+	if len(kept) == 0 && h.AnswerFilter.BlockEmpty {
+		metrics.FilteredAnswers.WithLabelValues("blocked").Inc()
+		return h.blockedResponse(query, rule)
+	}
+	metrics.FilteredAnswers.WithLabelValues("stripped").Inc()
+	msg.Answers = kept
+	return msg.Pack()
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpdateLocalZones replaces the set of zones answered authoritatively
+func (h *Handler) UpdateLocalZones(zones []*Zone) {
+	h.update(func(st *handlerState) {
+		st.zones = zones
+	})
+	if h.Verbose {
+		log.Info().Msgf("Local zones updated: %d zones", len(zones))
+	}
+}
+
+// LoadZoneFiles parses a comma-separated list of "origin=path" zone files
+func LoadZoneFiles(spec string) ([]*Zone, error) {
+	var zones []*Zone
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		origin, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("zone file %q: expected origin=path", entry)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		zone, err := ParseZone(origin, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// findZone returns the most specific local zone containing name
+func (st *handlerState) findZone(name string) *Zone {
+	name = canonicalName(name)
+	var best *Zone
+	for _, z := range st.zones {
+		if z.contains(name) && (best == nil || len(z.Origin) > len(best.Origin)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// answerLocal builds the response to queries answered without the upstream:
+// reverse lookups of the sinkhole, overridden names, names in a local zone
+// and special-use names. The second result is false when the query should be
+// forwarded.
+func (h *Handler) answerLocal(ctx context.Context, st *handlerState, query []byte) ([]byte, bool) {
+	response, source := h.answerLocalSource(ctx, st, query)
+	if source == "" {
+		return nil, false
+	}
+	metrics.LocalAnswers.WithLabelValues(source).Inc()
+	return response, true
+}
+
+// Sources of local answers, as in dns_local_answers_total
+const (
+	localSinkhole   = "sinkhole"
+	localOverride   = "override"
+	localZone       = "zone"
+	localSpecialUse = "special_use"
+	localAAAAFilter = "aaaa_filter"
+	localChaos      = "chaos"
+)
+
+// answerLocalSource is answerLocal, returning which kind of local data
+// answered the query, "" when none did
+func (h *Handler) answerLocalSource(ctx context.Context, st *handlerState, query []byte) ([]byte, string) {
+	if response, ok := h.answerChaos(query); ok {
+		return response, localChaos
+	}
+	if response, ok := h.answerSinkholePTR(query); ok {
+		return response, localSinkhole
+	}
+	if response, ok := h.answerOverride(ctx, st, query); ok {
+		return response, localOverride
+	}
+	if response, ok := h.answerZone(st, query); ok {
+		return response, localZone
+	}
+	if response, ok := h.answerSpecialUse(query); ok {
+		return response, localSpecialUse
+	}
+	if response, ok := h.answerFilteredAAAA(ctx, st, query); ok {
+		return response, localAAAAFilter
+	}
+	return nil, ""
+}
+
+// answerZone builds an authoritative response when the question falls in a
+// local zone
+func (h *Handler) answerZone(st *handlerState, query []byte) ([]byte, bool) {
+	if len(st.zones) == 0 {
+		return nil, false
+	}
+
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Class != ClassINET {
+		return nil, false
+	}
+	zone := st.findZone(q.Questions[0].Name)
+	if zone == nil {
+		return nil, false
+	}
+
+	answers, authority, rcode := zone.lookup(q.Questions[0])
+
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagAA | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+		Answers:   answers,
+		Authority: authority,
+	}
+	resp.SetRcode(rcode)
+
+	if h.Verbose {
+		log.Info().Msgf("Answered %s from local zone %s (rcode %d, %d answers)", q.Questions[0].Name, zone.Origin, rcode, len(answers))
+	}
+	return resp.Pack(), true
+}
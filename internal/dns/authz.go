@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	json "github.com/goccy/go-json"
+)
+
+// authzCacheSize bounds the decisions kept by an Authorizer
+const authzCacheSize = 10000
+
+// Authorizer asks an external authorization service, such as OPA, whether
+// queries for names below designated suffixes may be answered, for policy
+// logic that cannot be expressed as lists. It is a pre-match hook: a denial
+// blocks the query, an approval leaves it to the blocklist. Decisions are
+// cached per name, type and client, and concurrent queries awaiting the
+// same decision share one request.
+type Authorizer struct {
+	URL      string
+	Timeout  time.Duration // per request
+	CacheTTL time.Duration // how long a decision is reused
+	FailOpen bool          // answer queries when the service cannot decide, instead of blocking them
+
+	suffixes *matcher.Matcher
+	client   *http.Client
+
+	mu      sync.Mutex
+	cache   map[string]authzEntry
+	pending map[string]*authzCall
+}
+
+type authzEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// authzCall is a request in flight that later queries wait for
+type authzCall struct {
+	done  chan struct{}
+	allow bool
+	err   error
+}
+
+// authzRequest is the OPA data API input document
+type authzRequest struct {
+	Input HookQuery `json:"input"`
+}
+
+// authzResponse accepts both a boolean decision, {"result": true}, and an
+// object, {"result": {"allow": true}}
+type authzResponse struct {
+	Result json.RawMessage `json:"result"`
+}
+
+// NewAuthorizer returns an authorizer for queries below suffixes, each of
+// which also covers the name itself. failureMode is FailOpen or FailClosed.
+func NewAuthorizer(endpoint string, suffixes []string, timeout, cacheTTL time.Duration, failureMode string) (*Authorizer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid authorization URL %q", endpoint)
+	}
+	if len(suffixes) == 0 {
+		return nil, errors.New("no suffixes to authorize")
+	}
+	mode, err := ParseFailureMode(failureMode)
+	if err != nil {
+		return nil, err
+	}
+	var rules []string
+	for _, suffix := range suffixes {
+		suffix = strings.Trim(strings.TrimSpace(suffix), ".")
+		if suffix == "" {
+			continue
+		}
+		rules = append(rules, suffix, "*."+suffix)
+	}
+	return &Authorizer{
+		URL:      endpoint,
+		Timeout:  timeout,
+		CacheTTL: cacheTTL,
+		FailOpen: mode == FailOpen,
+		suffixes: matcher.BuildMatcher(rules),
+		client:   &http.Client{Timeout: timeout},
+		cache:    make(map[string]authzEntry),
+		pending:  make(map[string]*authzCall),
+	}, nil
+}
+
+// PreMatch implements QueryHooks
+func (a *Authorizer) PreMatch(ctx context.Context, q HookQuery) HookAction {
+	if !a.suffixes.Match(q.Name).Matched {
+		return HookContinue
+	}
+	allow, source := a.decide(ctx, q)
+	decision := "deny"
+	if allow {
+		decision = "allow"
+	}
+	metrics.AuthzDecisions.WithLabelValues(decision, source).Inc()
+	if !allow {
+		queryLog(ctx).Info().Msgf("Authorization denied %s (%s) for %s", q.Name, q.Type, q.Client)
+		return HookBlock
+	}
+	return HookContinue
+}
+
+// PreResponse implements QueryHooks; answers are not authorized
+func (a *Authorizer) PreResponse(ctx context.Context, q HookQuery, response []byte) HookAction {
+	return HookContinue
+}
+
+// decide returns the decision for q and where it came from: "cache",
+// "service" or "failure" when the service could not be asked
+func (a *Authorizer) decide(ctx context.Context, q HookQuery) (allow bool, source string) {
+	key := strings.ToLower(q.Name) + "/" + q.Type + "/" + q.Client
+
+	a.mu.Lock()
+	if entry, ok := a.cache[key]; ok && time.Now().Before(entry.expires) {
+		a.mu.Unlock()
+		return entry.allow, "cache"
+	}
+	call, waiting := a.pending[key]
+	if !waiting {
+		call = &authzCall{done: make(chan struct{})}
+		a.pending[key] = call
+	}
+	a.mu.Unlock()
+
+	if !waiting {
+		// Not bound to this query's context: the decision is shared
+		call.allow, call.err = a.ask(q)
+		a.mu.Lock()
+		delete(a.pending, key)
+		if call.err == nil {
+			a.store(key, call.allow)
+		}
+		a.mu.Unlock()
+		close(call.done)
+	} else {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return a.FailOpen, "failure"
+		}
+	}
+
+	if call.err != nil {
+		queryLog(ctx).Warn().Err(call.err).Msgf("Authorization of %s failed", q.Name)
+		return a.FailOpen, "failure"
+	}
+	return call.allow, "service"
+}
+
+// store caches a decision; the caller holds a.mu
+func (a *Authorizer) store(key string, allow bool) {
+	if a.CacheTTL <= 0 {
+		return
+	}
+	if _, ok := a.cache[key]; !ok && len(a.cache) >= authzCacheSize {
+		// Evict an arbitrary entry; map iteration order is random
+		for k := range a.cache {
+			delete(a.cache, k)
+			break
+		}
+	}
+	a.cache[key] = authzEntry{allow: allow, expires: time.Now().Add(a.CacheTTL)}
+}
+
+// ask posts q to the service and parses its decision
+func (a *Authorizer) ask(q HookQuery) (bool, error) {
+	body, err := json.Marshal(authzRequest{Input: q})
+	if err != nil {
+		return false, err
+	}
+	resp, err := a.client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code from authorization service: %d", resp.StatusCode)
+	}
+
+	var decision authzResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("invalid authorization response: %w", err)
+	}
+	var allow bool
+	if err := json.Unmarshal(decision.Result, &allow); err == nil {
+		return allow, nil
+	}
+	var result struct {
+		Allow *bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil || result.Allow == nil {
+		// OPA omits the result when the rule is undefined for the input
+		return false, errors.New("authorization response has no decision")
+	}
+	return *result.Allow, nil
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// BlocklistReport keeps the normalization report of the enforced blocklist,
+// so duplicates, shadowed rules and invalid entries can be cleaned up on the
+// controller side.
+type BlocklistReport struct {
+	current atomic.Pointer[matcher.Report]
+	rules   atomic.Pointer[[]string] // enforced rules, for export; the slice the matcher was built from, not a copy
+}
+
+// Update analyzes a new blocklist, publishes its report in the metrics and
+// logs a summary with examples when problems are found. rules is kept for
+// the export and must not be modified afterwards.
+func (b *BlocklistReport) Update(rules []string) {
+	report := matcher.Analyze(rules)
+	b.current.Store(&report)
+	b.rules.Store(&rules)
+
+	metrics.BlocklistRuleIssues.WithLabelValues("duplicate").Set(float64(report.DuplicateCount))
+	metrics.BlocklistRuleIssues.WithLabelValues("shadowed").Set(float64(report.ShadowedCount))
+	metrics.BlocklistRuleIssues.WithLabelValues("invalid").Set(float64(report.InvalidCount))
+	if report.Clean() {
+		return
+	}
+
+	event := log.Warn().
+		Int("entries", report.Entries).
+		Int("rules", report.Rules).
+		Int("duplicates", report.DuplicateCount).
+		Int("shadowed", report.ShadowedCount).
+		Int("invalid", report.InvalidCount)
+	if len(report.Duplicates) > 0 {
+		event = event.Strs("duplicateExamples", report.Duplicates)
+	}
+	if len(report.Shadowed) > 0 {
+		shadowed := make([]string, len(report.Shadowed))
+		for i, s := range report.Shadowed {
+			shadowed[i] = s.Rule + " (by " + s.By + ")"
+		}
+		event = event.Strs("shadowedExamples", shadowed)
+	}
+	if len(report.Invalid) > 0 {
+		event = event.Strs("invalidExamples", report.Invalid)
+	}
+	event.Msg("Blocklist has redundant or invalid entries, see /api/blocklist/report")
+}
+
+// ServeHTTP answers GET /api/blocklist/report with the report of the current
+// blocklist
+func (b *BlocklistReport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := b.current.Load()
+	if report == nil {
+		report = &matcher.Report{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ServeExport answers GET /api/blocklist/export with the current blocklist,
+// one rule per line, or as a Pi-hole adlist with ?format=pihole
+func (b *BlocklistReport) ServeExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rules []string
+	if p := b.rules.Load(); p != nil {
+		rules = *p
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch r.URL.Query().Get("format") {
+	case "", "rules":
+		for _, rule := range rules {
+			fmt.Fprintln(w, rule)
+		}
+	case "pihole":
+		matcher.ExportPihole(w, rules)
+	default:
+		http.Error(w, "format must be \"rules\" or \"pihole\"", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker open")
+
+// CircuitBreaker stops forwarding to an upstream that keeps failing. After
+// Threshold consecutive failures it opens for Cooldown, during which queries
+// fail immediately; afterwards a single probe query is let through and its
+// outcome closes or re-opens the breaker.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a breaker tripping after threshold consecutive failures
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	metrics.UpstreamBreakerOpen.Set(0)
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow reports whether a query may be sent to the upstream now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.Threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	// Cool-down over: let one probe through
+	b.probing = true
+	return true
+}
+
+// Record feeds the outcome of a forwarded query back into the breaker
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.Threshold
+	b.probing = false
+
+	if err == nil {
+		b.failures = 0
+		if wasOpen {
+			log.Info().Msg("Upstream recovered, circuit breaker closed")
+			metrics.UpstreamBreakerOpen.Set(0)
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openUntil = time.Now().Add(b.Cooldown)
+		if !wasOpen {
+			log.Warn().Msgf("Upstream failed %d times in a row, circuit breaker open for %s", b.failures, b.Cooldown)
+			metrics.UpstreamBreakerTrips.Inc()
+			metrics.UpstreamBreakerOpen.Set(1)
+		}
+	}
+}
+
+// upstreamAllowed consults the breaker, if any, before forwarding a query
+func (h *Handler) upstreamAllowed(protocol string) error {
+	if h.Breaker == nil || h.Breaker.Allow() {
+		return nil
+	}
+	metrics.UpstreamBreakerRejected.WithLabelValues(protocol).Inc()
+	return errCircuitOpen
+}
+
+// recordUpstream reports a forwarding outcome to the breaker, if any
+func (h *Handler) recordUpstream(err error) {
+	if h.Breaker == nil || errors.Is(err, errCircuitOpen) {
+		return
+	}
+	h.Breaker.Record(err)
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"hash/maphash"
+	"strings"
+	"time"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Canary tracks reported in metrics
+const (
+	trackStable = "stable"
+	trackCanary = "canary"
+)
+
+// CanaryRollout configures soaking of new blocklists on a share of queries
+type CanaryRollout struct {
+	Percent int           // share of query names evaluated against the new blocklist
+	Soak    time.Duration // how long the new blocklist stays in canary before full enforcement
+}
+
+// canaryState is a blocklist being soaked. It is part of handlerState and,
+// like it, never modified once published.
+type canaryState struct {
+	matcher *matcher.Matcher
+	percent uint64
+	seed    maphash.Seed
+}
+
+// startCanary publishes m as the canary blocklist, along with the dry-run
+// switch of its policy, and schedules its promotion. A newer blocklist
+// arriving during the soak replaces the canary and restarts the soak; the
+// stable blocklist is left untouched.
+func (h *Handler) startCanary(m *matcher.Matcher, dryRun bool) {
+	c := &canaryState{
+		matcher: m,
+		percent: uint64(h.Canary.Percent),
+		seed:    maphash.MakeSeed(),
+	}
+	h.update(func(st *handlerState) {
+		st.canary = c
+		st.dryRun = dryRun
+	})
+	metrics.CanaryActive.Set(1)
+	log.Info().Msgf("New blocklist (%d rules) in canary on %d%% of queries for %s", m.Len(), h.Canary.Percent, h.Canary.Soak)
+
+	time.AfterFunc(h.Canary.Soak, func() {
+		promoted := false
+		h.update(func(st *handlerState) {
+			if st.canary != c {
+				return
+			}
+			st.matcher = c.matcher
+			st.canary = nil
+			promoted = true
+		})
+		if promoted {
+			metrics.CanaryActive.Set(0)
+			log.Info().Msgf("Canary blocklist promoted to full enforcement (%d rules)", c.matcher.Len())
+		}
+	})
+}
+
+// canaryFor swaps the stable blocklist for the canary one when the query name
+// hashes into the canary share. Names rather than clients are hashed because
+// a sidecar usually serves a single client. Policy-set matchers are never
+// canaried. The returned track is "" when no canary is running.
+func (st *handlerState) canaryFor(m *matcher.Matcher, domain string) (*matcher.Matcher, string) {
+	if st.canary == nil || m != st.matcher {
+		return m, ""
+	}
+	if maphash.String(st.canary.seed, strings.ToLower(domain))%100 < st.canary.percent {
+		return st.canary.matcher, trackCanary
+	}
+	return m, trackStable
+}
+
+// countCanaryVerdict records a verdict made while a canary is running
+func countCanaryVerdict(track string, blocked bool) {
+	if track == "" {
+		return
+	}
+	verdict := "allowed"
+	if blocked {
+		verdict = "blocked"
+	}
+	metrics.CanaryVerdicts.WithLabelValues(track, verdict).Inc()
+}
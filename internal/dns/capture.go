@@ -0,0 +1,412 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// captureMaxBytes bounds the size of a capture file whatever its packet limit
+const captureMaxBytes = 64 << 20
+
+// captureFile is the name of the capture file in the capture directory; a
+// new capture replaces the previous one
+const captureFile = "capture.pcap"
+
+// linkTypeRaw is the pcap link type of packets starting with their IP header
+const linkTypeRaw = 101
+
+// errCaptureRunning is returned when a capture is requested during another
+var errCaptureRunning = errors.New("a capture is already running")
+
+// Capture records the DNS messages exchanged with clients to a pcap file
+// for a limited time or number of packets, started from the admin API. It
+// gives the packets tcpdump would have seen on the listening socket without
+// node-level privileges. Each message is written as one UDP datagram between
+// the client and the proxy, also those carried over TCP, so that Wireshark
+// decodes them as DNS.
+type Capture struct {
+	Dir        string        // directory the capture file is written to
+	Listen     string        // listen address, the proxy side of UDP packets
+	MaxSeconds time.Duration // longest capture that can be requested
+	MaxPackets int           // most packets a capture can be requested to keep
+
+	active atomic.Bool
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	timer   *time.Timer
+	started time.Time
+	until   time.Time
+	packets int
+	limit   int
+	bytes   int64
+	stopped string // why the last capture ended
+}
+
+// CaptureStatus describes the running or last capture
+type CaptureStatus struct {
+	Active     bool      `json:"active"`
+	File       string    `json:"file,omitempty"`
+	Started    time.Time `json:"started"`
+	Until      time.Time `json:"until"`
+	Packets    int       `json:"packets"`
+	MaxPackets int       `json:"maxPackets,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	Stopped    string    `json:"stopped,omitempty"`
+}
+
+func NewCapture(dir, listen string, maxSeconds time.Duration, maxPackets int) *Capture {
+	return &Capture{Dir: dir, Listen: listen, MaxSeconds: maxSeconds, MaxPackets: maxPackets}
+}
+
+// Start begins a capture of at most duration and packets, replacing the
+// previous capture file. Only one capture runs at a time.
+func (c *Capture) Start(duration time.Duration, packets int) error {
+	if duration <= 0 || duration > c.MaxSeconds {
+		return fmt.Errorf("capture duration must be between 1s and %s", c.MaxSeconds)
+	}
+	if packets <= 0 || packets > c.MaxPackets {
+		return fmt.Errorf("capture packets must be between 1 and %d", c.MaxPackets)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		return errCaptureRunning
+	}
+	file, err := os.Create(filepath.Join(c.Dir, captureFile))
+	if err != nil {
+		return err
+	}
+	c.file = file
+	c.w = bufio.NewWriter(file)
+	c.started = time.Now()
+	c.until = c.started.Add(duration)
+	c.packets, c.limit, c.bytes, c.stopped = 0, packets, 0, ""
+
+	// Global header: pcap 2.4 with microsecond timestamps
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	c.w.Write(header)
+	c.bytes = int64(len(header))
+
+	c.timer = time.AfterFunc(duration, func() { c.Stop("duration reached") })
+	c.active.Store(true)
+	log.Warn().Msgf("Capturing DNS traffic to %s for up to %s or %d packets", file.Name(), duration, packets)
+	return nil
+}
+
+// Stop ends the running capture, if any, giving reason in its status
+func (c *Capture) Stop(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked(reason)
+}
+
+func (c *Capture) stopLocked(reason string) {
+	if c.file == nil {
+		return
+	}
+	c.active.Store(false)
+	c.timer.Stop()
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to write capture file")
+		reason = err.Error()
+	}
+	log.Info().Msgf("Capture stopped (%s): %d packets, %d bytes in %s", reason, c.packets, c.bytes, c.file.Name())
+	c.file, c.w, c.timer = nil, nil, nil
+	c.stopped = reason
+}
+
+// Status reports the running or last capture
+func (c *Capture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := CaptureStatus{
+		Active:  c.file != nil,
+		Started: c.started,
+		Until:   c.until,
+		Packets: c.packets,
+		Bytes:   c.bytes,
+		Stopped: c.stopped,
+	}
+	if !c.started.IsZero() {
+		status.File = filepath.Join(c.Dir, captureFile)
+	}
+	if status.Active {
+		status.MaxPackets = c.limit
+	}
+	return status
+}
+
+// record writes one message sent from src to dst
+func (c *Capture) record(src, dst net.Addr, msg []byte) {
+	if !c.active.Load() {
+		return
+	}
+	packet := ipPacket(addrPort(src), addrPort(dst), msg)
+	if packet == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	if c.bytes+16+int64(len(packet)) > captureMaxBytes {
+		c.stopLocked("size limit reached")
+		return
+	}
+	now := time.Now()
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	c.w.Write(header)
+	c.w.Write(packet)
+	c.packets++
+	c.bytes += int64(len(header) + len(packet))
+	if c.packets >= c.limit {
+		c.stopLocked("packet limit reached")
+	}
+}
+
+// listenAddr returns the proxy side of UDP packets: the socket's own address
+// when the writer knows it, the configured listen address otherwise
+func (c *Capture) listenAddr(conn UDPWriter) net.Addr {
+	if l, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		return l.LocalAddr()
+	}
+	addr, _ := net.ResolveUDPAddr("udp", c.Listen)
+	return addr
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort()
+	case *net.TCPAddr:
+		return a.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// ipPacket wraps payload in IP and UDP headers, IPv4 when both addresses
+// are IPv4 and IPv6 otherwise. An unspecified source or destination, such as
+// an all-interfaces listen address, is written as the unspecified address of
+// the other side's family.
+func ipPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcIP.IsUnspecified() {
+		srcIP = netip.Addr{}
+	}
+	if dstIP.IsUnspecified() {
+		dstIP = netip.Addr{}
+	}
+	if !srcIP.IsValid() && !dstIP.IsValid() {
+		return nil
+	}
+	v4 := (!srcIP.IsValid() || srcIP.Is4()) && (!dstIP.IsValid() || dstIP.Is4())
+	if !srcIP.IsValid() || (srcIP.Is4() != v4) {
+		srcIP = unspecified(v4)
+	}
+	if !dstIP.IsValid() || (dstIP.Is4() != v4) {
+		dstIP = unspecified(v4)
+	}
+	if len(payload) > 65535-8-40 {
+		return nil
+	}
+
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	// The UDP checksum covers a pseudo-header of addresses, protocol and length
+	pseudo := append(srcIP.AsSlice(), dstIP.AsSlice()...)
+	pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+
+	if v4 {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], srcIP.AsSlice())
+		copy(ip[16:], dstIP.AsSlice())
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, udp...)
+	}
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // UDP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], srcIP.AsSlice())
+	copy(ip[24:], dstIP.AsSlice())
+	return append(ip, udp...)
+}
+
+func unspecified(v4 bool) netip.Addr {
+	if v4 {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+// checksum is the Internet checksum (RFC 1071) of b
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// captureUDP records a query received over UDP and returns conn wrapped to
+// record the response, while a capture runs
+func (h *Handler) captureUDP(conn UDPWriter, client *net.UDPAddr, query []byte) UDPWriter {
+	c := h.Capture
+	if c == nil || !c.active.Load() {
+		return conn
+	}
+	local := c.listenAddr(conn)
+	c.record(client, local, query)
+	return captureUDPWriter{UDPWriter: conn, capture: c, local: local}
+}
+
+// captureTCP records a query received over TCP and returns conn wrapped to
+// record the response, while a capture runs
+func (h *Handler) captureTCP(conn net.Conn, query []byte) net.Conn {
+	c := h.Capture
+	if c == nil || !c.active.Load() {
+		return conn
+	}
+	c.record(conn.RemoteAddr(), conn.LocalAddr(), query)
+	return captureTCPConn{Conn: conn, capture: c}
+}
+
+// captureUDPWriter records the responses a UDP query handler sends
+type captureUDPWriter struct {
+	UDPWriter
+	capture *Capture
+	local   net.Addr
+}
+
+func (w captureUDPWriter) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	w.capture.record(w.local, addr, b)
+	return w.UDPWriter.WriteToUDP(b, addr)
+}
+
+// captureTCPConn records the responses written to a TCP client. Every Write
+// is one length-prefixed message, as writeTCPMessage sends it.
+type captureTCPConn struct {
+	net.Conn
+	capture *Capture
+}
+
+func (c captureTCPConn) Write(b []byte) (int, error) {
+	if len(b) > 2 {
+		c.capture.record(c.LocalAddr(), c.RemoteAddr(), b[2:])
+	}
+	return c.Conn.Write(b)
+}
+
+// ServeHTTP serves /api/capture. POST starts a capture for ?seconds=
+// (default 10) or until ?packets= messages (default the maximum) have been
+// recorded, GET reports the running or last capture, DELETE stops the
+// running one. GET ?download=1 returns the last finished capture file.
+func (c *Capture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		seconds, packets := 10, c.MaxPackets
+		var err error
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			if seconds, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "seconds must be an integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.URL.Query().Get("packets"); s != "" {
+			if packets, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "packets must be an integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := c.Start(time.Duration(seconds)*time.Second, packets); err == errCaptureRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodGet:
+		if r.URL.Query().Get("download") != "" {
+			c.download(w)
+			return
+		}
+	case http.MethodDelete:
+		c.Stop("stopped from the API")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Status())
+}
+
+func (c *Capture) download(w http.ResponseWriter) {
+	status := c.Status()
+	if status.Active {
+		http.Error(w, "capture still running", http.StatusConflict)
+		return
+	}
+	file, err := os.Open(filepath.Join(c.Dir, captureFile))
+	if err != nil {
+		http.Error(w, "no capture available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+captureFile+`"`)
+	io.Copy(w, file)
+}
@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Chaos answers CHAOS-class queries, which name server software answers
+// with its version and host name, locally. Public upstreams refuse them or
+// answer for themselves, which only confuses whoever is debugging the
+// sidecar.
+type Chaos struct {
+	Version  string // TXT answer for version.bind and version.server, "" refuses
+	Hostname string // TXT answer for hostname.bind and id.server, "" refuses
+}
+
+// value returns the TXT answer for a CHAOS name, "" when it has none
+func (c *Chaos) value(name string) string {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "version.bind", "version.server":
+		return c.Version
+	case "hostname.bind", "id.server":
+		return c.Hostname
+	}
+	return ""
+}
+
+// answerChaos answers every CHAOS-class query: with a TXT record for the
+// names with a configured value, and REFUSED otherwise. The second result
+// is false for queries of other classes.
+func (h *Handler) answerChaos(query []byte) ([]byte, bool) {
+	if h.Chaos == nil {
+		return nil, false
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Class != ClassCHAOS {
+		return nil, false
+	}
+	question := q.Questions[0]
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagAA | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	value := h.Chaos.value(question.Name)
+	switch {
+	case value != "" && (question.Type == TypeTXT || question.Type == TypeANY):
+		resp.Answers = []RR{{Name: question.Name, Type: TypeTXT, Class: ClassCHAOS, Data: appendTXT(nil, value)}}
+	case value != "":
+		// NODATA: the name exists, with a TXT record only
+	default:
+		resp.Flags &^= flagAA
+		resp.SetRcode(RcodeRefused)
+	}
+
+	if h.Verbose {
+		log.Info().Msgf("Answered CHAOS query for %s locally (%s)", question.Name, RcodeName(resp.Rcode()))
+	}
+	return resp.Pack(), true
+}
+
+// appendTXT encodes s as the character-strings of TXT RDATA, split every
+// 255 bytes
+func appendTXT(data []byte, s string) []byte {
+	for len(s) > 255 {
+		data = append(data, 255)
+		data = append(data, s[:255]...)
+		s = s[255:]
+	}
+	data = append(data, byte(len(s)))
+	return append(data, s...)
+}
@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// ClientStats counts queries per client IP for a bounded number of clients,
+// so operators of a shared proxy can tell which pod generates blocked or
+// failing traffic. When full, an arbitrary client is evicted to make room.
+type ClientStats struct {
+	Max int // clients tracked at once
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*ClientCounters
+}
+
+// ClientCounters holds the statistics of one client
+type ClientCounters struct {
+	Client   string    `json:"client"`
+	Queries  uint64    `json:"queries"`
+	Blocked  uint64    `json:"blocked"`
+	Errors   uint64    `json:"errors"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func NewClientStats(max int) *ClientStats {
+	return &ClientStats{Max: max, clients: make(map[netip.Addr]*ClientCounters)}
+}
+
+func (s *ClientStats) record(ip netip.Addr, verdict string) {
+	if !ip.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[ip]
+	if !ok {
+		if len(s.clients) >= s.Max {
+			// Evict an arbitrary client; map iteration order is random
+			for k := range s.clients {
+				delete(s.clients, k)
+				break
+			}
+		}
+		c = &ClientCounters{Client: ip.String()}
+		s.clients[ip] = c
+	}
+	c.Queries++
+	switch verdict {
+	case VerdictBlocked:
+		c.Blocked++
+	case VerdictFailed:
+		c.Errors++
+	}
+	c.LastSeen = time.Now()
+}
+
+// Snapshot returns a copy of the counters of every tracked client
+func (s *ClientStats) Snapshot() []ClientCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ClientCounters, 0, len(s.clients))
+	for _, c := range s.clients {
+		out = append(out, *c)
+	}
+	return out
+}
+
+// ServeHTTP answers GET /api/stats/clients with the tracked clients, sorted
+// by the counter named in ?sort= (queries, blocked or errors; default
+// queries) and cut to ?limit= entries
+func (s *ClientStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := func(c ClientCounters) uint64 { return c.Queries }
+	switch r.URL.Query().Get("sort") {
+	case "", "queries":
+	case "blocked":
+		key = func(c ClientCounters) uint64 { return c.Blocked }
+	case "errors":
+		key = func(c ClientCounters) uint64 { return c.Errors }
+	default:
+		http.Error(w, "sort must be queries, blocked or errors", http.StatusBadRequest)
+		return
+	}
+
+	clients := s.Snapshot()
+	slices.SortFunc(clients, func(a, b ClientCounters) int {
+		if ka, kb := key(a), key(b); ka != kb {
+			if ka > kb {
+				return -1
+			}
+			return 1
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		clients = clients[:min(n, len(clients))]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Clients []ClientCounters `json:"clients"`
+	}{clients})
+}
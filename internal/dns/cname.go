@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+)
+
+// maxCNAMEHops bounds the CNAME chain followed through an answer
+const maxCNAMEHops = 16
+
+// cnameChain returns the targets of the CNAME chain in answers that starts
+// at name, in order
+func cnameChain(answers []RR, name string) []string {
+	var chain []string
+	for len(chain) < maxCNAMEHops {
+		next := ""
+		for _, rr := range answers {
+			if rr.Type == TypeCNAME && strings.EqualFold(rr.Name, name) {
+				next = recordTarget(rr)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		chain = append(chain, next)
+		name = next
+	}
+	return chain
+}
+
+// inspectCNAMEs replaces a forwarded answer with the blocked response when
+// the CNAME chain of the queried name leads to a name m blocks, which
+// defeats CNAME cloaking of trackers behind an allowed alias. It returns
+// the response to send and the matching rule, "" when the answer stands.
+// In dry-run mode a match is only logged.
+func (h *Handler) inspectCNAMEs(ctx context.Context, st *handlerState, m *matcher.Matcher, client net.Addr, domain, protocol string, query, response []byte) ([]byte, string) {
+	if !h.InspectCNAMEs || m == nil {
+		return response, ""
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Questions) != 1 || len(msg.Answers) == 0 {
+		return response, ""
+	}
+	for _, target := range cnameChain(msg.Answers, msg.Questions[0].Name) {
+		result := h.match(m, target)
+		if !result.Matched {
+			continue
+		}
+		if st.dryRun {
+			queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking %s - CNAME target %s matches rule %q", domain, target, result.Rule)
+			h.recordDryRun(client, domain, result.Rule)
+			return response, ""
+		}
+		queryLog(ctx).Info().Msgf("Blocking %s - CNAME target %s matches rule %q", domain, target, result.Rule)
+		metrics.CNAMEBlocked.WithLabelValues(protocol).Inc()
+		return h.blockedResponse(query, result.Rule), result.Rule
+	}
+	return response, ""
+}
@@ -0,0 +1,179 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// optionCookie is the EDNS COOKIE option code (RFC 7873)
+const optionCookie = 10
+
+// rcodeBadCookie is the extended response code of a server asking for the
+// query to be repeated with the server cookie it returned
+const rcodeBadCookie = 23
+
+// Lengths of the parts of a COOKIE option
+const (
+	clientCookieLength    = 8
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+)
+
+// CookieJar holds the DNS cookies of the sidecar as a client of its plain
+// UDP upstreams. Each upstream gets a client cookie of its own, derived from
+// a secret drawn at start, and is sent back the server cookie it last
+// returned. Once an upstream has returned a cookie, only responses echoing
+// the client cookie are accepted from it, which an off-path attacker cannot
+// know.
+type CookieJar struct {
+	secret  []byte
+	mu      sync.Mutex
+	servers map[string][]byte // last server cookie of each upstream
+}
+
+// NewCookieJar returns a jar with a new client secret
+func NewCookieJar() *CookieJar {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &CookieJar{secret: secret, servers: make(map[string][]byte)}
+}
+
+// cookieState is what attach did to a query
+type cookieState struct {
+	client   []byte // client cookie sent, nil when the query carries none of the jar's
+	addedOPT bool   // the OPT record was added for the cookie
+	required bool   // the upstream has returned cookies before
+}
+
+// clientCookie returns the client cookie used with upstream
+func (j *CookieJar) clientCookie(upstream string) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(upstream))
+	return mac.Sum(nil)[:clientCookieLength]
+}
+
+// attach returns query carrying a COOKIE option for upstream. Queries with
+// a cookie of their own, from clients talking to the upstream through the
+// sidecar, are left alone, as is everything when j is nil.
+func (j *CookieJar) attach(upstream string, query []byte) ([]byte, cookieState) {
+	if j == nil {
+		return query, cookieState{}
+	}
+	m, err := ParseMessage(query)
+	if err != nil {
+		return query, cookieState{}
+	}
+	var st cookieState
+	i := findOPT(m)
+	if i < 0 {
+		m.Additional = append(m.Additional, RR{Type: TypeOPT, Class: 512})
+		i = len(m.Additional) - 1
+		st.addedOPT = true
+	} else if _, ok := findOption(m.Additional[i].Data, optionCookie); ok {
+		return query, cookieState{}
+	}
+	j.mu.Lock()
+	server := j.servers[upstream]
+	j.mu.Unlock()
+	st.client, st.required = j.clientCookie(upstream), server != nil
+
+	opt := &m.Additional[i]
+	opt.Data = binary.BigEndian.AppendUint16(opt.Data, optionCookie)
+	opt.Data = binary.BigEndian.AppendUint16(opt.Data, uint16(len(st.client)+len(server)))
+	opt.Data = append(append(opt.Data, st.client...), server...)
+	return m.Pack(), st
+}
+
+// absorb keeps the server cookie of a response to a query attach gave a
+// cookie, and returns the response without the cookie for the client.
+// retry reports a BADCOOKIE answer, after which the query is to be sent
+// again with the new server cookie.
+func (j *CookieJar) absorb(upstream string, st cookieState, response []byte) (_ []byte, retry bool) {
+	if j == nil || st.client == nil {
+		return response, false
+	}
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response, false
+	}
+	i := findOPT(m)
+	if i < 0 {
+		metrics.UpstreamCookies.WithLabelValues("missing").Inc()
+		return response, false
+	}
+	opt := &m.Additional[i]
+	cookie, ok := findOption(opt.Data, optionCookie)
+	if !ok || !validCookie(cookie) {
+		metrics.UpstreamCookies.WithLabelValues("missing").Inc()
+	} else {
+		j.mu.Lock()
+		j.servers[upstream] = bytes.Clone(cookie[clientCookieLength:])
+		j.mu.Unlock()
+		if int(opt.TTL>>24)<<4|int(m.Flags&0x0F) == rcodeBadCookie {
+			metrics.UpstreamCookies.WithLabelValues("badcookie").Inc()
+			return response, true
+		}
+		metrics.UpstreamCookies.WithLabelValues("valid").Inc()
+	}
+	if st.addedOPT {
+		m.Additional = append(m.Additional[:i], m.Additional[i+1:]...)
+	} else {
+		opt.Data = withoutOption(opt.Data, optionCookie)
+	}
+	return m.Pack(), false
+}
+
+// forget drops the server cookie of an upstream that did not answer a query
+// requiring a cookie in time, in case it stopped returning them: its next
+// response is accepted without one
+func (j *CookieJar) forget(upstream string, st cookieState) {
+	if j == nil || !st.required {
+		return
+	}
+	j.mu.Lock()
+	delete(j.servers, upstream)
+	j.mu.Unlock()
+	log.Debug().Msgf("No answer from %s echoing the DNS cookie, forgetting its server cookie", upstream)
+}
+
+// validCookie reports whether a COOKIE option has a client cookie and a
+// server cookie of valid length
+func validCookie(cookie []byte) bool {
+	n := len(cookie) - clientCookieLength
+	return n >= minServerCookieLength && n <= maxServerCookieLength
+}
+
+// messageCookie returns the COOKIE option of msg
+func messageCookie(msg []byte) ([]byte, bool) {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return nil, false
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return nil, false
+	}
+	return findOption(m.Additional[i].Data, optionCookie)
+}
+
+// cookieMismatch reports whether a response fails the cookie check of a
+// query that sent the COOKIE option sent: the response's option must
+// start with the same client cookie, and be there at all when required.
+func cookieMismatch(sent, response []byte, required bool) bool {
+	if len(sent) < clientCookieLength {
+		return false
+	}
+	cookie, ok := messageCookie(response)
+	if !ok {
+		return required
+	}
+	return !validCookie(cookie) || !bytes.Equal(cookie[:clientCookieLength], sent[:clientCookieLength])
+}
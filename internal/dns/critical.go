@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+)
+
+// CriticalNames returns the rules for names the sidecar itself depends on:
+// the controller host, the upstream hosts and the cluster domain. Upstreams
+// may be host:port addresses or URLs; IP literals are skipped since they are
+// never resolved.
+func CriticalNames(controllerURL, clusterDomain string, upstreams ...string) []string {
+	var rules []string
+	for _, target := range append([]string{controllerURL}, upstreams...) {
+		if host := hostOf(target); host != "" && net.ParseIP(host) == nil {
+			rules = append(rules, host)
+		}
+	}
+	if domain := strings.Trim(clusterDomain, "."); domain != "" {
+		rules = append(rules, domain, "*."+domain)
+	}
+	return rules
+}
+
+// hostOf extracts the host name from a URL or host:port address
+func hostOf(target string) string {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// exemptCritical clears a block verdict for names in h.Critical, so a
+// blocklist matching everything cannot cut the sidecar off from its own
+// controller and upstreams
+func (h *Handler) exemptCritical(domain string, result matcher.MatchResult) matcher.MatchResult {
+	if !result.Matched || h.Critical == nil || !h.Critical.Match(domain).Matched {
+		return result
+	}
+	metrics.CriticalExemptions.Inc()
+	if h.Verbose {
+		log.Warn().Msgf("Rule %q matches critical name %s, allowing it", result.Rule, domain)
+	}
+	return matcher.MatchResult{}
+}
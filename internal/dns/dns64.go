@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"lktr/internal/metrics"
+)
+
+// dns64MaxNegativeTTL bounds the TTL of synthesized records when the
+// upstream's empty AAAA answer carried no SOA (RFC 6147 section 5.1.7)
+const dns64MaxNegativeTTL = 600
+
+// wellKnownPrefix is the NAT64 prefix of RFC 6052, which must not embed
+// addresses that are not globally reachable
+var wellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// mappedPrefix holds the IPv4-mapped addresses, never native IPv6 ones
+var mappedPrefix = netip.MustParsePrefix("::ffff:0:0/96")
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// netip does not count as private
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// DNS64 synthesizes AAAA records from A records (RFC 6147) for IPv6-only
+// clients reaching IPv4 services through a NAT64 gateway.
+type DNS64 struct {
+	prefix    net.IP
+	bits      int
+	wellKnown bool
+	exclude   []netip.Prefix // AAAA records treated as absent
+}
+
+// NewDNS64 parses a NAT64 prefix such as "64:ff9b::/96". Only the prefix
+// lengths defined by RFC 6052 are accepted. AAAA records in an exclude
+// prefix, and IPv4-mapped ones, do not count as native IPv6 addresses, so
+// the name is synthesized for as if they were missing.
+func NewDNS64(prefix string, exclude ...string) (*DNS64, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix %q: %w", prefix, err)
+	}
+	if ipnet.IP.To4() != nil {
+		return nil, fmt.Errorf("DNS64 prefix %q is not IPv6", prefix)
+	}
+
+	bits, _ := ipnet.Mask.Size()
+	switch bits {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("DNS64 prefix length /%d not supported (want 32, 40, 48, 56, 64 or 96)", bits)
+	}
+
+	d := &DNS64{prefix: ipnet.IP.To16(), bits: bits, exclude: []netip.Prefix{mappedPrefix}}
+	if p, ok := netip.AddrFromSlice(d.prefix); ok {
+		d.wellKnown = netip.PrefixFrom(p, bits) == wellKnownPrefix
+	}
+	for _, e := range exclude {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil || !p.Addr().Is6() {
+			return nil, fmt.Errorf("invalid DNS64 exclusion %q: not an IPv6 prefix", e)
+		}
+		d.exclude = append(d.exclude, p.Masked())
+	}
+	return d, nil
+}
+
+// excluded reports whether an AAAA record does not count as a native IPv6
+// address
+func (d *DNS64) excluded(rr RR) bool {
+	addr, ok := netip.AddrFromSlice(rr.Data)
+	if !ok {
+		return false
+	}
+	for _, p := range d.exclude {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddable reports whether ip4 may be synthesized into the prefix: RFC
+// 6052 section 3.1 keeps addresses that are not globally reachable out of
+// the well-known prefix
+func (d *DNS64) embeddable(ip4 net.IP) bool {
+	if !d.wellKnown {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip4.To4())
+	return ok && addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// Synthesize embeds an IPv4 address into the NAT64 prefix per RFC 6052
+// section 2.2, skipping the reserved octet at bits 64-71.
+func (d *DNS64) Synthesize(ip4 net.IP) net.IP {
+	out := make(net.IP, net.IPv6len)
+	copy(out, d.prefix[:d.bits/8])
+
+	pos := d.bits / 8
+	for _, octet := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = octet
+		pos++
+	}
+	return out
+}
+
+// applyDNS64 replaces an AAAA answer without native IPv6 addresses with
+// records synthesized from the name's A records. Queries of validating
+// clients (DO and CD set) are left alone, as RFC 6147 section 5.5 asks,
+// since synthesized records cannot validate. Any failure leaves the
+// upstream response untouched.
+func (h *Handler) applyDNS64(ctx context.Context, st *handlerState, query, response []byte, protocol string) []byte {
+	if h.DNS64 == nil {
+		return response
+	}
+
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Type != TypeAAAA || q.Questions[0].Class != ClassINET {
+		return response
+	}
+	if q.Flags&flagCD != 0 && dnssecOK(q) {
+		return response
+	}
+
+	resp, err := ParseMessage(response)
+	if err != nil || resp.Rcode() != RcodeSuccess {
+		return response
+	}
+	for _, rr := range resp.Answers {
+		if rr.Type == TypeAAAA && !h.DNS64.excluded(rr) {
+			return response
+		}
+	}
+
+	aQuery := *q
+	aQuery.Questions = []Question{{Name: q.Questions[0].Name, Type: TypeA, Class: ClassINET}}
+	aResponse, err := h.exchange(ctx, st, aQuery.Pack())
+	if err != nil {
+		queryLog(ctx).Err(err).Msg("DNS64: failed to look up A records")
+		return response
+	}
+
+	a, err := ParseMessage(aResponse)
+	if err != nil || a.Rcode() != RcodeSuccess {
+		return response
+	}
+
+	// Synthesized records live no longer than the upstream's negative answer
+	maxTTL := uint32(dns64MaxNegativeTTL)
+	for _, rr := range resp.Authority {
+		if rr.Type == TypeSOA && len(rr.Data) >= 4 {
+			maxTTL = min(rr.TTL, binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:]))
+			break
+		}
+	}
+
+	var answers []RR
+	synthesized := 0
+	for _, rr := range a.Answers {
+		if rr.Type == TypeA {
+			if len(rr.Data) != net.IPv4len || !h.DNS64.embeddable(net.IP(rr.Data)) {
+				continue
+			}
+			rr.Type = TypeAAAA
+			rr.Data = h.DNS64.Synthesize(net.IP(rr.Data))
+			rr.TTL = min(rr.TTL, maxTTL)
+			synthesized++
+		}
+		answers = append(answers, rr)
+	}
+	if synthesized == 0 {
+		return response
+	}
+
+	a.ID = q.ID
+	a.Questions = q.Questions
+	a.Answers = answers
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("DNS64: synthesized %d AAAA records for %s", synthesized, q.Questions[0].Name)
+	}
+	metrics.DNS64Synthesized.WithLabelValues(protocol).Inc()
+
+	return a.Pack()
+}
+
+// dnssecOK reports whether the DO bit is set in the OPT record of m
+func dnssecOK(m *Message) bool {
+	i := findOPT(m)
+	return i >= 0 && m.Additional[i].TTL&0x8000 != 0
+}
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// dryRunOther collects the queries of rules, names or clients beyond the limit
+const dryRunOther = "(other)"
+
+// DryRunReport accumulates the queries that dry-run mode let through although
+// the blocklist matched them, so a policy can be assessed before it is
+// enforced. At most Max distinct rules, names and clients are tracked each;
+// the rest are counted under "(other)". The report restarts whenever a
+// different blocklist is installed.
+type DryRunReport struct {
+	Max int
+
+	mu      sync.Mutex
+	since   time.Time
+	total   uint64
+	rules   map[string]uint64
+	domains map[string]uint64
+	clients map[string]uint64
+}
+
+// DryRunCount is one entry of a dry-run report
+type DryRunCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+func NewDryRunReport(max int) *DryRunReport {
+	r := &DryRunReport{Max: max}
+	r.Reset()
+	return r
+}
+
+// Reset discards everything accumulated so far
+func (r *DryRunReport) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.since = time.Now()
+	r.total = 0
+	r.rules = make(map[string]uint64)
+	r.domains = make(map[string]uint64)
+	r.clients = make(map[string]uint64)
+}
+
+func (r *DryRunReport) record(client net.Addr, domain, rule string) {
+	ip := clientIP(client)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total++
+	r.add(r.rules, rule)
+	r.add(r.domains, domain)
+	if ip.IsValid() {
+		r.add(r.clients, ip.String())
+	}
+}
+
+func (r *DryRunReport) add(counts map[string]uint64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= r.Max {
+		key = dryRunOther
+	}
+	counts[key]++
+}
+
+// ServeHTTP answers GET /api/dryrun/report with the would-be-blocked queries
+// per rule, name and client, each sorted by count and cut to ?limit= entries
+// (default 50). DELETE starts a new report.
+func (r *DryRunReport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		r.Reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 50
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	r.mu.Lock()
+	report := struct {
+		Since   time.Time     `json:"since"`
+		Total   uint64        `json:"wouldBlock"`
+		Rules   []DryRunCount `json:"rules"`
+		Domains []DryRunCount `json:"domains"`
+		Clients []DryRunCount `json:"clients"`
+	}{r.since, r.total, topCounts(r.rules, limit), topCounts(r.domains, limit), topCounts(r.clients, limit)}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// topCounts returns the limit largest counts, ties in key order
+func topCounts(counts map[string]uint64, limit int) []DryRunCount {
+	out := make([]DryRunCount, 0, len(counts))
+	for k, n := range counts {
+		out = append(out, DryRunCount{Key: k, Count: n})
+	}
+	slices.SortFunc(out, func(a, b DryRunCount) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return out[:min(limit, len(out))]
+}
+
+// recordDryRun adds a query that dry-run mode let through to the report
+func (h *Handler) recordDryRun(client net.Addr, domain, rule string) {
+	if h.DryRunReport != nil {
+		h.DryRunReport.record(client, domain, rule)
+	}
+}
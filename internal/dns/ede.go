@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// optionEDE is the Extended DNS Error option code (RFC 8914)
+const optionEDE = 15
+
+// Extended DNS Error codes given to blocked queries
+const (
+	EDEBlocked  uint16 = 15 // blocked by the operator's policy
+	EDEFiltered uint16 = 17 // blocked by a blocklist the client asked for
+)
+
+// maxEDEText bounds the EXTRA-TEXT of the option, so that a long rule does
+// not push the response over the client's payload size
+const maxEDEText = 200
+
+// ExtendedError marks blocked responses with an Extended DNS Error, so that
+// clients and debugging tools such as dig can tell a policy block from a
+// name that does not exist
+type ExtendedError struct {
+	Code uint16
+	Rule bool // name the matching rule in the EXTRA-TEXT
+}
+
+// ParseExtendedError validates an Extended DNS Error code name: "none",
+// "blocked" or "filtered". It returns nil for "none".
+func ParseExtendedError(code string, rule bool) (*ExtendedError, error) {
+	switch strings.ToLower(code) {
+	case "none":
+		return nil, nil
+	case "blocked":
+		return &ExtendedError{Code: EDEBlocked, Rule: rule}, nil
+	case "filtered":
+		return &ExtendedError{Code: EDEFiltered, Rule: rule}, nil
+	}
+	return nil, fmt.Errorf("unknown extended DNS error %q, expected none, blocked or filtered", code)
+}
+
+// withExtendedError returns the blocked response to query carrying the
+// Extended DNS Error, with rule as its text when the handler names rules.
+// Clients that did not send an OPT record cannot read one in the response
+// and get it unchanged.
+func (h *Handler) withExtendedError(query, response []byte, rule string) []byte {
+	if h.ExtendedError == nil {
+		return response
+	}
+	q, err := ParseMessage(query)
+	if err != nil {
+		return response
+	}
+	qi := findOPT(q)
+	if qi < 0 {
+		return response
+	}
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	text := ""
+	if h.ExtendedError.Rule && rule != "" {
+		text = "rule: " + rule
+		if len(text) > maxEDEText {
+			text = text[:maxEDEText]
+		}
+	}
+	option := binary.BigEndian.AppendUint16(nil, optionEDE)
+	option = binary.BigEndian.AppendUint16(option, uint16(2+len(text)))
+	option = binary.BigEndian.AppendUint16(option, h.ExtendedError.Code)
+	option = append(option, text...)
+
+	i := findOPT(m)
+	if i < 0 {
+		// The DO bit is echoed, extended RCODE and version stay 0
+		m.Additional = append(m.Additional, RR{Type: TypeOPT, Class: defaultUDPPayload, TTL: q.Additional[qi].TTL & 0x8000})
+		i = len(m.Additional) - 1
+	}
+	opt := &m.Additional[i]
+	opt.Data = append(withoutOption(opt.Data, optionEDE), option...)
+	return m.Pack()
+}
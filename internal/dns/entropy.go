@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Off-path attackers poisoning a cache have to guess what an answer must
+// carry to be accepted. Besides the transaction ID, the forwarder makes
+// them guess the source port of each query and, with CaseRandomization,
+// the case of every letter of the question name (draft-vixie-dnsext-dns0x20).
+
+// portAttempts is how many random source ports are tried before leaving the
+// choice to the system, in case the ones drawn are taken
+const portAttempts = 3
+
+// ephemeralPorts returns the range source ports of upstream UDP sockets are
+// drawn from: the system's ephemeral range, or the IANA one where it cannot
+// be read
+var ephemeralPorts = sync.OnceValues(func() (int, int) {
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range"); err == nil {
+		if f := strings.Fields(string(data)); len(f) == 2 {
+			lo, err1 := strconv.Atoi(f[0])
+			hi, err2 := strconv.Atoi(f[1])
+			if err1 == nil && err2 == nil && 1024 <= lo && lo < hi && hi <= 65535 {
+				return lo, hi
+			}
+		}
+	}
+	return 49152, 65535
+})
+
+// dialSocket connects to an upstream server. A UDP socket is bound to a
+// source port drawn at random from the ephemeral range, one socket per
+// query, so that the port adds to the entropy of the query whatever the
+// system's port allocation.
+func dialSocket(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return upstreamDialer.DialContext(ctx, network, address)
+	}
+	lo, hi := ephemeralPorts()
+	for range portAttempts {
+		d := upstreamDialer
+		d.LocalAddr = &net.UDPAddr{Port: lo + rand.IntN(hi-lo+1)}
+		conn, err := d.DialContext(ctx, network, address)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return upstreamDialer.DialContext(ctx, network, address)
+}
+
+// questionNameEnd returns the offset following the question name of msg,
+// and false when msg has no question or its name is compressed
+func questionNameEnd(msg []byte) (int, bool) {
+	if len(msg) < headerLength || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return 0, false
+	}
+	off := headerLength
+	for off < len(msg) && msg[off] != 0 {
+		if msg[off]&0xC0 != 0 {
+			return 0, false
+		}
+		off += 1 + int(msg[off])
+	}
+	if off >= len(msg) {
+		return 0, false
+	}
+	return off + 1, true
+}
+
+// randomizeCase returns a copy of query with each letter of its question
+// name in random case, and false when there is no name to randomize
+func randomizeCase(query []byte) ([]byte, bool) {
+	end, ok := questionNameEnd(query)
+	if !ok {
+		return query, false
+	}
+	out := bytes.Clone(query)
+	var bits uint64
+	left := 0
+	// Label lengths are below 64 and never read as letters
+	for i := headerLength; i < end; i++ {
+		if c := out[i] | 0x20; c >= 'a' && c <= 'z' {
+			if left == 0 {
+				bits, left = rand.Uint64(), 64
+			}
+			out[i] ^= byte(bits&1) << 5
+			bits >>= 1
+			left--
+		}
+	}
+	return out, true
+}
+
+// caseMismatch reports whether response has a question name that differs
+// from the one of query in the case of a letter. Responses without a
+// question are left to responseMismatch.
+func caseMismatch(query, response []byte) bool {
+	end, ok := questionNameEnd(query)
+	if !ok || len(response) < headerLength || binary.BigEndian.Uint16(response[4:]) != 1 {
+		return false
+	}
+	return len(response) < end || !bytes.Equal(query[headerLength:end], response[headerLength:end])
+}
+
+// restoreCase gives response the question name of the client's query, in
+// the client's case, once the upstream echoed the randomized one. Names
+// compressed to point at the question follow it.
+func restoreCase(response, query []byte) []byte {
+	end, ok := questionNameEnd(query)
+	if !ok {
+		return response
+	}
+	if rend, ok := questionNameEnd(response); ok && rend == end && strings.EqualFold(string(response[headerLength:end]), string(query[headerLength:end])) {
+		copy(response[headerLength:end], query[headerLength:end])
+	}
+	return response
+}
@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"lktr/internal/metrics"
+)
+
+// Error is a class of query-handling failure. Errors returned by the package
+// wrap one of the values below, so callers can test for them with errors.Is.
+type Error struct {
+	msg       string
+	errorType string
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// ErrorType returns the dns_errors_total type label the failure is counted under
+func (e *Error) ErrorType() string { return e.errorType }
+
+var (
+	// ErrTruncatedQuery reports a client query that ended before its announced length
+	ErrTruncatedQuery = &Error{msg: "truncated DNS query", errorType: metrics.ErrorTypeParse}
+	// ErrMalformedMessage reports a DNS message that could not be decoded
+	ErrMalformedMessage = &Error{msg: "malformed DNS message", errorType: metrics.ErrorTypeParse}
+	// ErrUpstreamTimeout reports an upstream that did not answer before the query deadline
+	ErrUpstreamTimeout = &Error{msg: "upstream timed out", errorType: metrics.ErrorTypeUpstreamTimeout}
+	// ErrResponseMismatch reports an upstream TCP response that does not answer the query sent
+	ErrResponseMismatch = &Error{msg: "upstream response does not match the query", errorType: metrics.ErrorTypeUpstreamMismatch}
+)
+
+// malformed returns an error wrapping ErrMalformedMessage
+func malformed(detail string) error {
+	return fmt.Errorf("%w: %s", ErrMalformedMessage, detail)
+}
+
+// upstreamError classifies a failed upstream exchange, marking timeouts
+// (including an expired query context) as ErrUpstreamTimeout
+func upstreamError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+	return err
+}
+
+// clientReadError classifies a failed read of a client's TCP query
+func clientReadError(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrTruncatedQuery, err)
+	}
+	return err
+}
+
+// countError records err in dns_errors_total under the type it carries,
+// or under errorType when it is not classified
+func countError(err error, errorType, protocol string) {
+	metrics.ErrorsTotal.WithLabelValues(metrics.ErrorType(err, errorType), protocol).Inc()
+}
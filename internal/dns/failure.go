@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upstream failure modes
+const (
+	// FailClosed answers SERVFAIL as soon as the upstream cannot be reached
+	FailClosed = "closed"
+	// FailOpen serves a stale cached answer, or retries over plain DNS when
+	// DoH is the failing transport, before giving up with SERVFAIL
+	FailOpen = "open"
+)
+
+const (
+	staleCacheSize = 10000
+	staleTTL       = 30 // seconds, as recommended by RFC 8767
+)
+
+// ParseFailureMode validates an upstream failure mode name
+func ParseFailureMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case FailClosed:
+		return FailClosed, nil
+	case FailOpen:
+		return FailOpen, nil
+	}
+	return "", fmt.Errorf("unknown upstream failure mode %q (want %q or %q)", mode, FailClosed, FailOpen)
+}
+
+// SetUpstreamFailureMode switches between fail-open and fail-closed handling
+// of upstream outages
+func (h *Handler) SetUpstreamFailureMode(mode string) {
+	failOpen := mode == FailOpen
+	h.update(func(st *handlerState) {
+		if st.failOpen != failOpen && h.Verbose {
+			log.Info().Msgf("Upstream failure mode set to %s", mode)
+		}
+		st.failOpen = failOpen
+	})
+
+	if failOpen {
+		metrics.UpstreamFailureMode.WithLabelValues(FailOpen).Set(1)
+		metrics.UpstreamFailureMode.WithLabelValues(FailClosed).Set(0)
+	} else {
+		metrics.UpstreamFailureMode.WithLabelValues(FailOpen).Set(0)
+		metrics.UpstreamFailureMode.WithLabelValues(FailClosed).Set(1)
+	}
+}
+
+// staleCache keeps the last good answer per question so a fail-open proxy
+// can keep serving known names through an upstream outage
+type staleCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *staleCache) put(key string, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string][]byte)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= staleCacheSize {
+		// Evict an arbitrary entry; map iteration order is random
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = response
+}
+
+func (c *staleCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	response, ok := c.entries[key]
+	return response, ok
+}
+
+func staleKey(domain, qtype string) string {
+	return strings.ToLower(domain) + "/" + qtype
+}
+
+// rememberResponse stores a successful upstream answer for serve-stale while
+// the handler is in fail-open mode
+func (h *Handler) rememberResponse(st *handlerState, domain, qtype string, response []byte) {
+	if !st.failOpen || domain == "" || len(response) < headerLength {
+		return
+	}
+	rcode := int(response[3] & 0x0F)
+	if rcode != RcodeSuccess && rcode != RcodeNXDomain {
+		return
+	}
+	h.stale.put(staleKey(domain, qtype), append([]byte(nil), response...))
+}
+
+// upstreamFailed decides what to tell the client when the upstream could not
+// answer. It returns nil only when no response can be built at all.
+func (h *Handler) upstreamFailed(ctx context.Context, st *handlerState, query []byte, domain, qtype string, cause error, protocol string) []byte {
+	if len(query) < headerLength {
+		return nil
+	}
+
+	if st.failOpen {
+		if cached, ok := h.stale.get(staleKey(domain, qtype)); ok {
+			if response := refreshStale(cached, query); response != nil {
+				queryLog(ctx).Warn().Msgf("Upstream unavailable (%v), serving stale answer for %s", cause, domain)
+				metrics.UpstreamFailureResponses.WithLabelValues(protocol, "stale").Inc()
+				return h.scrubOptions(response)
+			}
+		}
+
+		if st.httpsModeEnabled && h.upstream(st) != "" {
+			plain := *st
+			plain.httpsModeEnabled = false
+			if response, err := h.exchange(ctx, &plain, query); err == nil {
+				queryLog(ctx).Warn().Msgf("DoH upstream unavailable (%v), answered %s over plain DNS", cause, domain)
+				metrics.UpstreamFailureResponses.WithLabelValues(protocol, "fallback").Inc()
+				return h.scrubOptions(response)
+			}
+		}
+	}
+
+	metrics.UpstreamFailureResponses.WithLabelValues(protocol, "servfail").Inc()
+	return CreateServFailResponse(query)
+}
+
+// refreshStale rewrites a cached response for a new query: matching ID and
+// short TTLs so clients come back once the upstream recovers
+func refreshStale(cached, query []byte) []byte {
+	msg, err := ParseMessage(cached)
+	if err != nil {
+		return nil
+	}
+	msg.ID = uint16(query[0])<<8 | uint16(query[1])
+	for _, section := range [][]RR{msg.Answers, msg.Authority} {
+		for i := range section {
+			section[i].TTL = min(section[i].TTL, staleTTL)
+		}
+	}
+	return msg.Pack()
+}
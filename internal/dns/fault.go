@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Faults degrades forwarded queries on purpose, so that application teams
+// can rehearse a slow or failing resolver against their own pods. Fault
+// injection is available only in binaries built with the faultinject tag.
+type Faults struct {
+	Latency      time.Duration // delay added before a query is forwarded
+	LatencyRate  float64       // share of forwarded queries delayed
+	DropRate     float64       // share of forwarded queries left unanswered
+	ServFailRate float64       // share of forwarded queries answered with SERVFAIL
+}
+
+// errFaultDrop marks a query dropped by fault injection; it gets no answer
+var errFaultDrop = errors.New("query dropped by fault injection")
+
+// ParseFaults parses a comma-separated fault specification such as
+// "latency=200ms:0.5,drop=0.05,servfail=0.01". A latency without a rate
+// delays every query. An empty spec returns nil.
+func ParseFaults(spec string) (*Faults, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	f := &Faults{}
+	for _, item := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q (want name=value)", item)
+		}
+		var err error
+		switch key {
+		case "latency":
+			delay, rate, hasRate := strings.Cut(value, ":")
+			if f.Latency, err = time.ParseDuration(delay); err != nil {
+				return nil, fmt.Errorf("invalid fault latency %q: %w", delay, err)
+			}
+			f.LatencyRate = 1
+			if hasRate {
+				f.LatencyRate, err = parseFaultRate(rate)
+			}
+		case "drop":
+			f.DropRate, err = parseFaultRate(value)
+		case "servfail":
+			f.ServFailRate, err = parseFaultRate(value)
+		default:
+			return nil, fmt.Errorf("unknown fault %q, expected latency, drop or servfail", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.DropRate+f.ServFailRate > 1 {
+		return nil, fmt.Errorf("drop and servfail rates add up to more than 1")
+	}
+	return f, nil
+}
+
+func parseFaultRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid fault rate %q, expected 0-1", s)
+	}
+	return rate, nil
+}
+
+// String formats f in the syntax ParseFaults accepts
+func (f *Faults) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	if f.Latency > 0 && f.LatencyRate > 0 {
+		parts = append(parts, fmt.Sprintf("latency=%s:%g", f.Latency, f.LatencyRate))
+	}
+	if f.DropRate > 0 {
+		parts = append(parts, fmt.Sprintf("drop=%g", f.DropRate))
+	}
+	if f.ServFailRate > 0 {
+		parts = append(parts, fmt.Sprintf("servfail=%g", f.ServFailRate))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SetFaults replaces the injected faults; nil stops injecting them
+func (h *Handler) SetFaults(f *Faults) {
+	h.update(func(st *handlerState) {
+		st.faults = f
+	})
+	if f != nil {
+		log.Warn().Msgf("Fault injection active: %s", f)
+	} else {
+		log.Info().Msg("Fault injection stopped")
+	}
+}
+
+// injectFault applies the configured faults to a query about to be
+// forwarded. A delay is waited out and forwarding goes on; otherwise handled
+// reports that the fault replaces forwarding, with a SERVFAIL response or
+// errFaultDrop.
+func (h *Handler) injectFault(ctx context.Context, st *handlerState, query []byte) (_ []byte, handled bool, err error) {
+	f := st.faults
+	if f == nil {
+		return nil, false, nil
+	}
+	if f.Latency > 0 && rand.Float64() < f.LatencyRate {
+		metrics.FaultsInjected.WithLabelValues("latency").Inc()
+		select {
+		case <-time.After(f.Latency):
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	switch r := rand.Float64(); {
+	case r < f.DropRate:
+		metrics.FaultsInjected.WithLabelValues("drop").Inc()
+		return nil, true, errFaultDrop
+	case r < f.DropRate+f.ServFailRate:
+		metrics.FaultsInjected.WithLabelValues("servfail").Inc()
+		return CreateServFailResponse(query), true, nil
+	}
+	return nil, false, nil
+}
+
+// FaultControl serves /api/faults, which reads (GET), replaces (PUT, with a
+// fault specification as the body) and clears (DELETE) the injected faults
+type FaultControl struct {
+	Handler *Handler
+}
+
+func (c *FaultControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := ParseFaults(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.Handler.SetFaults(f)
+	case http.MethodDelete:
+		c.Handler.SetFaults(nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, c.Handler.snapshot().faults)
+}
@@ -0,0 +1,7 @@
+//go:build !faultinject
+
+package dns
+
+// FaultInjectionBuilt reports whether this binary may inject faults; build
+// with -tags faultinject to enable it
+const FaultInjectionBuilt = false
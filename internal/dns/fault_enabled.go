@@ -0,0 +1,6 @@
+//go:build faultinject
+
+package dns
+
+// FaultInjectionBuilt reports whether this binary may inject faults
+const FaultInjectionBuilt = true
@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"context"
+	"math"
+	"strings"
+)
+
+// CNAMEFlattener collapses CNAME chains in A/AAAA answers into records owned
+// by the queried name, for clients that mishandle long chains.
+type CNAMEFlattener struct {
+	MaxDepth int
+}
+
+// NewCNAMEFlattener returns a flattener that follows at most maxDepth CNAMEs
+func NewCNAMEFlattener(maxDepth int) *CNAMEFlattener {
+	if maxDepth <= 0 {
+		maxDepth = 8
+	}
+	return &CNAMEFlattener{MaxDepth: maxDepth}
+}
+
+// flattenCNAMEs follows the CNAME chain of an A/AAAA response, querying the
+// upstream for links it did not include, and returns the final records under
+// the original name with the smallest TTL seen along the chain. Chains that
+// exceed the depth limit are returned untouched; loops yield SERVFAIL.
+func (h *Handler) flattenCNAMEs(ctx context.Context, st *handlerState, query, response []byte) []byte {
+	if h.CNAMEFlattener == nil {
+		return response
+	}
+
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 {
+		return response
+	}
+	question := q.Questions[0]
+	if question.Type != TypeA && question.Type != TypeAAAA {
+		return response
+	}
+
+	resp, err := ParseMessage(response)
+	if err != nil || resp.Rcode() != RcodeSuccess || !hasType(resp.Answers, TypeCNAME) {
+		return response
+	}
+
+	pool := resp.Answers
+	name := strings.ToLower(question.Name)
+	visited := map[string]bool{name: true}
+	ttl := uint32(math.MaxUint32)
+
+	for depth := 0; ; depth++ {
+		var finals []RR
+		var cname *RR
+		for i := range pool {
+			rr := &pool[i]
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			switch rr.Type {
+			case question.Type:
+				finals = append(finals, *rr)
+			case TypeCNAME:
+				cname = rr
+			}
+		}
+
+		if len(finals) > 0 {
+			for i := range finals {
+				finals[i].Name = question.Name
+				finals[i].TTL = min(finals[i].TTL, ttl)
+			}
+			resp.Answers = finals
+			resp.Authority = nil
+			if h.Verbose {
+				queryLog(ctx).Info().Msgf("Flattened %d-link CNAME chain for %s", depth, question.Name)
+			}
+			return resp.Pack()
+		}
+
+		if cname == nil {
+			if depth == 0 {
+				return response
+			}
+			// The upstream stopped at an intermediate name; resolve it ourselves
+			sub, err := h.exchange(ctx, st, BuildQuery(q.ID, name, question.Type))
+			if err != nil {
+				queryLog(ctx).Err(err).Msgf("CNAME flattening: failed to resolve %s", name)
+				return response
+			}
+			subMsg, err := ParseMessage(sub)
+			if err != nil || subMsg.Rcode() != RcodeSuccess || len(subMsg.Answers) == 0 {
+				return response
+			}
+			pool = append(pool, subMsg.Answers...)
+			continue
+		}
+
+		if depth >= h.CNAMEFlattener.MaxDepth {
+			queryLog(ctx).Warn().Msgf("CNAME chain for %s exceeds %d links, not flattening", question.Name, h.CNAMEFlattener.MaxDepth)
+			return response
+		}
+
+		target, err := ReadName(cname.Data)
+		if err != nil {
+			return response
+		}
+		target = strings.ToLower(target)
+		if visited[target] {
+			queryLog(ctx).Warn().Msgf("CNAME loop detected for %s at %s", question.Name, target)
+			resp.SetRcode(RcodeServFail)
+			resp.Answers = nil
+			resp.Authority = nil
+			return resp.Pack()
+		}
+		visited[target] = true
+		ttl = min(ttl, cname.TTL)
+		name = target
+	}
+}
+
+func hasType(rrs []RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Type == rrtype {
+			return true
+		}
+	}
+	return false
+}
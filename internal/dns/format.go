@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TypeName returns the mnemonic of a record type, or TYPEn for unknown ones
+func TypeName(t uint16) string {
+	switch t {
+	case TypeA:
+		return "A"
+	case TypeNS:
+		return "NS"
+	case TypeCNAME:
+		return "CNAME"
+	case TypeSOA:
+		return "SOA"
+	case TypePTR:
+		return "PTR"
+	case TypeMX:
+		return "MX"
+	case TypeTXT:
+		return "TXT"
+	case TypeAAAA:
+		return "AAAA"
+	case TypeSRV:
+		return "SRV"
+	case TypeOPT:
+		return "OPT"
+	case 10:
+		return "NULL"
+	case 13:
+		return "HINFO"
+	case 35:
+		return "NAPTR"
+	case TypeSVCB:
+		return "SVCB"
+	case TypeHTTPS:
+		return "HTTPS"
+	case 252:
+		return "AXFR"
+	case TypeANY:
+		return "ANY"
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ClassName returns the mnemonic of a record class, or CLASSn
+func ClassName(c uint16) string {
+	switch c {
+	case ClassINET:
+		return "IN"
+	case ClassCHAOS:
+		return "CH"
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// RcodeName returns the mnemonic of a response code, or RCODEn
+func RcodeName(rcode int) string {
+	switch rcode {
+	case RcodeSuccess:
+		return "NOERROR"
+	case 1:
+		return "FORMERR"
+	case RcodeServFail:
+		return "SERVFAIL"
+	case RcodeNXDomain:
+		return "NXDOMAIN"
+	case 4:
+		return "NOTIMP"
+	case RcodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// fqdn returns name with a trailing dot, "." for the root
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// String formats the record in zone file presentation format. RDATA of
+// types without a known layout, or that fails to decode, is printed in the
+// generic \# form of RFC 3597.
+func (rr RR) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(rr.Name), rr.TTL, ClassName(rr.Class), TypeName(rr.Type), rr.DataString())
+}
+
+// DataString formats the RDATA of the record
+func (rr RR) DataString() string {
+	d := rr.Data
+	switch rr.Type {
+	case TypeA:
+		if len(d) == net.IPv4len {
+			return net.IP(d).String()
+		}
+	case TypeAAAA:
+		if len(d) == net.IPv6len {
+			return net.IP(d).String()
+		}
+	case TypeCNAME, TypeNS, TypePTR:
+		if name, err := ReadName(d); err == nil {
+			return fqdn(name)
+		}
+	case TypeMX:
+		if len(d) > 2 {
+			if name, err := ReadName(d[2:]); err == nil {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(d), fqdn(name))
+			}
+		}
+	case TypeSRV:
+		if len(d) > 6 {
+			if name, err := ReadName(d[6:]); err == nil {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(d), binary.BigEndian.Uint16(d[2:]), binary.BigEndian.Uint16(d[4:]), fqdn(name))
+			}
+		}
+	case TypeSVCB, TypeHTTPS:
+		if s, ok := svcbString(d); ok {
+			return s
+		}
+	case TypeTXT:
+		var parts []string
+		for len(d) > 0 && 1+int(d[0]) <= len(d) {
+			parts = append(parts, strconv.Quote(string(d[1:1+int(d[0])])))
+			d = d[1+int(d[0]):]
+		}
+		if len(d) == 0 {
+			return strings.Join(parts, " ")
+		}
+		d = rr.Data
+	case TypeSOA:
+		mname, next, err := readName(d, 0)
+		if err != nil {
+			break
+		}
+		rname, next, err := readName(d, next)
+		if err != nil || len(d)-next != 20 {
+			break
+		}
+		f := d[next:]
+		return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(mname), fqdn(rname),
+			binary.BigEndian.Uint32(f), binary.BigEndian.Uint32(f[4:]), binary.BigEndian.Uint32(f[8:]),
+			binary.BigEndian.Uint32(f[12:]), binary.BigEndian.Uint32(f[16:]))
+	}
+	if len(d) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(d), hex.EncodeToString(d))
+}
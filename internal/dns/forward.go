@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// forwardUDP relays a client's UDP query to the upstream, over DoH when that
+// mode is enabled, or to the spill upstream when the primary one is at its
+// in-flight limit. Queries in a forwarding zone go to its server, and with a
+// recursive resolver configured the others are resolved by it instead. Failures are logged and counted here. The returned
+// protocol is the label to use for the rest of the query ("https" for DoH).
+func (h *Handler) forwardUDP(ctx context.Context, st *handlerState, query []byte, protocol string) (_ []byte, _ string, err error) {
+	query = h.clampPayload(query, "query")
+	if response, handled, err := h.injectFault(ctx, st, query); handled {
+		return response, protocol, err
+	}
+	if zone := st.findForwardZone(query); zone != nil {
+		response, err := h.forwardToZone(ctx, zone, "udp", query, protocol)
+		return response, protocol, err
+	}
+	if h.Recursor != nil {
+		response, err := h.resolveRecursive(ctx, query, protocol)
+		return response, protocol, err
+	}
+	clientProtocol := protocol
+	if st.httpsModeEnabled {
+		protocol = "https"
+	}
+	if err := h.upstreamAllowed(protocol); err != nil {
+		return nil, protocol, err
+	}
+	spill, release, err := h.acquireUpstream(st)
+	if err != nil {
+		return nil, protocol, err
+	}
+	defer release()
+
+	upstream := h.upstream(st)
+	if spill != "" {
+		// Spilled queries go to a different server; keep them out of the breaker
+		upstream, protocol = spill, clientProtocol
+	} else {
+		defer func() { h.recordUpstream(err) }()
+	}
+
+	// Check if HTTPS mode is enabled
+	if st.httpsModeEnabled && spill == "" {
+		// Use DNS-over-HTTPS
+		start := time.Now()
+		response, err := h.queryHTTPS(ctx, st, query, protocol)
+		countExchange(h.HTTPSUpstream, defaultZone, start, response, err)
+		if err != nil {
+			queryLog(ctx).Err(err).Msg("Failed to query via DNS-over-HTTPS:")
+			countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+			return nil, protocol, err
+		}
+		return response, protocol, nil
+	}
+
+	// Use regular UDP forwarding
+	send := counted(func(ctx context.Context, upstream string) ([]byte, error) {
+		query, addedOPT := h.tagQuery(ctx, query)
+		response, err := h.exchangeUDP(ctx, upstream, query, protocol)
+		if err != nil {
+			return nil, err
+		}
+		response = h.retryTruncated(ctx, upstream, query, response, protocol)
+		return h.untagResponse(response, addedOPT), nil
+	})
+	if spill == "" {
+		response, err := h.hedged(ctx, upstream, h.routing(send))
+		return response, protocol, err
+	}
+	response, err := send(ctx, upstream)
+	return response, protocol, err
+}
+
+// retryTruncated repeats a query over TCP to the same upstream when its UDP
+// response has the TC bit set, and returns the complete answer. When the
+// retry fails the truncated response is returned, leaving the retry to the
+// client.
+func (h *Handler) retryTruncated(ctx context.Context, upstream string, query, response []byte, protocol string) []byte {
+	if len(response) < headerLength || binary.BigEndian.Uint16(response[2:])&flagTC == 0 {
+		return response
+	}
+	full, err := h.exchangeTCP(ctx, upstream, query, protocol)
+	if err != nil {
+		metrics.TruncationRetries.WithLabelValues("error").Inc()
+		queryLog(ctx).Warn().Err(err).Msg("TCP retry of truncated response failed")
+		return response
+	}
+	metrics.TruncationRetries.WithLabelValues("success").Inc()
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Truncated response retried over TCP, %d bytes", len(full))
+	}
+	return full
+}
+
+// exchangeUDP sends query to upstream over UDP and returns the reply.
+// Failures are logged and counted here.
+func (h *Handler) exchangeUDP(ctx context.Context, upstream string, query []byte, protocol string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+
+	upstreamConn, err := h.dialUpstream(ctx, "udp", upstream)
+	if err != nil {
+		err = upstreamError(err)
+		queryLog(ctx).Err(err).Msg("Failed to connect to upstream DNS:")
+		countError(err, metrics.ErrorTypeUpstreamDial, protocol)
+		return nil, err
+	}
+	defer upstreamConn.Close()
+	stop := bindConn(ctx, upstreamConn)
+	defer stop()
+
+	buffer := make([]byte, h.udpBufferSize())
+	response, written, err := h.roundTripUDP(ctx, upstreamConn, upstream, query, buffer)
+	if !written {
+		err = upstreamError(err)
+		queryLog(ctx).Err(err).Msg("Failed to send query to upstream:")
+		countError(err, metrics.ErrorTypeUpstreamWrite, protocol)
+		return nil, err
+	}
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Forwarded query to %s", upstream)
+	}
+
+	if err != nil {
+		err = upstreamError(err)
+		queryLog(ctx).Err(err).Msg("Failed to read response from upstream:")
+		countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+		return nil, err
+	}
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Received %d bytes from upstream", len(response))
+	}
+	return response, nil
+}
+
+// roundTripUDP sends query over conn, a socket connected to upstream, and
+// reads the response into buffer. With CaseRandomization the question goes
+// out in random case, which the response must echo; with Cookies the query
+// carries a DNS cookie and is repeated once when the upstream answers
+// BADCOOKIE. written reports whether the query could be sent, telling send
+// and read errors apart.
+func (h *Handler) roundTripUDP(ctx context.Context, conn net.Conn, upstream string, query, buffer []byte) (_ []byte, written bool, _ error) {
+	base, randomized := query, false
+	if h.CaseRandomization {
+		base, randomized = randomizeCase(query)
+	}
+	sent, cookie := h.Cookies.attach(upstream, base)
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(sent); err != nil {
+			return nil, attempt > 0, err
+		}
+		n, err := readUDPResponse(ctx, conn, sent, buffer, randomized, cookie.required)
+		if err != nil {
+			h.Cookies.forget(upstream, cookie)
+			return nil, true, err
+		}
+		response, retry := h.Cookies.absorb(upstream, cookie, buffer[:n])
+		if retry && attempt == 0 {
+			if h.Verbose {
+				queryLog(ctx).Info().Msgf("Upstream %s asked for its new DNS cookie, sending the query again", upstream)
+			}
+			sent, cookie = h.Cookies.attach(upstream, base)
+			continue
+		}
+		if randomized {
+			response = restoreCase(response, query)
+		}
+		return response, true, nil
+	}
+}
+
+// forwardTCP relays a client's TCP query to the upstream, over DoH when that
+// mode is enabled, or to the server of its forwarding zone, or resolves it
+// with the recursive resolver. Failures are
+// logged and counted here.
+func (h *Handler) forwardTCP(ctx context.Context, st *handlerState, query []byte, protocol string) (_ []byte, err error) {
+	if response, handled, err := h.injectFault(ctx, st, query); handled {
+		return response, err
+	}
+	if zone := st.findForwardZone(query); zone != nil {
+		return h.forwardToZone(ctx, zone, "tcp", removeKeepalive(query, false), protocol)
+	}
+	if h.Recursor != nil {
+		return h.resolveRecursive(ctx, query, protocol)
+	}
+	if err := h.upstreamAllowed(protocol); err != nil {
+		return nil, err
+	}
+	spill, release, err := h.acquireUpstream(st)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	upstream := h.upstream(st)
+	if spill != "" {
+		// Spilled queries go to a different server; keep them out of the breaker
+		upstream = spill
+	} else {
+		defer func() { h.recordUpstream(err) }()
+	}
+
+	// The client's keepalive negotiation is hop-by-hop and not forwarded
+	query = removeKeepalive(query, false)
+
+	// Check if HTTPS mode is enabled
+	if st.httpsModeEnabled && spill == "" {
+		// Use DNS-over-HTTPS
+		start := time.Now()
+		response, err := h.queryHTTPS(ctx, st, query, protocol)
+		countExchange(h.HTTPSUpstream, defaultZone, start, response, err)
+		if err != nil {
+			queryLog(ctx).Err(err).Msg("Failed to query via DNS-over-HTTPS:")
+			countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+			return nil, err
+		}
+		return response, nil
+	}
+
+	// Use regular TCP forwarding
+	send := counted(func(ctx context.Context, upstream string) ([]byte, error) {
+		query, addedOPT := h.tagQuery(ctx, query)
+		response, err := h.exchangeTCP(ctx, upstream, query, protocol)
+		if err != nil {
+			return nil, err
+		}
+		return h.untagResponse(response, addedOPT), nil
+	})
+	if spill == "" {
+		return h.hedged(ctx, upstream, h.routing(send))
+	}
+	return send(ctx, upstream)
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// ForwardZone sends queries for names at or below Zone to a dedicated plain
+// DNS server instead of the upstream, for example a corporate zone only its
+// own name servers know
+type ForwardZone struct {
+	Zone     string
+	Upstream string // IP address and port
+}
+
+// ParseUpstreamAddr validates an upstream address sent by the controller.
+// Only IP addresses are accepted: resolving a host name would go through the
+// proxy itself.
+func ParseUpstreamAddr(addr string) (string, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("upstream %q is not an IP address and port", addr)
+	}
+	return ap.String(), nil
+}
+
+// UpdateForwardZones replaces the conditional forwarding zones
+func (h *Handler) UpdateForwardZones(zones []ForwardZone) {
+	sorted := make([]ForwardZone, len(zones))
+	for i, z := range zones {
+		sorted[i] = ForwardZone{Zone: canonicalName(z.Zone), Upstream: z.Upstream}
+	}
+	// Most specific zone first
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Zone) > len(sorted[j].Zone) })
+	var removed []string
+	h.update(func(st *handlerState) {
+		for _, z := range st.forwardZones {
+			if !slices.ContainsFunc(sorted, func(s ForwardZone) bool { return s.Zone == z.Zone }) {
+				removed = append(removed, z.Zone)
+			}
+		}
+		st.forwardZones = sorted
+	})
+	// Series of zones that are gone would otherwise be exported for good
+	for _, zone := range removed {
+		metrics.ForwardZoneQueries.DeleteLabelValues(zone)
+		metrics.UpstreamExchanges.DeletePartialMatch(prometheus.Labels{"zone": zone})
+		metrics.UpstreamExchangeDuration.DeletePartialMatch(prometheus.Labels{"zone": zone})
+	}
+	if h.Verbose {
+		log.Info().Msgf("Forward zones updated: %d zones", len(sorted))
+	}
+}
+
+// findForwardZone returns the most specific forwarding zone containing the
+// question name of query, nil when there is none
+func (st *handlerState) findForwardZone(query []byte) *ForwardZone {
+	if len(st.forwardZones) == 0 {
+		return nil
+	}
+	domain, _ := ParseQuery(query)
+	name := canonicalName(domain)
+	for i, z := range st.forwardZones {
+		if name == z.Zone || strings.HasSuffix(name, "."+z.Zone) {
+			return &st.forwardZones[i]
+		}
+	}
+	return nil
+}
+
+// forwardToZone relays query to the server of its forwarding zone over
+// network, the client's transport. Like spilled queries, these stay out of
+// the breaker, the in-flight limit and hedging, which concern the upstream.
+func (h *Handler) forwardToZone(ctx context.Context, zone *ForwardZone, network string, query []byte, protocol string) ([]byte, error) {
+	metrics.ForwardZoneQueries.WithLabelValues(zone.Zone).Inc()
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Forwarding query to %s for zone %s", zone.Upstream, zone.Zone)
+	}
+	query, addedOPT := h.tagQuery(ctx, query)
+	start := time.Now()
+	var response []byte
+	var err error
+	if network == "tcp" {
+		response, err = h.exchangeTCP(ctx, zone.Upstream, query, protocol)
+	} else {
+		response, err = h.exchangeUDP(ctx, zone.Upstream, query, protocol)
+		if err == nil {
+			response = h.retryTruncated(ctx, zone.Upstream, query, response, protocol)
+		}
+	}
+	countExchange(zone.Upstream, zone.Zone, start, response, err)
+	if err != nil {
+		return nil, err
+	}
+	return h.untagResponse(response, addedOPT), nil
+}
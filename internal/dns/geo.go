@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GeoRule acts on forwarded answers with an address the GeoIP databases
+// place in one of its countries or autonomous systems
+type GeoRule struct {
+	Text      string           // as logged and recorded, e.g. "geo:country=KP,IR asn=64500"
+	Countries []string         // ISO 3166-1 alpha-2 codes, upper case
+	ASNs      []uint32         // autonomous system numbers
+	Domains   *matcher.Matcher // names the rule applies to, nil for every name
+	Flag      bool             // log and count matches instead of blocking
+}
+
+// matches reports whether the rule covers an address located in country
+// and autonomous system asn
+func (r *GeoRule) matches(country string, asn uint32) bool {
+	return country != "" && slices.Contains(r.Countries, country) || asn != 0 && slices.Contains(r.ASNs, asn)
+}
+
+// UpdateGeoRules replaces the GeoIP response rules, which need GeoIP. No
+// rules remove them.
+func (h *Handler) UpdateGeoRules(rules []GeoRule) {
+	same := func(a, b GeoRule) bool { return a.Text == b.Text && a.Flag == b.Flag }
+	if slices.EqualFunc(h.snapshot().geoRules, rules, same) {
+		return
+	}
+	h.update(func(st *handlerState) {
+		st.geoRules = rules
+	})
+	if len(rules) > 0 {
+		log.Info().Msgf("GeoIP rules loaded: %d rules", len(rules))
+	} else {
+		log.Info().Msg("GeoIP rules cleared")
+	}
+}
+
+// inspectGeo applies the GeoIP rules to the addresses of a forwarded
+// answer: its A and AAAA records, wherever in a CNAME chain they sit, and
+// the address hints of its SVCB and HTTPS records. A match of a blocking
+// rule replaces the answer with the blocked response; flagging rules only
+// log and count their matches. It returns the response to send and the
+// blocking rule, "" when the answer stands. Critical names are not
+// blocked, and in dry-run mode a block is only logged.
+func (h *Handler) inspectGeo(ctx context.Context, st *handlerState, client net.Addr, domain, protocol string, query, response []byte) ([]byte, string) {
+	if h.GeoIP == nil || len(st.geoRules) == 0 {
+		return response, ""
+	}
+	var rules []*GeoRule
+	for i := range st.geoRules {
+		if r := &st.geoRules[i]; r.Domains == nil || h.match(r.Domains, domain).Matched {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return response, ""
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Answers) == 0 {
+		return response, ""
+	}
+	flagged := make(map[*GeoRule]bool)
+	for _, rr := range msg.Answers {
+		for _, addr := range answerAddresses(rr) {
+			loc := h.GeoIP.Lookup(addr)
+			if loc.IsZero() {
+				continue
+			}
+			for _, r := range rules {
+				if !r.matches(loc.Country, loc.ASN) {
+					continue
+				}
+				if r.Flag {
+					if !flagged[r] {
+						flagged[r] = true
+						queryLog(ctx).Warn().Msgf("Flagging %s - answer %s (%s) matches rule %q", domain, addr.Unmap(), loc, r.Text)
+						metrics.GeoIPMatches.WithLabelValues("flag", loc.Country).Inc()
+					}
+					continue
+				}
+				if !h.exemptCritical(domain, matcher.MatchResult{Matched: true, Rule: r.Text}).Matched {
+					return response, ""
+				}
+				if st.dryRun {
+					queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking %s - answer %s (%s) matches rule %q", domain, addr.Unmap(), loc, r.Text)
+					h.recordDryRun(client, domain, r.Text)
+					return response, ""
+				}
+				queryLog(ctx).Info().Msgf("Blocking %s - answer %s (%s) matches rule %q", domain, addr.Unmap(), loc, r.Text)
+				metrics.GeoIPMatches.WithLabelValues("block", loc.Country).Inc()
+				return h.blockedResponse(query, r.Text), r.Text
+			}
+		}
+	}
+	return response, ""
+}
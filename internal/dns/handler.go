@@ -1,43 +1,111 @@
 package dns
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"lktr/internal/doh"
+	"lktr/internal/geoip"
 	"lktr/internal/metrics"
+	"lktr/internal/spiffe"
 	"lktr/pkg/matcher"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	INVALID_QUERY_LENGTH_MSG = "QueryLenghtTooLongException"
-)
+// handlerState is an immutable snapshot of the handler's runtime configuration.
+// A published snapshot is never modified; writers build a copy and swap it in.
+type handlerState struct {
+	matcher          *matcher.Matcher
+	dryRun           bool
+	httpsModeEnabled bool
+	dohClient        *doh.DoHClient
+	policySets       []policySetEntry     // per-client matchers, most specific prefix first
+	namespaces       []namespaceEntry     // client namespaces for metric labels, most specific prefix first
+	faults           *Faults              // injected faults, nil when none
+	zones            []*Zone              // zones answered authoritatively
+	failOpen         bool                 // serve stale or fall back instead of SERVFAIL on upstream failure
+	canary           *canaryState         // blocklist being soaked, nil when none
+	policyApplied    bool                 // a blocklist has been received since startup
+	shadow           *shadowState         // candidate blocklist compared but not enforced, nil when none
+	upstream         string               // plain DNS upstream sent by the controller, "" for UpstreamDNS
+	forwardZones     []ForwardZone        // conditional forwarding, most specific zone first
+	blockResponse    string               // block response mode sent by the controller, "" for BlockResponseMode
+	blockedIPs       *matcher.IPMatcher   // ranges forwarded answers are blocked for, nil when none
+	typeRules        *matcher.TypeMatcher // query-type rules, nil when none
+	overrides        map[string]*Override // answers replacing the upstream's, by name
+	filterAAAA       *matcher.Matcher     // names given no IPv6 addresses, nil when none
+	threatFeeds      []threatFeed         // threat-intelligence rules by feed, in name order
+	geoRules         []GeoRule            // rules on the location of answer addresses, applied in order
+}
 
 type Handler struct {
 	UpstreamDNS           string
 	Verbose               bool
-	DryRun                bool
-	Matcher               *matcher.Matcher
-	HTTPSModeEnabled      bool
 	HTTPSUpstream         string
-	DoHClient             *doh.DoHClient
 	dnsMeshDohTimeout     int
 	tlsCACert             string
 	tlsInsecureSkipVerify bool
 	getTLSCertData        func() ([]byte, []byte, []byte) // function to get current TLS cert/key/CA data
-	mu                    sync.RWMutex
+	DNS64                 *DNS64                          // optional AAAA synthesis, nil when disabled
+	TTLClamp              *TTLClamp                       // optional bounds on the TTLs of upstream answers, nil when disabled
+	Rewriter              *Rewriter                       // optional query-name rewrites, nil when disabled
+	CNAMEFlattener        *CNAMEFlattener                 // optional CNAME chain flattening, nil when disabled
+	SearchDomains         []string                        // search suffixes stripped before matching
+	Breaker               *CircuitBreaker                 // optional upstream circuit breaker, nil when disabled
+	Canary                *CanaryRollout                  // optional canary rollout of new blocklists, nil when disabled
+	Limiter               *InflightLimiter                // optional per-upstream in-flight cap, nil when disabled
+	Tap                   *QueryTap                       // optional live query stream, nil when disabled
+	ClientStats           *ClientStats                    // optional per-client counters, nil when disabled
+	Critical              *matcher.Matcher                // names never blocked, nil when none
+	TCPIdleTimeout        time.Duration                   // how long client TCP connections are kept open between queries, 0 closes after one query
+	UpstreamPool          *TCPPool                        // optional reuse of upstream TCP connections, nil opens one per query
+	ScrubOptions          []uint16                        // EDNS option codes removed from responses
+	MaxUDPPayload         int                             // cap on the EDNS UDP payload size in forwarded queries and responses, 0 leaves it alone
+	UDPSize               int                             // largest UDP message accepted from and sent to clients, 512 to MaxEDNSUDPSize; 0 for 1232
+	LogMode               string                          // LogAll or LogBlocked
+	Sinkhole              *Sinkhole                       // optional sinkhole answers for blocked queries
+	BlockResponseMode     string                          // answer to blocked queries, "" for BlockSinkhole with a Sinkhole and BlockNXDomain otherwise
+	ExtendedError         *ExtendedError                  // optional Extended DNS Error on blocked responses, nil when disabled
+	AnswerFilter          *AnswerFilter                   // optional removal of answer records for blocked names, nil when disabled
+	InspectCNAMEs         bool                            // answer as blocked when the CNAME chain of a forwarded answer leads to a blocked name
+	InspectSVCB           bool                            // answer as blocked when an SVCB or HTTPS record of a forwarded answer targets a blocked name
+	StripECH              bool                            // remove the ech parameter from forwarded SVCB and HTTPS records
+	Recursor              *Resolver                       // optional built-in recursive resolver replacing the upstream, nil forwards
+	Hedge                 *Hedge                          // optional duplicate of slow queries to a second upstream, nil when disabled
+	Router                *Router                         // optional choice among several upstreams by their latency and errors, nil uses UpstreamDNS
+	SpecialUse            *SpecialUse                     // optional local answers for special-use domains, nil forwards them
+	Chaos                 *Chaos                          // optional local answers for CHAOS-class queries, nil forwards them
+	GeoIP                 *geoip.DB                       // optional GeoIP databases the geo rules need, nil ignores them
+	DryRunReport          *DryRunReport                   // optional summary of queries dry-run mode let through, nil when disabled
+	Mirror                *Mirror                         // optional copy of sampled traffic to a shadow target, nil when disabled
+	Capture               *Capture                        // optional admin-triggered pcap capture, nil when disabled
+	Hooks                 QueryHooks                      // optional custom logic run on every query, nil when disabled
+	SPIFFE                *spiffe.Source                  // optional source of the DoH client identity, nil for static certificates
+	Bootstrap             *net.Resolver                   // optional resolver of the DoH upstream's host name, nil for the system resolver
+	LoopGuard             *LoopGuard                      // optional detection of queries looping back from the upstream, nil when disabled
+	HappyEyeballs         *HappyEyeballs                  // optional dual-stack dialing of upstreams given by host name, nil dials addresses in turn
+	Padding               *Padding                        // EDNS padding of queries sent over DoH, nil sends them unpadded
+	QueryIDOption         uint16                          // EDNS option code carrying the query ID upstream, 0 to not send it
+	CaseRandomization     bool                            // randomize the case of question names sent to plain UDP upstreams, and drop answers not echoing it
+	Cookies               *CookieJar                      // optional DNS cookies on queries to plain UDP upstreams, nil when disabled
+	NamespaceLabels       *NamespaceLabels                // optional namespace labels on the query counters, nil when disabled
+	stale                 staleCache                      // last good answers, kept while fail-open
+	state                 atomic.Pointer[handlerState]
+	mu                    sync.Mutex // serializes writers; the query path only loads state
 }
 
 func NewHandler(upstreamDNS string, verbose bool, m *matcher.Matcher, httpsModeEnabled bool, httpsUpstream string, dnsMeshDohTimeout int, tlsCACert string, tlsClientCert string, tlsClientKey string, tlsInsecureSkipVerify bool, getTLSCertData func() ([]byte, []byte, []byte)) *Handler {
 	handler := &Handler{
 		UpstreamDNS:           upstreamDNS,
 		Verbose:               verbose,
-		Matcher:               m,
-		HTTPSModeEnabled:      httpsModeEnabled,
 		HTTPSUpstream:         httpsUpstream,
 		dnsMeshDohTimeout:     dnsMeshDohTimeout,
 		tlsCACert:             tlsCACert,
@@ -45,9 +113,14 @@ func NewHandler(upstreamDNS string, verbose bool, m *matcher.Matcher, httpsModeE
 		getTLSCertData:        getTLSCertData,
 	}
 
+	st := &handlerState{
+		matcher:          m,
+		httpsModeEnabled: httpsModeEnabled,
+	}
+
 	// Initialize DoH client if HTTPS mode is enabled
 	if httpsModeEnabled {
-		handler.initDoHClient(tlsClientCert, tlsClientKey)
+		st.dohClient = handler.newDoHClient(tlsClientCert, tlsClientKey)
 
 		if verbose {
 			log.Info().Msgf("DNS-over-HTTPS mode enabled with upstream: %s", httpsUpstream)
@@ -63,11 +136,13 @@ func NewHandler(upstreamDNS string, verbose bool, m *matcher.Matcher, httpsModeE
 		}
 	}
 
+	handler.state.Store(st)
+
 	return handler
 }
 
-// initDoHClient initializes or reinitializes the DoH client with current TLS configuration
-func (h *Handler) initDoHClient(tlsClientCert, tlsClientKey string) {
+// newDoHClient builds a DoH client from the current TLS configuration
+func (h *Handler) newDoHClient(tlsClientCert, tlsClientKey string) *doh.DoHClient {
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
@@ -81,6 +156,10 @@ func (h *Handler) initDoHClient(tlsClientCert, tlsClientKey string) {
 		ClientKeyPath:      tlsClientKey,
 		InsecureSkipVerify: h.tlsInsecureSkipVerify,
 	}
+	if h.SPIFFE != nil {
+		dohConfig.ConfigureTLS = h.SPIFFE.ConfigureClient
+	}
+	dohConfig.Resolver = h.Bootstrap
 
 	// Get in-memory TLS data if available
 	if h.getTLSCertData != nil {
@@ -94,97 +173,206 @@ func (h *Handler) initDoHClient(tlsClientCert, tlsClientKey string) {
 		}
 	}
 
-	h.DoHClient = doh.NewDoHClient(dohConfig)
+	return doh.NewDoHClient(dohConfig)
 }
 
-// UpdateTLSConfig updates the DoH client with new TLS certificate data
-func (h *Handler) UpdateTLSConfig() {
+// snapshot returns the current configuration snapshot without locking
+func (h *Handler) snapshot() *handlerState {
+	return h.state.Load()
+}
+
+// update publishes a modified copy of the current snapshot
+func (h *Handler) update(fn func(st *handlerState)) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if !h.HTTPSModeEnabled {
-		return
-	}
+	next := *h.state.Load()
+	fn(&next)
+	h.state.Store(&next)
+}
 
-	if h.Verbose {
-		log.Info().Msg("Updating DoH client with new TLS configuration")
-	}
+// UpdateTLSConfig updates the DoH client with new TLS certificate data
+func (h *Handler) UpdateTLSConfig() {
+	h.update(func(st *handlerState) {
+		if !st.httpsModeEnabled {
+			return
+		}
 
-	h.initDoHClient("", "")
+		if h.Verbose {
+			log.Info().Msg("Updating DoH client with new TLS configuration")
+		}
+
+		st.dohClient = h.newDoHClient("", "")
+	})
 }
 
 // SetHTTPSMode dynamically enables or disables HTTPS mode
 func (h *Handler) SetHTTPSMode(enabled bool) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.HTTPSModeEnabled = enabled
+	h.update(func(st *handlerState) {
+		st.httpsModeEnabled = enabled
 
-	if enabled {
-		// Initialize DoH client when enabling
-		if h.DoHClient == nil {
-			h.initDoHClient("", "")
-		}
-		if h.Verbose {
-			log.Info().Msg("DNS-over-HTTPS mode enabled")
-		}
-	} else {
-		if h.Verbose {
-			log.Info().Msg("DNS-over-HTTPS mode disabled")
+		if enabled {
+			// Initialize DoH client when enabling
+			if st.dohClient == nil {
+				st.dohClient = h.newDoHClient("", "")
+			}
+			if h.Verbose {
+				log.Info().Msg("DNS-over-HTTPS mode enabled")
+			}
+		} else {
+			if h.Verbose {
+				log.Info().Msg("DNS-over-HTTPS mode disabled")
+			}
 		}
-	}
+	})
 }
 
-// isHTTPSModeEnabled returns whether HTTPS mode is currently enabled (thread-safe)
-func (h *Handler) isHTTPSModeEnabled() bool {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.HTTPSModeEnabled
+// SetDryRun toggles dry-run mode, in which matched queries are logged but not blocked
+func (h *Handler) SetDryRun(dryRun bool) {
+	h.update(func(st *handlerState) {
+		st.dryRun = dryRun
+	})
 }
 
-func (h *Handler) UpdateMatcher(m *matcher.Matcher) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.Matcher = m
+// DryRun reports whether dry-run mode is active
+func (h *Handler) DryRun() bool {
+	return h.snapshot().dryRun
+}
+
+// Rules returns the number of blocking rules in the enforced default
+// blocklist, as counted by matcher.Len
+func (h *Handler) Rules() int {
+	return h.snapshot().matcher.Len()
+}
+
+// UpdateMatcher installs a new blocklist together with the dry-run switch of
+// its policy, so that no query sees one without the other. With canary
+// rollout enabled, every blocklist after the first is soaked on a share of
+// queries before it is enforced, while dryRun applies at once; a block-all
+// list (strict-mode fallback) always applies at once.
+func (h *Handler) UpdateMatcher(m *matcher.Matcher, dryRun bool) {
+	if st := h.snapshot(); h.Canary != nil && st.policyApplied && !m.MatchesAll() && !st.matcher.Equal(m) {
+		// Periodic fetches resend the same list; keep the soak running
+		if st.canary == nil || !st.canary.matcher.Equal(m) {
+			h.startCanary(m, dryRun)
+		} else {
+			h.SetDryRun(dryRun)
+		}
+		return
+	}
+
+	if h.DryRunReport != nil && !h.snapshot().matcher.Equal(m) {
+		h.DryRunReport.Reset()
+	}
+
+	cancelled := false
+	h.update(func(st *handlerState) {
+		st.matcher = m
+		st.dryRun = dryRun
+		st.policyApplied = true
+		cancelled = st.canary != nil
+		st.canary = nil
+	})
+	if cancelled {
+		metrics.CanaryActive.Set(0)
+	}
 	if h.Verbose {
 		log.Printf("Matcher updated successfully")
 	}
 }
 
-func (h *Handler) getMatcher() *matcher.Matcher {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.Matcher
+// HandleHTTPS sends a DNS query over HTTPS and returns the response
+func (h *Handler) HandleHTTPS(ctx context.Context, query []byte, protocol string) ([]byte, error) {
+	return h.queryHTTPS(ctx, h.snapshot(), query, protocol)
 }
 
-// HandleHTTPS sends a DNS query over HTTPS and returns the response
-func (h *Handler) HandleHTTPS(query []byte, protocol string) ([]byte, error) {
-	if h.DoHClient == nil {
+func (h *Handler) queryHTTPS(ctx context.Context, st *handlerState, query []byte, protocol string) ([]byte, error) {
+	if st.dohClient == nil {
 		return nil, errors.New("DoH client not initialized")
 	}
 
 	if h.Verbose {
-		log.Info().Msgf("[%s] Sending query via DNS-over-HTTPS to %s", protocol, h.HTTPSUpstream)
+		queryLog(ctx).Info().Msgf("[%s] Sending query via DNS-over-HTTPS to %s", protocol, h.HTTPSUpstream)
+	}
+
+	query, tagAddedOPT := h.tagQuery(ctx, query)
+	addedOPT := false
+	if h.Padding != nil {
+		query, addedOPT = h.Padding.pad(query)
 	}
 
 	// Send query via DoH
-	response, err := h.DoHClient.Query(query)
+	response, err := st.dohClient.QueryContext(ctx, query)
 	if err != nil {
-		log.Err(err).Msgf("Failed to query via DNS-over-HTTPS")
+		err = upstreamError(err)
+		queryLog(ctx).Err(err).Msgf("Failed to query via DNS-over-HTTPS")
 		return nil, err
 	}
+	if h.Padding != nil {
+		response = unpad(response, addedOPT)
+	}
+	response = h.untagResponse(response, tagAddedOPT)
 
 	if h.Verbose {
-		log.Info().Msgf("[%s] Received %d bytes from DoH server", protocol, len(response))
+		queryLog(ctx).Info().Msgf("[%s] Received %d bytes from DoH server", protocol, len(response))
 	}
 
 	return response, nil
 }
 
-func (h *Handler) HandleUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr, query []byte) {
+// Query log modes
+const (
+	LogAll     = "all"     // every query is logged on arrival
+	LogBlocked = "blocked" // only blocked and failed queries are logged
+)
+
+// logArrival writes the per-query log line as the query is received. In
+// LogBlocked mode the line is held back until the query turns out to be
+// blocked or failed, see logHeld.
+func (h *Handler) logArrival(ctx context.Context, tag string, client net.Addr, domain, qtype string) {
+	if domain != "" && h.LogMode != LogBlocked {
+		queryLog(ctx).Info().Msgf("[%s] %s -> %s (%s)\n", tag, client, domain, qtype)
+	}
+}
+
+// logHeld writes the per-query log line held back in LogBlocked mode
+func (h *Handler) logHeld(ctx context.Context, tag string, client net.Addr, domain, qtype string) {
+	if domain != "" && h.LogMode == LogBlocked {
+		queryLog(ctx).Info().Msgf("[%s] %s -> %s (%s)\n", tag, client, domain, qtype)
+	}
+}
+
+// processResponse applies the optional response transformations to an
+// upstream reply before it is returned to the client.
+func (h *Handler) processResponse(ctx context.Context, st *handlerState, query, response []byte, protocol string) []byte {
+	response = h.scrubOptions(response)
+	response = h.clampPayload(response, "response")
+	response = h.applyDNS64(ctx, st, query, response, protocol)
+	response = h.flattenCNAMEs(ctx, st, query, response)
+	response = h.stripECH(response)
+	response = h.dropAAAA(st, response)
+	response = h.clampTTLs(response)
+	return response
+}
+
+// UDPWriter sends a datagram back to a client. *net.UDPConn satisfies it;
+// the server may substitute a batching writer.
+type UDPWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// HandleUDP answers one query datagram. Upstream work for the query is
+// bounded by a deadline derived from ctx and stops when ctx is cancelled.
+func (h *Handler) HandleUDP(ctx context.Context, serverConn UDPWriter, clientAddr *net.UDPAddr, query []byte) {
 	start := time.Now()
+	serverConn = h.captureUDP(serverConn, clientAddr, query)
+	ctx, cancel := h.queryContext(ctx)
+	defer cancel()
 	protocol := "udp"
+	st := h.snapshot()
+	namespace := h.namespaceLabel(st, clientAddr)
 	// Increment total queries
-	metrics.QueriesTotal.WithLabelValues(protocol).Inc()
+	metrics.QueriesTotal.WithLabelValues(protocol, namespace).Inc()
 	domain, qtype := ParseQuery(query)
 	// Track parse errors (when domain is empty and query is long enough)
 	if domain == "" && len(query) >= 12 {
@@ -193,174 +381,257 @@ func (h *Handler) HandleUDP(serverConn *net.UDPConn, clientAddr *net.UDPAddr, qu
 		return
 	}
 
-	if domain != "" {
-		log.Info().Msgf("[UDP] %s -> %s (%s)\n", clientAddr, domain, qtype)
+	ctx = h.withQueryID(ctx, query)
+	h.logArrival(ctx, "UDP", clientAddr, domain, qtype)
+
+	if servfail, ok := h.refuseLoop(ctx, "udp", clientAddr, query, domain); ok {
+		if _, err := serverConn.WriteToUDP(servfail, clientAddr); err != nil {
+			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
+		}
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return
 	}
 
-	m := h.getMatcher()
-	if m != nil {
-		result := m.Match(domain)
+	clientDomain := domain
+	query, domain = h.rewriteQuery(query, domain)
+
+	m, policySet := st.matcherFor(clientAddr)
+	m, track := st.canaryFor(m, domain)
+	var rule string
+	if m != nil || h.Hooks != nil || st.typeRules != nil || len(st.threatFeeds) > 0 {
+		result := h.matchQuery(ctx, st, m, clientAddr, query, domain, qtype, protocol)
+		countCanaryVerdict(track, result.Matched)
+		h.compareShadow(st, policySet, domain, result)
 		if h.Verbose {
-			log.Info().Msgf("Domain: %s, Matched: %v", domain, result.Matched)
+			queryLog(ctx).Info().Msgf("Domain: %s, Matched: %v, Policy set: %q", domain, result.Matched, policySet)
 		}
 
 		if result.Matched {
+			rule = result.Rule
 
-			if !h.DryRun {
-
-				log.Info().Msgf("[UDP] Blocking %s - returning NXDOMAIN\n", domain)
+			if !st.dryRun {
+				h.logHeld(ctx, "UDP", clientAddr, clientDomain, qtype)
+				queryLog(ctx).Info().Msgf("[UDP] Blocking %s - returning NXDOMAIN\n", domain)
 
 				// Increment blocked counter
-				metrics.QueriesBlocked.WithLabelValues(protocol).Inc()
+				metrics.QueriesBlocked.WithLabelValues(protocol, namespace).Inc()
 
-				nxdomainResponse := CreateNXDomainResponse(query)
-				_, err := serverConn.WriteToUDP(nxdomainResponse, clientAddr)
+				blocked := restoreName(h.blockedAnswer(query, result), clientDomain, domain)
+				_, err := serverConn.WriteToUDP(blocked, clientAddr)
 				if err != nil {
-					log.Err(err).Msg("Failed to send NXDOMAIN response to client:")
+					queryLog(ctx).Err(err).Msg("Failed to send NXDOMAIN response to client:")
 					metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 				}
 
+				h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictBlocked, rule, policySet)
 				metrics.QueryDuration.WithLabelValues(protocol, "blocked").Observe(time.Since(start).Seconds())
 				return
 			} else {
-				log.Info().Msgf("DryRun Mode enabled not blocking [UDP] %s - returning NXDOMAIN\n", domain)
+				h.logHeld(ctx, "UDP", clientAddr, clientDomain, qtype)
+				queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking [UDP] %s - returning NXDOMAIN\n", domain)
+				h.recordDryRun(clientAddr, clientDomain, rule)
 			}
 		}
 	}
 
-	var responseBuffer []byte
-	var n int
-
-	// Check if HTTPS mode is enabled
-	if h.isHTTPSModeEnabled() {
-		// Use DNS-over-HTTPS
-		protocol = "https"
-		response, err := h.HandleHTTPS(query, protocol)
-		if err != nil {
-			log.Err(err).Msg("Failed to query via DNS-over-HTTPS:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamRead, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-		responseBuffer = response
-		n = len(response)
-	} else {
-		// Use regular UDP forwarding
-		upstreamAddr, err := net.ResolveUDPAddr("udp", h.UpstreamDNS)
-		if err != nil {
-			log.Err(err).Msg("Failed to resolve upstream DNS:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamDial, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-
-		upstreamConn, err := net.DialUDP("udp", nil, upstreamAddr)
-		if err != nil {
-			log.Err(err).Msg("Failed to connect to upstream DNS:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamDial, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-		defer upstreamConn.Close()
-
-		upstreamConn.SetDeadline(time.Now().Add(5 * time.Second))
-
-		_, err = upstreamConn.Write(query)
-		if err != nil {
-			log.Err(err).Msg("Failed to send query to upstream:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamWrite, protocol).Inc()
+	if local, ok := h.answerLocal(ctx, st, query); ok {
+		local = h.fitUDP(query, restoreName(local, clientDomain, domain))
+		if _, err := serverConn.WriteToUDP(local, clientAddr); err != nil {
+			queryLog(ctx).Err(err).Msg("Failed to send local zone response to client:")
+			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
 			return
 		}
+		metrics.QueriesAllowed.WithLabelValues(protocol, namespace).Inc()
+		h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictLocal, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "local").Observe(time.Since(start).Seconds())
+		return
+	}
 
-		if h.Verbose {
-			log.Info().Msgf("Forwarded query to %s", h.UpstreamDNS)
-		}
-
-		buffer := make([]byte, 512)
-		n, err = upstreamConn.Read(buffer)
-		if err != nil {
-			log.Err(err).Msg("Failed to read response from upstream:")
-
-			// Check if it's a timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamTimeout, protocol).Inc()
-			} else {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamRead, protocol).Inc()
+	responseBuffer, protocol, err := h.forwardUDP(ctx, st, query, protocol)
+	if errors.Is(err, errFaultDrop) {
+		// Leave the client to time out, as if the packet were lost
+		h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictFailed, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return
+	}
+	if err != nil {
+		h.logHeld(ctx, "UDP", clientAddr, clientDomain, qtype)
+		responseBuffer = h.upstreamFailed(ctx, st, query, domain, qtype, err, protocol)
+		h.mirrorExchange(query, responseBuffer)
+		if responseBuffer != nil {
+			if _, err := serverConn.WriteToUDP(restoreName(responseBuffer, clientDomain, domain), clientAddr); err != nil {
+				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 			}
-
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
 		}
-		responseBuffer = buffer
+		h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictFailed, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return
+	}
+	h.rememberResponse(st, domain, qtype, responseBuffer)
 
-		if h.Verbose {
-			log.Info().Msgf("Received %d bytes from upstream", n)
+	responseBuffer = h.processResponse(ctx, st, query, responseBuffer, protocol)
+	responseBuffer, blockedRule := h.inspectCNAMEs(ctx, st, m, clientAddr, domain, protocol, query, responseBuffer)
+	if blockedRule == "" {
+		responseBuffer, blockedRule = h.inspectServiceBindings(ctx, st, m, clientAddr, domain, protocol, query, responseBuffer)
+	}
+	if blockedRule == "" {
+		responseBuffer, blockedRule = h.inspectAddresses(ctx, st, clientAddr, domain, protocol, query, responseBuffer)
+	}
+	if blockedRule == "" {
+		responseBuffer, blockedRule = h.inspectGeo(ctx, st, clientAddr, domain, protocol, query, responseBuffer)
+	}
+	if blockedRule == "" {
+		responseBuffer = h.filterAnswers(st, m, query, responseBuffer)
+		var hookBlocked bool
+		responseBuffer, hookBlocked = h.hookResponse(ctx, st, clientAddr, domain, qtype, protocol, query, responseBuffer)
+		if hookBlocked {
+			blockedRule = hookRule
 		}
 	}
+	h.mirrorExchange(query, responseBuffer)
+	responseBuffer = h.fitUDP(query, restoreName(responseBuffer, clientDomain, domain))
 
-	_, err := serverConn.WriteToUDP(responseBuffer[:n], clientAddr)
+	_, err = serverConn.WriteToUDP(responseBuffer, clientAddr)
 	if err != nil {
-		log.Err(err).Msg("Failed to send response to client:")
+		queryLog(ctx).Err(err).Msg("Failed to send response to client:")
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
 		return
 	}
 
 	if h.Verbose {
-		log.Printf("Sent response to %s", clientAddr)
+		queryLog(ctx).Printf("Sent response to %s", clientAddr)
+	}
+
+	if blockedRule != "" {
+		metrics.QueriesBlocked.WithLabelValues(protocol, namespace).Inc()
+		h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictBlocked, blockedRule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "blocked").Observe(time.Since(start).Seconds())
+		return
 	}
 
 	// Successfully allowed and forwarded
-	metrics.QueriesAllowed.WithLabelValues(protocol).Inc()
+	metrics.QueriesAllowed.WithLabelValues(protocol, namespace).Inc()
+	h.recordQuery(ctx, clientAddr, clientDomain, qtype, protocol, VerdictAllowed, rule, policySet)
 	metrics.QueryDuration.WithLabelValues(protocol, "allowed").Observe(time.Since(start).Seconds())
 }
 
-func (h *Handler) HandleTCP(clientConn net.Conn) {
-	defer clientConn.Close()
+// HandleTCP serves a client connection. After the first query the connection
+// stays open for further queries until the client leaves it idle for
+// TCPIdleTimeout; clients sending edns-tcp-keepalive are told that timeout.
+// Queries are read as they arrive and answered concurrently, up to
+// maxTCPPipeline at a time, each answer written as soon as it is ready so
+// that a slow upstream answer does not hold up the others (RFC 7766). The
+// connection is not idle while answers are pending. Cancelling ctx aborts
+// the queries in progress and closes idle connections.
+func (h *Handler) HandleTCP(ctx context.Context, clientConn net.Conn) {
+	reader := bufio.NewReader(clientConn)
+	conn := &tcpClientConn{Conn: clientConn}
+	stop := context.AfterFunc(ctx, conn.abort)
+	defer stop()
+
+	slots := make(chan struct{}, maxTCPPipeline)
+	var pending sync.WaitGroup
+	defer func() {
+		// Answers in progress are still written before the connection closes
+		pending.Wait()
+		clientConn.Close()
+	}()
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for first := true; ; first = false {
+		if !first && !h.awaitTCPQuery(ctx, conn, reader, slots, &pending) {
+			return
+		}
+		st, query, start, ok := h.readTCPQuery(ctx, conn, reader)
+		if !ok {
+			return
+		}
+		slots <- struct{}{}
+		pending.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				pending.Done()
+			}()
+			if !h.serveTCPQuery(ctx, st, conn, query, start) {
+				conn.abort()
+			}
+		}()
+	}
+}
+
+// awaitTCPQuery waits for the client to start another query on a connection
+// and reports whether it did. The idle timeout only runs while no answer is
+// pending.
+func (h *Handler) awaitTCPQuery(ctx context.Context, conn *tcpClientConn, reader *bufio.Reader, slots chan struct{}, pending *sync.WaitGroup) bool {
+	if h.TCPIdleTimeout <= 0 {
+		return false
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(h.TCPIdleTimeout))
+		// Checked after the deadline is set so a concurrent abort cannot be overwritten
+		if ctx.Err() != nil || conn.aborted.Load() {
+			return false
+		}
+		_, err := reader.Peek(2)
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			return true
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) || len(slots) == 0 {
+			// Idle timeout or the client closed the connection
+			return false
+		}
+		pending.Wait()
+	}
+}
+
+// readTCPQuery reads one query from a client connection, reporting whether
+// there was one to answer
+func (h *Handler) readTCPQuery(ctx context.Context, clientConn *tcpClientConn, reader io.Reader) (*handlerState, []byte, time.Time, bool) {
 	start := time.Now()
 	protocol := "tcp"
-	var n int
+	st := h.snapshot()
+	namespace := h.namespaceLabel(st, clientConn.RemoteAddr())
 
 	// Increment total queries
-	metrics.QueriesTotal.WithLabelValues(protocol).Inc()
+	metrics.QueriesTotal.WithLabelValues(protocol, namespace).Inc()
 
-	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	lengthBuf := make([]byte, 2)
-	_, err := clientConn.Read(lengthBuf)
+	queryLen, err := readTCPLength(reader)
+	if err != nil && (ctx.Err() != nil || clientConn.aborted.Load()) {
+		// Shutting down, or closing after a failed answer, before the client sent anything
+		return nil, nil, start, false
+	}
 	if err != nil {
+		err = clientReadError(err)
 		log.Err(err).Msg("Failed to read TCP length prefix:")
-		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeParse, protocol).Inc()
+		countError(err, metrics.ErrorTypeParse, protocol)
 		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
-	}
-
-	queryLen := int(lengthBuf[0])<<8 | int(lengthBuf[1])
-	if queryLen > 65535 {
-		err = errors.New(INVALID_QUERY_LENGTH_MSG)
-		log.Err(err).Msgf("Invalid query length: %d", queryLen)
-		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeParse, protocol).Inc()
-		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
+		return nil, nil, start, false
 	}
 
-	query := make([]byte, queryLen)
-	n, err = clientConn.Read(query)
+	query, err := readTCPBody(reader, queryLen)
 	if err != nil {
+		err = clientReadError(err)
 		log.Err(err).Msg("Failed to read TCP query:")
-		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeParse, protocol).Inc()
+		countError(err, metrics.ErrorTypeParse, protocol)
 		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
+		return nil, nil, start, false
 	}
+	return st, query, start, true
+}
 
-	if n != queryLen {
-		err = errors.New(INVALID_QUERY_LENGTH_MSG)
-		log.Err(err).Msgf("Expected %d bytes but got %d", queryLen, n)
-		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeParse, protocol).Inc()
-		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
-	}
+// serveTCPQuery answers one query read at start, reporting whether the
+// connection can carry further ones
+func (h *Handler) serveTCPQuery(ctx context.Context, st *handlerState, clientConn net.Conn, query []byte, start time.Time) bool {
+	protocol := "tcp"
+	namespace := h.namespaceLabel(st, clientConn.RemoteAddr())
+	clientConn = h.captureTCP(clientConn, query)
+
+	ctx, cancel := h.queryContext(ctx)
+	defer cancel()
 
 	domain, qtype := ParseQuery(query)
 
@@ -368,166 +639,145 @@ func (h *Handler) HandleTCP(clientConn net.Conn) {
 	if domain == "" && len(query) >= 12 {
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeParse, protocol).Inc()
 		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
+		return false
 	}
 
-	if domain != "" {
-		log.Info().Msgf("[TCP] %s -> %s (%s)\n", clientConn.RemoteAddr(), domain, qtype)
+	ctx = h.withQueryID(ctx, query)
+	h.logArrival(ctx, "TCP", clientConn.RemoteAddr(), domain, qtype)
+
+	if servfail, ok := h.refuseLoop(ctx, "tcp", clientConn.RemoteAddr(), query, domain); ok {
+		writeTCPMessage(clientConn, servfail)
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return false
 	}
 
 	if h.Verbose {
-		log.Info().Msgf("Processing TCP query from %s", clientConn.RemoteAddr())
+		queryLog(ctx).Info().Msgf("Processing TCP query from %s", clientConn.RemoteAddr())
 	}
 
-	m := h.getMatcher()
-	if m != nil {
-		result := m.Match(domain)
+	_, keepalive := keepaliveOption(query)
+	keepalive = keepalive && h.TCPIdleTimeout > 0
+
+	clientDomain := domain
+	query, domain = h.rewriteQuery(query, domain)
+
+	m, policySet := st.matcherFor(clientConn.RemoteAddr())
+	m, track := st.canaryFor(m, domain)
+	var rule string
+	if m != nil || h.Hooks != nil || st.typeRules != nil || len(st.threatFeeds) > 0 {
+		result := h.matchQuery(ctx, st, m, clientConn.RemoteAddr(), query, domain, qtype, protocol)
+		countCanaryVerdict(track, result.Matched)
+		h.compareShadow(st, policySet, domain, result)
 		if h.Verbose {
-			log.Info().Msgf("Domain: %s, Matched: %v", domain, result.Matched)
+			queryLog(ctx).Info().Msgf("Domain: %s, Matched: %v, Policy set: %q", domain, result.Matched, policySet)
 		}
 
 		if result.Matched {
-			log.Info().Msgf("[TCP] Blocking %s - returning NXDOMAIN\n", domain)
+			rule = result.Rule
+			h.logHeld(ctx, "TCP", clientConn.RemoteAddr(), clientDomain, qtype)
 
-			// Increment blocked counter
-			metrics.QueriesBlocked.WithLabelValues(protocol).Inc()
+			if !st.dryRun {
+				queryLog(ctx).Info().Msgf("[TCP] Blocking %s - returning NXDOMAIN\n", domain)
 
-			nxdomainResponse := CreateNXDomainResponse(query)
-			responseLen := len(nxdomainResponse)
-			lengthPrefix := []byte{byte(responseLen >> 8), byte(responseLen & 0xFF)}
-			_, err := clientConn.Write(lengthPrefix)
-			if err != nil {
-				log.Err(err).Msg("Failed to send NXDOMAIN length to client:")
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
-				metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-				return
-			}
-			_, err = clientConn.Write(nxdomainResponse)
-			if err != nil {
-				log.Err(err).Msg("Failed to send NXDOMAIN response to client:")
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
-			}
-
-			metrics.QueryDuration.WithLabelValues(protocol, "blocked").Observe(time.Since(start).Seconds())
-			return
-		}
-	}
+				// Increment blocked counter
+				metrics.QueriesBlocked.WithLabelValues(protocol, namespace).Inc()
 
-	var response []byte
+				blocked := restoreName(h.blockedAnswer(query, result), clientDomain, domain)
+				if err := writeTCPMessage(clientConn, h.keepaliveReply(blocked, keepalive)); err != nil {
+					queryLog(ctx).Err(err).Msg("Failed to send NXDOMAIN response to client:")
+					metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
+					metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+					return false
+				}
 
-	// Check if HTTPS mode is enabled
-	if h.isHTTPSModeEnabled() {
-		// Use DNS-over-HTTPS
-		dohResponse, err := h.HandleHTTPS(query, protocol)
-		if err != nil {
-			log.Err(err).Msg("Failed to query via DNS-over-HTTPS:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamRead, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-		response = dohResponse
-		n = len(dohResponse)
-	} else {
-		// Use regular TCP forwarding
-		upstreamConn, err := net.DialTimeout("tcp", h.UpstreamDNS, 5*time.Second)
-		if err != nil {
-			log.Err(err).Msg("Failed to connect to upstream DNS via TCP:")
-
-			// Check if it's a timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamTimeout, protocol).Inc()
-			} else {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamDial, protocol).Inc()
+				h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictBlocked, rule, policySet)
+				metrics.QueryDuration.WithLabelValues(protocol, "blocked").Observe(time.Since(start).Seconds())
+				return true
 			}
-
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
+			queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking [TCP] %s - returning NXDOMAIN\n", domain)
+			h.recordDryRun(clientConn.RemoteAddr(), clientDomain, rule)
 		}
-		defer upstreamConn.Close()
-
-		upstreamConn.SetDeadline(time.Now().Add(5 * time.Second))
-
-		_, err = upstreamConn.Write(lengthBuf)
-		if err != nil {
-			log.Err(err).Msg("Failed to send length prefix to upstream:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamWrite, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-
-		_, err = upstreamConn.Write(query)
-		if err != nil {
-			log.Err(err).Msg("Failed to send query to upstream:")
-			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamWrite, protocol).Inc()
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
-		}
-
-		if h.Verbose {
-			log.Info().Msgf("Forwarded TCP query to %s", h.UpstreamDNS)
-		}
-
-		responseLengthBuf := make([]byte, 2)
-		_, err = upstreamConn.Read(responseLengthBuf)
-		if err != nil {
-			log.Err(err).Msg("Failed to read response length from upstream:")
-
-			// Check if it's a timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamTimeout, protocol).Inc()
-			} else {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamRead, protocol).Inc()
-			}
+	}
 
+	if local, ok := h.answerLocal(ctx, st, query); ok {
+		local = restoreName(local, clientDomain, domain)
+		if err := writeTCPMessage(clientConn, h.keepaliveReply(local, keepalive)); err != nil {
+			queryLog(ctx).Err(err).Msg("Failed to send local zone response to client:")
+			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
+			return false
 		}
+		metrics.QueriesAllowed.WithLabelValues(protocol, namespace).Inc()
+		h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictLocal, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "local").Observe(time.Since(start).Seconds())
+		return true
+	}
 
-		responseLen := int(responseLengthBuf[0])<<8 | int(responseLengthBuf[1])
-
-		response = make([]byte, responseLen)
-		n, err = upstreamConn.Read(response)
-		if err != nil {
-			log.Err(err).Msg("Failed to read response from upstream:")
-
-			// Check if it's a timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamTimeout, protocol).Inc()
-			} else {
-				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeUpstreamRead, protocol).Inc()
+	response, err := h.forwardTCP(ctx, st, query, protocol)
+	if errors.Is(err, errFaultDrop) {
+		// A stream cannot lose one message; closing it is the nearest thing
+		h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictFailed, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return false
+	}
+	if err != nil {
+		h.logHeld(ctx, "TCP", clientConn.RemoteAddr(), clientDomain, qtype)
+		response = h.upstreamFailed(ctx, st, query, domain, qtype, err, protocol)
+		h.mirrorExchange(query, response)
+		if response != nil {
+			if err := writeTCPMessage(clientConn, h.keepaliveReply(restoreName(response, clientDomain, domain), keepalive)); err != nil {
+				metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
+				metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+				return false
 			}
-
-			metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-			return
 		}
+		h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictFailed, rule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
+		return response != nil
+	}
+	h.rememberResponse(st, domain, qtype, response)
 
-		if h.Verbose {
-			log.Info().Msgf("Received %d bytes from upstream via TCP", n)
+	response = h.processResponse(ctx, st, query, response, protocol)
+	response, blockedRule := h.inspectCNAMEs(ctx, st, m, clientConn.RemoteAddr(), domain, protocol, query, response)
+	if blockedRule == "" {
+		response, blockedRule = h.inspectServiceBindings(ctx, st, m, clientConn.RemoteAddr(), domain, protocol, query, response)
+	}
+	if blockedRule == "" {
+		response, blockedRule = h.inspectAddresses(ctx, st, clientConn.RemoteAddr(), domain, protocol, query, response)
+	}
+	if blockedRule == "" {
+		response, blockedRule = h.inspectGeo(ctx, st, clientConn.RemoteAddr(), domain, protocol, query, response)
+	}
+	if blockedRule == "" {
+		response = h.filterAnswers(st, m, query, response)
+		var hookBlocked bool
+		response, hookBlocked = h.hookResponse(ctx, st, clientConn.RemoteAddr(), domain, qtype, protocol, query, response)
+		if hookBlocked {
+			blockedRule = hookRule
 		}
 	}
+	h.mirrorExchange(query, response)
+	response = restoreName(response, clientDomain, domain)
 
 	// Send response to client with TCP length prefix
-	responseLen := len(response[:n])
-	lengthPrefix := []byte{byte(responseLen >> 8), byte(responseLen & 0xFF)}
-	_, err = clientConn.Write(lengthPrefix)
-	if err != nil {
-		log.Err(err).Msg("Failed to send response length to client:")
+	if err := writeTCPMessage(clientConn, h.keepaliveReply(response, keepalive)); err != nil {
+		queryLog(ctx).Err(err).Msg("Failed to send response to client:")
 		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
 		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
-	}
-
-	_, err = clientConn.Write(response[:n])
-	if err != nil {
-		log.Err(err).Msg("Failed to send response to client:")
-		metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, protocol).Inc()
-		metrics.QueryDuration.WithLabelValues(protocol, "error").Observe(time.Since(start).Seconds())
-		return
+		return false
 	}
 
 	if h.Verbose {
-		log.Info().Msgf("Sent TCP response to %s", clientConn.RemoteAddr())
+		queryLog(ctx).Info().Msgf("Sent TCP response to %s", clientConn.RemoteAddr())
+	}
+	if blockedRule != "" {
+		metrics.QueriesBlocked.WithLabelValues(protocol, namespace).Inc()
+		h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictBlocked, blockedRule, policySet)
+		metrics.QueryDuration.WithLabelValues(protocol, "blocked").Observe(time.Since(start).Seconds())
+		return true
 	}
-	metrics.QueriesAllowed.WithLabelValues(protocol).Inc()
+	metrics.QueriesAllowed.WithLabelValues(protocol, namespace).Inc()
+	h.recordQuery(ctx, clientConn.RemoteAddr(), clientDomain, qtype, protocol, VerdictAllowed, rule, policySet)
 	metrics.QueryDuration.WithLabelValues(protocol, "allowed").Observe(time.Since(start).Seconds())
+	return true
 }
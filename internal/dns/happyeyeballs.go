@@ -0,0 +1,422 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// happyEyeballsMemory is how long the family that won a race keeps the head
+// start for its host, after which IPv6 is preferred again
+const happyEyeballsMemory = 10 * time.Minute
+
+// HappyEyeballs dials upstreams given by a host name with both A and AAAA
+// records over IPv6 and IPv4, as RFC 8305 describes, so that an IPv6 path
+// that is configured but broken costs a short delay instead of a timeout
+// per query. The preferred family, IPv6 unless IPv4 won the last race for
+// the host, gets a head start of Delay. Over TCP the other family is dialed
+// when the first has not connected by then; over UDP the query is sent over
+// both when the first has not answered, and the socket answering first is
+// kept for the rest of the exchange. Upstreams given by address are dialed
+// as they are.
+type HappyEyeballs struct {
+	Delay time.Duration
+
+	mu      sync.Mutex
+	winners map[string]familyWin // by host
+}
+
+type familyWin struct {
+	ipv4 bool
+	at   time.Time
+}
+
+// family is the addresses of one family of a host, with the port
+type family struct {
+	ipv4    bool
+	targets []string
+}
+
+func (f family) label() string {
+	if f.ipv4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// NewHappyEyeballs returns dual-stack dialing giving the preferred family a
+// head start of delay; RFC 8305 recommends 250ms
+func NewHappyEyeballs(delay time.Duration) *HappyEyeballs {
+	return &HappyEyeballs{Delay: delay, winners: make(map[string]familyWin)}
+}
+
+// dial connects to address over network. A nil HappyEyeballs dials every
+// address as usual.
+func (he *HappyEyeballs) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if he == nil || err != nil {
+		return dialSocket(ctx, network, address)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialSocket(ctx, network, address)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	primary, secondary := family{}, family{ipv4: true}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		target := net.JoinHostPort(addr.String(), port)
+		if addr.Is4() {
+			secondary.targets = append(secondary.targets, target)
+		} else {
+			primary.targets = append(primary.targets, target)
+		}
+	}
+	if he.prefersIPv4(host) {
+		primary, secondary = secondary, primary
+	}
+	if len(primary.targets) == 0 || len(secondary.targets) == 0 {
+		return dialSerial(ctx, network, append(primary.targets, secondary.targets...))
+	}
+	if network == "udp" {
+		return he.dialUDP(ctx, host, primary, secondary)
+	}
+	return he.dialTCP(ctx, host, primary, secondary)
+}
+
+// dialSerial dials targets in turn and returns the first connection
+func dialSerial(ctx context.Context, network string, targets []string) (net.Conn, error) {
+	var err error
+	for _, target := range targets {
+		var conn net.Conn
+		if conn, err = dialSocket(ctx, network, target); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (he *HappyEyeballs) prefersIPv4(host string) bool {
+	he.mu.Lock()
+	defer he.mu.Unlock()
+	w, ok := he.winners[host]
+	return ok && w.ipv4 && time.Since(w.at) < happyEyeballsMemory
+}
+
+// won records the family whose socket connected or answered first
+func (he *HappyEyeballs) won(host string, f family) {
+	metrics.HappyEyeballsWins.WithLabelValues(f.label()).Inc()
+	he.mu.Lock()
+	defer he.mu.Unlock()
+	he.winners[host] = familyWin{ipv4: f.ipv4, at: time.Now()}
+}
+
+// dialTCP races connections over both families, the secondary one starting
+// after the delay or as soon as the primary one failed
+func (he *HappyEyeballs) dialTCP(ctx context.Context, host string, primary, secondary family) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		f    family
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, 2)
+	start := func(f family) {
+		go func() {
+			conn, err := dialSerial(ctx, "tcp", f.targets)
+			results <- attempt{f, conn, err}
+		}()
+	}
+	start(primary)
+	timer := time.NewTimer(he.Delay)
+	defer timer.Stop()
+
+	started, failed := 1, 0
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if started == 1 {
+				start(secondary)
+				started++
+			}
+		case a := <-results:
+			if a.err == nil {
+				he.won(host, a.f)
+				if pending := started - failed - 1; pending > 0 {
+					// The other family may connect before noticing the cancellation
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return a.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			if failed++; failed < started {
+				continue
+			}
+			if started == 2 {
+				return nil, firstErr
+			}
+			start(secondary)
+			started++
+		}
+	}
+}
+
+// dialUDP opens a socket for each family; connecting a UDP socket sends
+// nothing, so only a missing route is noticed here
+func (he *HappyEyeballs) dialUDP(ctx context.Context, host string, primary, secondary family) (net.Conn, error) {
+	first, err := dialSerial(ctx, "udp", primary.targets)
+	if err != nil {
+		return dialSerial(ctx, "udp", secondary.targets)
+	}
+	second, err := dialSerial(ctx, "udp", secondary.targets)
+	if err != nil {
+		return first, nil
+	}
+	return &raceConn{
+		he:          he,
+		host:        host,
+		conns:       [2]net.Conn{first, second},
+		families:    [2]family{primary, secondary},
+		winner:      -1,
+		reads:       make(chan raceRead),
+		deadlineSet: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// raceConn is a UDP connection over two sockets, one per family. Datagrams
+// are written to the primary socket, and to the secondary one when nothing
+// was read within the delay; the first socket a datagram is read from is
+// then used alone.
+type raceConn struct {
+	he       *HappyEyeballs
+	host     string
+	conns    [2]net.Conn
+	families [2]family
+
+	mu       sync.Mutex
+	winner   int    // index of the socket that answered, -1 until one did
+	pending  []byte // last datagram not yet sent over the secondary socket
+	failed   [2]bool
+	deadline time.Time
+	timers   []*time.Timer
+
+	readers     sync.Once
+	reads       chan raceRead
+	deadlineSet chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+type raceRead struct {
+	i    int
+	data []byte
+	err  error
+}
+
+func (c *raceConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	winner := c.winner
+	c.mu.Unlock()
+	if winner >= 0 {
+		return c.conns[winner].Write(b)
+	}
+
+	c.mu.Lock()
+	c.pending = bytes.Clone(b)
+	c.mu.Unlock()
+	n, err := c.conns[0].Write(b)
+	if err != nil {
+		if err := c.sendSecondary(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	c.mu.Lock()
+	c.timers = append(c.timers, time.AfterFunc(c.he.Delay, func() { c.sendSecondary() }))
+	c.mu.Unlock()
+	return n, nil
+}
+
+// sendSecondary writes the pending datagram to the secondary socket unless
+// a socket answered meanwhile
+func (c *raceConn) sendSecondary() error {
+	c.mu.Lock()
+	datagram := c.pending
+	c.pending = nil
+	send := datagram != nil && c.winner < 0
+	c.mu.Unlock()
+	if !send {
+		return nil
+	}
+	_, err := c.conns[1].Write(datagram)
+	return err
+}
+
+func (c *raceConn) Read(b []byte) (int, error) {
+	c.readers.Do(func() {
+		for i := range c.conns {
+			go c.readLoop(i)
+		}
+	})
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		var r raceRead
+		select {
+		case r = <-c.reads:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.deadlineSet:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if r.data == nil && r.err == nil {
+			continue // the deadline changed
+		}
+		if n, ok, err := c.take(r, b); ok {
+			return n, err
+		}
+	}
+}
+
+// take returns what a socket read unless it is to be ignored: datagrams
+// from the other socket once one answered, and the failure of one socket
+// while the other may still answer
+func (c *raceConn) take(r raceRead, b []byte) (int, bool, error) {
+	c.mu.Lock()
+	if c.winner >= 0 && r.i != c.winner {
+		c.mu.Unlock()
+		return 0, false, nil
+	}
+	if r.err != nil {
+		c.failed[r.i] = true
+		done := c.winner >= 0 || c.failed[0] && c.failed[1]
+		c.mu.Unlock()
+		if !done && r.i == 0 {
+			// Refused over the primary socket; no need to wait for the delay
+			if err := c.sendSecondary(); err != nil {
+				return 0, true, err
+			}
+		}
+		return 0, done, r.err
+	}
+	first := c.winner < 0
+	if first {
+		c.winner = r.i
+		c.pending = nil
+	}
+	c.mu.Unlock()
+	if first {
+		c.conns[1-r.i].Close()
+		c.he.won(c.host, c.families[r.i])
+	}
+	return copy(b, r.data), true, nil
+}
+
+// readLoop passes the datagrams read from socket i on until it fails
+func (c *raceConn) readLoop(i int) {
+	for {
+		buffer := make([]byte, MaxEDNSUDPSize)
+		n, err := c.conns[i].Read(buffer)
+		select {
+		case c.reads <- raceRead{i: i, data: buffer[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *raceConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.winner >= 0 {
+		return c.conns[c.winner]
+	}
+	return c.conns[0]
+}
+
+// LocalAddr returns the address of the socket in use, the primary one
+// until a socket answered
+func (c *raceConn) LocalAddr() net.Addr { return c.current().LocalAddr() }
+
+// RemoteAddr returns the upstream address of the socket in use
+func (c *raceConn) RemoteAddr() net.Addr { return c.current().RemoteAddr() }
+
+// localAddrs returns the addresses of both sockets
+func (c *raceConn) localAddrs() []net.Addr {
+	return []net.Addr{c.conns[0].LocalAddr(), c.conns[1].LocalAddr()}
+}
+
+func (c *raceConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to Read alone: the sockets are read in the
+// background until the connection is closed
+func (c *raceConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadlineSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *raceConn) SetWriteDeadline(t time.Time) error {
+	c.conns[0].SetWriteDeadline(t)
+	return c.conns[1].SetWriteDeadline(t)
+}
+
+func (c *raceConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		for _, t := range c.timers {
+			t.Stop()
+		}
+		c.mu.Unlock()
+		inUse := c.current()
+		for _, conn := range c.conns {
+			if closeErr := conn.Close(); conn == inUse {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// Hedge sends a copy of a query to a second upstream when the primary one
+// has not answered within Delay, and uses whichever answer arrives first.
+// Setting Delay near the upstream's p95 latency trims the tail at the cost
+// of duplicating about one query in twenty.
+type Hedge struct {
+	Upstream string
+	Delay    time.Duration
+}
+
+// NewHedge validates the hedge upstream address and delay
+func NewHedge(upstream string, delay time.Duration) (*Hedge, error) {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return nil, fmt.Errorf("hedge upstream %q: %w", upstream, err)
+	}
+	if delay <= 0 {
+		return nil, fmt.Errorf("hedge delay must be positive")
+	}
+	return &Hedge{Upstream: upstream, Delay: delay}, nil
+}
+
+// hedged runs send against upstream and, when no answer has come back after
+// the hedge delay or the primary exchange failed, against the hedge upstream
+// as well. The first answer wins. The slower exchange is left to finish on
+// its own timeout rather than cancelled, so that a genuinely failing upstream
+// is still logged and counted; it no longer has a client waiting.
+func (h *Handler) hedged(ctx context.Context, upstream string, send func(ctx context.Context, upstream string) ([]byte, error)) ([]byte, error) {
+	if h.Hedge == nil {
+		return send(ctx, upstream)
+	}
+
+	type result struct {
+		response []byte
+		err      error
+		hedge    bool
+	}
+	results := make(chan result, 2)
+	background := context.WithoutCancel(ctx)
+	start := func(upstream string, hedge bool) {
+		go func() {
+			response, err := send(background, upstream)
+			results <- result{response, err, hedge}
+		}()
+	}
+
+	start(upstream, false)
+	timer := time.NewTimer(h.Hedge.Delay)
+	defer timer.Stop()
+
+	pending, hedging := 1, false
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, upstreamError(ctx.Err())
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if hedging {
+					winner := "primary"
+					if r.hedge {
+						winner = "hedge"
+					}
+					metrics.HedgedQueries.WithLabelValues(winner).Inc()
+				}
+				return r.response, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+		if !hedging {
+			hedging = true
+			pending++
+			if h.Verbose {
+				queryLog(ctx).Info().Msgf("No answer from %s yet, hedging to %s", upstream, h.Hedge.Upstream)
+			}
+			start(h.Hedge.Upstream, true)
+		}
+	}
+	metrics.HedgedQueries.WithLabelValues("failed").Inc()
+	return nil, firstErr
+}
@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"context"
+	"net"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+)
+
+// HookAction is a hook's decision about a query
+type HookAction int
+
+const (
+	HookContinue HookAction = iota // leave the verdict to the blocklist
+	HookAllow                      // answer the query even if the blocklist matches it
+	HookBlock                      // answer the query as blocked
+)
+
+// hookRule is the rule reported for queries blocked by a hook
+const hookRule = "hook"
+
+// String names the action as in dns_query_hooks_total
+func (a HookAction) String() string {
+	switch a {
+	case HookAllow:
+		return "allow"
+	case HookBlock:
+		return "block"
+	}
+	return "continue"
+}
+
+// HookQuery describes the query a hook is called for
+type HookQuery struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Client   string `json:"client"`
+	Protocol string `json:"protocol"`
+}
+
+// QueryHooks run custom logic on every query. PreMatch is called before the
+// blocklist is consulted and may decide the verdict itself; PreResponse is
+// called with the upstream's answer before it is sent to the client and may
+// block it. Both are called concurrently and must return quickly; a hook
+// that fails returns HookContinue. Blocks follow dry-run like blocklist
+// matches do.
+type QueryHooks interface {
+	PreMatch(ctx context.Context, q HookQuery) HookAction
+	PreResponse(ctx context.Context, q HookQuery, response []byte) HookAction
+}
+
+func hookQuery(client net.Addr, domain, qtype, protocol string) HookQuery {
+	q := HookQuery{Name: domain, Type: qtype, Protocol: protocol}
+	if ip := clientIP(client); ip.IsValid() {
+		q.Client = ip.String()
+	}
+	return q
+}
+
+// matchQuery returns the verdict for domain: the pre-match hook's when it
+// takes a decision, then that of the query-type rules when one blocks query,
+// otherwise the match against m, which may be nil when no blocklist applies
+func (h *Handler) matchQuery(ctx context.Context, st *handlerState, m *matcher.Matcher, client net.Addr, query []byte, domain, qtype, protocol string) matcher.MatchResult {
+	if h.Hooks != nil {
+		action := h.Hooks.PreMatch(ctx, hookQuery(client, domain, qtype, protocol))
+		metrics.QueryHooks.WithLabelValues("pre_match", action.String()).Inc()
+		switch action {
+		case HookBlock:
+			return matcher.MatchResult{Matched: true, Rule: hookRule}
+		case HookAllow:
+			return matcher.MatchResult{}
+		}
+	}
+	if result := h.matchType(st, domain, query); result.Matched {
+		return result
+	}
+	var result matcher.MatchResult
+	if m != nil {
+		result = h.match(m, domain)
+	}
+	// An exception of the blocklist, reported by its rule, spares the feeds too
+	if !result.Matched && result.Rule == "" {
+		result = h.matchThreatFeeds(st, domain)
+	}
+	return result
+}
+
+// hookResponse runs the pre-response hook on a forwarded query's answer. A
+// block replaces the answer with the blocked response, and reports true,
+// unless the handler is in dry-run.
+func (h *Handler) hookResponse(ctx context.Context, st *handlerState, client net.Addr, domain, qtype, protocol string, query, response []byte) ([]byte, bool) {
+	if h.Hooks == nil {
+		return response, false
+	}
+	action := h.Hooks.PreResponse(ctx, hookQuery(client, domain, qtype, protocol), response)
+	metrics.QueryHooks.WithLabelValues("pre_response", action.String()).Inc()
+	if action != HookBlock {
+		return response, false
+	}
+	if st.dryRun {
+		queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking %s - answer rejected by hook", domain)
+		h.recordDryRun(client, domain, hookRule)
+		return response, false
+	}
+	queryLog(ctx).Info().Msgf("Blocking %s - answer rejected by hook", domain)
+	return h.blockedResponse(query, hookRule), true
+}
+
+// ChainHooks combines hooks, which are called in order until one of them
+// decides something other than HookContinue
+func ChainHooks(hooks ...QueryHooks) QueryHooks {
+	if len(hooks) == 1 {
+		return hooks[0]
+	}
+	return hookChain(hooks)
+}
+
+type hookChain []QueryHooks
+
+func (c hookChain) PreMatch(ctx context.Context, q HookQuery) HookAction {
+	for _, hooks := range c {
+		if action := hooks.PreMatch(ctx, q); action != HookContinue {
+			return action
+		}
+	}
+	return HookContinue
+}
+
+func (c hookChain) PreResponse(ctx context.Context, q HookQuery, response []byte) HookAction {
+	for _, hooks := range c {
+		if action := hooks.PreResponse(ctx, q, response); action != HookContinue {
+			return action
+		}
+	}
+	return HookContinue
+}
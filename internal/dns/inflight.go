@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"errors"
+	"sync"
+
+	"lktr/internal/metrics"
+)
+
+var errUpstreamBusy = errors.New("upstream in-flight limit reached")
+
+// InflightLimiter caps the number of queries outstanding at each upstream so
+// a slow resolver cannot pile up goroutines and sockets. Queries over the cap
+// spill to the Spill upstream when one is configured, or fail fast.
+type InflightLimiter struct {
+	Max   int    // maximum outstanding queries per upstream
+	Spill string // optional plain DNS upstream taking the excess
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// NewInflightLimiter returns a limiter allowing max outstanding queries per upstream
+func NewInflightLimiter(max int, spill string) *InflightLimiter {
+	return &InflightLimiter{Max: max, Spill: spill, slots: make(map[string]chan struct{})}
+}
+
+// tryAcquire reserves a slot for upstream without waiting
+func (l *InflightLimiter) tryAcquire(upstream string) bool {
+	l.mu.Lock()
+	slots, ok := l.slots[upstream]
+	if !ok {
+		slots = make(chan struct{}, l.Max)
+		l.slots[upstream] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		metrics.UpstreamInflight.WithLabelValues(upstream).Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *InflightLimiter) release(upstream string) {
+	l.mu.Lock()
+	slots := l.slots[upstream]
+	l.mu.Unlock()
+	<-slots
+	metrics.UpstreamInflight.WithLabelValues(upstream).Dec()
+}
+
+// acquireUpstream reserves an in-flight slot for a forwarded query. When the
+// primary upstream is full the query may spill, in which case the plain DNS
+// address to use instead is returned. release must be called once the
+// exchange is over.
+func (h *Handler) acquireUpstream(st *handlerState) (spill string, release func(), err error) {
+	l := h.Limiter
+	if l == nil {
+		return "", func() {}, nil
+	}
+
+	primary := h.upstream(st)
+	if st.httpsModeEnabled {
+		primary = h.HTTPSUpstream
+	}
+	if l.tryAcquire(primary) {
+		return "", func() { l.release(primary) }, nil
+	}
+	metrics.UpstreamInflightRejected.WithLabelValues(primary).Inc()
+
+	if l.Spill != "" && l.Spill != primary && l.tryAcquire(l.Spill) {
+		metrics.UpstreamSpilled.Inc()
+		return l.Spill, func() { l.release(l.Spill) }, nil
+	}
+	return "", nil, errUpstreamBusy
+}
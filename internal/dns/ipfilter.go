@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpdateBlockedCIDRs replaces the address ranges that forwarded answers are
+// blocked for, such as known command-and-control networks. A nil matcher
+// stops the inspection.
+func (h *Handler) UpdateBlockedCIDRs(m *matcher.IPMatcher) {
+	if m != nil && m.Len() == 0 {
+		m = nil
+	}
+	if st := h.snapshot(); (st.blockedIPs == nil && m == nil) || (st.blockedIPs != nil && m != nil && st.blockedIPs.Equal(m)) {
+		return
+	}
+	h.update(func(st *handlerState) {
+		st.blockedIPs = m
+	})
+	if m != nil {
+		log.Info().Msgf("Blocked CIDRs loaded: %d ranges", m.Len())
+	} else {
+		log.Info().Msg("Blocked CIDRs cleared")
+	}
+}
+
+// inspectAddresses replaces a forwarded answer with the blocked response
+// when one of its A or AAAA records, or an address hint of its SVCB or
+// HTTPS records, falls in a blocked CIDR, wherever in a CNAME chain the
+// record sits. It returns the response to send and the
+// matching range, "" when the answer stands. Critical names are exempt, and
+// in dry-run mode a match is only logged.
+func (h *Handler) inspectAddresses(ctx context.Context, st *handlerState, client net.Addr, domain, protocol string, query, response []byte) ([]byte, string) {
+	if st.blockedIPs == nil {
+		return response, ""
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Answers) == 0 {
+		return response, ""
+	}
+	for _, rr := range msg.Answers {
+		for _, addr := range answerAddresses(rr) {
+			result := h.exemptCritical(domain, st.blockedIPs.MatchIP(addr))
+			if !result.Matched {
+				continue
+			}
+			if st.dryRun {
+				queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking %s - answer %s is in blocked range %s", domain, addr.Unmap(), result.Rule)
+				h.recordDryRun(client, domain, result.Rule)
+				return response, ""
+			}
+			queryLog(ctx).Info().Msgf("Blocking %s - answer %s is in blocked range %s", domain, addr.Unmap(), result.Rule)
+			metrics.ResponseIPBlocked.WithLabelValues(protocol).Inc()
+			return h.blockedResponse(query, result.Rule), result.Rule
+		}
+	}
+	return response, ""
+}
+
+// answerAddresses returns the addresses an answer record gives: those of A
+// and AAAA records, and the address hints of SVCB and HTTPS records
+func answerAddresses(rr RR) []netip.Addr {
+	switch rr.Type {
+	case TypeA, TypeAAAA:
+		if addr, ok := netip.AddrFromSlice(rr.Data); ok {
+			return []netip.Addr{addr}
+		}
+	case TypeSVCB, TypeHTTPS:
+		return serviceHints(rr)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+// optionTCPKeepalive is the EDNS edns-tcp-keepalive option code (RFC 7828)
+const optionTCPKeepalive = 11
+
+// keepaliveUnit is the resolution of the edns-tcp-keepalive TIMEOUT field
+const keepaliveUnit = 100 * time.Millisecond
+
+// defaultUDPPayload is the payload size advertised in OPT records added by the proxy
+const defaultUDPPayload = 1232
+
+// findOPT returns the index of the OPT record in the additional section, or -1
+func findOPT(m *Message) int {
+	for i, rr := range m.Additional {
+		if rr.Type == TypeOPT {
+			return i
+		}
+	}
+	return -1
+}
+
+// keepaliveOption reports whether msg carries an edns-tcp-keepalive option
+// and the idle timeout it announces (0 when the option has no TIMEOUT field)
+func keepaliveOption(msg []byte) (time.Duration, bool) {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return 0, false
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return 0, false
+	}
+	data, ok := findOption(m.Additional[i].Data, optionTCPKeepalive)
+	if !ok {
+		return 0, false
+	}
+	if len(data) < 2 {
+		return 0, true
+	}
+	return time.Duration(binary.BigEndian.Uint16(data)) * keepaliveUnit, true
+}
+
+// setKeepalive returns msg carrying an edns-tcp-keepalive option with the
+// given timeout, or without a TIMEOUT field when timeout is negative (the form
+// used in queries). An OPT record is added when msg has none; addedOPT reports
+// that, so the caller can remove it again from the matching response.
+func setKeepalive(msg []byte, timeout time.Duration) (_ []byte, addedOPT bool) {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return msg, false
+	}
+
+	var data []byte
+	if timeout >= 0 {
+		data = binary.BigEndian.AppendUint16(nil, uint16(min(timeout/keepaliveUnit, 0xFFFF)))
+	}
+	option := binary.BigEndian.AppendUint16(nil, optionTCPKeepalive)
+	option = binary.BigEndian.AppendUint16(option, uint16(len(data)))
+	option = append(option, data...)
+
+	i := findOPT(m)
+	if i < 0 {
+		m.Additional = append(m.Additional, RR{Type: TypeOPT, Class: defaultUDPPayload})
+		i = len(m.Additional) - 1
+		addedOPT = true
+	}
+	opt := &m.Additional[i]
+	opt.Data = append(withoutOption(opt.Data, optionTCPKeepalive), option...)
+	return m.Pack(), addedOPT
+}
+
+// removeKeepalive returns msg without an edns-tcp-keepalive option, and
+// without its OPT record when dropOPT is set. msg is returned unchanged when
+// there is nothing to remove.
+func removeKeepalive(msg []byte, dropOPT bool) []byte {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return msg
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return msg
+	}
+	if dropOPT {
+		m.Additional = append(m.Additional[:i], m.Additional[i+1:]...)
+		return m.Pack()
+	}
+	if _, ok := findOption(m.Additional[i].Data, optionTCPKeepalive); !ok {
+		return msg
+	}
+	m.Additional[i].Data = withoutOption(m.Additional[i].Data, optionTCPKeepalive)
+	return m.Pack()
+}
+
+// findOption returns the data of the first EDNS option with the given code
+func findOption(rdata []byte, code uint16) ([]byte, bool) {
+	for len(rdata) >= 4 {
+		length := int(binary.BigEndian.Uint16(rdata[2:]))
+		if 4+length > len(rdata) {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(rdata) == code {
+			return rdata[4 : 4+length], true
+		}
+		rdata = rdata[4+length:]
+	}
+	return nil, false
+}
+
+// withoutOption returns a copy of OPT RDATA with every option of the given codes removed
+func withoutOption(rdata []byte, codes ...uint16) []byte {
+	out := make([]byte, 0, len(rdata))
+	for len(rdata) >= 4 {
+		length := int(binary.BigEndian.Uint16(rdata[2:]))
+		if 4+length > len(rdata) {
+			break
+		}
+		if !slices.Contains(codes, binary.BigEndian.Uint16(rdata)) {
+			out = append(out, rdata[:4+length]...)
+		}
+		rdata = rdata[4+length:]
+	}
+	return out
+}
+
+// keepaliveReply answers a client's edns-tcp-keepalive option with the idle
+// timeout, and otherwise makes sure the response carries none
+func (h *Handler) keepaliveReply(response []byte, requested bool) []byte {
+	if requested {
+		response, _ = setKeepalive(response, h.TCPIdleTimeout)
+		return response
+	}
+	return removeKeepalive(response, false)
+}
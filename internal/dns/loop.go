@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// LoopGuard recognizes queries the proxy sent upstream arriving back at its
+// own listener, as happens when the upstream is the proxy itself or when an
+// interception rule redirects the proxy's outgoing DNS traffic to it. Every
+// upstream socket is tracked while open; a query whose source is one of
+// them is a loop and is answered with SERVFAIL, which ends it on the first
+// round trip instead of chaining until every forward times out.
+type LoopGuard struct {
+	mu    sync.Mutex
+	conns map[string]int // open upstream sockets by network and local address
+}
+
+func NewLoopGuard() *LoopGuard {
+	return &LoopGuard{conns: make(map[string]int)}
+}
+
+func loopKey(network string, addr net.Addr) string {
+	return network + " " + addr.String()
+}
+
+// track follows the sockets of an upstream connection until it is closed.
+// A nil guard returns conn as it is.
+func (g *LoopGuard) track(network string, conn net.Conn) net.Conn {
+	if g == nil {
+		return conn
+	}
+	addrs := []net.Addr{conn.LocalAddr()}
+	if multi, ok := conn.(interface{ localAddrs() []net.Addr }); ok {
+		addrs = multi.localAddrs()
+	}
+	keys := make([]string, len(addrs))
+	g.mu.Lock()
+	for i, addr := range addrs {
+		keys[i] = loopKey(network, addr)
+		g.conns[keys[i]]++
+	}
+	g.mu.Unlock()
+	return &trackedConn{Conn: conn, guard: g, keys: keys}
+}
+
+func (g *LoopGuard) forget(keys []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		if g.conns[key]--; g.conns[key] <= 0 {
+			delete(g.conns, key)
+		}
+	}
+}
+
+// looped reports whether a query from client came from one of the proxy's
+// own upstream sockets
+func (g *LoopGuard) looped(network string, client net.Addr) bool {
+	if g == nil || client == nil {
+		return false
+	}
+	key := loopKey(network, client)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.conns[key] > 0
+}
+
+// trackedConn stops tracking its socket on Close
+type trackedConn struct {
+	net.Conn
+	guard *LoopGuard
+	keys  []string
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.guard.forget(c.keys) })
+	return c.Conn.Close()
+}
+
+// ReadFrom reads a datagram and its source from a UDP socket
+func (c *trackedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if pc, ok := c.Conn.(net.PacketConn); ok {
+		return pc.ReadFrom(b)
+	}
+	n, err := c.Conn.Read(b)
+	return n, c.Conn.RemoteAddr(), err
+}
+
+// refuseLoop answers a query that came back from the proxy's own upstream
+// socket with SERVFAIL. The second result is false for any other query.
+func (h *Handler) refuseLoop(ctx context.Context, network string, client net.Addr, query []byte, domain string) ([]byte, bool) {
+	if !h.LoopGuard.looped(network, client) {
+		return nil, false
+	}
+	queryLog(ctx).Error().Msgf("DNS loop: query for %s came back from this proxy's own upstream socket %s; the upstream %s, or a rule redirecting traffic to it, points back at the proxy", domain, client, h.upstream(h.snapshot()))
+	metrics.DNSLoops.Inc()
+	return CreateServFailResponse(query), true
+}
+
+// CheckLoop returns an error when one of the upstream addresses is the
+// proxy's own listen address, so that every forwarded query would come
+// straight back. Upstreams given by host name are resolved; empty entries
+// are skipped.
+func CheckLoop(listen string, upstreams ...string) error {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil
+	}
+	listenIP, _ := netip.ParseAddr(listenHost)
+	local := localAddrs()
+
+	for _, upstream := range upstreams {
+		host, port, err := net.SplitHostPort(upstream)
+		if err != nil || port != listenPort {
+			continue
+		}
+		addrs, err := lookupAddrs(host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			addr = addr.Unmap()
+			self := addr == listenIP.Unmap()
+			if !listenIP.IsValid() || listenIP.IsUnspecified() {
+				self = self || addr.IsLoopback() || addr.IsUnspecified() || local[addr]
+			}
+			if self {
+				return fmt.Errorf("upstream %s is this proxy's own listen address %s", upstream, net.JoinHostPort(listenHost, listenPort))
+			}
+		}
+	}
+	return nil
+}
+
+// lookupAddrs resolves host unless it is an address. The lookup is bounded
+// because at startup the resolver may be this proxy, not yet listening.
+func lookupAddrs(host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// localAddrs returns the addresses of this host's interfaces
+func localAddrs() map[netip.Addr]bool {
+	local := make(map[netip.Addr]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return local
+	}
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			local[prefix.Addr().Unmap()] = true
+		}
+	}
+	return local
+}
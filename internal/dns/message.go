@@ -0,0 +1,345 @@
+package dns
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Record types referenced by the handler
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+	TypeANY   uint16 = 255
+
+	ClassINET  uint16 = 1
+	ClassCHAOS uint16 = 3
+)
+
+// Response codes
+const (
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeRefused  = 5
+)
+
+// Header flag bits
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+	flagCD = 1 << 4
+)
+
+const (
+	maxNameLength   = 255
+	maxPointerHops  = 32
+	headerLength    = 12
+	compressionMask = 0xC0
+)
+
+var (
+	errShortMessage = malformed("message too short")
+	errBadName      = malformed("bad domain name")
+	errBadPointer   = malformed("invalid compression pointer")
+)
+
+// Question is a single entry of the question section
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record. Domain names embedded in the RDATA of well-known
+// types are decompressed while parsing, so Data can be re-encoded verbatim.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a decoded DNS message
+type Message struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []Question
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+}
+
+// Rcode returns the response code carried in the header
+func (m *Message) Rcode() int {
+	return int(m.Flags & 0x0F)
+}
+
+// SetRcode replaces the response code carried in the header
+func (m *Message) SetRcode(rcode int) {
+	m.Flags = m.Flags&^0x0F | uint16(rcode&0x0F)
+}
+
+// Truncated reports whether the TC bit is set
+func (m *Message) Truncated() bool {
+	return m.Flags&flagTC != 0
+}
+
+// ParseMessage decodes a wire-format DNS message
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < headerLength {
+		return nil, errShortMessage
+	}
+
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+	nscount := int(binary.BigEndian.Uint16(b[8:]))
+	arcount := int(binary.BigEndian.Uint16(b[10:]))
+
+	off := headerLength
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errShortMessage
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+
+	var err error
+	if m.Answers, off, err = readRRs(b, off, ancount); err != nil {
+		return nil, err
+	}
+	if m.Authority, off, err = readRRs(b, off, nscount); err != nil {
+		return nil, err
+	}
+	if m.Additional, _, err = readRRs(b, off, arcount); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func readRRs(b []byte, off, count int) ([]RR, int, error) {
+	var rrs []RR
+	for i := 0; i < count; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next+10 > len(b) {
+			return nil, 0, errShortMessage
+		}
+		rr := RR{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+			TTL:   binary.BigEndian.Uint32(b[next+4:]),
+		}
+		rdlength := int(binary.BigEndian.Uint16(b[next+8:]))
+		start := next + 10
+		if start+rdlength > len(b) {
+			return nil, 0, errShortMessage
+		}
+		rr.Data, err = readRData(b, rr.Type, start, rdlength)
+		if err != nil {
+			return nil, 0, err
+		}
+		rrs = append(rrs, rr)
+		off = start + rdlength
+	}
+	return rrs, off, nil
+}
+
+// readRData copies RDATA, expanding compressed names for types that may carry them
+func readRData(b []byte, rrtype uint16, start, length int) ([]byte, error) {
+	end := start + length
+	raw := b[start:end]
+
+	switch rrtype {
+	case TypeCNAME, TypeNS, TypePTR:
+		name, _, err := readName(b[:end], start)
+		if err != nil {
+			return nil, err
+		}
+		return appendName(nil, name), nil
+	case TypeMX:
+		if length < 3 {
+			return nil, errShortMessage
+		}
+		name, _, err := readName(b[:end], start+2)
+		if err != nil {
+			return nil, err
+		}
+		return appendName(append([]byte{}, raw[:2]...), name), nil
+	case TypeSOA:
+		mname, next, err := readName(b[:end], start)
+		if err != nil {
+			return nil, err
+		}
+		rname, next, err := readName(b[:end], next)
+		if err != nil {
+			return nil, err
+		}
+		if end-next != 20 {
+			return nil, errShortMessage
+		}
+		data := appendName(nil, mname)
+		data = appendName(data, rname)
+		return append(data, b[next:end]...), nil
+	}
+
+	return append([]byte{}, raw...), nil
+}
+
+// readName decodes a possibly compressed domain name starting at off and
+// returns it in dotted form without the trailing dot, plus the offset just
+// past the name in the original (uncompressed) position.
+func readName(b []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	next := -1
+	hops := 0
+
+	for {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		length := int(b[off])
+
+		switch length & compressionMask {
+		case 0x00:
+			if length == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return sb.String(), next, nil
+			}
+			if off+1+length > len(b) {
+				return "", 0, errShortMessage
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.Write(b[off+1 : off+1+length])
+			if sb.Len() > maxNameLength {
+				return "", 0, errBadName
+			}
+			off += 1 + length
+		case compressionMask:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			hops++
+			if hops > maxPointerHops {
+				return "", 0, errBadPointer
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		default:
+			return "", 0, errBadName
+		}
+	}
+}
+
+// appendName encodes name in uncompressed wire format
+func appendName(b []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// ReadName decodes a domain name stored uncompressed at the start of data,
+// such as the RDATA of a parsed CNAME, NS or PTR record.
+func ReadName(data []byte) (string, error) {
+	name, _, err := readName(data, 0)
+	return name, err
+}
+
+// NameData encodes name as uncompressed RDATA for CNAME, NS or PTR records
+func NameData(name string) []byte {
+	return appendName(nil, name)
+}
+
+// Pack encodes the message in wire format, compressing owner names
+func (m *Message) Pack() []byte {
+	b := make([]byte, headerLength, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.Flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+
+	names := make(map[string]int)
+	for _, q := range m.Questions {
+		b = packName(b, q.Name, names)
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			b = packName(b, rr.Name, names)
+			b = binary.BigEndian.AppendUint16(b, rr.Type)
+			b = binary.BigEndian.AppendUint16(b, rr.Class)
+			b = binary.BigEndian.AppendUint32(b, rr.TTL)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+			b = append(b, rr.Data...)
+		}
+	}
+	return b
+}
+
+// packName writes name, pointing at an earlier occurrence of any suffix
+func packName(b []byte, name string, names map[string]int) []byte {
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		key := strings.ToLower(name)
+		if off, ok := names[key]; ok {
+			return binary.BigEndian.AppendUint16(b, uint16(0xC000|off))
+		}
+		if len(b) < 0x3FFF {
+			names[key] = len(b)
+		}
+
+		label := name
+		rest := ""
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			label, rest = name[:i], name[i+1:]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+		name = rest
+	}
+	return append(b, 0)
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// mirrorQueueSize bounds the packets waiting to be mirrored; further ones are dropped
+const mirrorQueueSize = 1024
+
+// Mirror sends a sample of forwarded queries, and optionally the answers
+// returned for them, to a shadow upstream or collector over UDP. Packets
+// are queued and sent from a background goroutine, and whatever the target
+// replies is discarded, so the client-facing path never waits for it.
+type Mirror struct {
+	Target    string
+	Rate      float64 // fraction of queries mirrored, 0 < Rate <= 1
+	Responses bool    // also send the answers, with the QR bit set
+
+	conn  net.Conn
+	queue chan []byte
+}
+
+// NewMirror validates the target and sample rate and starts sending
+func NewMirror(target string, rate float64, responses bool) (*Mirror, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("mirror target %q: %w", target, err)
+	}
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("mirror rate must be in (0, 1]")
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf("mirror target %q: %w", target, err)
+	}
+	m := &Mirror{
+		Target:    target,
+		Rate:      rate,
+		Responses: responses,
+		conn:      conn,
+		queue:     make(chan []byte, mirrorQueueSize),
+	}
+	go m.send()
+	go m.discard()
+	return m, nil
+}
+
+func (m *Mirror) send() {
+	for packet := range m.queue {
+		if _, err := m.conn.Write(packet); err != nil {
+			log.Debug().Err(err).Msgf("Mirroring to %s failed", m.Target)
+			metrics.MirroredPackets.WithLabelValues("error").Inc()
+			continue
+		}
+		metrics.MirroredPackets.WithLabelValues("sent").Inc()
+	}
+}
+
+// discard reads and drops the target's replies so they do not pile up in
+// the socket buffer
+func (m *Mirror) discard() {
+	buf := make([]byte, 65535)
+	for {
+		// Errors such as ICMP port unreachable while the target is down are
+		// reported on later reads; only a closed socket ends the loop
+		if _, err := m.conn.Read(buf); errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (m *Mirror) enqueue(packet []byte) {
+	select {
+	case m.queue <- packet:
+	default:
+		metrics.MirroredPackets.WithLabelValues("dropped").Inc()
+	}
+}
+
+// mirrorExchange queues query, as sent upstream, and the processed response
+// for mirroring when the query is sampled. response may be nil when the
+// upstream failed and the client got no answer.
+func (h *Handler) mirrorExchange(query, response []byte) {
+	m := h.Mirror
+	if m == nil || (m.Rate < 1 && rand.Float64() >= m.Rate) {
+		return
+	}
+	// The buffers may be reused once the client has been answered
+	m.enqueue(append([]byte(nil), query...))
+	if m.Responses && response != nil {
+		m.enqueue(append([]byte(nil), response...))
+	}
+}
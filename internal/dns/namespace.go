@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"lktr/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// OtherNamespace is the namespace label of queries from namespaces beyond
+// the label limit
+const OtherNamespace = "other"
+
+// ClientNamespace attributes client addresses to the namespace of their pods
+type ClientNamespace struct {
+	Namespace string
+	Clients   []netip.Prefix
+}
+
+type namespaceEntry struct {
+	prefix    netip.Prefix
+	namespace string
+}
+
+// NamespaceLabels caps the distinct namespace labels of the query counters.
+// The first Max namespaces seen get their own series; queries from any
+// further namespace are counted as OtherNamespace, so a node running many
+// tenants cannot grow the metric cardinality without bound.
+type NamespaceLabels struct {
+	Max int
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+func NewNamespaceLabels(max int) *NamespaceLabels {
+	return &NamespaceLabels{Max: max, seen: make(map[string]struct{})}
+}
+
+// label returns the label to count a query from namespace under
+func (l *NamespaceLabels) label(namespace string) string {
+	l.mu.RLock()
+	_, ok := l.seen[namespace]
+	full := len(l.seen) >= l.Max
+	l.mu.RUnlock()
+	if ok {
+		return namespace
+	}
+	if full {
+		return OtherNamespace
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[namespace]; ok || len(l.seen) < l.Max {
+		l.seen[namespace] = struct{}{}
+		return namespace
+	}
+	return OtherNamespace
+}
+
+// retain forgets namespaces that are no longer attributed, freeing their
+// slots, and returns them
+func (l *NamespaceLabels) retain(current map[string]bool) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var gone []string
+	for namespace := range l.seen {
+		if !current[namespace] {
+			delete(l.seen, namespace)
+			gone = append(gone, namespace)
+		}
+	}
+	return gone
+}
+
+// UpdateNamespaces replaces the attribution of clients to namespaces that
+// labels the query counters. Series of namespaces no longer attributed are
+// removed.
+func (h *Handler) UpdateNamespaces(namespaces []ClientNamespace) {
+	var entries []namespaceEntry
+	current := make(map[string]bool)
+	for _, ns := range namespaces {
+		current[ns.Namespace] = true
+		for _, prefix := range ns.Clients {
+			entries = append(entries, namespaceEntry{prefix: prefix.Masked(), namespace: ns.Namespace})
+		}
+	}
+	// Most specific prefix first, as for policy sets
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].prefix.Bits() > entries[j].prefix.Bits() })
+
+	h.update(func(st *handlerState) {
+		st.namespaces = entries
+	})
+	if h.NamespaceLabels != nil {
+		for _, namespace := range h.NamespaceLabels.retain(current) {
+			labels := prometheus.Labels{"namespace": namespace}
+			metrics.QueriesTotal.DeletePartialMatch(labels)
+			metrics.QueriesBlocked.DeletePartialMatch(labels)
+			metrics.QueriesAllowed.DeletePartialMatch(labels)
+		}
+	}
+	if h.Verbose {
+		log.Info().Msgf("Client namespaces updated: %d namespaces, %d client selectors", len(namespaces), len(entries))
+	}
+}
+
+// namespaceLabel returns the namespace label of a client's queries, "" when
+// the client is not attributed to a namespace or labels are disabled
+func (h *Handler) namespaceLabel(st *handlerState, client net.Addr) string {
+	if h.NamespaceLabels == nil || len(st.namespaces) == 0 {
+		return ""
+	}
+	ip := clientIP(client)
+	if !ip.IsValid() {
+		return ""
+	}
+	for _, entry := range st.namespaces {
+		if entry.prefix.Contains(ip) {
+			return h.NamespaceLabels.label(entry.namespace)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultOverrideTTL is the TTL of override records without one, short so
+// that lifting an emergency redirect takes effect quickly
+const defaultOverrideTTL = 60
+
+// Override answers a name with fixed addresses, or as an alias of another
+// name, instead of the upstream's records. A name starting with "*." covers
+// every name below its base.
+type Override struct {
+	Name      string
+	Addresses []netip.Addr // A and AAAA answers, when CNAME is empty
+	CNAME     string       // alias target, resolved as any other name
+	TTL       uint32
+}
+
+// NewOverride validates an override of name with either addresses or a
+// CNAME target. A ttl of 0 selects the default.
+func NewOverride(name string, addresses []string, cname string, ttl uint32) (Override, error) {
+	o := Override{Name: canonicalName(name), CNAME: canonicalName(cname), TTL: ttl}
+	if strings.TrimPrefix(o.Name, "*.") == "" {
+		return Override{}, fmt.Errorf("override needs a name")
+	}
+	if (len(addresses) == 0) == (o.CNAME == "") {
+		return Override{}, fmt.Errorf("override of %s needs either addresses or a CNAME", o.Name)
+	}
+	for _, a := range addresses {
+		addr, err := netip.ParseAddr(strings.TrimSpace(a))
+		if err != nil {
+			return Override{}, fmt.Errorf("override of %s: %q is not an IP address", o.Name, a)
+		}
+		o.Addresses = append(o.Addresses, addr.Unmap())
+	}
+	if o.TTL == 0 {
+		o.TTL = defaultOverrideTTL
+	}
+	return o, nil
+}
+
+// LoadOverridesFile reads overrides from a file with one per line: a name,
+// an optional TTL, then either addresses or "CNAME" and the target, e.g.
+//
+//	internal.example.com  10.4.2.1
+//	api.example.com  30  10.4.2.2 fd00::2
+//	*.legacy.example.com  CNAME new.example.com
+//
+// Blank lines and lines starting with "#" are skipped.
+func LoadOverridesFile(path string) ([]Override, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var overrides []Override
+	lines := bufio.NewScanner(f)
+	for lineNo := 1; lines.Scan(); lineNo++ {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, values := fields[0], fields[1:]
+		var ttl uint32
+		if len(values) > 0 {
+			if v, err := strconv.ParseUint(values[0], 10, 32); err == nil {
+				ttl, values = uint32(v), values[1:]
+			}
+		}
+		var o Override
+		if len(values) > 0 && strings.EqualFold(values[0], "CNAME") {
+			if len(values) != 2 {
+				return nil, fmt.Errorf("%s line %d: CNAME needs one target", path, lineNo)
+			}
+			o, err = NewOverride(name, nil, values[1], ttl)
+		} else {
+			o, err = NewOverride(name, values, "", ttl)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, lineNo, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, lines.Err()
+}
+
+// UpdateOverrides replaces the answer overrides; when a name is given twice
+// the later override wins
+func (h *Handler) UpdateOverrides(overrides []Override) {
+	var byName map[string]*Override
+	if len(overrides) > 0 {
+		byName = make(map[string]*Override, len(overrides))
+		for i := range overrides {
+			byName[overrides[i].Name] = &overrides[i]
+		}
+	}
+	h.update(func(st *handlerState) {
+		st.overrides = byName
+	})
+	if h.Verbose {
+		log.Info().Msgf("Answer overrides updated: %d names", len(byName))
+	}
+}
+
+// findOverride returns the override of name: an exact one, or else the
+// closest wildcard
+func (st *handlerState) findOverride(name string) *Override {
+	if len(st.overrides) == 0 {
+		return nil
+	}
+	name = canonicalName(name)
+	if o, ok := st.overrides[name]; ok {
+		return o
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if o, ok := st.overrides["*."+name]; ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// answerOverride answers a query for an overridden name authoritatively.
+// The target of a CNAME override is followed through further overrides and
+// then resolved through the upstream, so that clients get the addresses in
+// the same answer. The second result is false when no override applies.
+func (h *Handler) answerOverride(ctx context.Context, st *handlerState, query []byte) ([]byte, bool) {
+	if len(st.overrides) == 0 {
+		return nil, false
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Class != ClassINET {
+		return nil, false
+	}
+	question := q.Questions[0]
+	o := st.findOverride(question.Name)
+	if o == nil {
+		return nil, false
+	}
+
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagAA | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	owner := question.Name
+	for hops := 0; o != nil && hops < maxCNAMEHops; hops++ {
+		if o.CNAME == "" {
+			resp.Answers = append(resp.Answers, o.records(owner, question.Type)...)
+			break
+		}
+		resp.Answers = append(resp.Answers, RR{Name: owner, Type: TypeCNAME, Class: ClassINET, TTL: o.TTL, Data: NameData(o.CNAME)})
+		if question.Type == TypeCNAME {
+			break
+		}
+		owner = o.CNAME
+		if o = st.findOverride(owner); o == nil {
+			h.resolveOverrideTarget(ctx, st, resp, owner, question.Type)
+		}
+	}
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Answered %s from an override (%d answers)", question.Name, len(resp.Answers))
+	}
+	return resp.Pack(), true
+}
+
+// records returns the addresses of an address override that answer qtype
+func (o *Override) records(owner string, qtype uint16) []RR {
+	var rrs []RR
+	for _, addr := range o.Addresses {
+		switch {
+		case addr.Is4() && (qtype == TypeA || qtype == TypeANY):
+			rrs = append(rrs, RR{Name: owner, Type: TypeA, Class: ClassINET, TTL: o.TTL, Data: addr.AsSlice()})
+		case addr.Is6() && (qtype == TypeAAAA || qtype == TypeANY):
+			rrs = append(rrs, RR{Name: owner, Type: TypeAAAA, Class: ClassINET, TTL: o.TTL, Data: addr.AsSlice()})
+		}
+	}
+	return rrs
+}
+
+// resolveOverrideTarget adds the upstream's answer for the CNAME target of
+// an override to resp, along with its rcode. When the upstream fails the
+// CNAME is sent alone, leaving the client to chase it.
+func (h *Handler) resolveOverrideTarget(ctx context.Context, st *handlerState, resp *Message, target string, qtype uint16) {
+	response, err := h.exchange(ctx, st, BuildQuery(uint16(rand.Uint32()), target, qtype))
+	if err != nil {
+		queryLog(ctx).Warn().Err(err).Msgf("Failed to resolve override target %s", target)
+		return
+	}
+	answer, err := ParseMessage(response)
+	if err != nil {
+		return
+	}
+	resp.Answers = append(resp.Answers, answer.Answers...)
+	resp.SetRcode(answer.Rcode())
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// optionPadding is the EDNS padding option code (RFC 7830)
+const optionPadding = 12
+
+// Padding policies for queries sent over encrypted transports (RFC 8467)
+const (
+	PaddingNone        = "none"         // send queries unpadded
+	PaddingBlock       = "block"        // pad to a multiple of the block length, the recommended policy
+	PaddingRandomBlock = "random-block" // pad to a random multiple of the block length, up to 4 blocks more
+)
+
+// Padding pads queries sent over encrypted upstream transports so that
+// their length no longer tells which name was asked for
+type Padding struct {
+	Policy string
+	Block  int // block length; RFC 8467 recommends 128 for queries
+}
+
+// ParsePadding validates a padding policy; it returns nil for PaddingNone
+func ParsePadding(policy string, block int) (*Padding, error) {
+	switch p := strings.ToLower(policy); p {
+	case PaddingNone:
+		return nil, nil
+	case PaddingBlock, PaddingRandomBlock:
+		if block <= 0 || block > 1024 {
+			return nil, fmt.Errorf("padding block length must be 1-1024, got %d", block)
+		}
+		return &Padding{Policy: p, Block: block}, nil
+	}
+	return nil, fmt.Errorf("unknown padding policy %q, expected %s, %s or %s", policy, PaddingNone, PaddingBlock, PaddingRandomBlock)
+}
+
+// pad returns query carrying a padding option that brings it to the length
+// the policy asks for, replacing any padding the client sent. An OPT record
+// is added when the query has none; addedOPT reports that, so the caller can
+// remove it again from the response.
+func (p *Padding) pad(query []byte) (_ []byte, addedOPT bool) {
+	m, err := ParseMessage(query)
+	if err != nil {
+		return query, false
+	}
+	i := findOPT(m)
+	if i < 0 {
+		m.Additional = append(m.Additional, RR{Type: TypeOPT, Class: defaultUDPPayload})
+		i = len(m.Additional) - 1
+		addedOPT = true
+	}
+	opt := &m.Additional[i]
+	opt.Data = withoutOption(opt.Data, optionPadding)
+
+	// Packing is deterministic, so the padded length is known up front
+	length := len(m.Pack()) + 4
+	target := (length + p.Block - 1) / p.Block * p.Block
+	if p.Policy == PaddingRandomBlock {
+		target += rand.IntN(5) * p.Block
+	}
+	padding := target - length
+	opt.Data = append(opt.Data, 0, optionPadding, byte(padding>>8), byte(padding))
+	opt.Data = append(opt.Data, make([]byte, padding)...)
+	return m.Pack(), addedOPT
+}
+
+// unpad removes padding from a response, which is of no use on the
+// plaintext path to the client, and the OPT record when pad added it
+func unpad(response []byte, addedOPT bool) []byte {
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return response
+	}
+	if addedOPT {
+		m.Additional = append(m.Additional[:i], m.Additional[i+1:]...)
+		return m.Pack()
+	}
+	if _, ok := findOption(m.Additional[i].Data, optionPadding); !ok {
+		return response
+	}
+	m.Additional[i].Data = withoutOption(m.Additional[i].Data, optionPadding)
+	return m.Pack()
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"lktr/internal/metrics"
+)
+
+// maxUDPMessage is the read buffer size for upstream UDP replies when the
+// payload size is not clamped
+const maxUDPMessage = 65535
+
+// MaxEDNSUDPSize is the largest UDP payload size the proxy accepts from
+// clients and advertises
+const MaxEDNSUDPSize = 4096
+
+// clampPayload lowers the UDP payload size advertised in the OPT record of
+// msg to MaxUDPPayload. Applied to queries it keeps upstream answers small
+// enough to avoid IP fragmentation, which is often dropped on the way and
+// leaves the client waiting for a timeout; larger answers come back
+// truncated and are retried over TCP. Applied to responses it keeps clients
+// from being told a server accepts more. direction labels the metric.
+func (h *Handler) clampPayload(msg []byte, direction string) []byte {
+	if h.MaxUDPPayload <= 0 {
+		return msg
+	}
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return msg
+	}
+	i := findOPT(m)
+	if i < 0 || int(m.Additional[i].Class) <= h.MaxUDPPayload {
+		return msg
+	}
+	m.Additional[i].Class = uint16(h.MaxUDPPayload)
+	metrics.EDNSPayloadClamped.WithLabelValues(direction).Inc()
+	return m.Pack()
+}
+
+// udpBufferSize is the largest upstream UDP reply the proxy can receive
+func (h *Handler) udpBufferSize() int {
+	if h.MaxUDPPayload <= 0 {
+		return maxUDPMessage
+	}
+	// Upstreams ignoring EDNS may still send up to 512 bytes
+	return max(h.MaxUDPPayload, 512)
+}
+
+// udpSize is the largest UDP message the proxy accepts from and sends to
+// clients
+func (h *Handler) udpSize() int {
+	if h.UDPSize <= 0 {
+		return defaultUDPPayload
+	}
+	return max(min(h.UDPSize, MaxEDNSUDPSize), 512)
+}
+
+// QueryBufferSize is the read buffer size for client UDP queries
+func (h *Handler) QueryBufferSize() int {
+	return h.udpSize()
+}
+
+// fitUDP truncates a UDP response that exceeds what the client can take: 512
+// bytes without EDNS, otherwise the payload size its OPT record advertises,
+// never more than the proxy's own. The truncated response keeps the header,
+// question and OPT record and sets TC, so the client retries over TCP.
+func (h *Handler) fitUDP(query, response []byte) []byte {
+	if len(response) <= 512 {
+		return response
+	}
+	limit := 512
+	if q, err := ParseMessage(query); err == nil {
+		if i := findOPT(q); i >= 0 {
+			limit = max(limit, int(q.Additional[i].Class))
+		}
+	}
+	limit = min(limit, h.udpSize())
+	if len(response) <= limit {
+		return response
+	}
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	var opt []RR
+	if i := findOPT(m); i >= 0 {
+		opt = m.Additional[i : i+1]
+	}
+	m.Answers, m.Authority, m.Additional = nil, nil, opt
+	m.Flags |= flagTC
+	metrics.UDPTruncated.Inc()
+	return m.Pack()
+}
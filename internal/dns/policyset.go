@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PolicySet is a named blocklist that applies to a group of clients
+type PolicySet struct {
+	Name    string
+	Clients []netip.Prefix
+	Matcher *matcher.Matcher
+}
+
+type policySetEntry struct {
+	prefix netip.Prefix
+	set    *PolicySet
+}
+
+// UpdatePolicySets replaces the per-client policy sets. Clients that match
+// no set keep using the default matcher.
+func (h *Handler) UpdatePolicySets(sets []PolicySet) {
+	var entries []policySetEntry
+	for i := range sets {
+		for _, prefix := range sets[i].Clients {
+			entries = append(entries, policySetEntry{prefix: prefix.Masked(), set: &sets[i]})
+		}
+	}
+	// Most specific prefix first, so a /32 pod entry overrides a subnet
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].prefix.Bits() > entries[j].prefix.Bits() })
+
+	h.update(func(st *handlerState) {
+		st.policySets = entries
+	})
+	if h.Verbose {
+		log.Info().Msgf("Policy sets updated: %d sets, %d client selectors", len(sets), len(entries))
+	}
+}
+
+// matcherFor selects the matcher for a client address, returning the name of
+// the policy set in use or "" for the default blocklist.
+func (st *handlerState) matcherFor(addr net.Addr) (*matcher.Matcher, string) {
+	if len(st.policySets) == 0 {
+		return st.matcher, ""
+	}
+
+	ip := clientIP(addr)
+	if !ip.IsValid() {
+		return st.matcher, ""
+	}
+
+	for _, entry := range st.policySets {
+		if entry.prefix.Contains(ip) {
+			return entry.set.Matcher, entry.set.Name
+		}
+	}
+	return st.matcher, ""
+}
+
+// clientIP extracts the IP of a UDP or TCP client address, or the zero Addr
+func clientIP(addr net.Addr) netip.Addr {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	}
+	return ip.Unmap()
+}
+
+// ParseClientSelector parses a client IP or CIDR into a prefix
+func ParseClientSelector(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
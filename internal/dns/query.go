@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+)
+
+// BuildQuery encodes a single-question DNS query with recursion desired set
+func BuildQuery(id uint16, domain string, qtype uint16) []byte {
+	domain = strings.TrimSuffix(domain, ".")
+
+	query := make([]byte, 12, 12+len(domain)+6)
+	query[0] = byte(id >> 8)
+	query[1] = byte(id)
+	query[2] = 0x01 // RD
+	query[5] = 1    // QDCOUNT
+
+	if domain != "" {
+		for _, label := range strings.Split(domain, ".") {
+			query = append(query, byte(len(label)))
+			query = append(query, label...)
+		}
+	}
+	query = append(query, 0)
+	query = append(query, byte(qtype>>8), byte(qtype), 0, 1) // QCLASS IN
+
+	return query
+}
+
+// ParseQType converts a record type mnemonic such as "AAAA", or the generic
+// form of RFC 3597 such as "TYPE65", to its numeric value
+func ParseQType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		v, err := strconv.ParseUint(n, 10, 16)
+		return uint16(v), err == nil
+	}
+	switch s {
+	case "A":
+		return 1, true
+	case "NS":
+		return 2, true
+	case "CNAME":
+		return 5, true
+	case "SOA":
+		return 6, true
+	case "PTR":
+		return 12, true
+	case "MX":
+		return 15, true
+	case "TXT":
+		return 16, true
+	case "AAAA":
+		return 28, true
+	case "SRV":
+		return 33, true
+	case "NULL":
+		return 10, true
+	case "HINFO":
+		return 13, true
+	case "NAPTR":
+		return 35, true
+	case "SVCB":
+		return 64, true
+	case "HTTPS":
+		return 65, true
+	case "AXFR":
+		return 252, true
+	case "ANY":
+		return 255, true
+	}
+	return 0, false
+}
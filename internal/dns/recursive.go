@@ -0,0 +1,564 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// rootHints are the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net, from the IANA root hints file
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	serverTimeout        = 2 * time.Second // one exchange with an authoritative server
+	serverAttempts       = 3               // servers of a zone tried before giving up on it
+	maxServerQueries     = 64              // server queries spent on one client query
+	maxRecursionDepth    = 8               // nested resolutions of name server addresses and CNAME targets
+	resolverCacheSize    = 10000
+	maxResolverCacheTTL  = 86400 // seconds
+	maxResolverNegTTL    = 3600  // seconds, for NXDOMAIN and empty answers
+	serverAddressesLimit = 4     // name server names resolved for a delegation without glue
+)
+
+var errResolutionBudget = errors.New("recursive resolution exceeded its query budget")
+
+// Resolver answers queries by iterating from the root servers down the
+// delegation chain instead of forwarding them to an upstream. It does not
+// validate DNSSEC.
+type Resolver struct {
+	Roots    []string // root server addresses (host:port)
+	Minimize bool     // QNAME minimisation (RFC 9156): servers only see the labels they are authoritative for
+	Verbose  bool
+
+	mu          sync.Mutex
+	answers     map[string]resolverEntry      // by name and type
+	delegations map[string]resolverDelegation // server addresses by zone
+}
+
+// resolution is the outcome of resolving one name and type
+type resolution struct {
+	rcode     int
+	answers   []RR
+	authority []RR // SOA of negative answers
+}
+
+type resolverEntry struct {
+	resolution
+	stored  time.Time
+	expires time.Time
+}
+
+type resolverDelegation struct {
+	servers []string
+	expires time.Time
+}
+
+// NewResolver returns a recursive resolver starting from roots, a
+// comma-separated list of root server addresses, or from the built-in root
+// hints when roots is empty. Addresses without a port use 53.
+func NewResolver(roots string, minimize bool) (*Resolver, error) {
+	r := &Resolver{
+		Minimize:    minimize,
+		answers:     make(map[string]resolverEntry),
+		delegations: make(map[string]resolverDelegation),
+	}
+	list := rootHints
+	if strings.TrimSpace(roots) != "" {
+		list = strings.Split(roots, ",")
+	}
+	for _, root := range list {
+		root = strings.TrimSpace(root)
+		if _, _, err := net.SplitHostPort(root); err != nil {
+			root = net.JoinHostPort(root, "53")
+		}
+		host, _, _ := net.SplitHostPort(root)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("root server %q is not an IP address", root)
+		}
+		r.Roots = append(r.Roots, root)
+	}
+	return r, nil
+}
+
+// resolveRecursive answers a client query with the built-in resolver
+func (h *Handler) resolveRecursive(ctx context.Context, query []byte, protocol string) ([]byte, error) {
+	q, err := ParseMessage(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.Questions) != 1 || q.Questions[0].Class != ClassINET {
+		resp := &Message{ID: q.ID, Flags: flagQR | flagRA | q.Flags&flagRD, Questions: q.Questions}
+		resp.SetRcode(RcodeRefused)
+		return resp.Pack(), nil
+	}
+	question := q.Questions[0]
+
+	res, err := h.Recursor.lookup(ctx, question.Name, question.Type)
+	if err != nil {
+		metrics.RecursiveResolutions.WithLabelValues("failed").Inc()
+		queryLog(ctx).Err(err).Msgf("Recursive resolution of %s failed:", question.Name)
+		countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+		return nil, err
+	}
+
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+		Answers:   res.answers,
+		Authority: res.authority,
+	}
+	resp.SetRcode(res.rcode)
+	return resp.Pack(), nil
+}
+
+// lookup resolves name and qtype iteratively, following CNAMEs, and returns
+// the records for the answer section. Name errors and empty answers are not
+// errors; they come back with their rcode and the zone's SOA.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) (*resolution, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if res, ok := r.cached(name, qtype); ok {
+		metrics.RecursiveResolutions.WithLabelValues("cached").Inc()
+		return res, nil
+	}
+
+	it := &iteration{r: r, ctx: ctx}
+	res, err := it.resolve(name, qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	metrics.RecursiveResolutions.WithLabelValues("resolved").Inc()
+	if r.Verbose {
+		queryLog(ctx).Info().Msgf("Resolved %s iteratively with %d server queries", name, it.queries)
+	}
+	return res, nil
+}
+
+// iteration tracks the work spent on one client query
+type iteration struct {
+	r       *Resolver
+	ctx     context.Context
+	queries int
+}
+
+func (it *iteration) resolve(name string, qtype uint16, depth int) (*resolution, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("resolving %s: too many nested lookups", name)
+	}
+	if res, ok := it.r.cached(name, qtype); ok {
+		return res, nil
+	}
+
+	zone, servers := it.r.closestServers(name)
+	labels := countLabels(name)
+	next := countLabels(zone) + 1 // labels of the next minimised query name
+	for {
+		qname, qt := name, qtype
+		if it.r.Minimize && next < labels {
+			// RFC 9156 recommends type A for the intermediate queries, as
+			// some servers mishandle NS queries for names that are not cuts
+			qname, qt = lastLabels(name, next), TypeA
+		}
+
+		resp, err := it.query(servers, zone, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+
+		if cut, nsNames, ttl := referral(resp, zone, qname); cut != "" {
+			servers, err = it.serverAddresses(resp, zone, nsNames, depth)
+			if err != nil {
+				return nil, fmt.Errorf("resolving servers of %s: %w", cut, err)
+			}
+			it.r.storeDelegation(cut, servers, ttl)
+			zone, next = cut, countLabels(cut)+1
+			continue
+		}
+
+		if qname != name {
+			// No zone cut at qname. A name error for it should cover the
+			// whole subtree (RFC 8020), but some servers get this wrong, so
+			// the full name is asked instead of trusting it.
+			if resp.Rcode() == RcodeNXDomain {
+				next = labels
+			} else {
+				next++
+			}
+			continue
+		}
+
+		return it.answer(resp, name, qtype, depth)
+	}
+}
+
+// answer turns the authoritative response for name into a resolution,
+// following a CNAME to its target
+func (it *iteration) answer(resp *Message, name string, qtype uint16, depth int) (*resolution, error) {
+	res := &resolution{rcode: resp.Rcode()}
+	var cname *RR
+	for i, rr := range resp.Answers {
+		if !strings.EqualFold(rr.Name, name) {
+			continue
+		}
+		switch {
+		case rr.Type == qtype || qtype == TypeANY:
+			res.answers = append(res.answers, rr)
+		case rr.Type == TypeCNAME:
+			cname = &resp.Answers[i]
+		}
+	}
+
+	if len(res.answers) == 0 && cname != nil {
+		target, err := ReadName(cname.Data)
+		if err != nil {
+			return nil, err
+		}
+		chained, err := it.resolve(strings.ToLower(target), qtype, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		res.rcode = chained.rcode
+		res.answers = append([]RR{*cname}, chained.answers...)
+		res.authority = chained.authority
+	}
+	if len(res.answers) == 0 {
+		for _, rr := range resp.Authority {
+			if rr.Type == TypeSOA {
+				res.authority = append(res.authority, rr)
+			}
+		}
+	}
+
+	it.r.store(name, qtype, res)
+	return res, nil
+}
+
+// query asks the servers of zone for qname in turn until one gives a usable
+// answer
+func (it *iteration) query(servers []string, zone, qname string, qtype uint16) (*Message, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no addresses for the servers of zone %q", zone)
+	}
+	start := rand.IntN(len(servers))
+	var lastErr error
+	for i := 0; i < min(len(servers), serverAttempts); i++ {
+		if it.queries >= maxServerQueries {
+			return nil, errResolutionBudget
+		}
+		it.queries++
+		server := servers[(start+i)%len(servers)]
+		resp, err := it.exchange(server, qname, qtype)
+		if err == nil && !usable(resp, zone, qname) {
+			err = fmt.Errorf("server %s gave no usable answer for %s (rcode %d)", server, qname, resp.Rcode())
+		}
+		if err != nil {
+			lastErr = err
+			if it.r.Verbose {
+				queryLog(it.ctx).Info().Msgf("Recursive query for %s to %s failed: %v", qname, server, err)
+			}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// exchange sends one non-recursive query to server, over UDP and again over
+// TCP when the answer is truncated
+func (it *iteration) exchange(server, qname string, qtype uint16) (*Message, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, upstreamError(err)
+	}
+	metrics.RecursiveServerQueries.Inc()
+	id := uint16(rand.Uint32())
+	query := (&Message{
+		ID:         id,
+		Questions:  []Question{{Name: qname, Type: qtype, Class: ClassINET}},
+		Additional: []RR{{Type: TypeOPT, Class: defaultUDPPayload}},
+	}).Pack()
+
+	ctx, cancel := context.WithTimeout(it.ctx, serverTimeout)
+	defer cancel()
+
+	raw, err := exchangeWith(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ParseMessage(raw)
+	if err == nil && resp.Truncated() {
+		if raw, err = exchangeWith(ctx, "tcp", server, query); err != nil {
+			return nil, err
+		}
+		resp, err = ParseMessage(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.ID != id || resp.Flags&flagQR == 0 || len(resp.Questions) != 1 ||
+		!strings.EqualFold(resp.Questions[0].Name, qname) || resp.Questions[0].Type != qtype {
+		return nil, fmt.Errorf("server %s answered a different query", server)
+	}
+	return resp, nil
+}
+
+// exchangeWith sends query to server over network ("udp" or "tcp") and
+// returns the reply
+func exchangeWith(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	conn, err := dialSocket(ctx, network, server)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	defer conn.Close()
+	stop := bindConn(ctx, conn)
+	defer stop()
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, upstreamError(err)
+		}
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, upstreamError(err)
+		}
+		return msg, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, upstreamError(err)
+	}
+	buffer := make([]byte, 4096)
+	n, err := readUDPResponse(ctx, conn, query, buffer, false, false)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return buffer[:n], nil
+}
+
+// usable reports whether a server response can be acted on: an answer or
+// name error from a server authoritative for the name, or a referral further
+// down the tree. Anything else, such as REFUSED or an upward referral from a
+// lame server, makes the resolver try another server.
+func usable(resp *Message, zone, qname string) bool {
+	switch resp.Rcode() {
+	case RcodeSuccess, RcodeNXDomain:
+	default:
+		return false
+	}
+	if resp.Flags&flagAA != 0 || len(resp.Answers) > 0 {
+		return true
+	}
+	cut, _, _ := referral(resp, zone, qname)
+	return cut != ""
+}
+
+// referral returns the zone a response delegates qname to, the names of its
+// servers and the TTL of the delegation. The cut is empty unless the
+// response is a referral to a zone below zone that contains qname.
+func referral(resp *Message, zone, qname string) (cut string, nsNames []string, ttl uint32) {
+	if resp.Rcode() != RcodeSuccess || len(resp.Answers) > 0 {
+		return "", nil, 0
+	}
+	ttl = maxResolverCacheTTL
+	for _, rr := range resp.Authority {
+		if rr.Type != TypeNS {
+			continue
+		}
+		owner := strings.ToLower(rr.Name)
+		if owner == zone || !inZone(owner, zone) || !inZone(qname, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		target, err := ReadName(rr.Data)
+		if err != nil {
+			continue
+		}
+		cut = owner
+		nsNames = append(nsNames, strings.ToLower(target))
+		ttl = min(ttl, rr.TTL)
+	}
+	return cut, nsNames, ttl
+}
+
+// serverAddresses returns the addresses of a delegation's name servers,
+// from in-bailiwick glue when the referral carries it and by resolving the
+// server names otherwise. IPv4 addresses come first.
+func (it *iteration) serverAddresses(resp *Message, zone string, nsNames []string, depth int) ([]string, error) {
+	isServer := make(map[string]bool, len(nsNames))
+	for _, ns := range nsNames {
+		isServer[ns] = true
+	}
+	var v4, v6 []string
+	for _, rr := range resp.Additional {
+		owner := strings.ToLower(rr.Name)
+		if !isServer[owner] || !inZone(owner, zone) {
+			continue
+		}
+		switch {
+		case rr.Type == TypeA && len(rr.Data) == net.IPv4len:
+			v4 = append(v4, net.JoinHostPort(net.IP(rr.Data).String(), "53"))
+		case rr.Type == TypeAAAA && len(rr.Data) == net.IPv6len:
+			v6 = append(v6, net.JoinHostPort(net.IP(rr.Data).String(), "53"))
+		}
+	}
+	if len(v4)+len(v6) > 0 {
+		return append(v4, v6...), nil
+	}
+
+	var lastErr error
+	for i, ns := range nsNames {
+		if i == serverAddressesLimit {
+			break
+		}
+		res, err := it.resolve(ns, TypeA, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var addrs []string
+		for _, rr := range res.answers {
+			if rr.Type == TypeA && len(rr.Data) == net.IPv4len {
+				addrs = append(addrs, net.JoinHostPort(net.IP(rr.Data).String(), "53"))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no server name has an address")
+	}
+	return nil, lastErr
+}
+
+// closestServers returns the deepest zone enclosing name whose server
+// addresses are cached, falling back to the root
+func (r *Resolver) closestServers(name string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for zone := name; zone != ""; zone = parentName(zone) {
+		if d, ok := r.delegations[zone]; ok && now.Before(d.expires) {
+			return zone, d.servers
+		}
+	}
+	return "", r.Roots
+}
+
+func (r *Resolver) storeDelegation(zone string, servers []string, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	evictOne(r.delegations, resolverCacheSize)
+	r.delegations[zone] = resolverDelegation{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// cached returns a stored resolution with its TTLs reduced by its age
+func (r *Resolver) cached(name string, qtype uint16) (*resolution, bool) {
+	r.mu.Lock()
+	e, ok := r.answers[cacheKey(name, qtype)]
+	r.mu.Unlock()
+	now := time.Now()
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	aged := func(rrs []RR) []RR {
+		out := make([]RR, len(rrs))
+		for i, rr := range rrs {
+			rr.TTL -= min(rr.TTL, age)
+			out[i] = rr
+		}
+		return out
+	}
+	return &resolution{rcode: e.rcode, answers: aged(e.answers), authority: aged(e.authority)}, true
+}
+
+// store caches res for the smallest TTL among its records, capped at a day
+// for answers and an hour for negative results
+func (r *Resolver) store(name string, qtype uint16, res *resolution) {
+	ttl := uint32(maxResolverCacheTTL)
+	records := res.answers
+	if len(records) == 0 {
+		// Negative answers live as long as the zone's SOA says (RFC 2308)
+		ttl, records = maxResolverNegTTL, res.authority
+		if len(records) == 0 {
+			return
+		}
+	}
+	for _, rr := range records {
+		ttl = min(ttl, rr.TTL)
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	evictOne(r.answers, resolverCacheSize)
+	r.answers[cacheKey(name, qtype)] = resolverEntry{resolution: *res, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// evictOne makes room for an entry in a full cache by dropping an arbitrary
+// one; map iteration order is random
+func evictOne[V any](m map[string]V, limit int) {
+	if len(m) < limit {
+		return
+	}
+	for k := range m {
+		delete(m, k)
+		return
+	}
+}
+
+func cacheKey(name string, qtype uint16) string {
+	return fmt.Sprintf("%s/%d", name, qtype)
+}
+
+// inZone reports whether name is zone or below it; every name is in the
+// root zone ""
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName strips the first label of name, returning "" for a single label
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func countLabels(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// lastLabels returns the n rightmost labels of name
+func lastLabels(name string, n int) string {
+	for labels := countLabels(name); labels > n; labels-- {
+		name = parentName(name)
+	}
+	return name
+}
@@ -18,3 +18,24 @@ func CreateNXDomainResponse(query []byte) []byte {
 
 	return response
 }
+
+// CreateServFailResponse answers a query with SERVFAIL, used when the
+// upstream cannot be reached
+func CreateServFailResponse(query []byte) []byte {
+	response := make([]byte, len(query))
+	copy(response, query)
+
+	response[2] = (query[2] & 0x01) | 0x80
+	response[3] = 0x82
+
+	response[6] = 0
+	response[7] = 0
+
+	response[8] = 0
+	response[9] = 0
+
+	response[10] = 0
+	response[11] = 0
+
+	return response
+}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RewriteRule maps a query name to another before matching and forwarding.
+// Suffix rules ("*.old.internal -> *.new.internal") keep the leading labels
+// and swap the parent domain; exact rules replace the whole name.
+type RewriteRule struct {
+	From   string
+	To     string
+	Suffix bool
+}
+
+// Rewriter applies query-name rewrite rules
+type Rewriter struct {
+	exact  map[string]string
+	suffix []RewriteRule // longest From first so the most specific rule wins
+}
+
+// ParseRewriteRules parses a comma-separated list of "from -> to" rules
+func ParseRewriteRules(spec string) (*Rewriter, error) {
+	r := &Rewriter{exact: make(map[string]string)}
+
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(raw, "->")
+		if !ok {
+			return nil, fmt.Errorf("rewrite rule %q: expected \"from -> to\"", raw)
+		}
+		from = canonicalName(from)
+		to = canonicalName(to)
+
+		fromSuffix := strings.HasPrefix(from, "*.")
+		toSuffix := strings.HasPrefix(to, "*.")
+		if fromSuffix != toSuffix {
+			return nil, fmt.Errorf("rewrite rule %q: both sides must be exact names or both *. suffixes", raw)
+		}
+		if fromSuffix {
+			from, to = from[2:], to[2:]
+		}
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("rewrite rule %q: empty name", raw)
+		}
+
+		if fromSuffix {
+			r.suffix = append(r.suffix, RewriteRule{From: from, To: to, Suffix: true})
+		} else {
+			r.exact[from] = to
+		}
+	}
+
+	sort.SliceStable(r.suffix, func(i, j int) bool { return len(r.suffix[i].From) > len(r.suffix[j].From) })
+	return r, nil
+}
+
+// Len returns the number of configured rules
+func (r *Rewriter) Len() int {
+	return len(r.exact) + len(r.suffix)
+}
+
+// Rewrite returns the rewritten form of name, if any rule applies
+func (r *Rewriter) Rewrite(name string) (string, bool) {
+	name = canonicalName(name)
+	if to, ok := r.exact[name]; ok {
+		return to, true
+	}
+	for _, rule := range r.suffix {
+		if strings.HasSuffix(name, "."+rule.From) {
+			return strings.TrimSuffix(name, rule.From) + rule.To, true
+		}
+	}
+	return "", false
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// rewriteQuery applies the configured rewrite rules to the question name and
+// returns the query to use from here on along with the name it now carries.
+func (h *Handler) rewriteQuery(query []byte, domain string) ([]byte, string) {
+	if h.Rewriter == nil || domain == "" {
+		return query, domain
+	}
+	target, ok := h.Rewriter.Rewrite(domain)
+	if !ok {
+		return query, domain
+	}
+
+	msg, err := ParseMessage(query)
+	if err != nil || len(msg.Questions) == 0 {
+		return query, domain
+	}
+	msg.Questions[0].Name = target
+
+	if h.Verbose {
+		log.Info().Msgf("Rewrote query %s -> %s", domain, target)
+	}
+	return msg.Pack(), target
+}
+
+// restoreName puts the client's original name back into a response to a
+// rewritten query: the question and any record owned by the rewritten name.
+func restoreName(response []byte, original, rewritten string) []byte {
+	if original == rewritten {
+		return response
+	}
+
+	msg, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+
+	for i := range msg.Questions {
+		if strings.EqualFold(msg.Questions[i].Name, rewritten) {
+			msg.Questions[i].Name = original
+		}
+	}
+	for _, section := range [][]RR{msg.Answers, msg.Authority, msg.Additional} {
+		for i := range section {
+			if strings.EqualFold(section[i].Name, rewritten) {
+				section[i].Name = original
+			}
+		}
+	}
+	return msg.Pack()
+}
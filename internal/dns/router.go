@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// routeExplore is the share of queries sent to an upstream other than
+	// the current one, so that every upstream keeps a fresh score
+	routeExplore = 0.05
+	// routeDecay is the weight of each new exchange in an upstream's score
+	routeDecay = 0.1
+	// routeMinSamples is how many exchanges an upstream needs before its
+	// score is trusted
+	routeMinSamples = 20
+)
+
+// Router sends plain DNS queries to whichever of several upstreams performs
+// best. Each upstream is scored by a moving average of its response time,
+// with every failed exchange or SERVFAIL answer costing as much as a timeout,
+// so that 1% of errors adds 50ms. The current upstream only changes when
+// another scores better by more than Margin and the last change is at least
+// Hold old, so that upstreams of similar performance do not take turns.
+type Router struct {
+	Upstreams []string
+	Margin    float64       // fraction by which a challenger's score must beat the current one
+	Hold      time.Duration // shortest time between two changes of upstream
+
+	mu       sync.Mutex
+	scores   []routeScore
+	current  int
+	switched time.Time
+}
+
+type routeScore struct {
+	latency float64 // seconds, successful exchanges only
+	errors  float64 // share of failed exchanges
+	samples int
+}
+
+// score is the expected cost of an exchange in seconds
+func (s routeScore) score() float64 {
+	return s.latency + s.errors*upstreamTimeout.Seconds()
+}
+
+// NewRouter validates the upstream addresses; the first one is used until
+// the others have proven better
+func NewRouter(upstreams []string, margin float64, hold time.Duration) (*Router, error) {
+	if len(upstreams) < 2 {
+		return nil, errors.New("adaptive routing needs at least two upstreams")
+	}
+	for i, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", upstream, err)
+		}
+		if slices.Index(upstreams, upstream) != i {
+			return nil, fmt.Errorf("upstream %q listed twice", upstream)
+		}
+	}
+	if margin < 0 || margin >= 1 {
+		return nil, fmt.Errorf("switch margin must be between 0 and 1")
+	}
+	if hold < 0 {
+		return nil, fmt.Errorf("hold time must not be negative")
+	}
+	metrics.UpstreamRouteCurrent.WithLabelValues(upstreams[0]).Set(1)
+	for _, upstream := range upstreams[1:] {
+		metrics.UpstreamRouteCurrent.WithLabelValues(upstream).Set(0)
+	}
+	return &Router{
+		Upstreams: upstreams,
+		Margin:    margin,
+		Hold:      hold,
+		scores:    make([]routeScore, len(upstreams)),
+		switched:  time.Now(),
+	}, nil
+}
+
+// Current returns the upstream queries are routed to
+func (r *Router) Current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Upstreams[r.current]
+}
+
+// explore returns, for a routeExplore share of the queries, another upstream
+// than the current one to send the query to instead
+func (r *Router) explore() (string, bool) {
+	if rand.Float64() >= routeExplore {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := rand.IntN(len(r.Upstreams) - 1)
+	if i >= r.current {
+		i++
+	}
+	return r.Upstreams[i], true
+}
+
+// observe scores an exchange with upstream that took rtt, then moves to a
+// better upstream when there is one. Upstreams not routed to are ignored.
+func (r *Router) observe(upstream string, rtt time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.Index(r.Upstreams, upstream)
+	if i < 0 {
+		return
+	}
+	s := &r.scores[i]
+	if failed {
+		s.errors += routeDecay * (1 - s.errors)
+	} else {
+		s.errors -= routeDecay * s.errors
+		if s.latency == 0 {
+			s.latency = rtt.Seconds()
+		} else {
+			s.latency += routeDecay * (rtt.Seconds() - s.latency)
+		}
+	}
+	s.samples++
+	metrics.UpstreamRouteScore.WithLabelValues(upstream).Set(s.score())
+
+	best := r.current
+	for j, c := range r.scores {
+		if c.samples >= routeMinSamples && c.score() < r.scores[best].score() {
+			best = j
+		}
+	}
+	cur := r.scores[r.current]
+	if best == r.current || cur.samples < routeMinSamples || time.Since(r.switched) < r.Hold {
+		return
+	}
+	if r.scores[best].score() >= cur.score()*(1-r.Margin) {
+		return
+	}
+	log.Info().Msgf("Routing queries to upstream %s instead of %s (score %.1fms against %.1fms)", r.Upstreams[best], r.Upstreams[r.current], r.scores[best].score()*1000, cur.score()*1000)
+	metrics.UpstreamRouteCurrent.WithLabelValues(r.Upstreams[r.current]).Set(0)
+	metrics.UpstreamRouteCurrent.WithLabelValues(r.Upstreams[best]).Set(1)
+	metrics.UpstreamRouteSwitches.WithLabelValues(r.Upstreams[best]).Inc()
+	r.current, r.switched = best, time.Now()
+}
+
+// routing wraps the send function of forwarded queries so that exchanges
+// with the upstreams the router tracks are scored. A share of the queries
+// meant for the current upstream explores another one; when that one fails
+// the query is sent to the current upstream after all, so exploring costs
+// clients time but not answers.
+func (h *Handler) routing(send func(ctx context.Context, upstream string) ([]byte, error)) func(ctx context.Context, upstream string) ([]byte, error) {
+	r := h.Router
+	if r == nil {
+		return send
+	}
+	return func(ctx context.Context, upstream string) ([]byte, error) {
+		target, explored := upstream, false
+		if upstream == r.Current() {
+			if alt, ok := r.explore(); ok {
+				target, explored = alt, true
+			}
+		}
+		response, err := h.scoredSend(ctx, target, send)
+		if err != nil && explored && ctx.Err() == nil {
+			if h.Verbose {
+				queryLog(ctx).Info().Msgf("Exploring upstream %s failed, sending to %s", target, upstream)
+			}
+			return h.scoredSend(ctx, upstream, send)
+		}
+		return response, err
+	}
+}
+
+// scoredSend runs send and reports its outcome to the router. Exchanges cut
+// short by the client going away say nothing of the upstream.
+func (h *Handler) scoredSend(ctx context.Context, upstream string, send func(ctx context.Context, upstream string) ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	response, err := send(ctx, upstream)
+	if !errors.Is(err, context.Canceled) {
+		failed := err != nil || isServFail(response)
+		h.Router.observe(upstream, time.Since(start), failed)
+	}
+	return response, err
+}
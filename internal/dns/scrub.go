@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"lktr/internal/metrics"
+)
+
+// EDNS options revealing details about the client or the upstream server
+const (
+	optionNSID = 3 // name server identifier (RFC 5001)
+	optionECS  = 8 // client subnet (RFC 7871)
+)
+
+// ParseScrubOptions parses a comma-separated list of EDNS options to remove
+// from responses: "ecs", "nsid" or numeric option codes
+func ParseScrubOptions(spec string) ([]uint16, error) {
+	var codes []uint16
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "":
+			continue
+		case "ecs":
+			codes = append(codes, optionECS)
+		case "nsid":
+			codes = append(codes, optionNSID)
+		default:
+			code, err := strconv.ParseUint(name, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown EDNS option %q", name)
+			}
+			codes = append(codes, uint16(code))
+		}
+	}
+	return codes, nil
+}
+
+// scrubOptions removes the configured EDNS options from a response
+func (h *Handler) scrubOptions(response []byte) []byte {
+	if len(h.ScrubOptions) == 0 {
+		return response
+	}
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return response
+	}
+	data := withoutOption(m.Additional[i].Data, h.ScrubOptions...)
+	if len(data) == len(m.Additional[i].Data) {
+		return response
+	}
+	m.Additional[i].Data = data
+	metrics.ScrubbedResponses.Inc()
+	return m.Pack()
+}
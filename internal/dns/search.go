@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"lktr/pkg/matcher"
+)
+
+// resolvConfPath is where the pod's stub resolver configuration lives
+const resolvConfPath = "/etc/resolv.conf"
+
+// ParseSearchDomains parses a comma-separated search-domain list. The value
+// "auto" reads the search line of /etc/resolv.conf, which in Kubernetes holds
+// the namespace, svc and cluster suffixes the stub resolver appends.
+func ParseSearchDomains(spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "auto" {
+		return readResolvConfSearch(resolvConfPath)
+	}
+
+	var domains []string
+	for _, d := range strings.Split(spec, ",") {
+		if d = canonicalName(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains, nil
+}
+
+func readResolvConfSearch(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			// Later search/domain lines override earlier ones, as in the resolver
+			domains = domains[:0]
+			for _, d := range fields[1:] {
+				if d = canonicalName(d); d != "" {
+					domains = append(domains, d)
+				}
+			}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// stripSearchDomain removes the longest configured search suffix from name,
+// returning "" when none applies.
+func (h *Handler) stripSearchDomain(name string) string {
+	name = canonicalName(name)
+	best := ""
+	for _, d := range h.SearchDomains {
+		if len(d) > len(best) && strings.HasSuffix(name, "."+d) {
+			best = d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return strings.TrimSuffix(name, "."+best)
+}
+
+// match checks a query name against m. Names carrying a search-domain
+// expansion (example.com.ns.svc.cluster.local) are also checked with the
+// suffix removed, so rules written for the external name still apply.
+// Critical names are never reported as matched.
+func (h *Handler) match(m *matcher.Matcher, domain string) matcher.MatchResult {
+	result := m.Match(domain)
+	if !result.Matched && len(h.SearchDomains) > 0 {
+		if stripped := h.stripSearchDomain(domain); stripped != "" {
+			domain, result = stripped, m.Match(stripped)
+		}
+	}
+	return h.exemptCritical(domain, result)
+}
@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+)
+
+// Self-test checks, as in dns_selftest_status
+const (
+	SelfTestUpstream      = "upstream"
+	SelfTestBlockResponse = "block_response"
+)
+
+// selfTestName is blocked by the synthetic rule of the self-test, which is
+// only ever matched there; .invalid keeps it from resolving anywhere else
+const selfTestName = "lktr-selftest.invalid"
+
+// SelfTestResult is the outcome of one self-test check
+type SelfTestResult struct {
+	Check    string
+	OK       bool
+	Detail   string
+	Duration time.Duration
+}
+
+// SelfTest resolves canary through the upstream, over the same transport as
+// forwarded queries, and checks that a query matching a synthetic rule gets
+// the configured block response, without touching the enforced blocklist.
+// Each result is also exported in dns_selftest_status.
+func (h *Handler) SelfTest(ctx context.Context, canary string) []SelfTestResult {
+	results := []SelfTestResult{h.selfTestUpstream(ctx, canary), h.selfTestBlockResponse()}
+	for _, r := range results {
+		status := 0.0
+		if r.OK {
+			status = 1
+		}
+		metrics.SelfTestStatus.WithLabelValues(r.Check).Set(status)
+	}
+	return results
+}
+
+// selfTestUpstream passes when the upstream answers the canary with NOERROR
+// or NXDOMAIN, which shows it is reachable and resolving
+func (h *Handler) selfTestUpstream(ctx context.Context, canary string) SelfTestResult {
+	start := time.Now()
+	result := SelfTestResult{Check: SelfTestUpstream}
+	query := BuildQuery(uint16(rand.Uint32()), canary, TypeA)
+	response, err := h.exchange(ctx, h.snapshot(), query)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Detail = fmt.Sprintf("resolving %s failed: %v", canary, err)
+		return result
+	}
+	if reason := responseMismatch(query, response); reason != "" {
+		result.Detail = fmt.Sprintf("answer for %s does not match the query (%s)", canary, reason)
+		return result
+	}
+	resp, err := ParseMessage(response)
+	if err != nil {
+		result.Detail = fmt.Sprintf("invalid answer for %s: %v", canary, err)
+		return result
+	}
+	switch rcode := resp.Rcode(); rcode {
+	case RcodeSuccess, RcodeNXDomain:
+		result.OK = true
+		result.Detail = fmt.Sprintf("%s resolved with %s (%d answers)", canary, RcodeName(rcode), len(resp.Answers))
+	default:
+		result.Detail = fmt.Sprintf("upstream answered %s with %s", canary, RcodeName(rcode))
+	}
+	return result
+}
+
+// selfTestBlockResponse exercises the code path of blocked queries: name
+// matching as for client queries, and the blocked response the block
+// response mode calls for. The synthetic rule is matched in a matcher
+// of its own, so the check says nothing about the enforced blocklist, which
+// may block nothing yet at startup.
+func (h *Handler) selfTestBlockResponse() (result SelfTestResult) {
+	start := time.Now()
+	result.Check = SelfTestBlockResponse
+	defer func() { result.Duration = time.Since(start) }()
+
+	m := matcher.BuildMatcher([]string{selfTestName})
+	if !h.match(m, selfTestName).Matched {
+		result.Detail = fmt.Sprintf("synthetic rule %s did not match", selfTestName)
+		return result
+	}
+	if h.match(m, "other-"+selfTestName).Matched {
+		result.Detail = fmt.Sprintf("synthetic rule %s matched another name", selfTestName)
+		return result
+	}
+
+	query := BuildQuery(uint16(rand.Uint32()), selfTestName, TypeA)
+	response := h.blockedResponse(query, selfTestName)
+	if reason := responseMismatch(query, response); reason != "" {
+		result.Detail = fmt.Sprintf("blocked response does not match the query (%s)", reason)
+		return result
+	}
+	resp, err := ParseMessage(response)
+	if err != nil {
+		result.Detail = fmt.Sprintf("invalid blocked response: %v", err)
+		return result
+	}
+
+	mode := h.blockMode()
+	rcode, answers := RcodeSuccess, 0
+	switch mode {
+	case BlockNXDomain:
+		rcode = RcodeNXDomain
+	case BlockRefused:
+		rcode = RcodeRefused
+	case BlockSinkhole:
+		if h.Sinkhole != nil && h.Sinkhole.IPv4 != nil {
+			answers = 1
+		}
+	}
+	if resp.Rcode() != rcode || len(resp.Answers) != answers {
+		result.Detail = fmt.Sprintf("blocked response is %s with %d answers, want %s with %d for %s", RcodeName(resp.Rcode()), len(resp.Answers), RcodeName(rcode), answers, mode)
+		return result
+	}
+	if answers == 1 && !bytes.Equal(resp.Answers[0].Data, h.Sinkhole.IPv4) {
+		result.Detail = fmt.Sprintf("blocked response points at %v, want the sinkhole %v", resp.Answers[0].Data, h.Sinkhole.IPv4)
+		return result
+	}
+	result.OK = true
+	result.Detail = fmt.Sprintf("synthetic rule answered with %s (%s)", RcodeName(rcode), mode)
+	return result
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"sync"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxShadowRules bounds the number of distinct rules given their own
+// per-rule metric series; further rules are counted under "other"
+const maxShadowRules = 200
+
+// shadowState is a candidate blocklist evaluated alongside the enforced one
+type shadowState struct {
+	matcher *matcher.Matcher
+
+	mu    sync.Mutex
+	rules map[string]struct{} // rules that already have a metric series
+}
+
+// UpdateShadowMatcher loads a candidate blocklist in shadow mode. Every query
+// that uses the default blocklist is also evaluated against the candidate and
+// verdict differences are logged and counted, but only the enforced blocklist
+// decides. A nil matcher stops the comparison.
+func (h *Handler) UpdateShadowMatcher(m *matcher.Matcher) {
+	if st := h.snapshot(); (st.shadow == nil && m == nil) || (st.shadow != nil && m != nil && st.shadow.matcher.Equal(m)) {
+		return
+	}
+
+	var shadow *shadowState
+	if m != nil {
+		shadow = &shadowState{matcher: m, rules: make(map[string]struct{})}
+	}
+	h.update(func(st *handlerState) {
+		st.shadow = shadow
+	})
+
+	if m != nil {
+		metrics.ShadowActive.Set(1)
+		log.Info().Msgf("Shadow blocklist loaded with %d rules", m.Len())
+	} else {
+		metrics.ShadowActive.Set(0)
+		log.Info().Msg("Shadow blocklist removed")
+	}
+}
+
+// compareShadow evaluates domain against the shadow blocklist, if any, and
+// records how its verdict differs from the enforced one
+func (h *Handler) compareShadow(st *handlerState, policySet, domain string, enforced matcher.MatchResult) {
+	if st.shadow == nil || policySet != "" {
+		return
+	}
+
+	candidate := h.match(st.shadow.matcher, domain)
+	switch {
+	case candidate.Matched == enforced.Matched:
+		metrics.ShadowVerdicts.WithLabelValues("same").Inc()
+	case candidate.Matched:
+		log.Info().Msgf("[shadow] %s would be blocked by candidate rule %q", domain, candidate.Rule)
+		metrics.ShadowVerdicts.WithLabelValues("would_block").Inc()
+		metrics.ShadowRuleHits.WithLabelValues("would_block", st.shadow.ruleLabel(candidate.Rule)).Inc()
+	default:
+		log.Info().Msgf("[shadow] %s would be allowed, candidate drops rule %q", domain, enforced.Rule)
+		metrics.ShadowVerdicts.WithLabelValues("would_allow").Inc()
+		metrics.ShadowRuleHits.WithLabelValues("would_allow", st.shadow.ruleLabel(enforced.Rule)).Inc()
+	}
+}
+
+// ruleLabel returns the metric label for a rule, capping label cardinality
+func (s *shadowState) ruleLabel(rule string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rules[rule]; ok {
+		return rule
+	}
+	if len(s.rules) >= maxShadowRules {
+		return "other"
+	}
+	s.rules[rule] = struct{}{}
+	return rule
+}
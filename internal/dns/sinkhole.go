@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Block response modes, the answers given to blocked queries
+const (
+	BlockNXDomain = "nxdomain" // name error
+	BlockNoData   = "nodata"   // NOERROR with an empty answer
+	BlockRefused  = "refused"  // REFUSED
+	BlockSinkhole = "sinkhole" // the sinkhole address, for A and AAAA queries
+)
+
+// defaultSinkholeTTL is the TTL of synthesized sinkhole records, short so
+// clients pick up an unblocked name quickly
+const defaultSinkholeTTL = 60
+
+// ParseBlockResponseMode validates a block response mode name
+func ParseBlockResponseMode(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case BlockNXDomain, BlockNoData, BlockRefused, BlockSinkhole:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown block response mode %q (want %s, %s, %s or %s)", mode, BlockNXDomain, BlockNoData, BlockRefused, BlockSinkhole)
+}
+
+// Sinkhole answers blocked address queries with fixed addresses, and reverse lookups of those addresses with Name, so that
+// clients see where a blocked connection went.
+type Sinkhole struct {
+	IPv4 net.IP // answer to blocked A queries, nil for an empty answer
+	IPv6 net.IP // answer to blocked AAAA queries, nil for an empty answer
+	Name string // PTR target of the sinkhole addresses
+	TTL  uint32 // of the synthesized records
+
+	reverse []string // reverse lookup names of the addresses
+}
+
+// NewSinkhole parses the sinkhole addresses. Either may be empty, but not both.
+func NewSinkhole(ipv4, ipv6, name string) (*Sinkhole, error) {
+	s := &Sinkhole{Name: strings.TrimSuffix(name, "."), TTL: defaultSinkholeTTL}
+	if ipv4 != "" {
+		ip := net.ParseIP(ipv4).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("sinkhole address %q is not IPv4", ipv4)
+		}
+		s.IPv4 = ip
+		s.reverse = append(s.reverse, reverseName(ip))
+	}
+	if ipv6 != "" {
+		ip := net.ParseIP(ipv6)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("sinkhole address %q is not IPv6", ipv6)
+		}
+		s.IPv6 = ip
+		s.reverse = append(s.reverse, reverseName(ip))
+	}
+	if s.IPv4 == nil && s.IPv6 == nil {
+		return nil, fmt.Errorf("sinkhole needs an IPv4 or IPv6 address")
+	}
+	if s.Name == "" {
+		return nil, fmt.Errorf("sinkhole needs a name for reverse lookups")
+	}
+	return s, nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var sb strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip16[i]&0x0F, ip16[i]>>4)
+	}
+	sb.WriteString("ip6.arpa")
+	return sb.String()
+}
+
+// blockedResponse builds the answer to a query blocked by rule according to
+// the block response mode, with the Extended DNS Error when one is set
+func (h *Handler) blockedResponse(query []byte, rule string) []byte {
+	return h.withExtendedError(query, h.blockModeResponse(query), rule)
+}
+
+// blockModeResponse builds the answer to a blocked query according to the
+// block response mode: NXDOMAIN, an empty answer, REFUSED, or the sinkhole
+// address for A/AAAA and an empty answer for other types
+func (h *Handler) blockModeResponse(query []byte) []byte {
+	mode := h.blockMode()
+	if mode == BlockNXDomain || (mode == BlockSinkhole && h.Sinkhole == nil) {
+		return CreateNXDomainResponse(query)
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 {
+		return CreateNXDomainResponse(query)
+	}
+
+	question := q.Questions[0]
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	switch {
+	case mode == BlockRefused:
+		resp.SetRcode(RcodeRefused)
+	case mode != BlockSinkhole:
+	case question.Type == TypeA && h.Sinkhole.IPv4 != nil:
+		resp.Answers = []RR{{Name: question.Name, Type: TypeA, Class: ClassINET, TTL: h.Sinkhole.TTL, Data: h.Sinkhole.IPv4}}
+	case question.Type == TypeAAAA && h.Sinkhole.IPv6 != nil:
+		resp.Answers = []RR{{Name: question.Name, Type: TypeAAAA, Class: ClassINET, TTL: h.Sinkhole.TTL, Data: h.Sinkhole.IPv6.To16()}}
+	}
+	return resp.Pack()
+}
+
+// SetBlockResponseMode replaces BlockResponseMode with mode until it is
+// called again; "" restores BlockResponseMode. The sinkhole mode needs a
+// Sinkhole.
+func (h *Handler) SetBlockResponseMode(mode string) error {
+	if mode == BlockSinkhole && h.Sinkhole == nil {
+		return fmt.Errorf("block response mode %s needs a sinkhole address", mode)
+	}
+	h.update(func(st *handlerState) {
+		if st.blockResponse != mode && h.Verbose {
+			log.Info().Msgf("Block response mode set to %q", mode)
+		}
+		st.blockResponse = mode
+	})
+	return nil
+}
+
+// blockMode returns the block response mode in effect
+func (h *Handler) blockMode() string {
+	if mode := h.snapshot().blockResponse; mode != "" {
+		return mode
+	}
+	switch {
+	case h.BlockResponseMode != "":
+		return h.BlockResponseMode
+	case h.Sinkhole != nil:
+		return BlockSinkhole
+	}
+	return BlockNXDomain
+}
+
+// answerSinkholePTR answers reverse lookups of the sinkhole addresses with
+// the sinkhole name. The second result is false for any other query.
+func (h *Handler) answerSinkholePTR(query []byte) ([]byte, bool) {
+	if h.Sinkhole == nil {
+		return nil, false
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Type != TypePTR || q.Questions[0].Class != ClassINET {
+		return nil, false
+	}
+	question := q.Questions[0]
+	found := false
+	for _, name := range h.Sinkhole.reverse {
+		found = found || strings.EqualFold(question.Name, name)
+	}
+	if !found {
+		return nil, false
+	}
+
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagAA | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+		Answers:   []RR{{Name: question.Name, Type: TypePTR, Class: ClassINET, TTL: h.Sinkhole.TTL, Data: NameData(h.Sinkhole.Name)}},
+	}
+	if h.Verbose {
+		log.Info().Msgf("Answered reverse lookup %s with sinkhole name %s", question.Name, h.Sinkhole.Name)
+	}
+	return resp.Pack(), true
+}
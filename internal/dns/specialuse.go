@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// specialUseTTL is the TTL of answers for special-use domains
+const specialUseTTL = 300
+
+// Actions for special-use domains
+const (
+	SpecialLoopback = "loopback" // A/AAAA answered with 127.0.0.1/::1, other types empty
+	SpecialNXDomain = "nxdomain"
+	SpecialRefused  = "refused"
+	SpecialForward  = "forward" // no special handling
+)
+
+// defaultSpecialUse follows RFC 6761 for localhost and invalid, RFC 7686 for
+// onion, and RFC 6762 for local, whose names belong to multicast DNS and must
+// not reach unicast servers
+var defaultSpecialUse = map[string]string{
+	"localhost": SpecialLoopback,
+	"invalid":   SpecialNXDomain,
+	"onion":     SpecialNXDomain,
+	"local":     SpecialNXDomain,
+}
+
+// SpecialUse answers queries for special-use domain names locally instead of
+// leaking them to the upstream.
+type SpecialUse struct {
+	zones  map[string]string // action by domain
+	exempt []string          // domains always forwarded, such as a cluster domain under local
+}
+
+// ParseSpecialUse parses a comma-separated list of domain=action pairs that
+// override or extend the defaults, e.g. "local=forward,home.arpa=nxdomain".
+// Names at or below an exempt domain are always forwarded.
+func ParseSpecialUse(spec string, exempt ...string) (*SpecialUse, error) {
+	s := &SpecialUse{zones: make(map[string]string, len(defaultSpecialUse))}
+	for zone, action := range defaultSpecialUse {
+		s.zones[zone] = action
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		zone, action, ok := strings.Cut(entry, "=")
+		zone, action = canonicalName(zone), strings.ToLower(strings.TrimSpace(action))
+		if !ok || zone == "" {
+			return nil, fmt.Errorf("special-use entry %q is not domain=action", entry)
+		}
+		switch action {
+		case SpecialLoopback, SpecialNXDomain, SpecialRefused, SpecialForward:
+		default:
+			return nil, fmt.Errorf("special-use domain %s: unknown action %q", zone, action)
+		}
+		s.zones[zone] = action
+	}
+	for _, d := range exempt {
+		if d = canonicalName(d); d != "" {
+			s.exempt = append(s.exempt, d)
+		}
+	}
+	return s, nil
+}
+
+// action returns the action for name and the special-use domain it falls
+// under, preferring the longest one
+func (s *SpecialUse) action(name string) (string, string) {
+	name = canonicalName(name)
+	for _, d := range s.exempt {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return SpecialForward, ""
+		}
+	}
+	for zone := name; zone != ""; zone = parentName(zone) {
+		if action, ok := s.zones[zone]; ok {
+			return action, zone
+		}
+	}
+	return SpecialForward, ""
+}
+
+// answerSpecialUse answers queries for special-use domains. The second
+// result is false for queries that should be forwarded.
+func (h *Handler) answerSpecialUse(query []byte) ([]byte, bool) {
+	if h.SpecialUse == nil {
+		return nil, false
+	}
+	q, err := ParseMessage(query)
+	if err != nil || len(q.Questions) != 1 || q.Questions[0].Class != ClassINET {
+		return nil, false
+	}
+	question := q.Questions[0]
+	action, zone := h.SpecialUse.action(question.Name)
+	if action == SpecialForward {
+		return nil, false
+	}
+
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagAA | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	switch action {
+	case SpecialLoopback:
+		switch question.Type {
+		case TypeA:
+			resp.Answers = []RR{{Name: question.Name, Type: TypeA, Class: ClassINET, TTL: specialUseTTL, Data: net.IPv4(127, 0, 0, 1).To4()}}
+		case TypeAAAA:
+			resp.Answers = []RR{{Name: question.Name, Type: TypeAAAA, Class: ClassINET, TTL: specialUseTTL, Data: net.IPv6loopback}}
+		}
+	case SpecialNXDomain:
+		resp.SetRcode(RcodeNXDomain)
+		resp.Authority = []RR{{Name: zone, Type: TypeSOA, Class: ClassINET, TTL: specialUseTTL, Data: defaultSOA(zone)}}
+	case SpecialRefused:
+		resp.Flags &^= flagAA
+		resp.SetRcode(RcodeRefused)
+	}
+
+	if h.Verbose {
+		log.Info().Msgf("Answered %s locally as special-use domain %s (%s)", question.Name, zone, action)
+	}
+	return resp.Pack(), true
+}
@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+)
+
+// SvcParamKeys of RFC 9460 the handler reads
+const (
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+)
+
+// svcParam is one key and value of the parameters of an SVCB or HTTPS record
+type svcParam struct {
+	key   uint16
+	value []byte
+}
+
+// parseSVCB splits the RDATA of an SVCB or HTTPS record into its priority,
+// target name and parameters. RFC 9460 forbids compressing the target, so
+// the RDATA is parsed as stored.
+func parseSVCB(data []byte) (priority uint16, target string, params []svcParam, ok bool) {
+	if len(data) < 3 {
+		return 0, "", nil, false
+	}
+	priority = binary.BigEndian.Uint16(data)
+	target, off, err := readName(data, 2)
+	if err != nil {
+		return 0, "", nil, false
+	}
+	for off < len(data) {
+		if off+4 > len(data) {
+			return 0, "", nil, false
+		}
+		key, length := binary.BigEndian.Uint16(data[off:]), int(binary.BigEndian.Uint16(data[off+2:]))
+		if off+4+length > len(data) {
+			return 0, "", nil, false
+		}
+		params = append(params, svcParam{key: key, value: data[off+4 : off+4+length]})
+		off += 4 + length
+	}
+	return priority, target, params, true
+}
+
+// serviceHints returns the ipv4hint and ipv6hint addresses of an SVCB or
+// HTTPS record, which clients may connect to without an A or AAAA lookup
+func serviceHints(rr RR) []netip.Addr {
+	if rr.Type != TypeSVCB && rr.Type != TypeHTTPS {
+		return nil
+	}
+	_, _, params, ok := parseSVCB(rr.Data)
+	if !ok {
+		return nil
+	}
+	var addrs []netip.Addr
+	for _, p := range params {
+		size := 0
+		switch p.key {
+		case svcParamIPv4Hint:
+			size = net.IPv4len
+		case svcParamIPv6Hint:
+			size = net.IPv6len
+		default:
+			continue
+		}
+		for v := p.value; len(v) >= size; v = v[size:] {
+			if addr, ok := netip.AddrFromSlice(v[:size]); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// inspectServiceBindings replaces a forwarded answer with the blocked
+// response when an SVCB or HTTPS record in it points clients at a name m
+// blocks. Browsers connect to the target name of HTTPS records, and to
+// their address hints, without the A and AAAA queries the blocklist would
+// catch. It returns the response to send and the matching rule, "" when the
+// answer stands. In dry-run mode a match is only logged.
+func (h *Handler) inspectServiceBindings(ctx context.Context, st *handlerState, m *matcher.Matcher, client net.Addr, domain, protocol string, query, response []byte) ([]byte, string) {
+	if !h.InspectSVCB || m == nil {
+		return response, ""
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || len(msg.Answers) == 0 {
+		return response, ""
+	}
+	for _, rr := range msg.Answers {
+		if rr.Type != TypeSVCB && rr.Type != TypeHTTPS {
+			continue
+		}
+		// An empty target is the owner name, which was matched as queried
+		target := recordTarget(rr)
+		if target == "" {
+			continue
+		}
+		result := h.match(m, target)
+		if !result.Matched {
+			continue
+		}
+		if st.dryRun {
+			queryLog(ctx).Info().Msgf("DryRun Mode enabled not blocking %s - %s target %s matches rule %q", domain, TypeName(rr.Type), target, result.Rule)
+			h.recordDryRun(client, domain, result.Rule)
+			return response, ""
+		}
+		queryLog(ctx).Info().Msgf("Blocking %s - %s target %s matches rule %q", domain, TypeName(rr.Type), target, result.Rule)
+		metrics.SVCBBlocked.WithLabelValues(protocol).Inc()
+		return h.blockedResponse(query, result.Rule), result.Rule
+	}
+	return response, ""
+}
+
+// stripECH removes the ech parameter from the SVCB and HTTPS records of a
+// response, so that clients fall back to a plain TLS handshake whose SNI
+// the network can still see. The response is returned unchanged when no
+// record carries one.
+func (h *Handler) stripECH(response []byte) []byte {
+	if !h.StripECH {
+		return response
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || !hasType(msg.Answers, TypeHTTPS) && !hasType(msg.Answers, TypeSVCB) {
+		return response
+	}
+	stripped := 0
+	for i, rr := range msg.Answers {
+		if data, ok := withoutSvcParam(rr, svcParamECH); ok {
+			msg.Answers[i].Data = data
+			stripped++
+		}
+	}
+	if stripped == 0 {
+		return response
+	}
+	metrics.ECHStripped.Add(float64(stripped))
+	return msg.Pack()
+}
+
+// withoutSvcParam returns the RDATA of an SVCB or HTTPS record without the
+// parameter key, and false when the record is of another type or has no
+// such parameter
+func withoutSvcParam(rr RR, key uint16) ([]byte, bool) {
+	if rr.Type != TypeSVCB && rr.Type != TypeHTTPS {
+		return nil, false
+	}
+	priority, target, params, ok := parseSVCB(rr.Data)
+	if !ok {
+		return nil, false
+	}
+	data := appendName(binary.BigEndian.AppendUint16(nil, priority), target)
+	found := false
+	for _, p := range params {
+		if p.key == key {
+			found = true
+			continue
+		}
+		data = binary.BigEndian.AppendUint16(data, p.key)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(p.value)))
+		data = append(data, p.value...)
+	}
+	return data, found
+}
+
+// svcbString formats SVCB and HTTPS RDATA in presentation format
+func svcbString(data []byte) (string, bool) {
+	priority, target, params, ok := parseSVCB(data)
+	if !ok {
+		return "", false
+	}
+	parts := []string{strconv.Itoa(int(priority)), fqdn(target)}
+	for _, p := range params {
+		parts = append(parts, svcParamString(p))
+	}
+	return strings.Join(parts, " "), true
+}
+
+func svcParamString(p svcParam) string {
+	switch p.key {
+	case svcParamALPN:
+		var ids []string
+		for v := p.value; len(v) > 0 && 1+int(v[0]) <= len(v); v = v[1+int(v[0]):] {
+			ids = append(ids, string(v[1:1+int(v[0])]))
+		}
+		return "alpn=" + strings.Join(ids, ",")
+	case svcParamNoDefaultALPN:
+		return "no-default-alpn"
+	case svcParamPort:
+		if len(p.value) == 2 {
+			return "port=" + strconv.Itoa(int(binary.BigEndian.Uint16(p.value)))
+		}
+	case svcParamIPv4Hint, svcParamIPv6Hint:
+		name, size := "ipv4hint=", net.IPv4len
+		if p.key == svcParamIPv6Hint {
+			name, size = "ipv6hint=", net.IPv6len
+		}
+		var addrs []string
+		for v := p.value; len(v) >= size; v = v[size:] {
+			addrs = append(addrs, net.IP(v[:size]).String())
+		}
+		return name + strings.Join(addrs, ",")
+	case svcParamECH:
+		return "ech=" + base64.StdEncoding.EncodeToString(p.value)
+	}
+	return fmt.Sprintf("key%d=%q", p.key, p.value)
+}
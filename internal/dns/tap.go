@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Query verdicts reported to tap subscribers
+const (
+	VerdictBlocked = "blocked"
+	VerdictAllowed = "allowed"
+	VerdictLocal   = "local"
+	VerdictFailed  = "failed"
+)
+
+// QueryEvent describes one answered query
+type QueryEvent struct {
+	ID        string // query ID, as in the query's log lines
+	Time      time.Time
+	Client    string
+	Name      string
+	Type      string
+	Protocol  string
+	Verdict   string
+	Rule      string // matching rule, for blocked queries and dry-run matches
+	PolicySet string // deciding policy set, "" for the default blocklist
+}
+
+// QueryTap fans query events out to live subscribers. Slow subscribers miss
+// events rather than slowing down the query path.
+type QueryTap struct {
+	mu          sync.Mutex
+	subscribers map[chan QueryEvent]struct{}
+	active      atomic.Int32
+}
+
+// NewQueryTap returns a tap without subscribers
+func NewQueryTap() *QueryTap {
+	return &QueryTap{subscribers: make(map[chan QueryEvent]struct{})}
+}
+
+// Subscribe returns a channel receiving events and a function that ends the subscription
+func (t *QueryTap) Subscribe(buffer int) (<-chan QueryEvent, func()) {
+	ch := make(chan QueryEvent, buffer)
+	t.mu.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mu.Unlock()
+	t.active.Add(1)
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subscribers, ch)
+			t.mu.Unlock()
+			t.active.Add(-1)
+		})
+	}
+}
+
+func (t *QueryTap) publish(ev QueryEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// recordQuery reports an answered query to the per-client statistics and to
+// the tap, if anyone is listening
+func (h *Handler) recordQuery(ctx context.Context, client net.Addr, name, qtype, protocol, verdict, rule, policySet string) {
+	if h.ClientStats != nil {
+		h.ClientStats.record(clientIP(client), verdict)
+	}
+	if h.Tap == nil || h.Tap.active.Load() == 0 {
+		return
+	}
+	h.Tap.publish(QueryEvent{
+		ID:        QueryID(ctx),
+		Time:      time.Now(),
+		Client:    client.String(),
+		Name:      name,
+		Type:      qtype,
+		Protocol:  protocol,
+		Verdict:   verdict,
+		Rule:      rule,
+		PolicySet: policySet,
+	})
+}
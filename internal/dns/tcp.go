@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTCPMessageSize is the largest DNS message a two-byte length prefix
+// can frame
+const maxTCPMessageSize = 65535
+
+// maxTCPPipeline bounds the queries of one client connection answered at the
+// same time; further ones are read once an answer is out
+const maxTCPPipeline = 32
+
+// tcpClientConn is a client connection whose queries are answered
+// concurrently. Writes are serialized so that each answer goes out whole.
+type tcpClientConn struct {
+	net.Conn
+	mu      sync.Mutex
+	aborted atomic.Bool
+}
+
+func (c *tcpClientConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// abort stops reading further queries from the connection, which closes once
+// the answers in progress are written
+func (c *tcpClientConn) abort() {
+	c.aborted.Store(true)
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// writeTCPMessage sends a DNS message with its two-byte length prefix, in a
+// single write so that concurrent answers on a connection do not interleave
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	if len(msg) > maxTCPMessageSize {
+		return fmt.Errorf("DNS message of %d bytes exceeds the TCP length prefix", len(msg))
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := conn.Write(append(frame, msg...))
+	return err
+}
+
+// readTCPLength reads the two-byte length prefix of a DNS message
+func readTCPLength(r io.Reader) (int, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(prefix[:])), nil
+}
+
+// readTCPBody reads the n bytes of a DNS message following its length
+// prefix, however the peer split them into segments. A connection closed
+// before the last of them is io.ErrUnexpectedEOF.
+func readTCPBody(r io.Reader, n int) ([]byte, error) {
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readTCPMessage reads a DNS message preceded by its two-byte length prefix
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	n, err := readTCPLength(r)
+	if err != nil {
+		return nil, err
+	}
+	return readTCPBody(r, n)
+}
@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"lktr/pkg/matcher"
+)
+
+// frame returns msg with its two-byte length prefix
+func frame(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestReadTCPMessageFragmented(t *testing.T) {
+	query := BuildQuery(0x1234, "fragmented.example.com", TypeA)
+	readers := map[string]func(io.Reader) io.Reader{
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data EOF": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			r := wrap(bytes.NewReader(append(frame(query), frame(query)...)))
+			for i := range 2 {
+				msg, err := readTCPMessage(r)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if !bytes.Equal(msg, query) {
+					t.Fatalf("message %d: got %x, want %x", i, msg, query)
+				}
+			}
+			if _, err := readTCPMessage(r); err != io.EOF {
+				t.Fatalf("after the last message: got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadTCPMessageZeroLength(t *testing.T) {
+	msg, err := readTCPMessage(bytes.NewReader([]byte{0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != 0 {
+		t.Fatalf("got %d bytes, want none", len(msg))
+	}
+}
+
+func TestReadTCPMessageTruncated(t *testing.T) {
+	tests := map[string][]byte{
+		"half a prefix":         {0},
+		"no body":               {0, 12},
+		"body shorter":          append([]byte{0, 12}, make([]byte, 5)...),
+		"one byte short of 64K": append([]byte{0xFF, 0xFF}, make([]byte, 0xFFFE)...),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := readTCPMessage(iotest.OneByteReader(bytes.NewReader(data)))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestWriteTCPMessage(t *testing.T) {
+	if err := writeTCPMessage(nil, make([]byte, maxTCPMessageSize+1)); err == nil {
+		t.Fatal("no error writing a message longer than the length prefix can frame")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	msg := bytes.Repeat([]byte{0xAB}, maxTCPMessageSize)
+	go func() {
+		if err := writeTCPMessage(server, msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	got, err := readTCPMessage(iotest.HalfReader(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %d bytes back, want %d", len(got), len(msg))
+	}
+}
+
+// TestHandleTCPFragmented sends two pipelined queries to HandleTCP one byte
+// at a time and expects both answered
+func TestHandleTCPFragmented(t *testing.T) {
+	h := NewHandler("127.0.0.1:1", false, matcher.BuildMatcher([]string{"blocked.example.com"}), false, "", 0, "", "", "", false, nil)
+	h.TCPIdleTimeout = time.Second
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		h.HandleTCP(context.Background(), server)
+		close(done)
+	}()
+
+	ids := []uint16{0x0101, 0x0202}
+	var stream []byte
+	for _, id := range ids {
+		stream = append(stream, frame(BuildQuery(id, "blocked.example.com", TypeA))...)
+	}
+	go func() {
+		for i := range stream {
+			if _, err := client.Write(stream[i : i+1]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answered := make(map[uint16]bool)
+	for range ids {
+		response, err := readTCPMessage(iotest.OneByteReader(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseMessage(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Flags&0x8000 == 0 || len(m.Questions) != 1 || m.Questions[0].Name != "blocked.example.com" {
+			t.Fatalf("unexpected response %x", response)
+		}
+		answered[m.ID] = true
+	}
+	for _, id := range ids {
+		if !answered[id] {
+			t.Errorf("query %#04x not answered", id)
+		}
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleTCP did not return after the client closed the connection")
+	}
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+)
+
+// TCPPool keeps upstream TCP connections open between queries for as long as
+// the upstream allows through edns-tcp-keepalive. Upstreams that do not
+// announce a timeout get a connection per query, as without a pool.
+type TCPPool struct {
+	MaxIdle int // idle connections kept per upstream
+
+	mu   sync.Mutex
+	idle map[string][]pooledConn
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	expires time.Time
+}
+
+func NewTCPPool(maxIdle int) *TCPPool {
+	return &TCPPool{MaxIdle: maxIdle, idle: make(map[string][]pooledConn)}
+}
+
+// get returns an idle connection to upstream, or nil when there is none
+func (p *TCPPool) get(upstream string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[upstream]
+	now := time.Now()
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if now.Before(pc.expires) {
+			p.idle[upstream] = conns
+			return pc.conn
+		}
+		pc.conn.Close()
+	}
+	delete(p.idle, upstream)
+	return nil
+}
+
+// put returns a connection to the pool for reuse within the announced idle
+// timeout, closing it when the pool is full
+func (p *TCPPool) put(upstream string, conn net.Conn, idle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[upstream]) >= p.MaxIdle {
+		conn.Close()
+		return
+	}
+	// Give the connection back slightly before the upstream would close it
+	p.idle[upstream] = append(p.idle[upstream], pooledConn{conn: conn, expires: time.Now().Add(idle * 4 / 5)})
+}
+
+// exchangeTCP sends query to upstream over TCP and returns the response,
+// reusing a pooled connection when one is available
+func (h *Handler) exchangeTCP(ctx context.Context, upstream string, query []byte, protocol string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+
+	if h.UpstreamPool == nil {
+		conn, err := h.dialTCP(ctx, upstream, protocol)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return h.roundTripTCP(ctx, conn, query, protocol, true)
+	}
+
+	query, addedOPT := setKeepalive(query, -1)
+	conn := h.UpstreamPool.get(upstream)
+	if conn != nil {
+		metrics.UpstreamTCPConns.WithLabelValues("reused").Inc()
+		response, err := h.roundTripTCP(ctx, conn, query, protocol, false)
+		if err == nil {
+			return h.releaseTCP(upstream, conn, response, addedOPT), nil
+		}
+		// The upstream may have closed the idle connection in the meantime;
+		// retry once on a fresh one
+		conn.Close()
+	}
+
+	conn, err := h.dialTCP(ctx, upstream, protocol)
+	if err != nil {
+		return nil, err
+	}
+	response, err := h.roundTripTCP(ctx, conn, query, protocol, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return h.releaseTCP(upstream, conn, response, addedOPT), nil
+}
+
+// releaseTCP pools conn if the upstream announced a keepalive timeout in
+// response, and returns response without the keepalive negotiation
+func (h *Handler) releaseTCP(upstream string, conn net.Conn, response []byte, addedOPT bool) []byte {
+	if timeout, ok := keepaliveOption(response); ok && timeout > 0 {
+		h.UpstreamPool.put(upstream, conn, timeout)
+	} else {
+		conn.Close()
+	}
+	return removeKeepalive(response, addedOPT)
+}
+
+func (h *Handler) dialTCP(ctx context.Context, upstream, protocol string) (net.Conn, error) {
+	conn, err := h.dialUpstream(ctx, "tcp", upstream)
+	if err != nil {
+		err = upstreamError(err)
+		queryLog(ctx).Err(err).Msg("Failed to connect to upstream DNS via TCP:")
+		countError(err, metrics.ErrorTypeUpstreamDial, protocol)
+		return nil, err
+	}
+	metrics.UpstreamTCPConns.WithLabelValues("new").Inc()
+	return conn, nil
+}
+
+// roundTripTCP writes one framed query and reads the framed response. Errors
+// are logged and counted only when report is set, so a failed attempt on a
+// reused connection can be retried silently.
+func (h *Handler) roundTripTCP(ctx context.Context, conn net.Conn, query []byte, protocol string, report bool) ([]byte, error) {
+	stop := bindConn(ctx, conn)
+	defer stop()
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		err = upstreamError(err)
+		if report {
+			queryLog(ctx).Err(err).Msg("Failed to send query to upstream:")
+			countError(err, metrics.ErrorTypeUpstreamWrite, protocol)
+		}
+		return nil, err
+	}
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Forwarded TCP query to %s", conn.RemoteAddr())
+	}
+
+	response, err := readTCPMessage(conn)
+	if err != nil {
+		err = upstreamError(err)
+		if report {
+			queryLog(ctx).Err(err).Msg("Failed to read response from upstream:")
+			countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+		}
+		return nil, err
+	}
+
+	// A stale response on a reused connection fails the attempt, which is
+	// then retried on a fresh one
+	if reason := responseMismatch(query, response); reason != "" {
+		metrics.UpstreamMismatches.WithLabelValues(reason).Inc()
+		err := fmt.Errorf("%w (%s)", ErrResponseMismatch, reason)
+		if report {
+			queryLog(ctx).Err(err).Msgf("Dropped a response from %s:", conn.RemoteAddr())
+			countError(err, metrics.ErrorTypeUpstreamRead, protocol)
+		}
+		return nil, err
+	}
+
+	if h.Verbose {
+		queryLog(ctx).Info().Msgf("Received %d bytes from upstream via TCP", len(response))
+	}
+	return response, nil
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"slices"
+	"strings"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// threatFeed is the matcher compiled from the indicators of one feed
+type threatFeed struct {
+	name    string
+	matcher *matcher.Matcher
+}
+
+// UpdateThreatFeed replaces the rules of a threat-intelligence feed. They
+// block queries from every client on top of the blocklist, whose exceptions
+// still apply. A nil or empty matcher removes the feed.
+func (h *Handler) UpdateThreatFeed(name string, m *matcher.Matcher) {
+	if m != nil && m.Len() == 0 {
+		m = nil
+	}
+	st := h.snapshot()
+	i := slices.IndexFunc(st.threatFeeds, func(f threatFeed) bool { return f.name == name })
+	if (i < 0 && m == nil) || (i >= 0 && m != nil && st.threatFeeds[i].matcher.Equal(m)) {
+		return
+	}
+	h.update(func(st *handlerState) {
+		feeds := slices.DeleteFunc(slices.Clone(st.threatFeeds), func(f threatFeed) bool { return f.name == name })
+		if m != nil {
+			feeds = append(feeds, threatFeed{name: name, matcher: m})
+			slices.SortFunc(feeds, func(a, b threatFeed) int { return strings.Compare(a.name, b.name) })
+		}
+		st.threatFeeds = feeds
+	})
+	if m != nil {
+		log.Info().Msgf("Threat feed %s loaded: %d rules", name, m.Len())
+	} else {
+		log.Info().Msgf("Threat feed %s cleared", name)
+	}
+}
+
+// matchThreatFeeds matches domain against the feeds in name order. The rule
+// of a match names the feed, e.g. "feed:abuse evil.example.com".
+func (h *Handler) matchThreatFeeds(st *handlerState, domain string) matcher.MatchResult {
+	for _, f := range st.threatFeeds {
+		result := h.match(f.matcher, domain)
+		if !result.Matched {
+			continue
+		}
+		metrics.ThreatFeedBlocked.WithLabelValues(f.name).Inc()
+		result.Rule = "feed:" + f.name + " " + result.Rule
+		return result
+	}
+	return matcher.MatchResult{}
+}
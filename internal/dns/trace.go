@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxQueryIDLength bounds the ID a client may send in the query ID option
+const maxQueryIDLength = 32
+
+type queryIDKey struct{}
+
+// withQueryID returns ctx carrying the ID that correlates the log lines and
+// tap event of one query. With QueryIDOption set, an ID the client sent in
+// that option is kept, so proxies chained in front of each other log the
+// same ID for a lookup.
+func (h *Handler) withQueryID(ctx context.Context, query []byte) context.Context {
+	var id string
+	if h.QueryIDOption != 0 {
+		if m, err := ParseMessage(query); err == nil {
+			if i := findOPT(m); i >= 0 {
+				if data, ok := findOption(m.Additional[i].Data, h.QueryIDOption); ok && len(data) > 0 && len(data) <= maxQueryIDLength {
+					id = hex.EncodeToString(data)
+				}
+			}
+		}
+	}
+	if id == "" {
+		id = fmt.Sprintf("%016x", rand.Uint64())
+	}
+	return context.WithValue(ctx, queryIDKey{}, id)
+}
+
+// QueryID returns the ID of the query ctx belongs to, "" outside a query
+func QueryID(ctx context.Context) string {
+	id, _ := ctx.Value(queryIDKey{}).(string)
+	return id
+}
+
+// queryLog returns the logger for the query ctx belongs to, which adds the
+// query ID to every line
+func queryLog(ctx context.Context) *zerolog.Logger {
+	id := QueryID(ctx)
+	if id == "" {
+		return &log.Logger
+	}
+	l := log.With().Str("query_id", id).Logger()
+	return &l
+}
+
+// tagQuery returns query carrying the query ID in the QueryIDOption EDNS
+// option, so the upstream can log it. An OPT record is added when the query
+// has none, advertising no more than the 512 bytes a client without EDNS can
+// receive; addedOPT reports that, so the caller can remove it again from the
+// response.
+func (h *Handler) tagQuery(ctx context.Context, query []byte) (_ []byte, addedOPT bool) {
+	if h.QueryIDOption == 0 {
+		return query, false
+	}
+	id, err := hex.DecodeString(QueryID(ctx))
+	if err != nil || len(id) == 0 {
+		return query, false
+	}
+	m, err := ParseMessage(query)
+	if err != nil {
+		return query, false
+	}
+	i := findOPT(m)
+	if i < 0 {
+		m.Additional = append(m.Additional, RR{Type: TypeOPT, Class: 512})
+		i = len(m.Additional) - 1
+		addedOPT = true
+	}
+	opt := &m.Additional[i]
+	opt.Data = append(withoutOption(opt.Data, h.QueryIDOption), byte(h.QueryIDOption>>8), byte(h.QueryIDOption), 0, byte(len(id)))
+	opt.Data = append(opt.Data, id...)
+	return m.Pack(), addedOPT
+}
+
+// untagResponse removes the query ID option from a response whose upstream
+// echoed it, and the OPT record when tagQuery added it
+func (h *Handler) untagResponse(response []byte, addedOPT bool) []byte {
+	if h.QueryIDOption == 0 {
+		return response
+	}
+	m, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	i := findOPT(m)
+	if i < 0 {
+		return response
+	}
+	if addedOPT {
+		m.Additional = append(m.Additional[:i], m.Additional[i+1:]...)
+		return m.Pack()
+	}
+	if _, ok := findOption(m.Additional[i].Data, h.QueryIDOption); !ok {
+		return response
+	}
+	m.Additional[i].Data = withoutOption(m.Additional[i].Data, h.QueryIDOption)
+	return m.Pack()
+}
@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"fmt"
+
+	"lktr/internal/metrics"
+)
+
+// TTLClamp bounds the TTLs of upstream answers. Lowering long TTLs makes
+// policy changes reach client caches sooner; raising tiny ones spares the
+// upstream queries for names that are looked up constantly.
+type TTLClamp struct {
+	Min uint32 // seconds, 0 for no lower bound
+	Max uint32 // seconds, 0 for no upper bound
+}
+
+// NewTTLClamp returns a clamp to at least min and at most max seconds, of
+// which 0 disables either bound. It returns nil when both are 0.
+func NewTTLClamp(min, max int) (*TTLClamp, error) {
+	if min < 0 || max < 0 {
+		return nil, fmt.Errorf("TTL bounds cannot be negative")
+	}
+	if max > 0 && min > max {
+		return nil, fmt.Errorf("minimum TTL %ds is above the maximum %ds", min, max)
+	}
+	if min == 0 && max == 0 {
+		return nil, nil
+	}
+	return &TTLClamp{Min: uint32(min), Max: uint32(max)}, nil
+}
+
+// clamp returns ttl within the bounds
+func (c *TTLClamp) clamp(ttl uint32) uint32 {
+	if c.Max > 0 && ttl > c.Max {
+		return c.Max
+	}
+	return max(ttl, c.Min)
+}
+
+// clampTTLs rewrites the TTLs of the records of a forwarded response that
+// fall outside the clamp, in every section but the OPT record, whose TTL
+// field carries EDNS flags. The response is returned unchanged when every
+// TTL is within bounds.
+func (h *Handler) clampTTLs(response []byte) []byte {
+	if h.TTLClamp == nil {
+		return response
+	}
+	msg, err := ParseMessage(response)
+	if err != nil {
+		return response
+	}
+	raised, lowered := 0, 0
+	for _, section := range [][]RR{msg.Answers, msg.Authority, msg.Additional} {
+		for i := range section {
+			rr := &section[i]
+			if rr.Type == TypeOPT {
+				continue
+			}
+			switch ttl := h.TTLClamp.clamp(rr.TTL); {
+			case ttl > rr.TTL:
+				raised++
+				rr.TTL = ttl
+			case ttl < rr.TTL:
+				lowered++
+				rr.TTL = ttl
+			}
+		}
+	}
+	if raised == 0 && lowered == 0 {
+		return response
+	}
+	if raised > 0 {
+		metrics.TTLClamped.WithLabelValues("raised").Add(float64(raised))
+	}
+	if lowered > 0 {
+		metrics.TTLClamped.WithLabelValues("lowered").Add(float64(lowered))
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"encoding/binary"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpdateTypeRules replaces the query-type rules. A nil matcher removes them.
+func (h *Handler) UpdateTypeRules(m *matcher.TypeMatcher) {
+	if m != nil && m.Len() == 0 {
+		m = nil
+	}
+	if st := h.snapshot(); (st.typeRules == nil && m == nil) || (st.typeRules != nil && m != nil && st.typeRules.Equal(m)) {
+		return
+	}
+	h.update(func(st *handlerState) {
+		st.typeRules = m
+	})
+	if m != nil {
+		log.Info().Msgf("Query type rules loaded: %d rules", m.Len())
+	} else {
+		log.Info().Msg("Query type rules cleared")
+	}
+}
+
+// matchType applies the query-type rules to query, whose question is for
+// domain. The type is read from the message itself, as the mnemonic the
+// handler logs does not name every type.
+func (h *Handler) matchType(st *handlerState, domain string, query []byte) matcher.MatchResult {
+	if st.typeRules == nil {
+		return matcher.MatchResult{}
+	}
+	qtype, ok := questionType(query)
+	if !ok {
+		return matcher.MatchResult{}
+	}
+	result := h.exemptCritical(domain, st.typeRules.Match(domain, qtype))
+	if result.Matched {
+		metrics.QueryTypeBlocked.WithLabelValues(TypeName(qtype)).Inc()
+	}
+	return result
+}
+
+// questionType returns the type of the first question of query
+func questionType(query []byte) (uint16, bool) {
+	_, end, err := readName(query, headerLength)
+	if err != nil || end+2 > len(query) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(query[end:]), true
+}
+
+// blockedAnswer is the response to a query blocked with result: REFUSED
+// for rules that refuse, otherwise the blocked response
+func (h *Handler) blockedAnswer(query []byte, result matcher.MatchResult) []byte {
+	if !result.Refuse {
+		return h.blockedResponse(query, result.Rule)
+	}
+	q, err := ParseMessage(query)
+	if err != nil {
+		return CreateServFailResponse(query)
+	}
+	resp := &Message{
+		ID:        q.ID,
+		Flags:     flagQR | flagRA | q.Flags&flagRD,
+		Questions: q.Questions,
+	}
+	resp.SetRcode(RcodeRefused)
+	return h.withExtendedError(query, resp.Pack(), result.Rule)
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// upstreamTimeout bounds a single exchange with the upstream resolver
+const upstreamTimeout = 5 * time.Second
+
+// upstreamDialer opens upstream connections, through dialSocket; dials give
+// up when the query context is done
+var upstreamDialer net.Dialer
+
+// dialUpstream connects to a plain DNS upstream, over both address families
+// with HappyEyeballs, tracking its sockets for loop detection
+func (h *Handler) dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := h.HappyEyeballs.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return h.LoopGuard.track(network, conn), nil
+}
+
+// upstream returns the plain DNS upstream: the one sent by the controller,
+// the one Router rates best, or UpstreamDNS
+func (h *Handler) upstream(st *handlerState) string {
+	if st.upstream != "" {
+		return st.upstream
+	}
+	if h.Router != nil {
+		return h.Router.Current()
+	}
+	return h.UpstreamDNS
+}
+
+// SetUpstream replaces UpstreamDNS with addr until it is called again; ""
+// restores UpstreamDNS
+func (h *Handler) SetUpstream(addr string) {
+	h.update(func(st *handlerState) {
+		if st.upstream != addr && h.Verbose {
+			shown := addr
+			if shown == "" {
+				shown = h.UpstreamDNS
+			}
+			log.Info().Msgf("Upstream set to %s", shown)
+		}
+		st.upstream = addr
+	})
+}
+
+// defaultZone is the zone label of exchanges for names outside the
+// forwarding zones
+const defaultZone = "."
+
+// countExchange records the outcome and duration of an exchange with
+// upstream for a query in zone. Exchanges cut short by the client going
+// away are left out.
+func countExchange(upstream, zone string, start time.Time, response []byte, err error) {
+	result := "success"
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		result = "error"
+	case isServFail(response):
+		result = "servfail"
+	}
+	metrics.UpstreamExchanges.WithLabelValues(upstream, zone, result).Inc()
+	metrics.UpstreamExchangeDuration.WithLabelValues(upstream, zone).Observe(time.Since(start).Seconds())
+}
+
+// counted wraps the send function of forwarded queries outside the
+// forwarding zones with countExchange
+func counted(send func(ctx context.Context, upstream string) ([]byte, error)) func(ctx context.Context, upstream string) ([]byte, error) {
+	return func(ctx context.Context, upstream string) ([]byte, error) {
+		start := time.Now()
+		response, err := send(ctx, upstream)
+		countExchange(upstream, defaultZone, start, response, err)
+		return response, err
+	}
+}
+
+// isServFail reports whether response carries the SERVFAIL response code
+func isServFail(response []byte) bool {
+	return len(response) >= headerLength && int(response[3]&0x0F) == RcodeServFail
+}
+
+// queryContext derives the context a client query runs under. Its deadline
+// covers a DoH request running into its own timeout followed by one plain
+// exchange, so failure handling still gets a chance to answer.
+func (h *Handler) queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := max(2*upstreamTimeout, time.Duration(h.dnsMeshDohTimeout)*time.Second+upstreamTimeout)
+	return context.WithTimeout(parent, timeout)
+}
+
+// bindConn applies the deadline of ctx to conn and interrupts pending I/O
+// once ctx is cancelled. The returned function detaches conn from ctx.
+func bindConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
+// exchange sends a query the handler generated itself (as opposed to one
+// relayed from a client) to the configured upstream, or the recursive
+// resolver, and returns the reply.
+func (h *Handler) exchange(ctx context.Context, st *handlerState, query []byte) ([]byte, error) {
+	if h.Recursor != nil {
+		return h.resolveRecursive(ctx, query, "")
+	}
+	if st.httpsModeEnabled {
+		return h.queryHTTPS(ctx, st, query, "https")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	query, addedOPT := h.tagQuery(ctx, query)
+
+	upstream := h.upstream(st)
+	conn, err := h.dialUpstream(ctx, "udp", upstream)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	defer conn.Close()
+	stop := bindConn(ctx, conn)
+	defer stop()
+
+	response, _, err := h.roundTripUDP(ctx, conn, upstream, query, make([]byte, 4096))
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return h.untagResponse(response, addedOPT), nil
+}
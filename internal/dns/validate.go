@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+
+	"lktr/internal/metrics"
+)
+
+// Reasons an upstream response is rejected, as in
+// dns_upstream_mismatched_responses_total
+const (
+	mismatchSource    = "source"    // sent from another address than the upstream's
+	mismatchID        = "id"        // transaction ID differs from the query's
+	mismatchQuestion  = "question"  // question name, type or class differs
+	mismatchCase      = "case"      // question name not in the randomized case of the query
+	mismatchCookie    = "cookie"    // DNS cookie missing or not echoing the query's client cookie
+	mismatchMalformed = "malformed" // not a response, or its question cannot be read
+)
+
+// responseMismatch returns why response does not answer query, "" when it
+// does. Names are compared case-insensitively, since upstreams may echo a
+// query's name in other case. Error responses without a question section
+// are accepted, as some upstreams omit it when refusing a query.
+func responseMismatch(query, response []byte) string {
+	if len(response) < headerLength || len(query) < headerLength {
+		return mismatchMalformed
+	}
+	if !bytes.Equal(response[:2], query[:2]) {
+		return mismatchID
+	}
+	flags := binary.BigEndian.Uint16(response[2:])
+	if flags&flagQR == 0 {
+		return mismatchMalformed
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		// Nothing to compare with; such queries are not forwarded as a rule
+		return ""
+	}
+	switch binary.BigEndian.Uint16(response[4:]) {
+	case 1:
+	case 0:
+		if rcode := int(flags & 0xF); rcode != RcodeSuccess && rcode != RcodeNXDomain {
+			return ""
+		}
+		return mismatchQuestion
+	default:
+		return mismatchQuestion
+	}
+
+	qname, qend, err := readName(query, headerLength)
+	if err != nil || qend+4 > len(query) {
+		return mismatchMalformed
+	}
+	rname, rend, err := readName(response, headerLength)
+	if err != nil || rend+4 > len(response) {
+		return mismatchMalformed
+	}
+	if !strings.EqualFold(qname, rname) || !bytes.Equal(query[qend:qend+4], response[rend:rend+4]) {
+		return mismatchQuestion
+	}
+	return ""
+}
+
+// readUDPResponse reads from conn, a socket connected to the upstream, until
+// a datagram answering query arrives or the deadline passes. Datagrams from
+// other addresses, with another ID or for another question are dropped and
+// counted, so that a spoofed or stale response cannot stand in for the
+// upstream's answer; the connected socket already filters most of them.
+// With exactCase, the question name must also be in the case of the query.
+// When the query carries a DNS cookie, a response's cookie must echo its
+// client cookie, and with requireCookie be there at all.
+func readUDPResponse(ctx context.Context, conn net.Conn, query, buffer []byte, exactCase, requireCookie bool) (int, error) {
+	packetConn, _ := conn.(net.PacketConn)
+	cookie, _ := messageCookie(query)
+	for {
+		var n int
+		var err error
+		var from net.Addr
+		if packetConn != nil {
+			n, from, err = packetConn.ReadFrom(buffer)
+		} else {
+			n, err = conn.Read(buffer)
+			from = conn.RemoteAddr()
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Read after the datagram: a dual-stack connection settles on the
+		// upstream address that answered first
+		upstream := unmapped(addrPort(conn.RemoteAddr()))
+
+		reason := mismatchSource
+		if unmapped(addrPort(from)) == upstream {
+			reason = responseMismatch(query, buffer[:n])
+			if reason == "" && exactCase && caseMismatch(query, buffer[:n]) {
+				reason = mismatchCase
+			}
+			if reason == "" && cookie != nil && cookieMismatch(cookie, buffer[:n], requireCookie) {
+				reason = mismatchCookie
+			}
+		}
+		if reason == "" {
+			return n, nil
+		}
+		metrics.UpstreamMismatches.WithLabelValues(reason).Inc()
+		queryLog(ctx).Debug().Msgf("Dropped a response from %s not matching the query (%s)", from, reason)
+	}
+}
+
+// unmapped returns ap with an IPv4-mapped address unmapped
+func unmapped(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
@@ -0,0 +1,406 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const defaultZoneTTL = 3600
+
+// Zone is a small authoritative zone served directly by the proxy
+type Zone struct {
+	Origin  string
+	records map[string][]RR // keyed by lower-case owner name
+	soa     *RR
+}
+
+// ParseZone reads a zone-file snippet in RFC 1035 master file format. Only
+// the directives and record types needed for stub zones are understood:
+// $ORIGIN, $TTL, and SOA, NS, A, AAAA, CNAME, PTR, MX, SRV and TXT records.
+// Owners starting with "*." are wildcards. Without an SOA record, one is
+// synthesized for negative answers.
+func ParseZone(origin string, r io.Reader) (*Zone, error) {
+	origin = canonicalName(origin)
+	z := &Zone{Origin: origin, records: make(map[string][]RR)}
+
+	ttl := uint32(defaultZoneTTL)
+	owner := origin
+	lineNo := 0
+
+	lines := bufio.NewScanner(r)
+	var pending []string
+	depth := 0
+
+	for lines.Scan() {
+		lineNo++
+		line := lines.Text()
+		tokens, opens, err := tokenizeZoneLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s line %d: %w", origin, lineNo, err)
+		}
+
+		// Parenthesized records continue over several lines; remember whether
+		// the first physical line started with blank space (inherited owner)
+		if depth == 0 {
+			pending = nil
+			if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(tokens) > 0 {
+				pending = append(pending, "")
+			}
+		}
+		pending = append(pending, tokens...)
+		depth += opens
+		if depth < 0 {
+			return nil, fmt.Errorf("zone %s line %d: unbalanced parentheses", origin, lineNo)
+		}
+		if depth > 0 || len(pending) == 0 {
+			continue
+		}
+
+		fields := pending
+		pending = nil
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("zone %s line %d: $ORIGIN needs a name", origin, lineNo)
+			}
+			origin = qualify(fields[1], origin)
+			continue
+		case "$TTL":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("zone %s line %d: $TTL needs a value", origin, lineNo)
+			}
+			v, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s line %d: bad $TTL: %w", origin, lineNo, err)
+			}
+			ttl = uint32(v)
+			continue
+		}
+
+		if fields[0] != "" {
+			owner = qualify(fields[0], origin)
+		}
+		fields = fields[1:]
+
+		rrTTL := ttl
+		// TTL and class may appear in either order before the type
+		for len(fields) > 0 {
+			if v, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				rrTTL = uint32(v)
+				fields = fields[1:]
+				continue
+			}
+			if strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("zone %s line %d: missing record type", origin, lineNo)
+		}
+
+		rrtype, data, err := parseRData(strings.ToUpper(fields[0]), fields[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s line %d: %w", origin, lineNo, err)
+		}
+		if owner != z.Origin && !strings.HasSuffix(owner, "."+z.Origin) {
+			return nil, fmt.Errorf("zone %s line %d: %s is outside the zone", z.Origin, lineNo, owner)
+		}
+
+		rr := RR{Name: owner, Type: rrtype, Class: ClassINET, TTL: rrTTL, Data: data}
+		z.records[owner] = append(z.records[owner], rr)
+		if rrtype == TypeSOA && owner == z.Origin {
+			z.soa = &z.records[owner][len(z.records[owner])-1]
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("zone %s: unterminated parentheses", z.Origin)
+	}
+
+	if z.soa == nil {
+		z.soa = &RR{Name: z.Origin, Type: TypeSOA, Class: ClassINET, TTL: defaultZoneTTL, Data: defaultSOA(z.Origin)}
+	} else {
+		// Take a copy so later appends to the owner's slice cannot move it
+		soa := *z.soa
+		z.soa = &soa
+	}
+	return z, nil
+}
+
+// tokenizeZoneLine splits a line into fields, honouring quotes and comments,
+// and reports the net number of parentheses opened.
+func tokenizeZoneLine(line string) ([]string, int, error) {
+	var tokens []string
+	var cur strings.Builder
+	inQuote := false
+	hasToken := false
+	opens := 0
+
+	flush := func() {
+		if hasToken {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+			hasToken = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case c == '"':
+			inQuote = !inQuote
+			hasToken = true
+			if !inQuote {
+				// Keep the quoting so TXT parsing can tell strings apart
+				tokens = append(tokens, "\""+cur.String())
+				cur.Reset()
+				hasToken = false
+			}
+		case inQuote:
+			cur.WriteByte(c)
+		case c == ';':
+			flush()
+			return tokens, opens, nil
+		case c == '(':
+			flush()
+			opens++
+		case c == ')':
+			flush()
+			opens--
+		case c == ' ' || c == '\t':
+			flush()
+		default:
+			cur.WriteByte(c)
+			hasToken = true
+		}
+	}
+	if inQuote {
+		return nil, 0, fmt.Errorf("unterminated quoted string")
+	}
+	flush()
+	return tokens, opens, nil
+}
+
+// qualify turns a possibly relative zone-file name into a canonical absolute one
+func qualify(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return canonicalName(name)
+	case origin == "":
+		return canonicalName(name)
+	default:
+		return canonicalName(name + "." + origin)
+	}
+}
+
+func parseRData(rrtype string, args []string, origin string) (uint16, []byte, error) {
+	need := func(n int) error {
+		if len(args) < n {
+			return fmt.Errorf("%s record needs %d fields", rrtype, n)
+		}
+		return nil
+	}
+	uint16Field := func(s string) ([]byte, error) {
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s field %q", rrtype, s)
+		}
+		return binary.BigEndian.AppendUint16(nil, uint16(v)), nil
+	}
+
+	switch rrtype {
+	case "A":
+		if err := need(1); err != nil {
+			return 0, nil, err
+		}
+		ip := net.ParseIP(args[0]).To4()
+		if ip == nil {
+			return 0, nil, fmt.Errorf("bad IPv4 address %q", args[0])
+		}
+		return TypeA, []byte(ip), nil
+	case "AAAA":
+		if err := need(1); err != nil {
+			return 0, nil, err
+		}
+		ip := net.ParseIP(args[0])
+		if ip == nil || ip.To4() != nil {
+			return 0, nil, fmt.Errorf("bad IPv6 address %q", args[0])
+		}
+		return TypeAAAA, []byte(ip.To16()), nil
+	case "NS", "CNAME", "PTR":
+		if err := need(1); err != nil {
+			return 0, nil, err
+		}
+		types := map[string]uint16{"NS": TypeNS, "CNAME": TypeCNAME, "PTR": TypePTR}
+		return types[rrtype], NameData(qualify(args[0], origin)), nil
+	case "MX":
+		if err := need(2); err != nil {
+			return 0, nil, err
+		}
+		data, err := uint16Field(args[0])
+		if err != nil {
+			return 0, nil, err
+		}
+		return TypeMX, appendName(data, qualify(args[1], origin)), nil
+	case "SRV":
+		if err := need(4); err != nil {
+			return 0, nil, err
+		}
+		var data []byte
+		for _, f := range args[:3] {
+			b, err := uint16Field(f)
+			if err != nil {
+				return 0, nil, err
+			}
+			data = append(data, b...)
+		}
+		return TypeSRV, appendName(data, qualify(args[3], origin)), nil
+	case "TXT":
+		if err := need(1); err != nil {
+			return 0, nil, err
+		}
+		var data []byte
+		for _, s := range args {
+			data = appendTXT(data, strings.TrimPrefix(s, "\""))
+		}
+		return TypeTXT, data, nil
+	case "SOA":
+		if err := need(7); err != nil {
+			return 0, nil, err
+		}
+		data := appendName(nil, qualify(args[0], origin))
+		data = appendName(data, qualify(args[1], origin))
+		for _, f := range args[2:7] {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return 0, nil, fmt.Errorf("bad SOA field %q", f)
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(v))
+		}
+		return TypeSOA, data, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported record type %s", rrtype)
+}
+
+// defaultSOA builds SOA RDATA for zones that do not define one
+func defaultSOA(origin string) []byte {
+	data := appendName(nil, "ns."+origin)
+	data = appendName(data, "hostmaster."+origin)
+	for _, v := range []uint32{1, 3600, 600, 86400, 60} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+// soaMinimum returns the negative-caching TTL of an SOA record
+func soaMinimum(soa *RR) uint32 {
+	if len(soa.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(soa.Data[len(soa.Data)-4:])
+}
+
+// contains reports whether name is at or below the zone origin
+func (z *Zone) contains(name string) bool {
+	return name == z.Origin || strings.HasSuffix(name, "."+z.Origin)
+}
+
+// exists reports whether name owns records or is an empty non-terminal
+func (z *Zone) exists(name string) bool {
+	if _, ok := z.records[name]; ok {
+		return true
+	}
+	suffix := "." + name
+	for owner := range z.records {
+		if strings.HasSuffix(owner, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup answers a question from the zone's data, following in-zone CNAMEs
+func (z *Zone) lookup(q Question) (answers, authority []RR, rcode int) {
+	name := canonicalName(q.Name)
+
+	synthesized := false
+	for hops := 0; hops < 8; hops++ {
+		rrs := z.records[name]
+		synthesized = false
+		if rrs == nil && !z.exists(name) {
+			rrs = z.wildcard(name)
+			synthesized = rrs != nil
+		}
+		matched := false
+		var cname *RR
+		for i := range rrs {
+			rr := rrs[i]
+			if hops == 0 {
+				rr.Name = q.Name
+			} else if synthesized {
+				rr.Name = name
+			}
+			if rr.Type == q.Type || q.Type == TypeANY {
+				answers = append(answers, rr)
+				matched = true
+			} else if rr.Type == TypeCNAME {
+				cname = &rr
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+
+		answers = append(answers, *cname)
+		target, err := ReadName(cname.Data)
+		if err != nil || !z.contains(target) {
+			// Out-of-zone targets are left for the client to chase
+			return answers, nil, RcodeSuccess
+		}
+		name = target
+	}
+
+	if len(answers) > 0 {
+		return answers, nil, RcodeSuccess
+	}
+
+	soa := *z.soa
+	soa.TTL = min(soa.TTL, soaMinimum(z.soa))
+	if !synthesized && !z.exists(name) {
+		return nil, []RR{soa}, RcodeNXDomain
+	}
+	return nil, []RR{soa}, RcodeSuccess
+}
+
+// wildcard returns the records answering for name, which does not exist in
+// the zone, from the wildcard below its closest existing ancestor, as RFC
+// 4592 has it: "*.corp.internal" answers for "a.b.corp.internal" unless
+// "b.corp.internal" exists
+func (z *Zone) wildcard(name string) []RR {
+	for encloser := name; encloser != z.Origin; {
+		i := strings.IndexByte(encloser, '.')
+		if i < 0 {
+			return nil
+		}
+		encloser = encloser[i+1:]
+		if encloser == z.Origin || z.exists(encloser) {
+			return z.records["*."+encloser]
+		}
+	}
+	return nil
+}
@@ -2,14 +2,18 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"lktr/internal/bootstrap"
+
 	"github.com/rs/zerolog/log"
 )
 
@@ -32,6 +36,11 @@ type DoHConfig struct {
 	ClientCertData     []byte
 	ClientKeyData      []byte
 	InsecureSkipVerify bool
+	// ConfigureTLS, when set, adjusts the loaded TLS configuration
+	ConfigureTLS func(*tls.Config)
+	// Resolver, when set, resolves the server's host name instead of the
+	// system resolver
+	Resolver *net.Resolver
 }
 
 // NewDoHClient creates a new DoH client with the given configuration
@@ -52,11 +61,17 @@ func NewDoHClient(config DoHConfig) *DoHClient {
 		log.Err(err).Msg("Failed to load TLS configuration, using defaults")
 		tlsConfig = config.TLSConfig
 	}
+	if config.ConfigureTLS != nil {
+		config.ConfigureTLS(tlsConfig)
+	}
 
 	transport := &http.Transport{
 		TLSClientConfig:   tlsConfig,
 		ForceAttemptHTTP2: true,
 	}
+	if config.Resolver != nil {
+		transport.DialContext = bootstrap.Dialer(config.Resolver).DialContext
+	}
 
 	httpClient := &http.Client{
 		Transport: transport,
@@ -131,7 +146,12 @@ func loadTLSConfig(config DoHConfig) (*tls.Config, error) {
 // Query sends a DNS query to the DoH server and returns the response
 // The query should be in DNS wire format
 func (c *DoHClient) Query(dnsQuery []byte) ([]byte, error) {
-	req, err := http.NewRequest("POST", c.ServerURL, bytes.NewReader(dnsQuery))
+	return c.QueryContext(context.Background(), dnsQuery)
+}
+
+// QueryContext is like Query but gives up when ctx is done
+func (c *DoHClient) QueryContext(ctx context.Context, dnsQuery []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.ServerURL, bytes.NewReader(dnsQuery))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
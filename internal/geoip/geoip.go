@@ -0,0 +1,132 @@
+// Package geoip looks up the country and autonomous system of addresses in
+// MaxMind DB files, such as the GeoLite2 Country and ASN databases, so that
+// DNS answers can be judged by where they point.
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// Location is what the databases know of an address; fields they do not
+// know are empty
+type Location struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	ASN     uint32 `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"` // organization of the autonomous system
+}
+
+// IsZero reports whether nothing is known of the address
+func (l Location) IsZero() bool {
+	return l == Location{}
+}
+
+func (l Location) String() string {
+	s := l.Country
+	if l.ASN != 0 {
+		if s != "" {
+			s += " "
+		}
+		s += fmt.Sprintf("AS%d", l.ASN)
+		if l.Org != "" {
+			s += " " + l.Org
+		}
+	}
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// DB answers lookups from one or more databases, a country and an ASN
+// database for instance, combining what each knows of an address
+type DB struct {
+	dbs []*mmdb
+	// cache holds the location of each record read, keyed by database and
+	// data offset; networks share records, so it stays as small as the data
+	cache sync.Map
+}
+
+type cacheKey struct {
+	db  int
+	off uint
+}
+
+// Open loads the databases at paths into memory
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		m, err := openMMDB(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		db.dbs = append(db.dbs, m)
+	}
+	return db, nil
+}
+
+// Types returns the database type of each database, e.g. "GeoLite2-ASN"
+func (db *DB) Types() []string {
+	types := make([]string, len(db.dbs))
+	for i, m := range db.dbs {
+		types[i] = m.databaseType
+	}
+	return types
+}
+
+// Lookup returns the location of addr. A record that does not decode is
+// treated as unknown.
+func (db *DB) Lookup(addr netip.Addr) Location {
+	var loc Location
+	for i, m := range db.dbs {
+		off, ok := m.lookup(addr)
+		if !ok {
+			continue
+		}
+		key := cacheKey{i, off}
+		found, ok := db.cache.Load(key)
+		if !ok {
+			found = locationOf(m, off)
+			db.cache.Store(key, found)
+		}
+		loc = merge(loc, found.(Location))
+	}
+	return loc
+}
+
+// locationOf reads the country and autonomous system of a record. City and
+// Country databases give the country the network is in, or else the one it
+// is registered in; ASN databases give the autonomous system.
+func locationOf(m *mmdb, off uint) Location {
+	v, _, err := decode(m.data, off, 0)
+	if err != nil {
+		return Location{}
+	}
+	record, _ := v.(map[string]any)
+	var loc Location
+	for _, field := range []string{"country", "registered_country"} {
+		if country, ok := record[field].(map[string]any); ok && loc.Country == "" {
+			loc.Country, _ = country["iso_code"].(string)
+		}
+	}
+	loc.ASN = uint32(asUint(record["autonomous_system_number"]))
+	loc.Org, _ = record["autonomous_system_organization"].(string)
+	return loc
+}
+
+// merge fills the fields of a that b knows
+func merge(a, b Location) Location {
+	if a.Country == "" {
+		a.Country = b.Country
+	}
+	if a.ASN == 0 {
+		a.ASN, a.Org = b.ASN, b.Org
+	}
+	return a
+}
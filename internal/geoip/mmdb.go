@@ -0,0 +1,272 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// metadataMarker starts the metadata section at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxDecodeDepth bounds the nesting of decoded values, and of pointers, so
+// that a corrupt file cannot recurse without end
+const maxDecodeDepth = 32
+
+// Data section types of the MaxMind DB format
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// mmdb reads a MaxMind DB file held in memory: a binary search tree over the
+// bits of addresses whose leaves point into a data section of records
+type mmdb struct {
+	databaseType string
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	tree         []byte
+	data         []byte
+	ipv4Start    uint // node reached by the 96 zero bits of ::/96 in IPv6 trees
+}
+
+func openMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta, _, err := decode(buf[i+len(metadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	db := &mmdb{
+		nodeCount:  uint(asUint(fields["node_count"])),
+		recordSize: uint(asUint(fields["record_size"])),
+		ipVersion:  uint(asUint(fields["ip_version"])),
+	}
+	db.databaseType, _ = fields["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	// The tree is followed by 16 zero bytes, then the data section
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if db.nodeCount == 0 || treeSize+16 > uint(i) {
+		return nil, errors.New("search tree exceeds the file")
+	}
+	db.tree, db.data = buf[:treeSize], buf[treeSize+16:i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a tree node
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.tree
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xF0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0F)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// lookup returns the data section offset of the record of addr, and false
+// when the database has none
+func (db *mmdb) lookup(addr netip.Addr) (uint, bool) {
+	addr = addr.Unmap()
+	var bits []byte
+	node := uint(0)
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		b := addr.As4()
+		bits, node = b[:], db.ipv4Start
+	case addr.Is4():
+		b := addr.As4()
+		bits = b[:]
+	case db.ipVersion == 4:
+		return 0, false
+	default:
+		b := addr.As16()
+		bits = b[:]
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		// Equal is the empty record; below, the address ran out of bits
+		return 0, false
+	}
+	off := node - db.nodeCount - 16
+	return off, off < uint(len(db.data))
+}
+
+// decode reads the value at off of a data section and returns it with the
+// offset following it. Maps decode to map[string]any, arrays to []any,
+// unsigned integers to uint64 (the low 64 bits of 128-bit ones), int32 to
+// int64 and floats to float64.
+func decode(data []byte, off uint, depth int) (any, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if off >= uint(len(data)) {
+		return nil, 0, errors.New("offset exceeds the data section")
+	}
+	ctrl := data[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		n := uint(ctrl>>3&3) + 1
+		if off+n > uint(len(data)) {
+			return nil, 0, errors.New("truncated pointer")
+		}
+		p := uint(0)
+		for _, b := range data[off : off+n] {
+			p = p<<8 | uint(b)
+		}
+		switch n {
+		case 1:
+			p |= uint(ctrl&7) << 8
+		case 2:
+			p = 2048 + (p | uint(ctrl&7)<<16)
+		case 3:
+			p = 526336 + (p | uint(ctrl&7)<<24)
+		}
+		v, _, err := decode(data, p, depth+1)
+		return v, off + n, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(data)) {
+			return nil, 0, errors.New("truncated type")
+		}
+		typ = 7 + uint(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, errors.New("truncated size")
+		}
+		extra := uint(0)
+		for _, b := range data[off : off+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+		off += n
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, next, err := decode(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := decode(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := decode(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(data)) {
+		return nil, 0, errors.New("value exceeds the data section")
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return bytes.Clone(b), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case typeInt32:
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// asUint returns an unsigned integer decoded from a data section, 0 for
+// other values
+func asUint(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
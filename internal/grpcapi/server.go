@@ -0,0 +1,210 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+	"lktr/pkg/sidecarpb"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// tailBuffer is the number of events queued per TailQueries stream before
+// events are dropped for that stream
+const tailBuffer = 256
+
+// Config configures the gRPC control-plane server
+type Config struct {
+	ListenAddr string
+	CertFile   string // server certificate; empty serves plaintext
+	KeyFile    string
+	ClientCA   string // CA for client certificates; set to require mTLS
+	// Certificate, when set, returns the server certificate for each
+	// handshake instead of CertFile, for certificates that are rotated
+	Certificate func() *tls.Certificate
+
+	Handler *dns.Handler
+	// UpdatePolicy applies a blocklist pushed by the controller
+	UpdatePolicy func(blockList []string, dryRun bool)
+	// Drain stops the DNS listeners
+	Drain func()
+}
+
+// Server implements the sidecar control-plane service
+type Server struct {
+	sidecarpb.UnimplementedSidecarServer
+
+	cfg        Config
+	started    time.Time
+	draining   atomic.Bool
+	generation atomic.Int64 // policies received, reported as their generation
+}
+
+// NewServer returns a control-plane server for cfg. UpdatePolicy and Drain
+// let whoever reaches the server change what the sidecar enforces or stop
+// it, so it must authenticate its clients with TLS and a client CA unless
+// it only listens on a loopback address.
+func NewServer(cfg Config) (*Server, error) {
+	secured := (cfg.CertFile != "" || cfg.Certificate != nil) && cfg.ClientCA != ""
+	if !secured && !loopback(cfg.ListenAddr) {
+		return nil, fmt.Errorf("gRPC control API on %s requires a server certificate and a client CA, or a loopback address", cfg.ListenAddr)
+	}
+	return &Server{cfg: cfg, started: time.Now()}, nil
+}
+
+// loopback reports whether addr only listens on a loopback address
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Start listens on the configured address and serves until the listener fails
+func (s *Server) Start() error {
+	var opts []grpc.ServerOption
+	if s.cfg.CertFile != "" || s.cfg.Certificate != nil {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else {
+		log.Warn().Msgf("gRPC control API is served without TLS on loopback address %s", s.cfg.ListenAddr)
+	}
+
+	listener, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.ListenAddr, err)
+	}
+
+	srv := grpc.NewServer(opts...)
+	sidecarpb.RegisterSidecarServer(srv, s)
+
+	log.Info().Msgf("gRPC control API listening on %s\n", s.cfg.ListenAddr)
+	return srv.Serve(listener)
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if s.cfg.Certificate != nil {
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.cfg.Certificate(), nil
+		}
+	} else {
+		cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load gRPC server certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if s.cfg.ClientCA != "" {
+		caCert, err := os.ReadFile(s.cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gRPC client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", s.cfg.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// UpdatePolicy replaces the default blocklist
+func (s *Server) UpdatePolicy(ctx context.Context, req *sidecarpb.UpdatePolicyRequest) (*sidecarpb.UpdatePolicyResponse, error) {
+	if s.cfg.UpdatePolicy == nil {
+		return nil, status.Error(codes.Unimplemented, "policy updates are not enabled")
+	}
+	s.cfg.UpdatePolicy(req.GetBlockList(), req.GetDryRun())
+	metrics.PolicyGeneration.WithLabelValues("grpc", "").Set(float64(s.generation.Add(1)))
+	metrics.PolicyApplyStatus.WithLabelValues("grpc", "").Set(1)
+	metrics.PolicyLastApplied.WithLabelValues("grpc", "").Set(float64(time.Now().Unix()))
+	log.Info().Msgf("Blocklist with %d entries received over gRPC", len(req.GetBlockList()))
+	return &sidecarpb.UpdatePolicyResponse{Rules: int32(len(req.GetBlockList()))}, nil
+}
+
+// GetStats returns query counters and policy state
+func (s *Server) GetStats(ctx context.Context, req *sidecarpb.GetStatsRequest) (*sidecarpb.Stats, error) {
+	return &sidecarpb.Stats{
+		Queries:  uint64(metrics.Total("dns_queries_total")),
+		Blocked:  uint64(metrics.Total("dns_queries_blocked_total")),
+		Allowed:  uint64(metrics.Total("dns_queries_allowed_total")),
+		Errors:   uint64(metrics.Total("dns_errors_total")),
+		Rules:    int32(s.cfg.Handler.Rules()),
+		DryRun:   s.cfg.Handler.DryRun(),
+		Draining: s.draining.Load(),
+		Started:  timestamppb.New(s.started),
+	}, nil
+}
+
+// TailQueries streams answered queries until the client goes away
+func (s *Server) TailQueries(req *sidecarpb.TailQueriesRequest, stream grpc.ServerStreamingServer[sidecarpb.QueryEvent]) error {
+	if s.cfg.Handler.Tap == nil {
+		return status.Error(codes.Unimplemented, "query tap is not enabled")
+	}
+	events, cancel := s.cfg.Handler.Tap.Subscribe(tailBuffer)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if req.GetBlockedOnly() && ev.Verdict != dns.VerdictBlocked {
+				continue
+			}
+			err := stream.Send(&sidecarpb.QueryEvent{
+				Time:      timestamppb.New(ev.Time),
+				Client:    ev.Client,
+				Name:      ev.Name,
+				Type:      ev.Type,
+				Protocol:  ev.Protocol,
+				Verdict:   ev.Verdict,
+				Rule:      ev.Rule,
+				PolicySet: ev.PolicySet,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Drain closes the DNS listeners once the grace period has passed
+func (s *Server) Drain(ctx context.Context, req *sidecarpb.DrainRequest) (*sidecarpb.DrainResponse, error) {
+	if s.cfg.Drain == nil {
+		return nil, status.Error(codes.Unimplemented, "draining is not enabled")
+	}
+	if !s.draining.CompareAndSwap(false, true) {
+		return &sidecarpb.DrainResponse{}, nil
+	}
+
+	grace := time.Duration(req.GetGraceSeconds()) * time.Second
+	log.Info().Msgf("Drain requested over gRPC, closing DNS listeners in %s", grace)
+	time.AfterFunc(grace, s.cfg.Drain)
+	return &sidecarpb.DrainResponse{}, nil
+}
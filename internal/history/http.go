@@ -0,0 +1,85 @@
+package history
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// ServeHTTP answers GET /api/stats/history with the totals of each of the
+// last ?hours= hours (default 24) and the names or clients (?kind=domains or
+// clients, default domains) over that period, sorted by the counter named in
+// ?sort= (queries, blocked or errors; default queries) and cut to ?limit=
+// entries (default 50)
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	kind := query.Get("kind")
+	switch kind {
+	case "":
+		kind = KindDomains
+	case KindDomains, KindClients:
+	default:
+		http.Error(w, "kind must be domains or clients", http.StatusBadRequest)
+		return
+	}
+
+	key := func(c KeyCounts) uint64 { return c.Queries }
+	switch query.Get("sort") {
+	case "", "queries":
+	case "blocked":
+		key = func(c KeyCounts) uint64 { return c.Blocked }
+	case "errors":
+		key = func(c KeyCounts) uint64 { return c.Errors }
+	default:
+		http.Error(w, "sort must be queries, blocked or errors", http.StatusBadRequest)
+		return
+	}
+
+	hours := 24
+	if v := query.Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "hours must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+	limit := 50
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	to := time.Now()
+	totals, keys, err := s.Range(kind, to.Add(-time.Duration(hours-1)*time.Hour), to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(keys, func(a, b KeyCounts) int {
+		if c := cmp.Compare(key(b), key(a)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	keys = keys[:min(limit, len(keys))]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Hours   []HourCounts `json:"hours"`
+		Entries []KeyCounts  `json:"entries"`
+	}{totals, keys})
+}
@@ -0,0 +1,279 @@
+package history
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"lktr/internal/dns"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// hourFormat names the bucket of each hour; the names sort chronologically
+const hourFormat = "2006-01-02T15"
+
+// Kinds of keys aggregated per hour
+const (
+	KindDomains = "domains"
+	KindClients = "clients"
+)
+
+// EventBuffer is the query tap buffer to subscribe a store with; events
+// beyond it are dropped while the store is busy
+const EventBuffer = 4096
+
+// otherKey collects the names or clients of an hour beyond the key limit
+const otherKey = "(other)"
+
+// totalsKey holds the totals of an hour in its bucket, next to the kind buckets
+var totalsKey = []byte("totals")
+
+// Counts are the query statistics of one name, client or hour
+type Counts struct {
+	Queries uint64 `json:"queries"`
+	Blocked uint64 `json:"blocked"`
+	Errors  uint64 `json:"errors"`
+}
+
+func (c *Counts) add(o Counts) {
+	c.Queries += o.Queries
+	c.Blocked += o.Blocked
+	c.Errors += o.Errors
+}
+
+func (c Counts) encode() []byte {
+	b := make([]byte, 0, 24)
+	b = binary.BigEndian.AppendUint64(b, c.Queries)
+	b = binary.BigEndian.AppendUint64(b, c.Blocked)
+	return binary.BigEndian.AppendUint64(b, c.Errors)
+}
+
+func decodeCounts(b []byte) Counts {
+	if len(b) < 24 {
+		return Counts{}
+	}
+	return Counts{
+		Queries: binary.BigEndian.Uint64(b),
+		Blocked: binary.BigEndian.Uint64(b[8:]),
+		Errors:  binary.BigEndian.Uint64(b[16:]),
+	}
+}
+
+// hour accumulates the counts of one hour between flushes
+type hour struct {
+	totals Counts
+	keys   map[string]map[string]*Counts // counts by key, by kind
+}
+
+// Store aggregates answered queries per hour, per name and per client and
+// persists them to a bbolt file, which outlives the retention of Prometheus
+// and can be copied off the node for offline reporting. Counts are kept in
+// memory and written every flush interval, so a crash loses at most one
+// interval. Hours older than Retention are deleted; at most MaxKeys names
+// and clients are kept per hour, the rest are counted under "(other)".
+type Store struct {
+	Retention time.Duration
+	MaxKeys   int
+
+	db      *bolt.DB
+	mu      sync.Mutex
+	pending map[string]*hour
+}
+
+// Open opens or creates the statistics file at path
+func Open(path string, retention time.Duration, maxKeys int) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open statistics store %s: %w", path, err)
+	}
+	return &Store{Retention: retention, MaxKeys: maxKeys, db: db, pending: make(map[string]*hour)}, nil
+}
+
+// Close writes the pending counts and closes the file
+func (s *Store) Close() error {
+	if err := s.Flush(); err != nil {
+		log.Err(err).Msg("Failed to flush query statistics:")
+	}
+	return s.db.Close()
+}
+
+// Run records the events until the channel is closed, writing them every
+// flush interval and pruning expired hours as it goes
+func (s *Store) Run(events <-chan dns.QueryEvent, flush time.Duration) {
+	go func() {
+		ticker := time.NewTicker(flush)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Flush(); err != nil {
+				log.Err(err).Msg("Failed to flush query statistics:")
+			}
+			if err := s.prune(time.Now().Add(-s.Retention)); err != nil {
+				log.Err(err).Msg("Failed to prune query statistics:")
+			}
+		}
+	}()
+	for ev := range events {
+		s.Record(ev)
+	}
+}
+
+// Record counts one answered query
+func (s *Store) Record(ev dns.QueryEvent) {
+	var c Counts
+	c.Queries = 1
+	switch ev.Verdict {
+	case dns.VerdictBlocked:
+		c.Blocked = 1
+	case dns.VerdictFailed:
+		c.Errors = 1
+	}
+	client := ev.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := ev.Time.UTC().Format(hourFormat)
+	h, ok := s.pending[name]
+	if !ok {
+		h = &hour{keys: map[string]map[string]*Counts{KindDomains: {}, KindClients: {}}}
+		s.pending[name] = h
+	}
+	h.totals.add(c)
+	s.count(h.keys[KindDomains], ev.Name, c)
+	s.count(h.keys[KindClients], client, c)
+}
+
+func (s *Store) count(counts map[string]*Counts, key string, c Counts) {
+	entry, ok := counts[key]
+	if !ok {
+		if len(counts) >= s.MaxKeys {
+			key = otherKey
+			entry = counts[key]
+		}
+		if entry == nil {
+			entry = new(Counts)
+			counts[key] = entry
+		}
+	}
+	entry.add(c)
+}
+
+// Flush adds the counts recorded since the last flush to the file
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*hour)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for name, h := range pending {
+			hb, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			totals := decodeCounts(hb.Get(totalsKey))
+			totals.add(h.totals)
+			if err := hb.Put(totalsKey, totals.encode()); err != nil {
+				return err
+			}
+			for kind, counts := range h.keys {
+				kb, err := hb.CreateBucketIfNotExists([]byte(kind))
+				if err != nil {
+					return err
+				}
+				stored := kb.Stats().KeyN
+				for key, c := range counts {
+					k := []byte(key)
+					existing := kb.Get(k)
+					if existing == nil && stored >= s.MaxKeys {
+						k, existing = []byte(otherKey), kb.Get([]byte(otherKey))
+					}
+					if existing == nil {
+						stored++
+					}
+					merged := decodeCounts(existing)
+					merged.add(*c)
+					if err := kb.Put(k, merged.encode()); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// prune deletes the hours that ended before cutoff
+func (s *Store) prune(cutoff time.Time) error {
+	last := []byte(cutoff.UTC().Add(-time.Hour).Format(hourFormat))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		c := tx.Cursor()
+		for k, _ := c.First(); k != nil && string(k) <= string(last); k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HourCounts are the totals of one hour
+type HourCounts struct {
+	Hour string `json:"hour"`
+	Counts
+}
+
+// KeyCounts are the counts of one name or client summed over a range of hours
+type KeyCounts struct {
+	Key string `json:"key"`
+	Counts
+}
+
+// Range returns the totals of every stored hour from from to to, and the
+// counts of each key of the given kind summed over those hours. Counts not
+// flushed yet are not included.
+func (s *Store) Range(kind string, from, to time.Time) ([]HourCounts, []KeyCounts, error) {
+	first := []byte(from.UTC().Format(hourFormat))
+	last := to.UTC().Format(hourFormat)
+	var hours []HourCounts
+	sums := make(map[string]*Counts)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Seek(first); k != nil && string(k) <= last; k, _ = c.Next() {
+			hb := tx.Bucket(k)
+			hours = append(hours, HourCounts{Hour: string(k), Counts: decodeCounts(hb.Get(totalsKey))})
+			kb := hb.Bucket([]byte(kind))
+			if kb == nil {
+				continue
+			}
+			kb.ForEach(func(key, v []byte) error {
+				sum, ok := sums[string(key)]
+				if !ok {
+					sum = new(Counts)
+					sums[string(key)] = sum
+				}
+				sum.add(decodeCounts(v))
+				return nil
+			})
+		}
+		return nil
+	})
+	keys := make([]KeyCounts, 0, len(sums))
+	for k, c := range sums {
+		keys = append(keys, KeyCounts{Key: k, Counts: *c})
+	}
+	return hours, keys, err
+}
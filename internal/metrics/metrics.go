@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"errors"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -12,7 +14,7 @@ var (
 			Name: "dns_queries_total",
 			Help: "Total number of DNS queries received",
 		},
-		[]string{"protocol"},
+		[]string{"protocol", "namespace"},
 	)
 
 	// QueriesBlocked counts DNS queries that were blocked
@@ -21,7 +23,7 @@ var (
 			Name: "dns_queries_blocked_total",
 			Help: "Total number of DNS queries blocked",
 		},
-		[]string{"protocol"},
+		[]string{"protocol", "namespace"},
 	)
 
 	// QueriesAllowed counts DNS queries that were allowed and forwarded
@@ -30,7 +32,7 @@ var (
 			Name: "dns_queries_allowed_total",
 			Help: "Total number of DNS queries allowed and forwarded",
 		},
-		[]string{"protocol"},
+		[]string{"protocol", "namespace"},
 	)
 
 	// ErrorsTotal counts DNS errors by type
@@ -42,6 +44,653 @@ var (
 		[]string{"type", "protocol"},
 	)
 
+	// TTLClamped counts upstream records whose TTL was raised or lowered to the configured bounds
+	TTLClamped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_ttl_clamped_total",
+			Help: "Total number of upstream records whose TTL was clamped, by direction",
+		},
+		[]string{"direction"},
+	)
+
+	// DNS64Synthesized counts AAAA responses synthesized from A records
+	DNS64Synthesized = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_dns64_synthesized_total",
+			Help: "Total number of AAAA responses synthesized via DNS64",
+		},
+		[]string{"protocol"},
+	)
+
+	// UpstreamFailureMode reports the active upstream failure mode (1 = active)
+	UpstreamFailureMode = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_failure_mode",
+			Help: "Active upstream failure mode, 1 for the mode in effect",
+		},
+		[]string{"mode"},
+	)
+
+	// UpstreamFailureResponses counts responses given while the upstream was unavailable
+	UpstreamFailureResponses = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_failure_responses_total",
+			Help: "Total number of responses served while the upstream was unavailable, by action",
+		},
+		[]string{"protocol", "action"},
+	)
+
+	// UpstreamBreakerOpen reports whether the upstream circuit breaker is open
+	UpstreamBreakerOpen = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_breaker_open",
+			Help: "Whether the upstream circuit breaker is open (1) or closed (0)",
+		},
+	)
+
+	// UpstreamBreakerTrips counts transitions of the circuit breaker to open
+	UpstreamBreakerTrips = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_breaker_trips_total",
+			Help: "Total number of times the upstream circuit breaker opened",
+		},
+	)
+
+	// UpstreamBreakerRejected counts queries short-circuited by an open breaker
+	UpstreamBreakerRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_breaker_rejected_total",
+			Help: "Total number of queries not forwarded because the circuit breaker was open",
+		},
+		[]string{"protocol"},
+	)
+
+	// FaultsInjected counts faults injected into forwarded queries
+	FaultsInjected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_faults_injected_total",
+			Help: "Total number of faults injected into forwarded queries, by fault",
+		},
+		[]string{"fault"},
+	)
+
+	// QueryHooks counts the decisions of the query hooks
+	QueryHooks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_query_hooks_total",
+			Help: "Total number of query hook calls, by hook and result",
+		},
+		[]string{"hook", "result"},
+	)
+
+	// QueryHookErrors counts query hook calls that failed
+	QueryHookErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_query_hook_errors_total",
+			Help: "Total number of query hook calls that failed or timed out, by hook",
+		},
+		[]string{"hook"},
+	)
+
+	// AuthzDecisions counts external authorization decisions
+	AuthzDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_authz_decisions_total",
+			Help: "Total number of external authorization decisions, by decision and source (service, cache or failure)",
+		},
+		[]string{"decision", "source"},
+	)
+
+	// RegoEvaluations counts evaluations of the controller's Rego policy
+	RegoEvaluations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_rego_evaluations_total",
+			Help: "Total number of Rego policy evaluations, by result (deny, continue or error)",
+		},
+		[]string{"result"},
+	)
+
+	// SPIFFESVIDExpiry is when the current SPIFFE SVID expires
+	SPIFFESVIDExpiry = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_spiffe_svid_expiry_timestamp_seconds",
+			Help: "Unix time at which the current SPIFFE X.509 SVID expires",
+		},
+	)
+
+	// SPIFFEStreamErrors counts broken Workload API streams
+	SPIFFEStreamErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_spiffe_stream_errors_total",
+			Help: "Total number of SPIFFE Workload API streams that failed or ended",
+		},
+	)
+
+	// SecretRefreshes counts fetches from the secrets provider
+	SecretRefreshes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_secret_refreshes_total",
+			Help: "Total number of secret fetches from Vault or the secrets endpoint, by result",
+		},
+		[]string{"result"},
+	)
+
+	// PolicyGeneration is the generation of the policy last applied, by source
+	PolicyGeneration = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_policy_generation",
+			Help: "Generation of the policy last applied from each source (the controller's observedGeneration)",
+		},
+		[]string{"source", "policy"},
+	)
+
+	// PolicyApplyStatus reports whether the last policy update from each source was applied
+	PolicyApplyStatus = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_policy_apply_status",
+			Help: "1 when the last policy update from the source was applied, 0 when it could not be fetched or applied",
+		},
+		[]string{"source", "policy"},
+	)
+
+	// PolicyLastApplied is when a policy from each source was last applied
+	PolicyLastApplied = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_policy_last_applied_timestamp_seconds",
+			Help: "Unix time at which a policy from the source was last applied",
+		},
+		[]string{"source", "policy"},
+	)
+
+	// CanaryActive reports whether a new blocklist is being soaked as a canary
+	CanaryActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_canary_active",
+			Help: "Whether a canary blocklist is currently being soaked (1) or not (0)",
+		},
+	)
+
+	// CanaryVerdicts counts verdicts made while a canary is running, by track
+	CanaryVerdicts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_canary_verdicts_total",
+			Help: "Total number of verdicts made during a canary rollout, by track and verdict",
+		},
+		[]string{"track", "verdict"},
+	)
+
+	// ShadowActive reports whether a shadow blocklist is loaded
+	ShadowActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_shadow_active",
+			Help: "Whether a shadow blocklist is loaded (1) or not (0)",
+		},
+	)
+
+	// ShadowVerdicts compares shadow blocklist verdicts with the enforced ones
+	ShadowVerdicts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_shadow_verdicts_total",
+			Help: "Total number of queries evaluated against the shadow blocklist, by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	// ShadowRuleHits attributes shadow verdict differences to rules
+	ShadowRuleHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_shadow_rule_hits_total",
+			Help: "Total number of shadow verdict differences, by change and responsible rule",
+		},
+		[]string{"change", "rule"},
+	)
+
+	// UpstreamInflight tracks queries currently outstanding at each upstream
+	UpstreamInflight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_inflight",
+			Help: "Number of queries currently outstanding at each upstream",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamInflightRejected counts queries refused by a full upstream
+	UpstreamInflightRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_inflight_rejected_total",
+			Help: "Total number of queries that found the upstream at its in-flight limit",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamSpilled counts queries sent to the spill upstream
+	UpstreamSpilled = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_spilled_total",
+			Help: "Total number of queries spilled to the secondary upstream",
+		},
+	)
+
+	// ForwardZoneQueries counts queries sent to the server of a forwarding zone
+	ForwardZoneQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_forward_zone_queries_total",
+			Help: "Total number of queries forwarded to the server of a conditional forwarding zone",
+		},
+		[]string{"zone"},
+	)
+
+	// UpstreamExchanges counts exchanges with upstream servers, by server, zone and outcome
+	UpstreamExchanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_exchanges_total",
+			Help: "Total number of queries exchanged with upstream servers, by upstream, forwarding zone (\".\" outside the zones) and result (success, servfail, error)",
+		},
+		[]string{"upstream", "zone", "result"},
+	)
+
+	// UpstreamExchangeDuration tracks how long exchanges with upstream servers take
+	UpstreamExchangeDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_upstream_exchange_duration_seconds",
+			Help:    "Duration of exchanges with upstream servers in seconds, failed ones included, by upstream and forwarding zone",
+			Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"upstream", "zone"},
+	)
+
+	// UpstreamTCPConns counts upstream TCP connections used, by whether they were reused
+	UpstreamTCPConns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_tcp_connections_total",
+			Help: "Total number of upstream TCP connections used for queries, by new or reused",
+		},
+		[]string{"result"},
+	)
+
+	// EDNSPayloadClamped counts queries and responses whose EDNS UDP payload size was lowered
+	EDNSPayloadClamped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_edns_payload_clamped_total",
+			Help: "Total number of messages with the EDNS UDP payload size lowered to the configured maximum, by direction",
+		},
+		[]string{"direction"},
+	)
+
+	// UpstreamMismatches counts upstream responses dropped for not answering the query
+	UpstreamMismatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_mismatched_responses_total",
+			Help: "Total number of upstream responses dropped because their source, ID, question, question case or DNS cookie did not match the query, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	// UpstreamCookies counts upstream responses to queries carrying a DNS cookie
+	UpstreamCookies = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_cookies_total",
+			Help: "Total number of upstream responses to queries carrying a DNS cookie, by whether they returned a valid server cookie (valid, missing) or asked for the query again (badcookie)",
+		},
+		[]string{"result"},
+	)
+
+	// UDPTruncated counts UDP responses truncated to the client's payload size
+	UDPTruncated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_udp_truncated_total",
+			Help: "Total number of UDP responses truncated because they exceeded the client's payload size",
+		},
+	)
+
+	// SelfTestStatus reports the outcome of the last self-test, by check
+	SelfTestStatus = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_selftest_status",
+			Help: "1 when the check passed in the last self-test, 0 when it failed",
+		},
+		[]string{"check"},
+	)
+
+	// QueryLogEntries counts answered queries offered to the query log
+	QueryLogEntries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_query_log_entries_total",
+			Help: "Total number of answered queries offered to the query log, by result (written, filtered, error)",
+		},
+		[]string{"result"},
+	)
+
+	// QueryLogBytes is the size of the query log on disk
+	QueryLogBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_query_log_bytes",
+			Help: "Size of the query log segments on disk in bytes",
+		},
+	)
+
+	// QueryLogPurged counts query log bytes deleted by retention or on demand
+	QueryLogPurged = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_query_log_purged_bytes_total",
+			Help: "Total number of query log bytes deleted, by reason (age, size, api)",
+		},
+		[]string{"reason"},
+	)
+
+	// TruncationRetries counts truncated upstream UDP responses retried over TCP
+	TruncationRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_truncation_retries_total",
+			Help: "Total number of truncated upstream UDP responses retried over TCP, by result",
+		},
+		[]string{"result"},
+	)
+
+	// ScrubbedResponses counts responses with EDNS options removed
+	ScrubbedResponses = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_scrubbed_responses_total",
+			Help: "Total number of responses with privacy-sensitive EDNS options removed",
+		},
+	)
+
+	// LocalAnswers counts queries answered from local data, by its source
+	LocalAnswers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_local_answers_total",
+			Help: "Total number of queries answered from local data instead of the upstream",
+		},
+		[]string{"source"},
+	)
+
+	// AAAAStripped counts forwarded answers whose IPv6 addresses were removed by the AAAA filter
+	AAAAStripped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_aaaa_stripped_total",
+			Help: "Total number of upstream answers whose IPv6 addresses were removed by the AAAA filter",
+		},
+	)
+
+	// ResponseIPBlocked counts answers blocked for an address in a blocked CIDR
+	ResponseIPBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_response_ip_blocked_total",
+			Help: "Total number of responses answered as blocked because an A or AAAA record fell in a blocked CIDR",
+		},
+		[]string{"protocol"},
+	)
+
+	// GeoIPMatches counts forwarded answers matching GeoIP rules, by action and country
+	GeoIPMatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_geoip_matches_total",
+			Help: "Total number of responses whose addresses matched a GeoIP rule, by action (block or flag) and country",
+		},
+		[]string{"action", "country"},
+	)
+
+	// QueryTypeBlocked counts queries blocked by query-type rules, by type
+	QueryTypeBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_query_type_blocked_total",
+			Help: "Total number of queries blocked or refused by query-type rules, by query type",
+		},
+		[]string{"qtype"},
+	)
+
+	// CNAMEBlocked counts forwarded answers blocked because their CNAME chain led to a blocked name
+	CNAMEBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_cname_blocked_total",
+			Help: "Total number of queries blocked because the CNAME chain of the upstream answer led to a blocked name",
+		},
+		[]string{"protocol"},
+	)
+
+	// SVCBBlocked counts forwarded answers blocked because an SVCB or HTTPS record targeted a blocked name
+	SVCBBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_svcb_blocked_total",
+			Help: "Total number of queries blocked because an SVCB or HTTPS record of the upstream answer targeted a blocked name",
+		},
+		[]string{"protocol"},
+	)
+
+	// ECHStripped counts SVCB and HTTPS records whose ech parameter was removed
+	ECHStripped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_ech_stripped_total",
+			Help: "Total number of SVCB and HTTPS records whose ech parameter was removed",
+		},
+	)
+
+	// FilteredAnswers counts responses changed because answer records pointed at blocked names
+	FilteredAnswers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_filtered_answers_total",
+			Help: "Total number of responses with answer records for blocked names removed, by result",
+		},
+		[]string{"result"},
+	)
+
+	// RecursiveResolutions counts queries answered by the built-in recursive resolver
+	RecursiveResolutions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_recursive_resolutions_total",
+			Help: "Total number of queries answered by the recursive resolver, by result",
+		},
+		[]string{"result"},
+	)
+
+	// RecursiveServerQueries counts queries the recursive resolver sent to authoritative servers
+	RecursiveServerQueries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_recursive_server_queries_total",
+			Help: "Total number of queries sent to authoritative servers by the recursive resolver",
+		},
+	)
+
+	// HedgedQueries counts queries duplicated to the hedge upstream, by which answer was used
+	HedgedQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_hedged_queries_total",
+			Help: "Total number of queries also sent to the hedge upstream, by winner",
+		},
+		[]string{"winner"},
+	)
+
+	// UpstreamRouteScore reports the score of each upstream of adaptive routing
+	UpstreamRouteScore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_route_score_seconds",
+			Help: "Expected cost of an exchange with the upstream, its average response time plus a timeout per failure, by upstream",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamRouteCurrent reports which upstream adaptive routing sends queries to
+	UpstreamRouteCurrent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_route_current",
+			Help: "1 for the upstream adaptive routing sends queries to, 0 for the others",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamRouteSwitches counts changes of the upstream adaptive routing sends queries to
+	UpstreamRouteSwitches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_route_switches_total",
+			Help: "Total number of times adaptive routing moved queries to another upstream, by new upstream",
+		},
+		[]string{"upstream"},
+	)
+
+	// DNSLoops counts queries that came back from the proxy's own upstream sockets
+	DNSLoops = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_loops_detected_total",
+			Help: "Total number of queries refused because they looped back from the proxy's own upstream queries",
+		},
+	)
+
+	// MirroredPackets counts packets copied to the mirror target, by result
+	MirroredPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_mirrored_packets_total",
+			Help: "Total number of queries and responses mirrored to the shadow target, by result",
+		},
+		[]string{"result"},
+	)
+
+	// BlocklistRuleIssues reports the redundant and invalid entries of the enforced blocklist
+	BlocklistRuleIssues = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_blocklist_rule_issues",
+			Help: "Entries of the current blocklist that are duplicate, shadowed by a wildcard or invalid, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	// CriticalExemptions counts block verdicts overridden for critical names
+	CriticalExemptions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_critical_exemptions_total",
+			Help: "Total number of queries for critical names allowed despite matching the blocklist",
+		},
+	)
+
+	// FallbackActive reports whether the fallback blocklist is enforced because of a controller outage
+	FallbackActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_fallback_blocklist_active",
+			Help: "Whether the fallback blocklist is enforced because the controller is unreachable (1) or not (0)",
+		},
+	)
+
+	// PolicyDrift reports whether the enforced blocklist differs from the one the controller expects
+	PolicyDrift = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_policy_drift",
+			Help: "Whether the enforced blocklist differs from the policy blockListHash sent by the controller (1) or not (0)",
+		},
+	)
+
+	// ControllerRegistered reports whether the controller accepted the sidecar's registration
+	ControllerRegistered = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_controller_registered",
+			Help: "Whether the sidecar is registered with the controller (1) or not (0)",
+		},
+	)
+
+	// ControllerHeartbeats counts registration and heartbeat requests to the controller
+	ControllerHeartbeats = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_controller_heartbeats_total",
+			Help: "Total number of registration and heartbeat requests sent to the controller, by result",
+		},
+		[]string{"result"},
+	)
+
+	// TelemetryUploads counts query summaries posted to the controller
+	TelemetryUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_telemetry_uploads_total",
+			Help: "Total number of query summaries posted to the controller, by result",
+		},
+		[]string{"result"},
+	)
+
+	// PolicyDeltas counts incremental policy responses by how they were handled
+	PolicyDeltas = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_policy_deltas_total",
+			Help: "Total number of incremental policy responses, by result",
+		},
+		[]string{"result"},
+	)
+
+	// PolicyPropagation tracks the delay from policy generation on the controller to matcher activation
+	PolicyPropagation = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dns_policy_propagation_seconds",
+			Help:    "Time from policy generation on the controller to activation in the sidecar, in seconds",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		},
+	)
+
+	// HappyEyeballsWins counts dual-stack upstream dials by the family first to connect or answer
+	HappyEyeballsWins = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_happy_eyeballs_wins_total",
+			Help: "Total number of dual-stack upstream dials, by the address family that connected or answered first",
+		},
+		[]string{"family"},
+	)
+
+	// QueryRate is the rate of queries over the anomaly window
+	QueryRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_query_rate",
+			Help: "Queries per second over the anomaly detection window",
+		},
+	)
+
+	// BlockRate is the fraction of queries blocked over the anomaly window
+	BlockRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_block_rate",
+			Help: "Fraction of queries blocked over the anomaly detection window",
+		},
+	)
+
+	// AnomalyAlerts counts anomaly alerts by alert and result
+	AnomalyAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_anomaly_alerts_total",
+			Help: "Total number of anomaly alerts, by alert and whether the webhook was sent, failed or suppressed by the cooldown",
+		},
+		[]string{"alert", "result"},
+	)
+
+	// ThreatFeedBlocked counts queries blocked by the rules of a threat-intelligence feed
+	ThreatFeedBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_threat_feed_blocked_total",
+			Help: "Total number of queries matched by the indicators of a threat-intelligence feed",
+		},
+		[]string{"feed"},
+	)
+
+	// ThreatFeedIndicators is the number of indicators enforced from each feed
+	ThreatFeedIndicators = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_threat_feed_indicators",
+			Help: "Number of domain indicators enforced from each threat-intelligence feed",
+		},
+		[]string{"feed"},
+	)
+
+	// ThreatFeedFetches counts polls of threat-intelligence feeds
+	ThreatFeedFetches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_threat_feed_fetches_total",
+			Help: "Total number of threat-intelligence feed polls, by result",
+		},
+		[]string{"feed", "result"},
+	)
+
+	// ThreatFeedLastSuccess is when each feed was last polled successfully
+	ThreatFeedLastSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_threat_feed_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful poll of each threat-intelligence feed",
+		},
+		[]string{"feed"},
+	)
+
 	InfoTotal = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "informal_metrics",
@@ -50,7 +699,7 @@ var (
 		[]string{"type", "protocol"},
 	)
 	// QueryDuration tracks DNS query processing duration
-	QueryDuration = promauto.NewHistogramVec(
+	QueryDuration = newTimingVec(
 		prometheus.HistogramOpts{
 			Name:    "dns_query_duration_seconds",
 			Help:    "DNS query processing duration in seconds",
@@ -60,14 +709,36 @@ var (
 	)
 )
 
+func init() {
+	prometheus.MustRegister(QueryDuration.HistogramVec)
+
+}
+
 // Error type constants
 const (
-	ErrorTypeParse           = "parse"
-	ErrorTypeUpstreamDial    = "upstream_dial"
-	ErrorTypeUpstreamWrite   = "upstream_write"
-	ErrorTypeUpstreamRead    = "upstream_read"
-	ErrorTypeUpstreamTimeout = "upstream_timeout"
-	ErrorTypeClientWrite     = "client_write"
-	ErrorTypePolicyFetch     = "policy_fetch"
-	InformalMetric           = "policy"
+	ErrorTypeParse            = "parse"
+	ErrorTypeUpstreamDial     = "upstream_dial"
+	ErrorTypeUpstreamWrite    = "upstream_write"
+	ErrorTypeUpstreamRead     = "upstream_read"
+	ErrorTypeUpstreamTimeout  = "upstream_timeout"
+	ErrorTypeUpstreamMismatch = "upstream_mismatch"
+	ErrorTypeClientWrite      = "client_write"
+	ErrorTypePolicyFetch      = "policy_fetch"
+	InformalMetric            = "policy"
 )
+
+// ErrorTyper is implemented by errors that name the type they are counted
+// under in dns_errors_total
+type ErrorTyper interface {
+	ErrorType() string
+}
+
+// ErrorType returns the dns_errors_total type label for err: the one carried
+// by err or an error it wraps, else fallback
+func ErrorType(err error, fallback string) string {
+	var typed ErrorTyper
+	if errors.As(err, &typed) {
+		return typed.ErrorType()
+	}
+	return fallback
+}
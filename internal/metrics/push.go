@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushConfig configures the optional Pushgateway exporter
+type PushConfig struct {
+	URL      string            // Pushgateway base URL
+	Job      string            // job label of the pushed group
+	Interval time.Duration     // time between pushes
+	Labels   map[string]string // extra grouping labels
+}
+
+// ParsePushLabels parses "key=value,key=value" into grouping labels
+func ParsePushLabels(spec string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid push label %q (want key=value)", pair)
+		}
+		labels[key] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// StartPusher pushes all registered metrics to a Pushgateway every interval.
+// The group is identified by the job and the grouping labels; an "instance"
+// label defaults to the host name so sidecars do not overwrite each other.
+func StartPusher(cfg PushConfig) {
+	pusher := push.New(cfg.URL, cfg.Job).Gatherer(prometheus.DefaultGatherer)
+
+	if _, ok := cfg.Labels["instance"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			pusher = pusher.Grouping("instance", hostname)
+		}
+	}
+	for key, value := range cfg.Labels {
+		pusher = pusher.Grouping(key, value)
+	}
+
+	log.Printf("Pushing metrics to %s every %s", cfg.URL, cfg.Interval)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := pusher.Push(); err != nil {
+			log.Printf("Failed to push metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxStatsDPacket keeps datagrams below a typical path MTU
+const maxStatsDPacket = 1432
+
+// StatsDConfig configures the optional StatsD/DogStatsD emitter
+type StatsDConfig struct {
+	Addr     string        // host:port of the StatsD agent
+	Prefix   string        // prepended to every metric name
+	Interval time.Duration // how often counters and gauges are flushed
+	Tags     bool          // send labels as DogStatsD tags instead of name segments
+}
+
+// statsd is the running emitter, nil when StatsD is disabled
+var statsd atomic.Pointer[statsdClient]
+
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+
+	mu   sync.Mutex
+	buf  []byte
+	last map[string]float64 // last counter values, to send deltas
+}
+
+// StartStatsD connects to the StatsD agent and starts emitting. Timings are
+// sent as they are observed; counters (as deltas) and gauges are flushed
+// every interval. Only the sidecar's dns_* metrics are emitted.
+func StartStatsD(cfg StatsDConfig) error {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("statsd: %w", err)
+	}
+	c := &statsdClient{
+		conn:   conn,
+		prefix: cfg.Prefix,
+		tags:   cfg.Tags,
+		buf:    make([]byte, 0, maxStatsDPacket),
+		last:   make(map[string]float64),
+	}
+	statsd.Store(c)
+
+	log.Printf("Sending StatsD metrics to %s every %s", cfg.Addr, cfg.Interval)
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.flush()
+		}
+	}()
+	return nil
+}
+
+// emit queues a single metric line, sending the buffer when it is full
+func (c *statsdClient) emit(name string, labels []string, values []string, value float64, kind string) {
+	var line []byte
+	line = append(line, c.prefix...)
+	line = append(line, name...)
+	if !c.tags {
+		for _, v := range values {
+			line = append(line, '.')
+			line = append(line, v...)
+		}
+	}
+	line = append(line, ':')
+	line = strconv.AppendFloat(line, value, 'f', -1, 64)
+	line = append(line, '|')
+	line = append(line, kind...)
+	if c.tags && len(labels) > 0 {
+		line = append(line, "|#"...)
+		for i, l := range labels {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = append(line, l...)
+			line = append(line, ':')
+			line = append(line, values[i]...)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > maxStatsDPacket {
+		c.send()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// send writes the buffered lines; callers hold c.mu
+func (c *statsdClient) send() {
+	if len(c.buf) == 0 {
+		return
+	}
+	// StatsD is fire-and-forget; a missing agent must not affect queries
+	c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+// flush emits counter deltas and gauge values gathered from the registry
+func (c *statsdClient) flush() {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Printf("statsd: failed to gather metrics: %v", err)
+	}
+
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), "dns_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels, values := labelPairs(m)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				key := mf.GetName() + "{" + strings.Join(values, ",") + "}"
+				value := m.GetCounter().GetValue()
+				delta := value - c.last[key]
+				c.last[key] = value
+				if delta > 0 {
+					c.emit(mf.GetName(), labels, values, delta, "c")
+				}
+			case dto.MetricType_GAUGE:
+				c.emit(mf.GetName(), labels, values, m.GetGauge().GetValue(), "g")
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.send()
+	c.mu.Unlock()
+}
+
+func labelPairs(m *dto.Metric) (labels, values []string) {
+	for _, lp := range m.GetLabel() {
+		if lp.GetValue() == "" {
+			// An empty label is no label, as in Prometheus
+			continue
+		}
+		labels = append(labels, lp.GetName())
+		values = append(values, lp.GetValue())
+	}
+	return labels, values
+}
+
+// TimingVec is a histogram whose observations are also sent to StatsD as
+// timings when the emitter is running
+type TimingVec struct {
+	*prometheus.HistogramVec
+	name   string
+	labels []string
+}
+
+func newTimingVec(opts prometheus.HistogramOpts, labels []string) *TimingVec {
+	return &TimingVec{
+		HistogramVec: prometheus.NewHistogramVec(opts, labels),
+		name:         strings.TrimSuffix(opts.Name, "_seconds"),
+		labels:       labels,
+	}
+}
+
+// WithLabelValues returns the observer for the given label values
+func (v *TimingVec) WithLabelValues(values ...string) prometheus.Observer {
+	o := v.HistogramVec.WithLabelValues(values...)
+	if c := statsd.Load(); c != nil {
+		return timingObserver{Observer: o, client: c, vec: v, values: values}
+	}
+	return o
+}
+
+type timingObserver struct {
+	prometheus.Observer
+	client *statsdClient
+	vec    *TimingVec
+	values []string
+}
+
+// Observe records seconds in the histogram and sends milliseconds to StatsD
+func (o timingObserver) Observe(seconds float64) {
+	o.Observer.Observe(seconds)
+	o.client.emit(o.vec.name, o.vec.labels, o.values, seconds*1000, "ms")
+}
@@ -0,0 +1,57 @@
+package querylog
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// ServeHTTP answers GET /api/querylog with the size of the log, and DELETE
+// /api/querylog by purging entries: all of them, or those written before
+// ?before= (RFC 3339) and those of the client IP in ?client=
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		usage, err := l.Usage()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		var f Filter
+		if v := query.Get("before"); v != "" {
+			before, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "before must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			f.Before = before
+		}
+		if v := query.Get("client"); v != "" {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				http.Error(w, "client must be an IP address", http.StatusBadRequest)
+				return
+			}
+			f.Client = ip.String()
+		}
+		removed, err := l.Purge(f)
+		log.Info().Msgf("Purged %d query log entries (before %q, client %q)", removed, query.Get("before"), f.Client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,408 @@
+// Package querylog writes answered queries to rotated files and keeps them
+// only as long as configured: segments older than the maximum age and the
+// oldest segments beyond the size limit are deleted, verdicts that need not
+// be kept are never written, and entries can be purged on demand, such as
+// for a client exercising its right to erasure.
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// EventBuffer is the query tap buffer to subscribe a log with; events beyond
+// it are dropped while the log is busy
+const EventBuffer = 4096
+
+const (
+	// segmentAge is how long a segment is written to before the next one is
+	// started, which bounds how long entries outlive the maximum age
+	segmentAge = time.Hour
+	// maxSegmentSize bounds a segment, and so the data deleted at once when
+	// the size limit is reached
+	maxSegmentSize = 8 << 20
+	// segmentFormat names segments after their creation; the names sort
+	// chronologically
+	segmentFormat = "20060102T150405.000000000Z"
+	segmentPrefix = "queries-"
+	segmentSuffix = ".jsonl"
+)
+
+// Entry is one line of the log
+type Entry struct {
+	ID        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Protocol  string    `json:"protocol"`
+	Verdict   string    `json:"verdict"`
+	Rule      string    `json:"rule,omitempty"`
+	PolicySet string    `json:"policySet,omitempty"`
+}
+
+// Log writes query entries to segment files in Dir
+type Log struct {
+	Dir      string
+	MaxAge   time.Duration   // 0 keeps entries regardless of age
+	MaxSize  int64           // bytes over all segments, 0 for no limit
+	Verdicts map[string]bool // verdicts written, nil for all
+
+	mu      sync.Mutex
+	file    *os.File // current segment, nil until the next entry
+	w       *bufio.Writer
+	opened  time.Time
+	written int64 // bytes in the current segment, buffered ones included
+}
+
+// Open returns a log writing to dir, which is created if needed. verdicts
+// lists the verdicts to write; an empty list writes all of them.
+func Open(dir string, maxAge time.Duration, maxSize int64, verdicts []string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create query log directory: %w", err)
+	}
+	l := &Log{Dir: dir, MaxAge: maxAge, MaxSize: maxSize}
+	for _, verdict := range verdicts {
+		verdict = strings.TrimSpace(verdict)
+		switch verdict {
+		case "":
+			continue
+		case dns.VerdictBlocked, dns.VerdictAllowed, dns.VerdictLocal, dns.VerdictFailed:
+		default:
+			return nil, fmt.Errorf("unknown query log verdict %q", verdict)
+		}
+		if l.Verdicts == nil {
+			l.Verdicts = make(map[string]bool)
+		}
+		l.Verdicts[verdict] = true
+	}
+	return l, nil
+}
+
+// Run writes the events until the channel is closed, flushing them every
+// second and enforcing the retention limits every minute
+func (l *Log) Run(events <-chan dns.QueryEvent) {
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	retention := time.NewTicker(time.Minute)
+	defer retention.Stop()
+	l.enforce(time.Now())
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				l.mu.Lock()
+				l.closeSegment()
+				l.mu.Unlock()
+				return
+			}
+			l.Write(ev)
+		case <-flush.C:
+			l.mu.Lock()
+			if l.w != nil {
+				if err := l.w.Flush(); err != nil {
+					log.Err(err).Msg("Failed to write the query log:")
+					l.closeSegment()
+				}
+			}
+			l.mu.Unlock()
+		case now := <-retention.C:
+			l.enforce(now)
+		}
+	}
+}
+
+// Write appends one answered query, unless its verdict is not logged
+func (l *Log) Write(ev dns.QueryEvent) {
+	if l.Verdicts != nil && !l.Verdicts[ev.Verdict] {
+		metrics.QueryLogEntries.WithLabelValues("filtered").Inc()
+		return
+	}
+	line, err := json.Marshal(Entry(ev))
+	if err != nil {
+		metrics.QueryLogEntries.WithLabelValues("error").Inc()
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && (l.written+int64(len(line)) > l.segmentSize() || time.Since(l.opened) >= segmentAge) {
+		l.closeSegment()
+	}
+	if l.file == nil {
+		if err := l.openSegment(); err != nil {
+			log.Err(err).Msg("Failed to open a query log segment:")
+			metrics.QueryLogEntries.WithLabelValues("error").Inc()
+			return
+		}
+	}
+	if _, err := l.w.Write(line); err != nil {
+		log.Err(err).Msg("Failed to write the query log:")
+		metrics.QueryLogEntries.WithLabelValues("error").Inc()
+		l.closeSegment()
+		return
+	}
+	l.written += int64(len(line))
+	metrics.QueryLogEntries.WithLabelValues("written").Inc()
+}
+
+// segmentSize is the size segments are rotated at: small enough for the
+// size limit to be held to within a quarter
+func (l *Log) segmentSize() int64 {
+	if l.MaxSize > 0 {
+		return max(min(maxSegmentSize, l.MaxSize/4), 4096)
+	}
+	return maxSegmentSize
+}
+
+// openSegment starts a new segment; the caller holds l.mu
+func (l *Log) openSegment() error {
+	now := time.Now()
+	name := filepath.Join(l.Dir, segmentPrefix+now.UTC().Format(segmentFormat)+segmentSuffix)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file, l.w, l.opened, l.written = f, bufio.NewWriter(f), now, 0
+	return nil
+}
+
+// closeSegment flushes and closes the current segment, if any; the caller
+// holds l.mu
+func (l *Log) closeSegment() {
+	if l.file == nil {
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		log.Err(err).Msg("Failed to write the query log:")
+	}
+	if err := l.file.Close(); err != nil {
+		log.Err(err).Msg("Failed to close a query log segment:")
+	}
+	l.file, l.w = nil, nil
+}
+
+// segment is a log file and when its last entry was written
+type segment struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// segments lists the log files, oldest first; the caller holds l.mu
+func (l *Log) segments() ([]segment, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(l.Dir, name), size: info.Size(), modified: info.ModTime()})
+	}
+	slices.SortFunc(segments, func(a, b segment) int { return strings.Compare(a.path, b.path) })
+	return segments, nil
+}
+
+// current reports whether s is the segment being written; the caller holds l.mu
+func (l *Log) current(s segment) bool {
+	return l.file != nil && l.file.Name() == s.path
+}
+
+// enforce deletes the segments whose newest entry is older than MaxAge, then
+// the oldest segments while the log exceeds MaxSize
+func (l *Log) enforce(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A segment left idle is closed, so that its entries expire with it
+	if l.file != nil && now.Sub(l.opened) >= segmentAge {
+		l.closeSegment()
+	}
+	segments, err := l.segments()
+	if err != nil {
+		log.Err(err).Msg("Failed to list query log segments:")
+		return
+	}
+
+	var total int64
+	kept := segments[:0]
+	for _, s := range segments {
+		if l.MaxAge > 0 && !l.current(s) && now.Sub(s.modified) > l.MaxAge {
+			l.remove(s, "age")
+			continue
+		}
+		if l.current(s) {
+			s.size = l.written
+		}
+		total += s.size
+		kept = append(kept, s)
+	}
+	for _, s := range kept {
+		if l.MaxSize <= 0 || total <= l.MaxSize || l.current(s) {
+			break
+		}
+		l.remove(s, "size")
+		total -= s.size
+	}
+	metrics.QueryLogBytes.Set(float64(total))
+}
+
+func (l *Log) remove(s segment, reason string) {
+	if err := os.Remove(s.path); err != nil {
+		log.Err(err).Msgf("Failed to delete query log segment %s:", s.path)
+		return
+	}
+	metrics.QueryLogPurged.WithLabelValues(reason).Add(float64(s.size))
+	log.Debug().Msgf("Deleted query log segment %s (%s)", s.path, reason)
+}
+
+// Filter selects the entries removed by Purge; the zero value selects all
+type Filter struct {
+	Before time.Time // only entries written before, zero for any time
+	Client string    // only entries of this client IP or address, "" for any client
+}
+
+func (f Filter) matches(e Entry) bool {
+	if !f.Before.IsZero() && !e.Time.Before(f.Before) {
+		return false
+	}
+	if f.Client == "" || e.Client == f.Client {
+		return true
+	}
+	host, _, err := net.SplitHostPort(e.Client)
+	return err == nil && host == f.Client
+}
+
+// Purge removes the entries f selects from every segment and returns how
+// many it removed. Segments left empty are deleted; the others are
+// rewritten and keep their age.
+func (l *Log) Purge(f Filter) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Entries after the purge go to a new segment
+	l.closeSegment()
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, s := range segments {
+		n, err := l.purgeSegment(s, f)
+		removed += n
+		if err != nil {
+			return removed, fmt.Errorf("purge %s: %w", s.path, err)
+		}
+	}
+	l.updateSize()
+	return removed, nil
+}
+
+// purgeSegment removes the entries f selects from one segment
+func (l *Log) purgeSegment(s segment, f Filter) (int, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	var kept bytes.Buffer
+	removed := 0
+	for line := range bytes.Lines(data) {
+		var e Entry
+		if err := json.Unmarshal(line, &e); err == nil && f.matches(e) {
+			removed++
+			continue
+		}
+		kept.Write(line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if kept.Len() == 0 {
+		if err := os.Remove(s.path); err != nil {
+			return 0, err
+		}
+		metrics.QueryLogPurged.WithLabelValues("api").Add(float64(s.size))
+		return removed, nil
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0o600); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Chtimes(tmp, s.modified, s.modified); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	metrics.QueryLogPurged.WithLabelValues("api").Add(float64(s.size - int64(kept.Len())))
+	return removed, nil
+}
+
+// Usage describes the segments on disk
+type Usage struct {
+	Segments int        `json:"segments"`
+	Bytes    int64      `json:"bytes"`
+	Oldest   *time.Time `json:"oldest,omitempty"` // creation of the oldest segment
+}
+
+// Usage returns the current size of the log
+func (l *Log) Usage() (Usage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments, err := l.segments()
+	if err != nil {
+		return Usage{}, err
+	}
+	u := Usage{Segments: len(segments)}
+	for i, s := range segments {
+		if l.current(s) {
+			s.size = l.written
+		}
+		u.Bytes += s.size
+		if i == 0 {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(s.path), segmentPrefix), segmentSuffix)
+			if created, err := time.Parse(segmentFormat, name); err == nil {
+				u.Oldest = &created
+			}
+		}
+	}
+	return u, nil
+}
+
+// updateSize sets dns_query_log_bytes after a purge; the caller holds l.mu
+func (l *Log) updateSize() {
+	segments, err := l.segments()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, s := range segments {
+		total += s.size
+	}
+	metrics.QueryLogBytes.Set(float64(total))
+}
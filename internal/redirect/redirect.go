@@ -0,0 +1,60 @@
+// Package redirect steers the DNS queries of a pod to the sidecar with eBPF
+// programs attached to the pod's cgroup, for clusters that do not install
+// iptables rules. The programs hook connect(2), sendmsg(2) and recvmsg(2) of
+// IPv4 sockets: queries to port 53 are sent to the sidecar's listener
+// instead, and its answers appear to come from the address the client asked.
+// The sockets of one UID, the sidecar's own, are left alone so that its
+// upstream queries go out unchanged.
+//
+// sk_lookup programs only see traffic addressed to the pod, not the queries
+// it sends, so they are of no use here.
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// DNSPort is the destination port of the queries that are redirected
+const DNSPort = 53
+
+// Options configures the redirection
+type Options struct {
+	// CgroupPath is the cgroup v2 directory of the pod; every process in it
+	// and its descendants is redirected
+	CgroupPath string
+	// Target is the listener the queries are sent to
+	Target netip.AddrPort
+	// ExcludeUID is the UID whose sockets are not redirected
+	ExcludeUID uint32
+}
+
+// ListenTarget returns the address clients in the pod reach the sidecar
+// listening on listenAddr at: a wildcard listener is reached on loopback.
+// Only IPv4 listeners can be redirected to.
+func ListenTarget(listenAddr string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	addr := netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	if host != "" {
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("listen address %q is not an IP address", host)
+		}
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			return netip.AddrPort{}, fmt.Errorf("listen address %s is not IPv4", addr)
+		}
+		if addr.IsUnspecified() {
+			addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
@@ -0,0 +1,328 @@
+//go:build linux
+
+package redirect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapEntries bounds the sockets whose original destination is remembered;
+// the map is an LRU, so the least recently redirected are forgotten first
+const mapEntries = 65536
+
+// Offsets in struct bpf_sock_addr
+const (
+	ctxUserIP4  = 4
+	ctxUserPort = 24
+)
+
+// Helper function IDs, from enum bpf_func_id
+const (
+	helperMapLookupElem    = 1
+	helperMapUpdateElem    = 2
+	helperGetCurrentUIDGID = 15
+	helperGetSocketCookie  = 46
+)
+
+// Redirector holds the attached programs; they are detached when it is
+// closed or the process exits, after which queries go out unchanged
+type Redirector struct {
+	fds []int
+}
+
+// Attach loads the redirection programs and attaches them to the cgroup in
+// opts. It needs CAP_BPF and CAP_NET_ADMIN, or CAP_SYS_ADMIN, and a kernel
+// with BPF links for cgroups (5.7 or newer).
+func Attach(opts Options) (*Redirector, error) {
+	if !opts.Target.Addr().Is4() {
+		return nil, fmt.Errorf("redirect target %s is not IPv4", opts.Target)
+	}
+	cgroup, err := unix.Open(opts.CgroupPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening cgroup %s: %w", opts.CgroupPath, err)
+	}
+	defer unix.Close(cgroup)
+
+	r := &Redirector{}
+	origins, err := createMap()
+	if err != nil {
+		return nil, fmt.Errorf("creating the destination map: %w", err)
+	}
+	r.fds = append(r.fds, origins)
+
+	programs := []struct {
+		name       string
+		attachType uint32
+		insns      []insn
+	}{
+		{"lktr_connect4", unix.BPF_CGROUP_INET4_CONNECT, redirectProgram(origins, opts)},
+		{"lktr_sendmsg4", unix.BPF_CGROUP_UDP4_SENDMSG, redirectProgram(origins, opts)},
+		{"lktr_recvmsg4", unix.BPF_CGROUP_UDP4_RECVMSG, restoreProgram(origins, opts)},
+	}
+	for _, p := range programs {
+		prog, err := loadProgram(p.name, p.attachType, p.insns)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("loading %s: %w", p.name, err)
+		}
+		r.fds = append(r.fds, prog)
+		link, err := createLink(prog, cgroup, p.attachType)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("attaching %s to %s: %w", p.name, opts.CgroupPath, err)
+		}
+		r.fds = append(r.fds, link)
+	}
+	return r, nil
+}
+
+// Close detaches the programs
+func (r *Redirector) Close() error {
+	var errs []error
+	for _, fd := range r.fds {
+		errs = append(errs, unix.Close(fd))
+	}
+	r.fds = nil
+	return errors.Join(errs...)
+}
+
+// redirectProgram sends IPv4 queries to port 53 to the target, unless the
+// caller runs as the excluded UID. The original destination is stored
+// under the socket's cookie so that answers can be made to come from it.
+// It serves both connect4 and sendmsg4.
+func redirectProgram(origins int, opts Options) []insn {
+	return assemble(
+		mov64Reg(6, 1),
+		call(helperGetCurrentUIDGID),
+		mov32Reg(0, 0), // the UID is the lower half
+		jmp32Imm(unix.BPF_JEQ, 0, int32(opts.ExcludeUID)),
+		ldxW(1, 6, ctxUserPort),
+		jmp32Imm(unix.BPF_JNE, 1, portImm(DNSPort)),
+
+		mov64Reg(1, 6),
+		call(helperGetSocketCookie),
+		stxDW(10, 0, -8),
+		ldxW(1, 6, ctxUserIP4),
+		stxW(10, 1, -16),
+		ldxW(1, 6, ctxUserPort),
+		stxW(10, 1, -12),
+		ldMapFD(1, origins),
+		mov64Reg(2, 10),
+		add64Imm(2, -8),
+		mov64Reg(3, 10),
+		add64Imm(3, -16),
+		mov64Imm(4, 0),
+		call(helperMapUpdateElem),
+
+		mov64Imm(1, addrImm(opts)),
+		stxW(6, 1, ctxUserIP4),
+		mov64Imm(1, portImm(opts.Target.Port())),
+		stxW(6, 1, ctxUserPort),
+	)
+}
+
+// restoreProgram makes answers from the target to a redirected socket
+// appear to come from the destination the socket first asked, since
+// resolvers drop answers from another address than their server's
+func restoreProgram(origins int, opts Options) []insn {
+	return assemble(
+		mov64Reg(6, 1),
+		ldxW(1, 6, ctxUserPort),
+		jmp32Imm(unix.BPF_JNE, 1, portImm(opts.Target.Port())),
+		ldxW(1, 6, ctxUserIP4),
+		jmp32Imm(unix.BPF_JNE, 1, addrImm(opts)),
+
+		mov64Reg(1, 6),
+		call(helperGetSocketCookie),
+		stxDW(10, 0, -8),
+		ldMapFD(1, origins),
+		mov64Reg(2, 10),
+		add64Imm(2, -8),
+		call(helperMapLookupElem),
+		jmpImm(unix.BPF_JEQ, 0, 0),
+
+		ldxW(1, 0, 0),
+		stxW(6, 1, ctxUserIP4),
+		ldxW(1, 0, 4),
+		stxW(6, 1, ctxUserPort),
+	)
+}
+
+// addrImm is the target address as the 32-bit word holding it in network
+// byte order
+func addrImm(opts Options) int32 {
+	ip := opts.Target.Addr().As4()
+	return int32(binary.NativeEndian.Uint32(ip[:]))
+}
+
+// portImm is port as the user_port field holds it, in network byte order
+func portImm(port uint16) int32 {
+	return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, port)))
+}
+
+// insn is a struct bpf_insn
+type insn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high one
+	off  int16
+	imm  int32
+}
+
+// jumpOut marks the offset of a jump to the end of the program, where it
+// returns 1 to let the call proceed; assemble resolves it
+const jumpOut = -0x8000
+
+// assemble appends the epilogue to body, completes its 64-bit loads and
+// resolves its jumps
+func assemble(body ...insn) []insn {
+	var insns []insn
+	for _, in := range body {
+		insns = append(insns, in)
+		if in.code == unix.BPF_LD|unix.BPF_DW|unix.BPF_IMM {
+			insns = append(insns, insn{})
+		}
+	}
+	insns = append(insns, mov64Imm(0, 1), insn{code: unix.BPF_JMP | unix.BPF_EXIT})
+	out := len(insns) - 2
+	for i := range insns {
+		if insns[i].off == jumpOut {
+			insns[i].off = int16(out - i - 1)
+		}
+	}
+	return insns
+}
+
+func mov64Imm(dst uint8, imm int32) insn {
+	return insn{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, regs: dst, imm: imm}
+}
+
+func mov64Reg(dst, src uint8) insn {
+	return insn{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X, regs: dst | src<<4}
+}
+
+func mov32Reg(dst, src uint8) insn {
+	return insn{code: unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X, regs: dst | src<<4}
+}
+
+func add64Imm(dst uint8, imm int32) insn {
+	return insn{code: unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_K, regs: dst, imm: imm}
+}
+
+func ldxW(dst, src uint8, off int16) insn {
+	return insn{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, regs: dst | src<<4, off: off}
+}
+
+func stxW(dst, src uint8, off int16) insn {
+	return insn{code: unix.BPF_STX | unix.BPF_MEM | unix.BPF_W, regs: dst | src<<4, off: off}
+}
+
+func stxDW(dst, src uint8, off int16) insn {
+	return insn{code: unix.BPF_STX | unix.BPF_MEM | unix.BPF_DW, regs: dst | src<<4, off: off}
+}
+
+// jmp32Imm jumps out when the lower half of dst compares to imm by op
+func jmp32Imm(op uint8, dst uint8, imm int32) insn {
+	return insn{code: unix.BPF_JMP32 | op | unix.BPF_K, regs: dst, off: jumpOut, imm: imm}
+}
+
+// jmpImm jumps out when dst compares to imm by op
+func jmpImm(op uint8, dst uint8, imm int32) insn {
+	return insn{code: unix.BPF_JMP | op | unix.BPF_K, regs: dst, off: jumpOut, imm: imm}
+}
+
+func call(helper int32) insn {
+	return insn{code: unix.BPF_JMP | unix.BPF_CALL, imm: helper}
+}
+
+// ldMapFD loads the map with the fd into dst
+func ldMapFD(dst uint8, fd int) insn {
+	return insn{code: unix.BPF_LD | unix.BPF_DW | unix.BPF_IMM, regs: dst | unix.BPF_PSEUDO_MAP_FD<<4, imm: int32(fd)}
+}
+
+func createMap() (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, flags uint32
+	}{
+		mapType:    unix.BPF_MAP_TYPE_LRU_HASH,
+		keySize:    8, // socket cookie
+		valueSize:  8, // original address and port
+		maxEntries: mapEntries,
+	}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func loadProgram(name string, attachType uint32, insns []insn) (int, error) {
+	code := make([]byte, 0, len(insns)*8)
+	for _, in := range insns {
+		code = append(code, in.code, in.regs)
+		code = binary.NativeEndian.AppendUint16(code, uint16(in.off))
+		code = binary.NativeEndian.AppendUint32(code, uint32(in.imm))
+	}
+	license := []byte("GPL\x00")
+	verifierLog := make([]byte, 64*1024)
+
+	attr := struct {
+		progType           uint32
+		insnCnt            uint32
+		insns              uint64
+		license            uint64
+		logLevel           uint32
+		logSize            uint32
+		logBuf             uint64
+		kernVersion        uint32
+		progFlags          uint32
+		progName           [unix.BPF_OBJ_NAME_LEN]byte
+		progIfindex        uint32
+		expectedAttachType uint32
+	}{
+		progType:           unix.BPF_PROG_TYPE_CGROUP_SOCK_ADDR,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(verifierLog)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&verifierLog[0]))),
+		expectedAttachType: attachType,
+	}
+	copy(attr.progName[:], name)
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	if err != nil {
+		if msg := bytes.TrimRight(verifierLog, "\x00\n"); len(msg) > 0 {
+			return -1, fmt.Errorf("%w: %s", err, msg[bytes.LastIndexByte(msg, '\n')+1:])
+		}
+		return -1, err
+	}
+	return fd, nil
+}
+
+func createLink(prog, target int, attachType uint32) (int, error) {
+	attr := struct {
+		progFD, targetFD, attachType, flags uint32
+	}{
+		progFD:     uint32(prog),
+		targetFD:   uint32(target),
+		attachType: attachType,
+	}
+	return bpf(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		if errno == unix.EPERM {
+			return -1, fmt.Errorf("%w (CAP_BPF and CAP_NET_ADMIN are needed)", os.NewSyscallError("bpf", errno))
+		}
+		return -1, os.NewSyscallError("bpf", errno)
+	}
+	return int(fd), nil
+}
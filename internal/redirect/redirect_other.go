@@ -0,0 +1,18 @@
+//go:build !linux
+
+package redirect
+
+import "errors"
+
+// Redirector holds the attached programs
+type Redirector struct{}
+
+// Attach fails: eBPF redirection is only available on Linux
+func Attach(opts Options) (*Redirector, error) {
+	return nil, errors.New("eBPF DNS redirection is only supported on Linux")
+}
+
+// Close does nothing
+func (r *Redirector) Close() error {
+	return nil
+}
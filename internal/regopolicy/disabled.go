@@ -0,0 +1,43 @@
+//go:build !rego
+
+package regopolicy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"lktr/internal/client"
+	"lktr/internal/dns"
+)
+
+// Built reports whether this binary can evaluate Rego policies
+const Built = false
+
+// Evaluator stands in for the Rego evaluator in binaries built without the
+// rego tag: it decides nothing and rejects policies
+type Evaluator struct {
+	Timeout time.Duration
+}
+
+func New(timeout time.Duration) *Evaluator {
+	return &Evaluator{Timeout: timeout}
+}
+
+// Update fails for any policy
+func (e *Evaluator) Update(policy *client.RegoPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	return errors.New("Rego policies require a binary built with -tags rego")
+}
+
+// PreMatch implements dns.QueryHooks
+func (e *Evaluator) PreMatch(ctx context.Context, q dns.HookQuery) dns.HookAction {
+	return dns.HookContinue
+}
+
+// PreResponse implements dns.QueryHooks
+func (e *Evaluator) PreResponse(ctx context.Context, q dns.HookQuery, response []byte) dns.HookAction {
+	return dns.HookContinue
+}
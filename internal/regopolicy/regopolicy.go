@@ -0,0 +1,122 @@
+//go:build rego
+
+// Package regopolicy evaluates Rego policies, distributed by the controller
+// as OPA bundles, against the attributes of every query. It is only
+// compiled with the rego build tag.
+package regopolicy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/client"
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/rs/zerolog/log"
+)
+
+// Built reports whether this binary can evaluate Rego policies
+const Built = true
+
+// Evaluator is a pre-match hook deciding queries with the Rego policy the
+// controller sent last. The rule named by the policy's query is evaluated
+// with the input
+//
+//	{"qname": "ads.example.com", "qtype": "A", "client": "10.0.3.7", "protocol": "udp", "time": "2026-01-15T10:04:05Z"}
+//
+// and blocks the query when it is true. Any other value, an undefined rule
+// or a failed evaluation leaves the query to the blocklist.
+type Evaluator struct {
+	Timeout time.Duration // per evaluation
+
+	query atomic.Pointer[rego.PreparedEvalQuery]
+
+	mu     sync.Mutex // serializes updates
+	loaded [sha256.Size]byte
+}
+
+func New(timeout time.Duration) *Evaluator {
+	return &Evaluator{Timeout: timeout}
+}
+
+// Update compiles and activates a policy; nil removes the active one. A
+// policy that fails to compile is reported and the previous one kept.
+func (e *Evaluator) Update(policy *client.RegoPolicy) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if policy == nil {
+		if e.query.Swap(nil) != nil {
+			log.Info().Msg("Rego policy removed")
+		}
+		e.loaded = [sha256.Size]byte{}
+		return nil
+	}
+
+	query := policy.Query
+	if query == "" {
+		query = "data.dns.deny"
+	}
+	// The controller resends the policy with every response
+	sum := sha256.Sum256(append([]byte(query+"\n"), policy.Bundle...))
+	if sum == e.loaded && e.query.Load() != nil {
+		return nil
+	}
+
+	b, err := bundle.NewReader(bytes.NewReader(policy.Bundle)).Read()
+	if err != nil {
+		return fmt.Errorf("read Rego bundle: %w", err)
+	}
+	prepared, err := rego.New(rego.Query(query), rego.ParsedBundle("controller", &b)).PrepareForEval(context.Background())
+	if err != nil {
+		return fmt.Errorf("compile Rego policy: %w", err)
+	}
+	e.query.Store(&prepared)
+	e.loaded = sum
+	log.Info().Msgf("Rego policy activated: %s, %d modules", query, len(b.Modules))
+	return nil
+}
+
+// PreMatch implements dns.QueryHooks
+func (e *Evaluator) PreMatch(ctx context.Context, q dns.HookQuery) dns.HookAction {
+	prepared := e.query.Load()
+	if prepared == nil {
+		return dns.HookContinue
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	input := map[string]any{
+		"qname":    q.Name,
+		"qtype":    q.Type,
+		"client":   q.Client,
+		"protocol": q.Protocol,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+	}
+	results, err := prepared.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		metrics.RegoEvaluations.WithLabelValues("error").Inc()
+		log.Debug().Err(err).Msgf("Rego evaluation for %s failed", q.Name)
+		return dns.HookContinue
+	}
+	if len(results) > 0 && len(results[0].Expressions) > 0 {
+		if deny, ok := results[0].Expressions[0].Value.(bool); ok && deny {
+			metrics.RegoEvaluations.WithLabelValues("deny").Inc()
+			return dns.HookBlock
+		}
+	}
+	metrics.RegoEvaluations.WithLabelValues("continue").Inc()
+	return dns.HookContinue
+}
+
+// PreResponse implements dns.QueryHooks; answers are not evaluated
+func (e *Evaluator) PreResponse(ctx context.Context, q dns.HookQuery, response []byte) dns.HookAction {
+	return dns.HookContinue
+}
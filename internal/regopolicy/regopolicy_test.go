@@ -0,0 +1,108 @@
+//go:build rego
+
+package regopolicy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+
+	"lktr/internal/client"
+	"lktr/internal/dns"
+)
+
+const denyPolicy = `package dns
+
+import rego.v1
+
+default deny := false
+
+deny if endswith(input.qname, ".ads.example.com")
+
+deny if {
+	input.qtype == "ANY"
+	input.protocol == "udp"
+}
+`
+
+// buildBundle returns a bundle tarball holding the given files
+func buildBundle(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEvaluatorBundle(t *testing.T) {
+	e := New(time.Second)
+	bundle := buildBundle(t, map[string]string{"/dns/policy.rego": denyPolicy})
+	if err := e.Update(&client.RegoPolicy{Bundle: bundle}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query dns.HookQuery
+		want  dns.HookAction
+	}{
+		{dns.HookQuery{Name: "tracker.ads.example.com", Type: "A", Client: "10.0.3.7", Protocol: "udp"}, dns.HookBlock},
+		{dns.HookQuery{Name: "www.example.com", Type: "A", Client: "10.0.3.7", Protocol: "udp"}, dns.HookContinue},
+		{dns.HookQuery{Name: "www.example.com", Type: "ANY", Client: "10.0.3.7", Protocol: "udp"}, dns.HookBlock},
+		{dns.HookQuery{Name: "www.example.com", Type: "ANY", Client: "10.0.3.7", Protocol: "tcp"}, dns.HookContinue},
+	}
+	for _, tt := range tests {
+		if got := e.PreMatch(context.Background(), tt.query); got != tt.want {
+			t.Errorf("%s %s over %s: got %v, want %v", tt.query.Name, tt.query.Type, tt.query.Protocol, got, tt.want)
+		}
+	}
+
+	// A broken policy keeps the previous one
+	broken := buildBundle(t, map[string]string{"/dns/policy.rego": "package dns\n\ndeny if {"})
+	if err := e.Update(&client.RegoPolicy{Bundle: broken}); err == nil {
+		t.Fatal("no error activating a policy that does not compile")
+	}
+	if got := e.PreMatch(context.Background(), tests[0].query); got != dns.HookBlock {
+		t.Fatalf("after a failed update: got %v, want the previous policy to block", got)
+	}
+
+	if err := e.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.PreMatch(context.Background(), tests[0].query); got != dns.HookContinue {
+		t.Fatalf("after removing the policy: got %v, want %v", got, dns.HookContinue)
+	}
+}
+
+func TestEvaluatorQuery(t *testing.T) {
+	e := New(time.Second)
+	bundle := buildBundle(t, map[string]string{"/mesh/rules.rego": "package mesh\n\nimport rego.v1\n\nblock if input.client == \"10.0.9.9\"\n"})
+	if err := e.Update(&client.RegoPolicy{Bundle: bundle, Query: "data.mesh.block"}); err != nil {
+		t.Fatal(err)
+	}
+	q := dns.HookQuery{Name: "www.example.com", Type: "A", Client: "10.0.9.9", Protocol: "tcp"}
+	if got := e.PreMatch(context.Background(), q); got != dns.HookBlock {
+		t.Fatalf("got %v, want %v", got, dns.HookBlock)
+	}
+	// An undefined rule leaves the query to the blocklist
+	q.Client = "10.0.3.7"
+	if got := e.PreMatch(context.Background(), q); got != dns.HookContinue {
+		t.Fatalf("got %v, want %v", got, dns.HookContinue)
+	}
+}
@@ -0,0 +1,127 @@
+// Package secrets fetches TLS material and tokens from HashiCorp Vault or a
+// generic secrets endpoint and refreshes them periodically, so that they do
+// not have to be mounted as files.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"time"
+
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// Keys of the secrets the sidecar uses; missing keys leave the setting to
+// its flags. Certificates and keys are PEM.
+const (
+	DoHClientCert   = "doh_client_cert"
+	DoHClientKey    = "doh_client_key"
+	DoHCACert       = "doh_ca_cert"
+	GRPCTLSCert     = "grpc_tls_cert"
+	GRPCTLSKey      = "grpc_tls_key"
+	ControllerToken = "controller_token"
+)
+
+// Secrets maps keys to values
+type Secrets map[string]string
+
+// Provider fetches the current secrets
+type Provider interface {
+	Fetch(ctx context.Context) (Secrets, error)
+}
+
+// Endpoint is a generic secrets endpoint answering GET with a JSON object of
+// string values, such as {"doh_client_cert": "-----BEGIN CERTIFICATE-----..."}
+type Endpoint struct {
+	URL    string
+	client *http.Client
+}
+
+func NewEndpoint(url string) *Endpoint {
+	return &Endpoint{URL: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Fetch implements Provider
+func (e *Endpoint) Fetch(ctx context.Context) (Secrets, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from secrets endpoint: %d", resp.StatusCode)
+	}
+	var secrets Secrets
+	if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets response: %w", err)
+	}
+	return secrets, nil
+}
+
+// Watcher applies the provider's secrets at startup and again whenever they
+// change
+type Watcher struct {
+	Provider Provider
+	Interval time.Duration
+	Apply    func(Secrets) // called with the complete set after a change
+
+	current Secrets
+}
+
+// Load fetches the secrets once and applies them; it is called before the
+// components using them start, so that they start with the secrets
+func (w *Watcher) Load(ctx context.Context) error {
+	secrets, err := w.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	w.current = secrets
+	w.Apply(secrets)
+	return nil
+}
+
+// Run refreshes the secrets every Interval until ctx is done. Failed
+// refreshes keep the secrets in use.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		secrets, err := w.fetch(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to refresh secrets, keeping the current ones")
+			continue
+		}
+		if maps.Equal(secrets, w.current) {
+			continue
+		}
+		w.current = secrets
+		log.Info().Msgf("Secrets changed, applying %d", len(secrets))
+		w.Apply(secrets)
+	}
+}
+
+func (w *Watcher) fetch(ctx context.Context) (Secrets, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	secrets, err := w.Provider.Fetch(ctx)
+	if err != nil {
+		metrics.SecretRefreshes.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	metrics.SecretRefreshes.WithLabelValues("success").Inc()
+	return secrets, nil
+}
@@ -0,0 +1,159 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// Vault reads secrets from a key/value secret in HashiCorp Vault, KV version
+// 1 or 2, and keeps its token alive by renewing it once half of its TTL has
+// passed
+type Vault struct {
+	Addr      string // e.g. https://vault.internal:8200
+	Path      string // e.g. secret/data/dns-sidecar for KV version 2
+	Token     string
+	TokenFile string // read on every fetch, for tokens rotated by Vault Agent; overrides Token
+
+	client *http.Client
+
+	token   string        // token the lease below belongs to
+	ttl     time.Duration // TTL granted at the last lookup or renewal, 0 for none
+	renewAt time.Time
+}
+
+func NewVault(addr, path, token, tokenFile string) (*Vault, error) {
+	if addr == "" || path == "" {
+		return nil, errors.New("Vault address and secret path are required")
+	}
+	if token == "" && tokenFile == "" {
+		return nil, errors.New("no Vault token")
+	}
+	return &Vault{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Path:      strings.Trim(path, "/"),
+		Token:     token,
+		TokenFile: tokenFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// vaultResponse is the envelope of Vault API responses
+type vaultResponse struct {
+	Data map[string]any `json:"data"`
+	Auth *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Fetch implements Provider
+func (v *Vault) Fetch(ctx context.Context) (Secrets, error) {
+	token := v.Token
+	if v.TokenFile != "" {
+		data, err := os.ReadFile(v.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != v.token {
+		v.token = token
+		v.lookup(ctx)
+	} else if v.ttl > 0 && time.Now().After(v.renewAt) {
+		v.renew(ctx)
+	}
+
+	var resp vaultResponse
+	if err := v.call(ctx, http.MethodGet, v.Path, &resp); err != nil {
+		return nil, fmt.Errorf("read %s: %w", v.Path, err)
+	}
+	data := resp.Data
+	// KV version 2 wraps the secret in data.data, next to its metadata
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	secrets := make(Secrets, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			secrets[key] = s
+		}
+	}
+	return secrets, nil
+}
+
+// lookup learns the TTL of a new token
+func (v *Vault) lookup(ctx context.Context) {
+	v.ttl = 0
+	var resp vaultResponse
+	if err := v.call(ctx, http.MethodGet, "auth/token/lookup-self", &resp); err != nil {
+		log.Warn().Err(err).Msg("Vault token lookup failed, the token will not be renewed")
+		return
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	if renewable, _ := resp.Data["renewable"].(bool); renewable && ttl > 0 {
+		v.schedule(time.Duration(ttl) * time.Second)
+	}
+}
+
+// renew extends the token's lease
+func (v *Vault) renew(ctx context.Context) {
+	var resp vaultResponse
+	if err := v.call(ctx, http.MethodPost, "auth/token/renew-self", &resp); err != nil || resp.Auth == nil {
+		log.Warn().Err(err).Msg("Vault token renewal failed")
+		// Retry at the next fetch
+		return
+	}
+	if !resp.Auth.Renewable {
+		v.ttl = 0
+		return
+	}
+	v.schedule(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	log.Debug().Msgf("Vault token renewed for %v", v.ttl)
+}
+
+func (v *Vault) schedule(ttl time.Duration) {
+	v.ttl = ttl
+	v.renewAt = time.Now().Add(ttl / 2)
+}
+
+// call sends a request to the Vault API and decodes its response into out
+func (v *Vault) call(ctx context.Context, method, path string, out *vaultResponse) error {
+	var body *bytes.Reader
+	if method == http.MethodPost {
+		body = bytes.NewReader([]byte("{}"))
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.Addr+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("invalid Vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("Vault returned %d: %s", resp.StatusCode, strings.Join(out.Errors, "; "))
+		}
+		return fmt.Errorf("Vault returned %d", resp.StatusCode)
+	}
+	return nil
+}
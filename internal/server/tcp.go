@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
@@ -12,6 +15,12 @@ type TCPServer struct {
 	ListenAddr string
 	Handler    *dns.Handler
 	Verbose    bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	ctx      context.Context // parent of every connection's context, cancelled by Stop
+	cancel   context.CancelFunc
+	closed   bool
 }
 
 func NewTCPServer(listenAddr string, handler *dns.Handler, verbose bool) *TCPServer {
@@ -30,15 +39,40 @@ func (s *TCPServer) Start() error {
 	}
 	defer listener.Close()
 
+	s.mu.Lock()
+	if s.closed {
+		// Stopped before the listener was open
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = listener
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Unlock()
+
 	log.Info().Msgf("DNS proxy listening on TCP %s\n", s.ListenAddr)
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Err(err).Msg("Error accepting TCP connection:")
 			continue
 		}
 
-		go s.Handler.HandleTCP(conn)
+		go s.Handler.HandleTCP(s.ctx, conn)
+	}
+}
+
+// Stop closes the listener, making Start return, and cancels open
+// connections: queries in progress are aborted and idle connections closed.
+func (s *TCPServer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+		s.cancel()
 	}
 }
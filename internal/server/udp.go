@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
@@ -12,6 +15,12 @@ type UDPServer struct {
 	ListenAddr string
 	Handler    *dns.Handler
 	Verbose    bool
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	ctx    context.Context // parent of every query's context, cancelled by Stop
+	cancel context.CancelFunc
+	closed bool
 }
 
 func NewUDPServer(listenAddr string, handler *dns.Handler, verbose bool) *UDPServer {
@@ -36,12 +45,42 @@ func (s *UDPServer) Start() error {
 	}
 	defer conn.Close()
 
+	s.mu.Lock()
+	if s.closed {
+		// Stopped before the socket was open
+		s.mu.Unlock()
+		return nil
+	}
+	s.conn = conn
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Unlock()
+
 	log.Info().Msgf("DNS proxy listening on UDP %s\n", s.ListenAddr)
 
-	buffer := make([]byte, 512)
+	return s.serve(conn)
+}
+
+// Stop closes the listening socket, making Start return, and cancels the
+// queries still in progress
+func (s *UDPServer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+		s.cancel()
+	}
+}
+
+// servePortable reads one datagram per syscall; used where batched I/O is unavailable
+func (s *UDPServer) servePortable(conn *net.UDPConn) error {
+	buffer := make([]byte, s.Handler.QueryBufferSize())
 
 	for {
 		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Err(err).Msgf("Error reading from UDP:")
 			continue
@@ -54,6 +93,6 @@ func (s *UDPServer) Start() error {
 		queryCopy := make([]byte, n)
 		copy(queryCopy, buffer[:n])
 
-		go s.Handler.HandleUDP(conn, clientAddr, queryCopy)
+		go s.Handler.HandleUDP(s.ctx, conn, clientAddr, queryCopy)
 	}
 }
@@ -0,0 +1,151 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
+)
+
+// udpBatchSize is the number of datagrams moved per recvmmsg/sendmmsg call
+const udpBatchSize = 64
+
+// serve reads and writes datagrams in batches via recvmmsg/sendmmsg
+func (s *UDPServer) serve(conn *net.UDPConn) error {
+	pc := ipv4.NewPacketConn(conn)
+	writer := newBatchWriter(pc)
+	go writer.run()
+	defer writer.stop()
+
+	msgs := make([]ipv4.Message, udpBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, s.Handler.QueryBufferSize())}
+	}
+
+	for {
+		count, err := pc.ReadBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Err(err).Msgf("Error reading from UDP:")
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			msg := &msgs[i]
+			clientAddr, ok := msg.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+
+			if s.Verbose {
+				log.Info().Msgf("Received %d bytes from %s", msg.N, clientAddr)
+			}
+
+			queryCopy := make([]byte, msg.N)
+			copy(queryCopy, msg.Buffers[0][:msg.N])
+
+			go s.Handler.HandleUDP(s.ctx, writer, clientAddr, queryCopy)
+		}
+	}
+}
+
+type outgoing struct {
+	payload []byte
+	addr    *net.UDPAddr
+}
+
+// errQueueFull is returned for responses dropped because the socket cannot
+// keep up with the handlers
+var errQueueFull = errors.New("UDP response queue full")
+
+// batchWriter queues responses from handler goroutines and flushes them
+// with as few sendmmsg calls as possible.
+type batchWriter struct {
+	pc    *ipv4.PacketConn
+	queue chan outgoing
+	done  chan struct{} // closed when the socket is, stopping run
+}
+
+func newBatchWriter(pc *ipv4.PacketConn) *batchWriter {
+	return &batchWriter{
+		pc:    pc,
+		queue: make(chan outgoing, udpBatchSize*16),
+		done:  make(chan struct{}),
+	}
+}
+
+// WriteToUDP queues b for delivery to addr. The caller must not modify b
+// afterwards. Rather than holding up the handler, a response is dropped
+// when the queue is full; send failures are counted by the flushing
+// goroutine.
+func (w *batchWriter) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-w.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case w.queue <- outgoing{payload: b, addr: addr}:
+		return len(b), nil
+	default:
+		return 0, errQueueFull
+	}
+}
+
+// stop ends run. Responses still queued are not sent, the socket being
+// closed.
+func (w *batchWriter) stop() {
+	close(w.done)
+}
+
+func (w *batchWriter) run() {
+	msgs := make([]ipv4.Message, udpBatchSize)
+	for {
+		var out outgoing
+		select {
+		case out = <-w.queue:
+		case <-w.done:
+			return
+		}
+		n := 0
+		msgs[n] = ipv4.Message{Buffers: [][]byte{out.payload}, Addr: out.addr}
+		n++
+
+		// Pick up whatever else is already waiting without blocking
+	fill:
+		for n < udpBatchSize {
+			select {
+			case more := <-w.queue:
+				msgs[n] = ipv4.Message{Buffers: [][]byte{more.payload}, Addr: more.addr}
+				n++
+			default:
+				break fill
+			}
+		}
+
+		w.flush(msgs[:n])
+	}
+}
+
+func (w *batchWriter) flush(msgs []ipv4.Message) {
+	for len(msgs) > 0 {
+		sent, err := w.pc.WriteBatch(msgs, 0)
+		if err != nil {
+			log.Err(err).Msg("Failed to send response batch to clients:")
+			metrics.ErrorsTotal.WithLabelValues(metrics.ErrorTypeClientWrite, "udp").Inc()
+			// Skip the datagram that failed and keep going with the rest
+			sent++
+		}
+		if sent > len(msgs) {
+			sent = len(msgs)
+		}
+		msgs = msgs[sent:]
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+func (s *UDPServer) serve(conn *net.UDPConn) error {
+	return s.servePortable(conn)
+}
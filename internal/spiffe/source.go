@@ -0,0 +1,259 @@
+// Package spiffe obtains X.509 SVIDs from a SPIFFE Workload API, such as
+// the SPIRE agent's socket, and keeps them current as they are rotated, so
+// that mTLS identities need no certificate files.
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fetchMethod streams the workload's X.509 SVIDs and trust bundles
+const fetchMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// SVID is an X.509 SPIFFE identity with the trust bundle of its domain
+type SVID struct {
+	ID          *url.URL
+	Certificate tls.Certificate
+	Bundle      *x509.CertPool
+	Expires     time.Time
+}
+
+// Source streams SVIDs from the Workload API and always holds the latest one
+type Source struct {
+	Endpoint string // unix:///path or the socket path
+
+	svid  atomic.Pointer[SVID]
+	ready chan struct{}
+}
+
+// NewSource returns a source for the Workload API at endpoint. Nothing is
+// fetched until Start.
+func NewSource(endpoint string) (*Source, error) {
+	if endpoint == "" {
+		return nil, errors.New("no SPIFFE Workload API socket")
+	}
+	if !strings.HasPrefix(endpoint, "unix:") {
+		endpoint = "unix://" + endpoint
+	}
+	return &Source{Endpoint: endpoint, ready: make(chan struct{})}, nil
+}
+
+// Start streams SVIDs in the background, reconnecting whenever the stream
+// breaks, and waits up to timeout for the first one
+func (s *Source) Start(timeout time.Duration) error {
+	conn, err := grpc.NewClient(s.Endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return fmt.Errorf("connect to SPIFFE Workload API: %w", err)
+	}
+	go s.run(conn)
+
+	select {
+	case <-s.ready:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no SVID from the SPIFFE Workload API at %s after %v", s.Endpoint, timeout)
+	}
+}
+
+// SVID returns the current identity, nil before the first one arrived
+func (s *Source) SVID() *SVID {
+	return s.svid.Load()
+}
+
+func (s *Source) run(conn *grpc.ClientConn) {
+	backoff := time.Second
+	for {
+		received, err := s.stream(conn)
+		if received {
+			backoff = time.Second
+		}
+		metrics.SPIFFEStreamErrors.Inc()
+		log.Warn().Err(err).Msgf("SPIFFE Workload API stream ended, reconnecting in %v", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+		if svid := s.svid.Load(); svid != nil && time.Now().After(svid.Expires) {
+			log.Error().Msg("SPIFFE SVID expired while the Workload API is unreachable")
+		}
+	}
+}
+
+// stream applies every response of one FetchX509SVID call until it fails,
+// and reports whether any SVID was received
+func (s *Source) stream(conn *grpc.ClientConn) (received bool, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The Workload API rejects calls without this header
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fetchMethod)
+	if err != nil {
+		return false, err
+	}
+	if err := stream.SendMsg([]byte{}); err != nil {
+		return false, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return false, err
+	}
+	for {
+		var msg []byte
+		if err := stream.RecvMsg(&msg); err != nil {
+			return received, err
+		}
+		svid, err := parseResponse(msg)
+		if err != nil {
+			log.Err(err).Msg("Ignoring invalid SVID from the SPIFFE Workload API")
+			continue
+		}
+		received = true
+		previous := s.svid.Swap(svid)
+		metrics.SPIFFESVIDExpiry.Set(float64(svid.Expires.Unix()))
+		if previous == nil {
+			log.Info().Msgf("SPIFFE identity %s, valid until %s", svid.ID, svid.Expires.Format(time.RFC3339))
+			close(s.ready)
+		} else {
+			log.Debug().Msgf("SPIFFE SVID rotated, valid until %s", svid.Expires.Format(time.RFC3339))
+		}
+	}
+}
+
+// parseResponse decodes an X509SVIDResponse and returns its first SVID,
+// the workload's default identity
+func parseResponse(msg []byte) (*SVID, error) {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.BytesType {
+			svid, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			return parseSVID(svid)
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return nil, errors.New("response has no SVID")
+}
+
+// parseSVID decodes an X509SVID message: the SPIFFE ID (1), the DER chain
+// (2), the PKCS#8 key (3) and the trust bundle as DER certificates (4)
+func parseSVID(msg []byte) (*SVID, error) {
+	var chain, key, bundle []byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch num {
+		case 2:
+			chain = value
+		case 3:
+			key = value
+		case 4:
+			bundle = value
+		}
+	}
+
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("invalid SVID certificate chain: %v", err)
+	}
+	id, err := spiffeID(certs[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVID key: %w", err)
+	}
+	if _, ok := signer.(crypto.Signer); !ok {
+		return nil, errors.New("SVID key cannot sign")
+	}
+	roots, err := x509.ParseCertificates(bundle)
+	if err != nil || len(roots) == 0 {
+		return nil, fmt.Errorf("invalid trust bundle: %v", err)
+	}
+
+	svid := &SVID{ID: id, Bundle: x509.NewCertPool(), Expires: certs[0].NotAfter}
+	for _, root := range roots {
+		svid.Bundle.AddCert(root)
+	}
+	svid.Certificate = tls.Certificate{PrivateKey: signer, Leaf: certs[0]}
+	for _, cert := range certs {
+		svid.Certificate.Certificate = append(svid.Certificate.Certificate, cert.Raw)
+	}
+	return svid, nil
+}
+
+// spiffeID returns the single spiffe:// URI SAN of an SVID
+func spiffeID(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" || cert.URIs[0].Host == "" {
+		return nil, errors.New("certificate has no SPIFFE ID")
+	}
+	return cert.URIs[0], nil
+}
+
+// rawCodec passes messages as bytes, which are encoded and decoded with
+// protowire instead of generated types
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,68 @@
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// ConfigureClient makes tlsConfig present the current SVID as its client
+// certificate, replacing any static one, and accept servers that either
+// pass the usual verification against tlsConfig's roots or present an SVID
+// of the same trust domain signed by the current bundle. Rotated SVIDs and
+// bundles apply to new connections without rebuilding the configuration.
+func (s *Source) ConfigureClient(tlsConfig *tls.Config) {
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		svid := s.svid.Load()
+		if svid == nil {
+			return nil, errors.New("no SPIFFE SVID yet")
+		}
+		return &svid.Certificate, nil
+	}
+	if tlsConfig.InsecureSkipVerify {
+		return
+	}
+
+	// Verification is done in VerifyConnection, which sees the server name
+	roots := tlsConfig.RootCAs
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: cs.ServerName})
+		if err == nil {
+			return nil
+		}
+		if _, idErr := spiffeID(leaf); idErr != nil {
+			return err
+		}
+		return s.verifyServer(leaf, intermediates)
+	}
+}
+
+// verifyServer checks a server SVID against the current trust bundle
+func (s *Source) verifyServer(leaf *x509.Certificate, intermediates *x509.CertPool) error {
+	svid := s.svid.Load()
+	if svid == nil {
+		return errors.New("no SPIFFE trust bundle yet")
+	}
+	id, err := spiffeID(leaf)
+	if err != nil {
+		return err
+	}
+	if id.Host != svid.ID.Host {
+		return fmt.Errorf("server SPIFFE ID %s is not in trust domain %s", id, svid.ID.Host)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: svid.Bundle, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("server SVID %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package telemetry summarizes the queries a sidecar answers, for upload to
+// the controller: totals by verdict and the most queried and blocked names
+// and most used rules of each period, from an optional sample of the
+// queries. Raw queries and client addresses are not kept.
+package telemetry
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/client"
+	"lktr/internal/dns"
+)
+
+// EventBuffer is the query tap buffer to subscribe a collector with; events
+// beyond it are dropped while the collector is busy
+const EventBuffer = 4096
+
+// trackKeys bounds the names and rules counted per period; once reached,
+// further ones are left out of the tables, not of the totals
+const trackKeys = 5000
+
+// Collector counts query events between reports
+type Collector struct {
+	SampleRate float64 // fraction of queries counted in the tables, 0 to 1
+	Top        int     // lines per table, 0 sends totals only
+
+	mu       sync.Mutex
+	start    time.Time
+	verdicts map[string]uint64
+	queried  map[string]uint64
+	blocked  map[string]uint64
+	rules    map[string]uint64
+}
+
+// New returns a collector keeping the top names of a sampleRate fraction of
+// the queries
+func New(sampleRate float64, top int) *Collector {
+	c := &Collector{SampleRate: sampleRate, Top: top}
+	c.reset(time.Now())
+	return c
+}
+
+func (c *Collector) reset(now time.Time) {
+	c.start = now
+	c.verdicts = make(map[string]uint64)
+	c.queried = make(map[string]uint64)
+	c.blocked = make(map[string]uint64)
+	c.rules = make(map[string]uint64)
+}
+
+// Run counts the events until the channel is closed
+func (c *Collector) Run(events <-chan dns.QueryEvent) {
+	for ev := range events {
+		c.record(ev)
+	}
+}
+
+// record counts one answered query
+func (c *Collector) record(ev dns.QueryEvent) {
+	sampled := c.Top > 0 && c.SampleRate > 0 && (c.SampleRate >= 1 || rand.Float64() < c.SampleRate)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verdicts[ev.Verdict]++
+	if !sampled {
+		return
+	}
+	count(c.queried, ev.Name)
+	if ev.Verdict == dns.VerdictBlocked {
+		count(c.blocked, ev.Name)
+		if ev.Rule != "" {
+			count(c.rules, ev.Rule)
+		}
+	}
+}
+
+func count(counts map[string]uint64, key string) {
+	if _, ok := counts[key]; ok || len(counts) < trackKeys {
+		counts[key]++
+	}
+}
+
+// Report returns the summary of the queries since the last report and
+// starts a new period
+func (c *Collector) Report() client.Telemetry {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := client.Telemetry{
+		Start:      c.start,
+		End:        now,
+		Verdicts:   c.verdicts,
+		SampleRate: c.SampleRate,
+	}
+	for _, n := range c.verdicts {
+		t.Queries += n
+	}
+	for _, dc := range top(c.queried, c.Top) {
+		t.TopQueried = append(t.TopQueried, client.DomainCount{Name: dc.key, Count: dc.count})
+	}
+	for _, dc := range top(c.blocked, c.Top) {
+		t.TopBlocked = append(t.TopBlocked, client.DomainCount{Name: dc.key, Count: dc.count})
+	}
+	for _, rc := range top(c.rules, c.Top) {
+		t.TopRules = append(t.TopRules, client.RuleCount{Rule: rc.key, Count: rc.count})
+	}
+	c.reset(now)
+	return t
+}
+
+type keyCount struct {
+	key   string
+	count uint64
+}
+
+// top returns the n most frequent keys, ties in key order
+func top(counts map[string]uint64, n int) []keyCount {
+	out := make([]keyCount, 0, len(counts))
+	for key, count := range counts {
+		out = append(out, keyCount{key, count})
+	}
+	slices.SortFunc(out, func(a, b keyCount) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	return out[:min(n, len(out))]
+}
@@ -0,0 +1,324 @@
+// Package threatintel polls threat-intelligence feeds, TAXII 2.1
+// collections or STIX 2.1 bundles served over HTTP, and turns their domain
+// indicators into blocklist rules, one matcher per feed, so that a block
+// can be traced back to the feed and indicator behind it.
+package threatintel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultInterval = time.Hour
+	fetchTimeout    = 2 * time.Minute
+	maxPages        = 100      // TAXII pages read per poll
+	maxPageSize     = 64 << 20 // bytes
+)
+
+// acceptFeed asks TAXII servers for 2.1 envelopes and plain servers for
+// STIX bundles
+const acceptFeed = "application/taxii+json;version=2.1, application/stix+json;version=2.1;q=0.9, application/json;q=0.8"
+
+// Feed is one feed of a feeds file
+type Feed struct {
+	Name string `json:"name"`
+	// URL is a TAXII 2.1 collection objects endpoint, e.g.
+	// https://taxii.example.com/api1/collections/<id>/objects/, or the URL
+	// of a STIX bundle
+	URL      string `json:"url"`
+	Token    string `json:"token,omitempty"` // bearer token
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// MinConfidence skips indicators below this STIX confidence (0-100);
+	// indicators without one pass only when it is 0
+	MinConfidence int `json:"minConfidence,omitempty"`
+	// Subdomains blocks the names below each domain as well
+	Subdomains bool `json:"subdomains,omitempty"`
+	// IntervalSeconds is the polling period, an hour when unset
+	IntervalSeconds int `json:"intervalSeconds,omitempty"`
+	// ExpireAfterDays bounds the life of indicators without valid_until,
+	// from their last modification; 0 keeps them until the feed drops them
+	ExpireAfterDays int `json:"expireAfterDays,omitempty"`
+}
+
+// LoadFeeds reads a JSON array of feeds from path
+func LoadFeeds(path string) ([]Feed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var feeds []Feed
+	if err := json.Unmarshal(data, &feeds); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, f := range feeds {
+		if f.Name == "" || strings.ContainsAny(f.Name, " \t") {
+			return nil, fmt.Errorf("%s: feed %q needs a name without spaces", path, f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("%s: feed %s is given twice", path, f.Name)
+		}
+		seen[f.Name] = true
+		if u, err := url.Parse(f.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: feed %s has an invalid URL %q", path, f.Name, f.URL)
+		}
+		if f.MinConfidence < 0 || f.MinConfidence > 100 {
+			return nil, fmt.Errorf("%s: feed %s: minConfidence must be between 0 and 100", path, f.Name)
+		}
+	}
+	return feeds, nil
+}
+
+// Feeds polls feeds and passes the rules of each to Update
+type Feeds struct {
+	// Update replaces the matcher of a feed
+	Update func(feed string, m *matcher.Matcher)
+
+	client *http.Client
+	feeds  []*feedState
+}
+
+// feedState is a feed and the outcome of its last poll
+type feedState struct {
+	Feed
+
+	mu          sync.Mutex
+	indicators  []Indicator
+	lastPoll    time.Time
+	lastSuccess time.Time
+	lastErr     string
+	skipped     map[string]int // indicators left out, by reason
+}
+
+// New returns the poller of feeds
+func New(feeds []Feed, update func(feed string, m *matcher.Matcher)) *Feeds {
+	f := &Feeds{Update: update, client: &http.Client{Timeout: fetchTimeout}}
+	for _, feed := range feeds {
+		f.feeds = append(f.feeds, &feedState{Feed: feed})
+	}
+	return f
+}
+
+// Run starts polling each feed in the background, at once and then at its
+// interval
+func (f *Feeds) Run() {
+	for _, feed := range f.feeds {
+		go func() {
+			interval := time.Duration(feed.IntervalSeconds) * time.Second
+			if interval <= 0 {
+				interval = defaultInterval
+			}
+			for {
+				f.poll(feed)
+				time.Sleep(interval)
+			}
+		}()
+	}
+}
+
+// poll fetches a feed and updates its rules. A failed poll keeps the rules
+// of the last successful one, which expire on their own.
+func (f *Feeds) poll(feed *feedState) {
+	now := time.Now()
+	objects, err := f.fetch(feed.Feed)
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	feed.lastPoll = now
+	if err != nil {
+		feed.lastErr = err.Error()
+		metrics.ThreatFeedFetches.WithLabelValues(feed.Name, "error").Inc()
+		log.Warn().Err(err).Msgf("Failed to poll threat feed %s", feed.Name)
+		return
+	}
+	indicators, skipped := feed.indicatorsOf(objects, now)
+	feed.indicators, feed.skipped = indicators, skipped
+	feed.lastSuccess, feed.lastErr = now, ""
+	metrics.ThreatFeedFetches.WithLabelValues(feed.Name, "success").Inc()
+	metrics.ThreatFeedIndicators.WithLabelValues(feed.Name).Set(float64(len(indicators)))
+	metrics.ThreatFeedLastSuccess.WithLabelValues(feed.Name).Set(float64(now.Unix()))
+	f.Update(feed.Name, matcher.BuildMatcher(feed.rules()))
+}
+
+// fetch reads the objects of a feed, following TAXII pagination
+func (f *Feeds) fetch(feed Feed) ([]stixObject, error) {
+	var objects []stixObject
+	next := ""
+	for range maxPages {
+		target := feed.URL
+		if next != "" {
+			u, _ := url.Parse(feed.URL)
+			q := u.Query()
+			q.Set("next", next)
+			u.RawQuery = q.Encode()
+			target = u.String()
+		}
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", acceptFeed)
+		if feed.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+feed.Token)
+		} else if feed.Username != "" {
+			req.SetBasicAuth(feed.Username, feed.Password)
+		}
+		resp, err := f.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		// A bundle and a TAXII envelope both carry "objects"
+		var page struct {
+			Objects []stixObject `json:"objects"`
+			More    bool         `json:"more"`
+			Next    string       `json:"next"`
+		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("feed returned %s", resp.Status)
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxPageSize)).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid feed response: %w", err)
+		}
+		objects = append(objects, page.Objects...)
+		if !page.More || page.Next == "" {
+			return objects, nil
+		}
+		next = page.Next
+	}
+	return nil, fmt.Errorf("feed has more than %d pages", maxPages)
+}
+
+// indicatorsOf selects the indicators of objects the feed blocks, and counts
+// the others by reason
+func (feed *feedState) indicatorsOf(objects []stixObject, now time.Time) ([]Indicator, map[string]int) {
+	skipped := make(map[string]int)
+	var indicators []Indicator
+	for _, o := range objects {
+		if o.Type != "indicator" {
+			continue
+		}
+		var domains []string
+		if o.PatternType == "" || o.PatternType == "stix" {
+			domains = patternDomains(o.Pattern)
+		}
+		switch {
+		case o.Revoked:
+			skipped["revoked"]++
+			continue
+		case len(domains) == 0:
+			skipped["unsupported"]++
+			continue
+		case o.Confidence == nil && feed.MinConfidence > 0, o.Confidence != nil && *o.Confidence < feed.MinConfidence:
+			skipped["low_confidence"]++
+			continue
+		}
+		expires := parseTime(o.ValidUntil)
+		if modified := parseTime(o.Modified); expires.IsZero() && feed.ExpireAfterDays > 0 && !modified.IsZero() {
+			expires = modified.AddDate(0, 0, feed.ExpireAfterDays)
+		}
+		if !expires.IsZero() && !now.Before(expires) {
+			skipped["expired"]++
+			continue
+		}
+		ind := Indicator{ID: o.ID, Feed: feed.Name, Domains: domains, Confidence: o.Confidence}
+		if !expires.IsZero() {
+			ind.Expires = &expires
+		}
+		indicators = append(indicators, ind)
+	}
+	return indicators, skipped
+}
+
+// rules returns the blocklist rules of the feed's indicators. The caller
+// holds the lock.
+func (feed *feedState) rules() []string {
+	var rules []string
+	for _, ind := range feed.indicators {
+		suffix := ""
+		if ind.Expires != nil {
+			suffix = "$expires=" + ind.Expires.UTC().Format(time.RFC3339)
+		}
+		for _, d := range ind.Domains {
+			rules = append(rules, d+suffix)
+			if feed.Subdomains {
+				rules = append(rules, "*."+d+suffix)
+			}
+		}
+	}
+	return rules
+}
+
+// feedStatus is a feed as reported by /api/threatintel
+type feedStatus struct {
+	Name        string         `json:"name"`
+	Indicators  int            `json:"indicators"`
+	Skipped     map[string]int `json:"skipped,omitempty"`
+	LastPoll    *time.Time     `json:"lastPoll,omitempty"`
+	LastSuccess *time.Time     `json:"lastSuccess,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// ServeHTTP answers GET /api/threatintel with the status of every feed, or
+// with ?domain= the indicators naming that domain, or a domain it is below
+// for feeds that block subdomains
+func (f *Feeds) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if domain := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("domain"), ".")); domain != "" {
+		json.NewEncoder(w).Encode(map[string]any{"domain": domain, "indicators": f.lookup(domain)})
+		return
+	}
+	statuses := make([]feedStatus, 0, len(f.feeds))
+	for _, feed := range f.feeds {
+		feed.mu.Lock()
+		// A poll replaces the skipped counts rather than changing them
+		s := feedStatus{Name: feed.Name, Indicators: len(feed.indicators), Skipped: feed.skipped, Error: feed.lastErr}
+		lastPoll, lastSuccess := feed.lastPoll, feed.lastSuccess
+		feed.mu.Unlock()
+		if !lastPoll.IsZero() {
+			s.LastPoll = &lastPoll
+		}
+		if !lastSuccess.IsZero() {
+			s.LastSuccess = &lastSuccess
+		}
+		statuses = append(statuses, s)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"feeds": statuses})
+}
+
+// lookup returns the indicators that block domain
+func (f *Feeds) lookup(domain string) []Indicator {
+	found := []Indicator{}
+	for _, feed := range f.feeds {
+		feed.mu.Lock()
+		for _, ind := range feed.indicators {
+			if slices.ContainsFunc(ind.Domains, func(d string) bool {
+				return d == domain || feed.Subdomains && strings.HasSuffix(domain, "."+d)
+			}) {
+				found = append(found, ind)
+			}
+		}
+		feed.mu.Unlock()
+	}
+	return found
+}
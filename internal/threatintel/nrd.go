@@ -0,0 +1,209 @@
+package threatintel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NRDFeed is the feed name newly registered domains are blocked under, as
+// in the rule "feed:nrd new.example.com"
+const NRDFeed = "nrd"
+
+const (
+	nrdInterval    = 24 * time.Hour
+	maxNRDListSize = 512 << 20 // bytes, decompressed
+)
+
+// NRD blocks newly registered domains, read from a list polled daily: one
+// domain per line, optionally followed by its registration date, as in
+//
+//	new.example.com,2026-10-01
+//
+// A domain and the names below it are blocked until MaxAge after its
+// registration, or after the list first named it when the date is missing,
+// so that domains expire on time whatever the polling. The category can be
+// switched off and on again with SetEnabled.
+type NRD struct {
+	URL    string
+	MaxAge time.Duration
+	// Update replaces the matcher of the feed, nil when it blocks nothing
+	Update func(feed string, m *matcher.Matcher)
+
+	client    *http.Client
+	mu        sync.Mutex
+	firstSeen map[string]time.Time // listed domains without a registration date
+	rules     *matcher.Matcher     // of the last successful poll
+	enabled   bool
+}
+
+// NewNRD returns the poller of the list at rawURL, blocking once polled
+func NewNRD(rawURL string, maxAge time.Duration, update func(feed string, m *matcher.Matcher)) (*NRD, error) {
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid newly registered domain feed URL %q", rawURL)
+	}
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("newly registered domain age must be positive")
+	}
+	return &NRD{
+		URL:       rawURL,
+		MaxAge:    maxAge,
+		Update:    update,
+		client:    &http.Client{Timeout: fetchTimeout},
+		firstSeen: make(map[string]time.Time),
+		enabled:   true,
+	}, nil
+}
+
+// SetEnabled switches blocking newly registered domains on or off. The list
+// is still polled while off, so that switching back on blocks at once.
+func (n *NRD) SetEnabled(enabled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.enabled == enabled {
+		return
+	}
+	n.enabled = enabled
+	if enabled {
+		log.Info().Msg("Newly registered domain blocking enabled")
+	} else {
+		log.Info().Msg("Newly registered domain blocking disabled")
+	}
+	n.apply()
+}
+
+// apply passes the rules on when enabled. The caller holds the lock.
+func (n *NRD) apply() {
+	if n.enabled {
+		n.Update(NRDFeed, n.rules)
+	} else {
+		n.Update(NRDFeed, nil)
+	}
+}
+
+// Run starts polling the list in the background, at once and then daily
+func (n *NRD) Run() {
+	go func() {
+		for {
+			n.poll()
+			time.Sleep(nrdInterval)
+		}
+	}()
+}
+
+// poll fetches the list and updates the rules. A failed poll keeps the
+// rules of the last successful one, which expire on their own.
+func (n *NRD) poll() {
+	now := time.Now()
+	listed, err := n.fetch()
+	if err != nil {
+		metrics.ThreatFeedFetches.WithLabelValues(NRDFeed, "error").Inc()
+		log.Warn().Err(err).Msg("Failed to poll newly registered domains")
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	firstSeen := make(map[string]time.Time)
+	var rules []string
+	blocked := 0
+	for domain, registered := range listed {
+		if registered.IsZero() {
+			registered = now
+			if seen, ok := n.firstSeen[domain]; ok {
+				registered = seen
+			}
+			firstSeen[domain] = registered
+		}
+		expires := registered.Add(n.MaxAge)
+		if !now.Before(expires) {
+			continue
+		}
+		suffix := "$expires=" + expires.UTC().Format(time.RFC3339)
+		rules = append(rules, domain+suffix, "*."+domain+suffix)
+		blocked++
+	}
+	// Domains the list dropped start over should it name them again
+	n.firstSeen = firstSeen
+	n.rules = matcher.BuildMatcher(rules)
+
+	metrics.ThreatFeedFetches.WithLabelValues(NRDFeed, "success").Inc()
+	metrics.ThreatFeedIndicators.WithLabelValues(NRDFeed).Set(float64(blocked))
+	metrics.ThreatFeedLastSuccess.WithLabelValues(NRDFeed).Set(float64(now.Unix()))
+	n.apply()
+}
+
+// fetch reads the list, returning each valid domain with its registration
+// date, zero when not given. Lists whose URL ends in .gz are decompressed.
+func (n *NRD) fetch() (map[string]time.Time, error) {
+	resp, err := n.client.Get(n.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("feed returned %s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if u, _ := url.Parse(n.URL); strings.HasSuffix(u.Path, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feed response: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	listed := make(map[string]time.Time)
+	scanner := bufio.NewScanner(io.LimitReader(body, maxNRDListSize))
+	for scanner.Scan() {
+		domain, registered, ok := parseNRDLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if prev, seen := listed[domain]; !seen || prev.IsZero() || registered.After(prev) {
+			listed[domain] = registered
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("invalid feed response: %w", err)
+	}
+	return listed, nil
+}
+
+// parseNRDLine reads a domain and the optional registration date following
+// it after a comma, tab or space. Comments, blank lines and invalid domains
+// are skipped; a date that cannot be read counts as missing.
+func parseNRDLine(line string) (string, time.Time, bool) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' })
+	if len(fields) == 0 {
+		return "", time.Time{}, false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+	if !validDomain(domain) {
+		return "", time.Time{}, false
+	}
+	var registered time.Time
+	if len(fields) > 1 {
+		if t, err := time.Parse(time.DateOnly, fields[1]); err == nil {
+			registered = t
+		} else {
+			registered = parseTime(fields[1])
+		}
+	}
+	return domain, registered, true
+}
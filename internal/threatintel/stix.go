@@ -0,0 +1,73 @@
+package threatintel
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// domainComparison is a STIX pattern comparison of a domain name
+var domainComparison = regexp.MustCompile(`domain-name:value\s*=\s*'([^'\\]*)'`)
+
+// patternGlue is what may remain of a pattern once its domain comparisons
+// are removed, when every observation names a domain alone
+var patternGlue = regexp.MustCompile(`^(?:[\s\[\]()]|\bOR\b)*$`)
+
+// stixObject holds the fields of STIX 2.1 objects read from feeds.
+// Timestamps are kept as text so one malformed object cannot fail a page.
+type stixObject struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	Confidence  *int   `json:"confidence"`
+	Revoked     bool   `json:"revoked"`
+	Modified    string `json:"modified"`
+	ValidUntil  string `json:"valid_until"`
+}
+
+// Indicator is a STIX indicator naming domains to block
+type Indicator struct {
+	ID         string     `json:"id"`
+	Feed       string     `json:"feed"`
+	Domains    []string   `json:"domains"`
+	Confidence *int       `json:"confidence,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"` // nil when it does not expire
+}
+
+// patternDomains returns the domains of a STIX pattern made of domain-name
+// equality comparisons joined by OR, such as
+//
+//	[domain-name:value = 'evil.example.com' OR domain-name:value = 'evil.example.net']
+//
+// Other patterns, which would block more than the indicator describes when
+// reduced to their domains, return nil.
+func patternDomains(pattern string) []string {
+	matches := domainComparison.FindAllStringSubmatch(pattern, -1)
+	if len(matches) == 0 || !patternGlue.MatchString(domainComparison.ReplaceAllString(pattern, "")) {
+		return nil
+	}
+	var domains []string
+	for _, m := range matches {
+		if d := strings.ToLower(strings.TrimSuffix(m[1], ".")); validDomain(d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// validDomain rejects names that would read as more than one domain in a
+// blocklist rule: wildcards, exceptions, options and single labels, which
+// would block a whole top-level domain
+func validDomain(d string) bool {
+	return strings.Contains(d, ".") && !strings.ContainsAny(d, "*@$ \t")
+}
+
+// parseTime reads a STIX timestamp, zero when missing or malformed
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,85 @@
+package tuning
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cgroup files holding the container memory limit, v2 first then v1
+var memoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// Options controls runtime tuning applied at startup
+type Options struct {
+	// GCPercent sets the GC target percentage; 0 keeps GOGC or the runtime default
+	GCPercent int
+	// MemoryLimitMB sets an explicit soft memory limit in MiB; 0 derives it
+	// from the container limit using MemoryLimitRatio
+	MemoryLimitMB int
+	// MemoryLimitRatio is the fraction of the container memory limit to use
+	// as the soft limit; 0 disables automatic detection
+	MemoryLimitRatio float64
+}
+
+// Apply configures the Go runtime for the sidecar's container. GOMAXPROCS is
+// already derived from the cgroup CPU quota by the runtime (Go 1.25+) and is
+// only reported here; an explicit GOMAXPROCS or GOMEMLIMIT environment
+// variable always wins.
+func Apply(opts Options) {
+	log.Info().Msgf("GOMAXPROCS: %d (CPUs visible: %d)", runtime.GOMAXPROCS(0), runtime.NumCPU())
+
+	if opts.GCPercent != 0 {
+		prev := debug.SetGCPercent(opts.GCPercent)
+		log.Info().Msgf("GC percent set to %d (was %d)", opts.GCPercent, prev)
+	}
+
+	if os.Getenv("GOMEMLIMIT") != "" {
+		log.Info().Msgf("Memory limit taken from GOMEMLIMIT=%s", os.Getenv("GOMEMLIMIT"))
+		return
+	}
+
+	var limit int64
+	switch {
+	case opts.MemoryLimitMB > 0:
+		limit = int64(opts.MemoryLimitMB) << 20
+	case opts.MemoryLimitRatio > 0:
+		containerLimit, ok := containerMemoryLimit()
+		if !ok {
+			return
+		}
+		limit = int64(float64(containerLimit) * opts.MemoryLimitRatio)
+	default:
+		return
+	}
+
+	debug.SetMemoryLimit(limit)
+	log.Info().Msgf("Soft memory limit set to %d MiB", limit>>20)
+}
+
+// containerMemoryLimit returns the cgroup memory limit in bytes, if any
+func containerMemoryLimit() (int64, bool) {
+	for _, path := range memoryLimitFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, false
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		// cgroup v1 reports a huge sentinel when unlimited
+		if err != nil || limit <= 0 || limit >= 1<<62 {
+			return 0, false
+		}
+		return limit, true
+	}
+	return 0, false
+}
@@ -0,0 +1,15 @@
+//go:build !wasmhooks
+
+package wasmhook
+
+import (
+	"errors"
+	"time"
+
+	"lktr/internal/dns"
+)
+
+// Load fails: this binary was built without WASM plugin support
+func Load(path string, instances int, timeout time.Duration) (dns.QueryHooks, error) {
+	return nil, errors.New("WASM plugins require a binary built with -tags wasmhooks")
+}
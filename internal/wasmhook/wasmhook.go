@@ -0,0 +1,197 @@
+//go:build wasmhooks
+
+// Package wasmhook runs query hooks compiled to WebAssembly, with wazero, so
+// custom query logic can be shipped without forking the proxy. It is only
+// compiled with the wasmhooks build tag.
+//
+// A plugin module exports its linear memory, alloc(size i32) i32, which
+// returns a buffer for the host to write to, and one or both hooks:
+//
+//	pre_match(query_ptr i32, query_len i32) i32
+//	pre_response(query_ptr i32, query_len i32, response_ptr i32, response_len i32) i32
+//
+// The query is a JSON object with name, type, client and protocol; the
+// response is the DNS message in wire format. A hook returns 0 to continue,
+// 1 to allow and 2 to block. When the module also exports free(ptr i32,
+// size i32), buffers are handed back to it after each call.
+package wasmhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+
+	json "github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugin is a WebAssembly module providing query hooks. A module instance
+// serves one call at a time, so calls are spread over a pool of instances.
+type Plugin struct {
+	runtime     wazero.Runtime
+	compiled    wazero.CompiledModule
+	instances   chan api.Module
+	timeout     time.Duration
+	preMatch    bool
+	preResponse bool
+	free        bool
+}
+
+// Load compiles the module at path and starts instances of it. Each hook
+// call is bounded by timeout; a call that overruns or traps counts as
+// HookContinue, and its instance is replaced.
+func Load(path string, instances int, timeout time.Duration) (dns.QueryHooks, error) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if instances < 1 {
+		return nil, errors.New("at least one plugin instance is required")
+	}
+
+	ctx := context.Background()
+	// Closing on context cancellation is what lets the timeout stop a
+	// runaway hook
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("compile %s: %w", path, err)
+	}
+
+	exports := compiled.ExportedFunctions()
+	p := &Plugin{
+		runtime:   runtime,
+		compiled:  compiled,
+		instances: make(chan api.Module, instances),
+		timeout:   timeout,
+	}
+	_, p.preMatch = exports["pre_match"]
+	_, p.preResponse = exports["pre_response"]
+	_, p.free = exports["free"]
+	if _, ok := exports["alloc"]; !ok {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("%s does not export alloc", path)
+	}
+	if !p.preMatch && !p.preResponse {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("%s exports neither pre_match nor pre_response", path)
+	}
+
+	for range instances {
+		mod, err := p.instantiate()
+		if err != nil {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("instantiate %s: %w", path, err)
+		}
+		p.instances <- mod
+	}
+	log.Info().Msgf("WASM plugin %s loaded (pre_match: %v, pre_response: %v, %d instances)", path, p.preMatch, p.preResponse, instances)
+	return p, nil
+}
+
+// instantiate starts an instance; reactor modules are initialized through
+// their _initialize export
+func (p *Plugin) instantiate() (api.Module, error) {
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	return p.runtime.InstantiateModule(context.Background(), p.compiled, config)
+}
+
+// PreMatch implements dns.QueryHooks
+func (p *Plugin) PreMatch(ctx context.Context, q dns.HookQuery) dns.HookAction {
+	if !p.preMatch {
+		return dns.HookContinue
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return dns.HookContinue
+	}
+	return p.call(ctx, "pre_match", data)
+}
+
+// PreResponse implements dns.QueryHooks
+func (p *Plugin) PreResponse(ctx context.Context, q dns.HookQuery, response []byte) dns.HookAction {
+	if !p.preResponse {
+		return dns.HookContinue
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return dns.HookContinue
+	}
+	return p.call(ctx, "pre_response", data, response)
+}
+
+// call runs hook on a pooled instance with buffers copied into its memory
+func (p *Plugin) call(ctx context.Context, hook string, buffers ...[]byte) dns.HookAction {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var mod api.Module
+	select {
+	case mod = <-p.instances:
+	case <-ctx.Done():
+		p.failed(hook, errors.New("no plugin instance free"))
+		return dns.HookContinue
+	}
+
+	action, err := p.run(ctx, mod, hook, buffers)
+	if err != nil {
+		p.failed(hook, err)
+		// The instance may be closed or left inconsistent by the failure
+		mod.Close(context.Background())
+		if mod, err = p.instantiate(); err != nil {
+			log.Err(err).Msg("Failed to replace WASM plugin instance")
+			return dns.HookContinue
+		}
+	}
+	p.instances <- mod
+	return action
+}
+
+func (p *Plugin) run(ctx context.Context, mod api.Module, hook string, buffers [][]byte) (dns.HookAction, error) {
+	args := make([]uint64, 0, 2*len(buffers))
+	for _, b := range buffers {
+		results, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(b)))
+		if err != nil {
+			return dns.HookContinue, fmt.Errorf("alloc: %w", err)
+		}
+		ptr := uint32(results[0])
+		if !mod.Memory().Write(ptr, b) {
+			return dns.HookContinue, fmt.Errorf("alloc returned %d, outside memory", ptr)
+		}
+		args = append(args, uint64(ptr), uint64(len(b)))
+	}
+
+	results, err := mod.ExportedFunction(hook).Call(ctx, args...)
+	if err != nil {
+		return dns.HookContinue, err
+	}
+	if p.free {
+		for i := 0; i < len(args); i += 2 {
+			if _, err := mod.ExportedFunction("free").Call(ctx, args[i], args[i+1]); err != nil {
+				return dns.HookContinue, fmt.Errorf("free: %w", err)
+			}
+		}
+	}
+
+	switch action := dns.HookAction(int32(results[0])); action {
+	case dns.HookContinue, dns.HookAllow, dns.HookBlock:
+		return action, nil
+	default:
+		return dns.HookContinue, fmt.Errorf("%s returned unknown action %d", hook, action)
+	}
+}
+
+func (p *Plugin) failed(hook string, err error) {
+	metrics.QueryHookErrors.WithLabelValues(hook).Inc()
+	log.Debug().Err(err).Msgf("WASM plugin %s failed", hook)
+}
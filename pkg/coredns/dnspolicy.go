@@ -0,0 +1,50 @@
+//go:build coredns
+
+package coredns
+
+import (
+	"context"
+
+	"lktr/internal/metrics"
+	"lktr/pkg/policy"
+
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+var log = clog.NewWithPlugin(pluginName)
+
+// DNSPolicy answers queries for blocked names with NXDOMAIN and passes the
+// others to the next plugin
+type DNSPolicy struct {
+	Next     plugin.Handler
+	Enforcer *policy.Enforcer
+}
+
+// ServeDNS implements plugin.Handler
+func (p *DNSPolicy) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	protocol := state.Proto()
+	metrics.QueriesTotal.WithLabelValues(protocol, "").Inc()
+
+	verdict := p.Enforcer.Check(state.Name())
+	if verdict.Matched && !verdict.Blocked {
+		log.Infof("[dry-run] %s from %s would be blocked by rule %q", state.Name(), state.IP(), verdict.Rule)
+	}
+	if !verdict.Blocked {
+		metrics.QueriesAllowed.WithLabelValues(protocol, "").Inc()
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
+	metrics.QueriesBlocked.WithLabelValues(protocol, "").Inc()
+	log.Debugf("Blocked %s from %s by rule %q", state.Name(), state.IP(), verdict.Rule)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	w.WriteMsg(m)
+	return dns.RcodeNameError, nil
+}
+
+// Name implements plugin.Handler
+func (p *DNSPolicy) Name() string { return pluginName }
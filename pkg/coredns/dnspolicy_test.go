@@ -0,0 +1,91 @@
+//go:build coredns
+
+package coredns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lktr/pkg/policy"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestParseConfig(t *testing.T) {
+	c := caddy.NewTestController("dns", `dnspolicy http://controller:8080 {
+		interval 30s
+		operational_mode strict
+		cluster_domain
+		verbose
+	}`)
+	cfg, err := parseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := policy.Config{ControllerURL: "http://controller:8080", FetchInterval: 30 * time.Second, OperationalMode: "strict", Verbose: true}
+	if cfg != want {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+
+	for _, corefile := range []string{
+		`dnspolicy`,
+		`dnspolicy http://controller:8080 { interval -1s }`,
+		`dnspolicy http://controller:8080 { operational_mode lenient }`,
+		`dnspolicy http://controller:8080 { retries 3 }`,
+	} {
+		if _, err := parseConfig(caddy.NewTestController("dns", corefile)); err == nil {
+			t.Errorf("%q: no error", corefile)
+		}
+	}
+}
+
+// TestServeDNS fetches a blocklist from a fake controller and expects
+// blocked names answered with NXDOMAIN and the others passed on
+func TestServeDNS(t *testing.T) {
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"policy":{"spec":{"blockList":["ads.example.com"]}}}`))
+	}))
+	defer controller.Close()
+
+	enforcer, err := policy.New(policy.Config{ControllerURL: controller.URL, FetchInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enforcer.Start()
+	for deadline := time.Now().Add(5 * time.Second); enforcer.Rules() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("blocklist not fetched from the controller")
+		}
+	}
+
+	p := &DNSPolicy{Next: test.NextHandler(dns.RcodeSuccess, nil), Enforcer: enforcer}
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{"ads.example.com.", dns.RcodeNameError},
+		{"www.example.com.", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := p.ServeDNS(context.Background(), rec, r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rcode != tt.rcode {
+			t.Errorf("%s: got rcode %d, want %d", tt.name, rcode, tt.rcode)
+		}
+		if tt.rcode == dns.RcodeNameError && (rec.Msg == nil || rec.Msg.Rcode != dns.RcodeNameError) {
+			t.Errorf("%s: no NXDOMAIN response written", tt.name)
+		}
+	}
+}
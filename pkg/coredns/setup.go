@@ -0,0 +1,99 @@
+//go:build coredns
+
+// Package coredns is the dnspolicy CoreDNS plugin, which enforces DnsPolicy
+// blocklists from the controller in clusters that already run CoreDNS. It
+// shares the policy fetcher and matcher with the sidecar through package
+// policy. The plugin needs the coredns build tag, so that the sidecar
+// itself does not depend on CoreDNS.
+package coredns
+
+import (
+	"time"
+
+	"lktr/pkg/policy"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+)
+
+const pluginName = "dnspolicy"
+
+func init() { plugin.Register(pluginName, setup) }
+
+func setup(c *caddy.Controller) error {
+	cfg, err := parseConfig(c)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+	enforcer, err := policy.New(cfg)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+
+	c.OnStartup(func() error {
+		enforcer.Start()
+		return nil
+	})
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return &DNSPolicy{Next: next, Enforcer: enforcer}
+	})
+	return nil
+}
+
+// parseConfig reads the plugin's Corefile block:
+//
+//	dnspolicy CONTROLLER_URL {
+//	    interval DURATION
+//	    operational_mode strict|balance
+//	    cluster_domain DOMAIN
+//	    verbose
+//	}
+func parseConfig(c *caddy.Controller) (policy.Config, error) {
+	cfg := policy.Config{ClusterDomain: "cluster.local"}
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return cfg, c.ArgErr()
+		}
+		cfg.ControllerURL = args[0]
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "interval":
+				if !c.NextArg() {
+					return cfg, c.ArgErr()
+				}
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil || interval <= 0 {
+					return cfg, c.Errf("invalid interval %q", c.Val())
+				}
+				cfg.FetchInterval = interval
+			case "operational_mode":
+				if !c.NextArg() {
+					return cfg, c.ArgErr()
+				}
+				switch c.Val() {
+				case "strict", "balance":
+					cfg.OperationalMode = c.Val()
+				default:
+					return cfg, c.Errf("invalid operational_mode %q, expected strict or balance", c.Val())
+				}
+			case "cluster_domain":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return cfg, c.ArgErr()
+				}
+				cfg.ClusterDomain = ""
+				if len(args) == 1 {
+					cfg.ClusterDomain = args[0]
+				}
+			case "verbose":
+				cfg.Verbose = true
+			default:
+				return cfg, c.Errf("unknown property %q", c.Val())
+			}
+		}
+	}
+	return cfg, nil
+}
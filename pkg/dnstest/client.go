@@ -0,0 +1,75 @@
+package dnstest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"lktr/internal/dns"
+)
+
+// Client sends queries to a DNS server, such as the proxy under test
+type Client struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+// NewClient returns a client for the server at addr with a 2 second timeout
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr, Timeout: 2 * time.Second}
+}
+
+// Query resolves name over UDP
+func (c *Client) Query(name string, qtype uint16) (*Message, error) {
+	return c.query("udp", name, qtype)
+}
+
+// QueryTCP resolves name over TCP
+func (c *Client) QueryTCP(name string, qtype uint16) (*Message, error) {
+	return c.query("tcp", name, qtype)
+}
+
+func (c *Client) query(network, name string, qtype uint16) (*Message, error) {
+	id := uint16(rand.UintN(1 << 16))
+	response, err := c.Exchange(network, dns.BuildQuery(id, name, qtype))
+	if err != nil {
+		return nil, err
+	}
+	m, err := dns.ParseMessage(response)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID != id {
+		return nil, fmt.Errorf("response id %d does not match query id %d", m.ID, id)
+	}
+	return m, nil
+}
+
+// Exchange sends a wire-format query over network ("udp" or "tcp") and
+// returns the raw response
+func (c *Client) Exchange(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if network == "tcp" {
+		if err := writeFrame(conn, query); err != nil {
+			return nil, err
+		}
+		return readFrame(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,314 @@
+// Package dnstest provides an in-process DNS upstream with scriptable answers
+// and a small query client, for exercising the handler and servers without
+// real resolvers.
+package dnstest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/dns"
+)
+
+// Record is a resource record. An empty Name is replaced by the query name
+// when the record is answered.
+type Record = dns.RR
+
+// Message is a decoded DNS message
+type Message = dns.Message
+
+// Header flag bits set on scripted responses
+const (
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+// Answer scripts the upstream's reply to a name and type
+type Answer struct {
+	Rcode    int           // response code, dns.RcodeSuccess by default
+	Records  []Record      // answer section
+	Extra    []Record      // additional section, e.g. an OPT record carrying EDNS options
+	Delay    time.Duration // wait this long before replying
+	Drop     bool          // never reply, inducing a client timeout
+	Truncate bool          // reply over UDP with TC set and no records
+}
+
+type answerKey struct {
+	name  string
+	qtype uint16
+}
+
+// Upstream is a DNS server on a loopback port answering UDP and TCP queries
+// from scripted answers. Names without an answer get NXDOMAIN unless a
+// default is set.
+type Upstream struct {
+	Addr string // host:port serving both UDP and TCP
+
+	// KeepaliveTimeout, when set before queries are sent, is announced in an
+	// edns-tcp-keepalive option to TCP queries carrying one (RFC 7828)
+	KeepaliveTimeout time.Duration
+
+	conn        net.PacketConn
+	listener    net.Listener
+	wg          sync.WaitGroup
+	connections atomic.Int64
+
+	mu       sync.Mutex
+	answers  map[answerKey]Answer
+	fallback Answer
+	queries  []dns.Question
+}
+
+// NewUpstream starts an upstream on a free loopback port
+func NewUpstream() (*Upstream, error) {
+	u := &Upstream{
+		answers:  make(map[answerKey]Answer),
+		fallback: Answer{Rcode: dns.RcodeNXDomain},
+	}
+
+	// The TCP listener must share the UDP port; retry when another process
+	// holds the TCP side of the port picked for UDP
+	var err error
+	for range 10 {
+		u.conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		u.Addr = u.conn.LocalAddr().String()
+		u.listener, err = net.Listen("tcp", u.Addr)
+		if err == nil {
+			break
+		}
+		u.conn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u.wg.Add(2)
+	go u.serveUDP()
+	go u.serveTCP()
+	return u, nil
+}
+
+// Close stops the upstream and waits for its listeners to exit
+func (u *Upstream) Close() {
+	u.conn.Close()
+	u.listener.Close()
+	u.wg.Wait()
+}
+
+// Set scripts the answer to queries for name and qtype
+func (u *Upstream) Set(name string, qtype uint16, answer Answer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.answers[answerKey{canonical(name), qtype}] = answer
+}
+
+// SetDefault scripts the answer to queries without an answer of their own
+func (u *Upstream) SetDefault(answer Answer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fallback = answer
+}
+
+// Queries returns the questions received so far, in arrival order
+func (u *Upstream) Queries() []dns.Question {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]dns.Question(nil), u.queries...)
+}
+
+// Connections returns the number of TCP connections accepted so far
+func (u *Upstream) Connections() int {
+	return int(u.connections.Load())
+}
+
+// Reset forgets the scripted answers and received queries
+func (u *Upstream) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clear(u.answers)
+	u.fallback = Answer{Rcode: dns.RcodeNXDomain}
+	u.queries = nil
+}
+
+func (u *Upstream) lookup(q dns.Question) Answer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries = append(u.queries, q)
+	if answer, ok := u.answers[answerKey{canonical(q.Name), q.Type}]; ok {
+		return answer
+	}
+	return u.fallback
+}
+
+// reply builds the response to query, or returns nil when it should be dropped
+func (u *Upstream) reply(query []byte, tcp bool) []byte {
+	m, err := dns.ParseMessage(query)
+	if err != nil || len(m.Questions) == 0 {
+		return nil
+	}
+	q := m.Questions[0]
+	answer := u.lookup(q)
+	if answer.Delay > 0 {
+		time.Sleep(answer.Delay)
+	}
+	if answer.Drop {
+		return nil
+	}
+
+	keepalive := tcp && u.KeepaliveTimeout > 0 && hasKeepalive(m)
+
+	m.Flags = m.Flags&flagRD | flagQR | flagRA
+	m.SetRcode(answer.Rcode)
+	m.Answers, m.Authority = nil, nil
+	m.Additional = append([]Record(nil), answer.Extra...)
+	if keepalive {
+		timeout := binary.BigEndian.AppendUint16(nil, uint16(min(u.KeepaliveTimeout/(100*time.Millisecond), 0xFFFF)))
+		option := append([]byte{0, optionTCPKeepalive, 0, 2}, timeout...)
+		if i := slices.IndexFunc(m.Additional, func(rr Record) bool { return rr.Type == dns.TypeOPT }); i >= 0 {
+			m.Additional[i].Data = append(slices.Clip(m.Additional[i].Data), option...)
+		} else {
+			m.Additional = append(m.Additional, Record{Type: dns.TypeOPT, Class: 1232, Data: option})
+		}
+	}
+	if answer.Truncate && !tcp {
+		m.Flags |= flagTC
+		m.Additional = nil
+		return m.Pack()
+	}
+	for _, rr := range answer.Records {
+		if rr.Name == "" {
+			rr.Name = q.Name
+		}
+		if rr.Class == 0 {
+			rr.Class = dns.ClassINET
+		}
+		m.Answers = append(m.Answers, rr)
+	}
+	return m.Pack()
+}
+
+func (u *Upstream) serveUDP() {
+	defer u.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := u.reply(query, false); response != nil {
+				u.conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (u *Upstream) serveTCP() {
+	defer u.wg.Done()
+	for {
+		conn, err := u.listener.Accept()
+		if err != nil {
+			return
+		}
+		u.connections.Add(1)
+		go u.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries until the client closes the connection
+func (u *Upstream) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		query, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		response := u.reply(query, true)
+		if response == nil {
+			continue
+		}
+		if err := writeFrame(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errors.New("dns message too large for TCP")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// optionTCPKeepalive is the EDNS edns-tcp-keepalive option code
+const optionTCPKeepalive = 11
+
+// hasKeepalive reports whether the OPT record of m carries edns-tcp-keepalive
+func hasKeepalive(m *Message) bool {
+	for _, rr := range m.Additional {
+		if rr.Type != dns.TypeOPT {
+			continue
+		}
+		for data := rr.Data; len(data) >= 4; {
+			length := int(binary.BigEndian.Uint16(data[2:]))
+			if binary.BigEndian.Uint16(data) == optionTCPKeepalive {
+				return true
+			}
+			if 4+length > len(data) {
+				break
+			}
+			data = data[4+length:]
+		}
+	}
+	return false
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// A returns an A record for ip
+func A(ip string, ttl uint32) Record {
+	return Record{Type: dns.TypeA, TTL: ttl, Data: net.ParseIP(ip).To4()}
+}
+
+// AAAA returns an AAAA record for ip
+func AAAA(ip string, ttl uint32) Record {
+	return Record{Type: dns.TypeAAAA, TTL: ttl, Data: net.ParseIP(ip).To16()}
+}
+
+// CNAME returns a CNAME record pointing at target
+func CNAME(target string, ttl uint32) Record {
+	return Record{Type: dns.TypeCNAME, TTL: ttl, Data: dns.NameData(target)}
+}
+
+// TXT returns a TXT record holding a single string
+func TXT(text string, ttl uint32) Record {
+	return Record{Type: dns.TypeTXT, TTL: ttl, Data: append([]byte{byte(len(text))}, text...)}
+}
@@ -0,0 +1,98 @@
+package matcher
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// IPMatcher holds compiled CIDR rules, which match the addresses in
+// responses rather than query names
+type IPMatcher struct {
+	prefixes map[netip.Prefix]struct{} // masked rules
+	bits4    []int                     // distinct IPv4 prefix lengths, longest first
+	bits6    []int                     // distinct IPv6 prefix lengths, longest first
+}
+
+// BuildIPMatcher compiles CIDR rules such as "192.0.2.0/24" or
+// "2001:db8::/32". A bare address is a rule for that address alone, and
+// IPv4-mapped IPv6 rules are taken as IPv4. Rules that do not parse are
+// skipped.
+func BuildIPMatcher(rules []string) *IPMatcher {
+	m := &IPMatcher{prefixes: make(map[netip.Prefix]struct{}, len(rules))}
+	for _, raw := range rules {
+		p, ok := parseCIDR(raw)
+		if !ok {
+			continue
+		}
+		m.prefixes[p] = struct{}{}
+		if p.Addr().Is4() {
+			m.bits4 = append(m.bits4, p.Bits())
+		} else {
+			m.bits6 = append(m.bits6, p.Bits())
+		}
+	}
+	m.bits4 = longestFirst(m.bits4)
+	m.bits6 = longestFirst(m.bits6)
+	return m
+}
+
+// parseCIDR parses one CIDR rule into its masked prefix
+func parseCIDR(raw string) (netip.Prefix, bool) {
+	s := strings.TrimSpace(raw)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), true
+}
+
+// longestFirst sorts and deduplicates prefix lengths, longest first
+func longestFirst(bits []int) []int {
+	slices.Sort(bits)
+	bits = slices.Compact(bits)
+	slices.Reverse(bits)
+	return slices.Clip(bits)
+}
+
+// Len returns the number of distinct CIDR rules
+func (m *IPMatcher) Len() int {
+	return len(m.prefixes)
+}
+
+// Equal reports whether both matchers were built from the same set of rules
+func (m *IPMatcher) Equal(other *IPMatcher) bool {
+	return maps.Equal(m.prefixes, other.prefixes)
+}
+
+// MatchIP reports whether addr falls in a CIDR rule, and in which: the most
+// specific one when several match
+func (m *IPMatcher) MatchIP(addr netip.Addr) MatchResult {
+	addr = addr.Unmap()
+	bits := m.bits6
+	if addr.Is4() {
+		bits = m.bits4
+	}
+	for _, b := range bits {
+		p, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if _, ok := m.prefixes[p]; ok {
+			return MatchResult{Matched: true, Rule: p.String(), Type: RCIDR}
+		}
+	}
+	return MatchResult{}
+}
@@ -1,126 +1,302 @@
 package matcher
 
 import (
+	"hash/maphash"
+	"maps"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/net/idna"
-	"golang.org/x/net/publicsuffix"
-
-	"github.com/armon/go-radix"
-	"github.com/bits-and-blooms/bloom/v3"
 )
 
+// maxNameLength bounds the length of a domain name, and so of a wildcard rule
+const maxNameLength = 255
+
 const (
 	RExact ruleType = iota
 	RWildcard
+	RException
+	RCIDR
+	RQType
 )
 
-func normalizeDomain(d string) (string, string) {
-	d = strings.TrimSpace(strings.TrimSuffix(strings.ToLower(d), "."))
-	puny, _ := idna.Lookup.ToASCII(d)
-	etld1, _ := publicsuffix.EffectiveTLDPlusOne(puny)
-	return puny, etld1
+// exceptionPrefix marks a rule that allows names an other rule would block
+const exceptionPrefix = "@@"
+
+// expiresOption introduces the expiry timestamp of a rule
+const expiresOption = "$expires="
+
+func normalizeDomain(d string) string {
+	d = strings.TrimSpace(strings.TrimSuffix(d, "."))
+	if isPlainASCII(d) {
+		return strings.ToLower(d)
+	}
+	puny, _ := idna.Lookup.ToASCII(strings.ToLower(d))
+	return puny
 }
 
-func reverseLabels(d string) string {
-	parts := strings.Split(d, ".")
-	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
-		parts[i], parts[j] = parts[j], parts[i]
+// isPlainASCII reports whether d is already a valid ASCII hostname, in
+// which case the comparatively expensive IDNA mapping can be skipped.
+func isPlainASCII(d string) bool {
+	for i := 0; i < len(d); i++ {
+		c := d[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
 	}
-	return strings.Join(parts, ".")
+	return !strings.HasPrefix(d, "xn--") && !strings.Contains(d, ".xn--")
 }
 
+// BuildMatcher compiles rules into a matcher. A rule is an exact name, a
+// "*." wildcard matching every name below its base at any depth, or "*"
+// matching everything. Wildcard bases need not be registrable domains:
+// "*.zip" blocks a whole top-level domain at the cost of any other wildcard,
+// one hash lookup per label of the query. Exact and wildcard rules prefixed
+// with "@@" are exceptions: names they match are never blocked.
+//
+// Any rule may end in "$expires=" and an RFC 3339 timestamp, after which the
+// matcher ignores it. Rules with an unparseable expiry are skipped. When the
+// same rule is given with and without an expiry it never expires.
 func BuildMatcher(rules []string) *Matcher {
 	m := &Matcher{
-		exact: make(map[string]struct{}, len(rules)),
-		wild:  radix.New(),
-	}
-
-	if len(rules) > 10000 {
-		m.bf = bloom.NewWithEstimates(uint(len(rules))*4, 1e-4)
+		exact: make([]uint64, 0, len(rules)),
 	}
 
+	var expiring map[string]time.Time
 	for _, raw := range rules {
-		r := strings.TrimSpace(raw)
-		if r == "" {
+		r, ok := parseRule(raw)
+		if !ok {
 			continue
 		}
+		if !r.expires.IsZero() {
+			if expiring == nil {
+				expiring = make(map[string]time.Time)
+			}
+			if t, seen := expiring[r.text()]; !seen || r.expires.After(t) {
+				expiring[r.text()] = r.expires
+			}
+		}
 
-		// Check for match-all wildcard
-		if r == "*" {
+		switch {
+		case r.matchAll:
 			m.matchAll = true
-			continue
+		case r.exception && r.wildcard:
+			m.allowWild = append(m.allowWild, m.hash(r.canon))
+		case r.exception:
+			m.allowExact = append(m.allowExact, m.hash(r.canon))
+		case r.wildcard:
+			m.wild = append(m.wild, m.hash(r.canon))
+		default:
+			m.exact = append(m.exact, m.hash(r.canon))
 		}
+	}
 
-		isWildcard := strings.HasPrefix(r, "*.")
-		base := r
-		if isWildcard {
-			base = strings.TrimPrefix(r, "*.")
+	if len(expiring) > 0 {
+		// A permanent copy of a rule overrides its expiry
+		for _, raw := range rules {
+			if r, ok := parseRule(raw); ok && r.expires.IsZero() {
+				delete(expiring, r.text())
+			}
 		}
+		m.expires = make(map[uint64]expiry, len(expiring))
+		for text, t := range expiring {
+			block := text != "*" && !strings.HasPrefix(text, exceptionPrefix)
+			m.expires[m.hash(text)] = expiry{at: t, block: block}
+		}
+	}
 
-		canon, _ := normalizeDomain(base)
-		if canon == "" {
+	m.exact = compactHashes(m.exact)
+	m.wild = compactHashes(m.wild)
+	m.allowExact = compactHashes(m.allowExact)
+	m.allowWild = compactHashes(m.allowWild)
+	return m
+}
+
+// Exceptions turns allowlist entries into the exception rules BuildMatcher
+// expects, for allowlists kept apart from the blocklist. Entries already
+// written as exceptions are kept as they are.
+func Exceptions(names []string) []string {
+	rules := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
 			continue
 		}
+		if !strings.HasPrefix(name, exceptionPrefix) {
+			name = exceptionPrefix + name
+		}
+		rules = append(rules, name)
+	}
+	return rules
+}
 
-		if isWildcard {
-			key := reverseLabels(canon)
-			m.wild.Insert(key, &rule{typ: RWildcard, val: canon})
-			if m.bf != nil {
-				m.bf.AddString(canon)
-			}
-		} else {
-			m.exact[canon] = struct{}{}
-			if m.bf != nil {
-				m.bf.AddString(canon)
-			}
+// rule is a parsed blocklist entry
+type rule struct {
+	canon     string // canonical base name, empty for "*"
+	wildcard  bool
+	exception bool
+	matchAll  bool
+	expires   time.Time // zero for rules that do not expire
+}
+
+// parseRule parses one blocklist entry, reporting false for entries to skip
+func parseRule(raw string) (rule, bool) {
+	var r rule
+	s := strings.TrimSpace(raw)
+	if i := strings.Index(s, expiresOption); i >= 0 {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(s[i+len(expiresOption):]))
+		if err != nil {
+			return rule{}, false
 		}
+		s, r.expires = strings.TrimSpace(s[:i]), t
 	}
-	return m
+	if s == "" {
+		return rule{}, false
+	}
+
+	r.exception = strings.HasPrefix(s, exceptionPrefix)
+	if r.exception {
+		s = strings.TrimSpace(strings.TrimPrefix(s, exceptionPrefix))
+	}
+
+	// Check for match-all wildcard; an exception for everything is meaningless
+	if s == "*" {
+		r.matchAll = true
+		return r, !r.exception
+	}
+
+	r.wildcard = strings.HasPrefix(s, "*.")
+	r.canon = normalizeDomain(strings.TrimPrefix(s, "*."))
+	return r, r.canon != ""
+}
+
+// text returns the canonical form of the rule, as reported in match results
+func (r rule) text() string {
+	var prefix string
+	if r.exception {
+		prefix = exceptionPrefix
+	}
+	switch {
+	case r.matchAll:
+		return "*"
+	case r.wildcard:
+		return prefix + "*." + r.canon
+	default:
+		return prefix + r.canon
+	}
+}
+
+// expired reports whether the rule with canonical form text has an expiry
+// that has passed
+func (m *Matcher) expired(text string) bool {
+	if len(m.expires) == 0 {
+		return false
+	}
+	e, ok := m.expires[m.hash(text)]
+	return ok && !time.Now().Before(e.at)
+}
+
+// compactHashes sorts and deduplicates a hash set, trimming spare capacity
+func compactHashes(h []uint64) []uint64 {
+	slices.Sort(h)
+	return slices.Clip(slices.Compact(h))
+}
+
+func contains(h []uint64, v uint64) bool {
+	_, ok := slices.BinarySearch(h, v)
+	return ok
+}
+
+func (m *Matcher) hash(s string) uint64 {
+	return maphash.String(ruleSeed, s)
 }
 
+// Len returns the number of distinct exact and wildcard blocking rules that
+// have not expired. Exceptions and the "*" rule are not counted.
+func (m *Matcher) Len() int {
+	n := len(m.exact) + len(m.wild)
+	now := time.Now()
+	for _, e := range m.expires {
+		if e.block && !now.Before(e.at) {
+			n--
+		}
+	}
+	return n
+}
+
+// Equal reports whether both matchers were built from the same set of rules
+func (m *Matcher) Equal(other *Matcher) bool {
+	return m.matchAll == other.matchAll &&
+		slices.Equal(m.exact, other.exact) &&
+		slices.Equal(m.wild, other.wild) &&
+		slices.Equal(m.allowExact, other.allowExact) &&
+		slices.Equal(m.allowWild, other.allowWild) &&
+		maps.Equal(m.expires, other.expires)
+}
+
+// MatchesAll reports whether the matcher was built with the "*" rule and
+// the rule has not expired
+func (m *Matcher) MatchesAll() bool {
+	return m.matchAll && !m.expired("*")
+}
+
+// Match reports whether query is blocked and by which rule. When both a
+// blocking rule and an exception match, the more specific one decides: an
+// exact rule beats any wildcard, a longer wildcard a shorter one, and an
+// exception wins a tie. A query spared by an exception is reported unmatched
+// with the exception as its rule.
 func (m *Matcher) Match(query string) MatchResult {
-	q, _ := normalizeDomain(query)
+	q := normalizeDomain(query)
 	if q == "" {
 		return MatchResult{}
 	}
 
-	// Check match-all flag first
-	if m.matchAll {
-		return MatchResult{Matched: true, Rule: "*", Type: RWildcard}
+	var result MatchResult
+	if m.MatchesAll() {
+		result = MatchResult{Matched: true, Rule: "*", Type: RWildcard}
+	} else if rule, rt, ok := m.lookup(q, m.exact, m.wild, ""); ok {
+		result = MatchResult{Matched: true, Rule: rule, Type: rt}
+	} else {
+		return MatchResult{}
 	}
 
-	if m.bf != nil && !m.bf.TestString(q) {
-		// Bloom filter optimization
+	if rule, rt, ok := m.lookup(q, m.allowExact, m.allowWild, exceptionPrefix); ok && specificity(rule, rt) >= specificity(result.Rule, result.Type) {
+		return MatchResult{Rule: exceptionPrefix + rule, Type: RException}
 	}
+	return result
+}
 
-	if _, ok := m.exact[q]; ok {
-		return MatchResult{Matched: true, Rule: q, Type: RExact}
+// specificity ranks matching rules for precedence between blocking rules and
+// exceptions
+func specificity(rule string, rt ruleType) int {
+	if rt == RExact {
+		return maxNameLength + 1
 	}
+	return len(rule)
+}
 
-	rev := reverseLabels(q)
-	parts := strings.Split(rev, ".")
-	var best *rule
-	var bestLen int
+// lookup finds the unexpired rule in one exact/wildcard pair of sets that
+// matches the canonical name q, preferring an exact rule, then the longest
+// wildcard. prefix marks the rules of the pair in their canonical form.
+func (m *Matcher) lookup(q string, exact, wild []uint64, prefix string) (string, ruleType, bool) {
+	if len(exact) > 0 && contains(exact, m.hash(q)) && !m.expired(prefix+q) {
+		return q, RExact, true
+	}
 
-	for i := 1; i <= len(parts); i++ {
-		prefix := strings.Join(parts[:i], ".")
-		if v, ok := m.wild.Get(prefix); ok {
-			r := v.(*rule)
-			qLabels := strings.Count(q, ".") + 1
-			rLabels := strings.Count(r.val, ".") + 1
-			if qLabels > rLabels {
-				if len(prefix) > bestLen {
-					best = r
-					bestLen = len(prefix)
-				}
-			}
-		}
+	if len(wild) == 0 {
+		return "", 0, false
 	}
 
-	if best != nil {
-		return MatchResult{Matched: true, Rule: "*." + best.val, Type: RWildcard}
+	// Walk parent domains from the closest one outwards; the first hit is the
+	// longest wildcard. The query itself is skipped since "*.x" never matches "x".
+	for i := strings.IndexByte(q, '.'); i >= 0; i = strings.IndexByte(q, '.') {
+		q = q[i+1:]
+		if contains(wild, m.hash(q)) && !m.expired(prefix+"*."+q) {
+			return "*." + q, RWildcard, true
+		}
 	}
 
-	return MatchResult{}
+	return "", 0, false
 }
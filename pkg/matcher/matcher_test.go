@@ -0,0 +1,44 @@
+package matcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLenExpired(t *testing.T) {
+	past := "$expires=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := "$expires=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	m := BuildMatcher([]string{
+		"ads.example.com",
+		"*.example.com",
+		"old.example.com" + past,
+		"*.tracker.example" + past,
+		"*.live.example" + future,
+		"*" + past,
+		"@@good.example.com" + past,
+		"@@*.cdn.example.com" + past,
+		"@@safe.example.com",
+	})
+	// ads.example.com, *.example.com and *.live.example
+	if got := m.Len(); got != 3 {
+		t.Fatalf("got %d rules, want 3", got)
+	}
+	if m.MatchesAll() {
+		t.Error("the expired * rule still matches everything")
+	}
+	for name, blocked := range map[string]bool{
+		"good.example.com":    true, // its exception expired
+		"img.cdn.example.com": true,
+		"safe.example.com":    false,
+		"www.tracker.example": false,
+		"www.live.example":    true,
+	} {
+		if got := m.Match(name).Matched; got != blocked {
+			t.Errorf("%s: blocked %v, want %v", name, got, blocked)
+		}
+	}
+
+	if got := BuildMatcher([]string{"@@good.example.com", "*"}).Len(); got != 0 {
+		t.Errorf("exceptions and * counted: got %d rules, want 0", got)
+	}
+}
@@ -0,0 +1,179 @@
+package matcher
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// piholeWildcard is the regex Pi-hole writes for a wildcard domainlist entry
+// ("Add domain as wildcard"): the domain itself and every name below it
+var piholeWildcard = regexp.MustCompile(`^\(\\\.\|\^\)((?:[a-z0-9-]+\\\.)*[a-z0-9-]+)\$$`)
+
+// PiholeImport is the result of converting a Pi-hole list
+type PiholeImport struct {
+	Rules   []string // converted rules, in the matcher's syntax
+	Skipped []string // entries without an equivalent, such as arbitrary regexes
+}
+
+// ImportPihole converts a Pi-hole adlist or domainlist export into rules. It
+// accepts one entry per line in any of the formats gravity reads: plain
+// domains, hosts file lines ("0.0.0.0 ads.example.com"), Adblock-style
+// "||ads.example.com^" and "@@||ads.example.com^" (an exception), and the
+// regexes Pi-hole generates for wildcard domains. Entries covering a domain
+// and its subdomains become an exact and a "*." rule. With allow set, the
+// list is a Pi-hole allowlist and every entry becomes an exception. Blank
+// lines and "#" or "!" comments are skipped silently; other regexes and
+// unparseable lines are returned in Skipped.
+func ImportPihole(r io.Reader, allow bool) (PiholeImport, error) {
+	var out PiholeImport
+	seen := make(map[string]bool)
+	add := func(rule string) {
+		if allow && !strings.HasPrefix(rule, exceptionPrefix) {
+			rule = exceptionPrefix + rule
+		}
+		if !seen[rule] {
+			seen[rule] = true
+			out.Rules = append(out.Rules, rule)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		if m := piholeWildcard.FindStringSubmatch(strings.ToLower(line)); m != nil {
+			domain := strings.ReplaceAll(m[1], `\.`, ".")
+			add(domain)
+			add("*." + domain)
+			continue
+		}
+
+		exception := false
+		s := line
+		if rest, ok := strings.CutPrefix(s, "@@"); ok {
+			exception, s = true, rest
+		}
+		if rest, ok := strings.CutPrefix(s, "||"); ok {
+			// Adblock-style: the domain and its subdomains; options after
+			// "$" (such as "$important") do not change what is blocked
+			rest, _, _ = strings.Cut(rest, "$")
+			domain, ok := strings.CutSuffix(rest, "^")
+			if !ok || !isPiholeDomain(domain) {
+				out.Skipped = append(out.Skipped, line)
+				continue
+			}
+			prefix := ""
+			if exception {
+				prefix = exceptionPrefix
+			}
+			add(prefix + normalizeDomain(domain))
+			add(prefix + "*." + normalizeDomain(domain))
+			continue
+		}
+		if exception {
+			out.Skipped = append(out.Skipped, line)
+			continue
+		}
+
+		fields := strings.Fields(s)
+		if len(fields) > 1 && isHostsAddress(fields[0]) {
+			// Hosts file line: every name after the address is blocked
+			for _, name := range fields[1:] {
+				if isPiholeDomain(name) && !isHostsOwnName(name) {
+					add(normalizeDomain(name))
+				}
+			}
+			continue
+		}
+		if len(fields) == 1 && isPiholeDomain(fields[0]) {
+			add(normalizeDomain(fields[0]))
+			continue
+		}
+		out.Skipped = append(out.Skipped, line)
+	}
+	return out, scanner.Err()
+}
+
+// isHostsAddress reports whether s is an address hosts-format blocklists
+// point blocked names at
+func isHostsAddress(s string) bool {
+	switch s {
+	case "0.0.0.0", "127.0.0.1", "::", "::1", "0:0:0:0:0:0:0:0":
+		return true
+	}
+	return false
+}
+
+// isHostsOwnName reports whether name is one of the entries hosts files
+// carry for the machine itself rather than to block it
+func isHostsOwnName(name string) bool {
+	switch strings.ToLower(name) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// isPiholeDomain reports whether s is a domain gravity would accept
+func isPiholeDomain(s string) bool {
+	if s == "" || strings.ContainsAny(s, "*^$|/\\()[]{}+?") || !strings.Contains(s, ".") {
+		return false
+	}
+	return normalizeDomain(s) != ""
+}
+
+// ExportPihole writes rules as a Pi-hole adlist, in the Adblock-style syntax
+// gravity reads since Pi-hole v6. Exact rules are written as plain domains.
+// Pi-hole has no form for the subdomains of a name without the name itself,
+// so "*." rules are widened to "||name^", which blocks the base name too, and
+// exceptions, which Adblock syntax only has for a name and its subdomains,
+// to "@@||name^". Expiry times are dropped, the "*" rule cannot be expressed
+// and is left out, and rules covered by a widened one are not repeated.
+func ExportPihole(w io.Writer, rules []string) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Exported from dns-mesh-sidecar\n")
+
+	wild := make(map[string]bool) // bases of blocking "*." rules
+	var parsed []rule
+	for _, raw := range rules {
+		r, ok := parseRule(raw)
+		if !ok || r.matchAll {
+			continue
+		}
+		if r.wildcard && !r.exception {
+			wild[r.canon] = true
+		}
+		parsed = append(parsed, r)
+	}
+
+	written := make(map[string]bool)
+	for _, r := range parsed {
+		var line string
+		switch {
+		case r.exception:
+			line = "@@||" + r.canon + "^"
+		case r.wildcard:
+			line = "||" + r.canon + "^"
+		case wild[r.canon]:
+			// Already covered by the "||" line of its wildcard
+			continue
+		default:
+			line = r.canon
+		}
+		if written[line] {
+			continue
+		}
+		written[line] = true
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
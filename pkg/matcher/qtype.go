@@ -0,0 +1,74 @@
+package matcher
+
+import "slices"
+
+// TypeRule blocks queries of some record types, for every name or for the
+// names its domain rules match. Query types used for tunneling, such as TXT
+// and NULL, or ANY, which amplifies reflection attacks, are typical.
+type TypeRule struct {
+	Types   []uint16
+	Domains []string // rules as for BuildMatcher; empty applies to every name
+	Refuse  bool     // answer REFUSED instead of the block response
+	Text    string   // reported as the rule of the queries it blocks
+}
+
+// TypeMatcher holds compiled query-type rules
+type TypeMatcher struct {
+	rules []typeRule
+}
+
+type typeRule struct {
+	types  []uint16 // sorted
+	names  *Matcher // nil for every name
+	refuse bool
+	text   string
+}
+
+// BuildTypeMatcher compiles query-type rules; rules without types are
+// skipped. When several rules match a query the first one decides.
+func BuildTypeMatcher(rules []TypeRule) *TypeMatcher {
+	m := &TypeMatcher{}
+	for _, r := range rules {
+		if len(r.Types) == 0 {
+			continue
+		}
+		compiled := typeRule{
+			types:  slices.Compact(slices.Sorted(slices.Values(r.Types))),
+			refuse: r.Refuse,
+			text:   r.Text,
+		}
+		if len(r.Domains) > 0 {
+			compiled.names = BuildMatcher(r.Domains)
+		}
+		m.rules = append(m.rules, compiled)
+	}
+	return m
+}
+
+// Len returns the number of rules
+func (m *TypeMatcher) Len() int {
+	return len(m.rules)
+}
+
+// Match reports whether a query for name of type qtype is blocked, and by
+// which rule
+func (m *TypeMatcher) Match(name string, qtype uint16) MatchResult {
+	for _, r := range m.rules {
+		if _, ok := slices.BinarySearch(r.types, qtype); !ok {
+			continue
+		}
+		if r.names != nil && !r.names.Match(name).Matched {
+			continue
+		}
+		return MatchResult{Matched: true, Rule: r.text, Type: RQType, Refuse: r.refuse}
+	}
+	return MatchResult{}
+}
+
+// Equal reports whether both matchers were built from the same rules
+func (m *TypeMatcher) Equal(other *TypeMatcher) bool {
+	return slices.EqualFunc(m.rules, other.rules, func(a, b typeRule) bool {
+		return a.refuse == b.refuse && a.text == b.text && slices.Equal(a.types, b.types) &&
+			(a.names == nil) == (b.names == nil) && (a.names == nil || a.names.Equal(b.names))
+	})
+}
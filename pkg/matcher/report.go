@@ -0,0 +1,147 @@
+package matcher
+
+import (
+	"strings"
+)
+
+// ReportSampleSize bounds the number of example rules listed per problem in a
+// Report
+const ReportSampleSize = 20
+
+// Report describes the problems found in a rule list: entries that repeat
+// an earlier rule once normalized, blocking rules that a broader wildcard
+// already covers, and entries that cannot match any name. The counts cover
+// the whole list, the rule lists only the first ReportSampleSize of each.
+type Report struct {
+	Entries        int            `json:"entries"` // non-blank entries
+	Rules          int            `json:"rules"`   // distinct valid rules
+	DuplicateCount int            `json:"duplicateCount"`
+	ShadowedCount  int            `json:"shadowedCount"`
+	InvalidCount   int            `json:"invalidCount"`
+	Duplicates     []string       `json:"duplicates,omitempty"`
+	Shadowed       []ShadowedRule `json:"shadowed,omitempty"`
+	Invalid        []string       `json:"invalid,omitempty"`
+}
+
+// ShadowedRule is a blocking rule with no effect because of a broader one
+type ShadowedRule struct {
+	Rule string `json:"rule"`
+	By   string `json:"by"`
+}
+
+// Clean reports whether no problem was found
+func (r *Report) Clean() bool {
+	return r.DuplicateCount == 0 && r.ShadowedCount == 0 && r.InvalidCount == 0
+}
+
+// Analyze checks rules as BuildMatcher would compile them. A rule counts as
+// shadowed only when a permanent wildcard (or "*") covers it and no
+// exception could make it matter, so removing every shadowed rule leaves the
+// verdicts unchanged.
+func Analyze(rules []string) Report {
+	var report Report
+	seen := make(map[string]bool, len(rules)) // canonical rule text; true once a permanent copy was seen
+	var distinct []rule
+	for _, raw := range rules {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		report.Entries++
+		r, ok := parseRule(raw)
+		if !ok || (!r.matchAll && !validName(r.canon)) {
+			report.InvalidCount++
+			if len(report.Invalid) < ReportSampleSize {
+				report.Invalid = append(report.Invalid, strings.TrimSpace(raw))
+			}
+			continue
+		}
+		text := r.text()
+		if permanent, dup := seen[text]; dup {
+			seen[text] = permanent || r.expires.IsZero()
+			report.DuplicateCount++
+			if len(report.Duplicates) < ReportSampleSize {
+				report.Duplicates = append(report.Duplicates, text)
+			}
+			continue
+		}
+		seen[text] = r.expires.IsZero()
+		distinct = append(distinct, r)
+	}
+	report.Rules = len(distinct)
+
+	// Wildcards that block their whole subtree for good, and the bases of
+	// exception wildcards that can override them
+	blockWild := make(map[string]bool)
+	allowWild := make(map[string]bool)
+	matchAll := seen["*"]
+	for _, r := range distinct {
+		switch {
+		case r.exception && r.wildcard:
+			allowWild[r.canon] = true
+		case r.wildcard && !r.exception && seen[r.text()]:
+			blockWild[r.canon] = true
+		}
+	}
+
+	for _, r := range distinct {
+		if r.exception || r.matchAll {
+			continue
+		}
+		// An exact rule beats every exception but its own
+		if _, excepted := seen[exceptionPrefix+r.canon]; excepted && !r.wildcard {
+			continue
+		}
+		// The closest enclosing wildcard decides the names the rule covers;
+		// an exception wins a tie
+		by, spared := "", false
+		for name := parent(r.canon); name != ""; name = parent(name) {
+			if allowWild[name] {
+				spared = true
+				break
+			}
+			if blockWild[name] {
+				by = "*." + name
+				break
+			}
+		}
+		if by == "" && !spared && matchAll {
+			by = "*"
+		}
+		if by == "" {
+			continue
+		}
+		report.ShadowedCount++
+		if len(report.Shadowed) < ReportSampleSize {
+			report.Shadowed = append(report.Shadowed, ShadowedRule{Rule: r.text(), By: by})
+		}
+	}
+	return report
+}
+
+// parent strips the first label of name, returning "" for a single label
+func parent(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// validName reports whether a canonical name can occur in a query: labels
+// of 1-63 letters, digits, hyphens or underscores, 253 characters at most
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
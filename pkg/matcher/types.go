@@ -1,24 +1,34 @@
 package matcher
 
 import (
+	"hash/maphash"
 	"sync/atomic"
-
-	"github.com/armon/go-radix"
-	"github.com/bits-and-blooms/bloom/v3"
+	"time"
 )
 
 type ruleType uint8
 
-type rule struct {
-	typ ruleType
-	val string
-}
+// ruleSeed seeds the rule hashes of every matcher in the process
+var ruleSeed = maphash.MakeSeed()
 
+// Matcher holds a compiled blocklist. Rules are stored only as sorted 64-bit
+// seeded hashes of their canonical names, about 8 bytes per rule regardless
+// of name length; with a random per-process seed the chance of a false match
+// is negligible (about n/2^64 per lookup for n rules). Sharing the seed keeps
+// matchers built from the same rules comparable.
 type Matcher struct {
-	exact    map[string]struct{}
-	wild     *radix.Tree
-	bf       *bloom.BloomFilter
-	matchAll bool
+	exact      []uint64
+	wild       []uint64
+	allowExact []uint64 // "@@" exceptions
+	allowWild  []uint64
+	expires    map[uint64]expiry // by hash of the canonical rule, for rules that expire
+	matchAll   bool
+}
+
+// expiry is when a rule stops applying
+type expiry struct {
+	at    time.Time
+	block bool // an exact or wildcard blocking rule, counted by Len
 }
 
 type AtomicMatcher struct {
@@ -29,4 +39,5 @@ type MatchResult struct {
 	Matched bool
 	Rule    string
 	Type    ruleType
+	Refuse  bool // answer REFUSED whatever the block response mode, for query-type rules that refuse
 }
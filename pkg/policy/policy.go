@@ -0,0 +1,112 @@
+// Package policy enforces DnsPolicy blocklists outside the sidecar's own
+// DNS server: it fetches the policy from the controller as the sidecar does
+// and answers whether a name is blocked, for DNS servers such as CoreDNS
+// that do the serving themselves.
+package policy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"lktr/internal/client"
+	"lktr/internal/dns"
+	"lktr/pkg/matcher"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Config configures an Enforcer. Only ControllerURL is required.
+type Config struct {
+	ControllerURL   string
+	FetchInterval   time.Duration // poll interval until the controller sets one, default 10s
+	OperationalMode string        // behaviour on failed fetches: "strict", "balance" or "" (keep the last policy)
+	ClusterDomain   string        // names below it are never blocked, "" for none
+	Verbose         bool
+}
+
+// Verdict is the decision for one name
+type Verdict struct {
+	Blocked bool   // the name must be answered as blocked
+	Matched bool   // a rule matched, also in dry-run where Blocked is false
+	Rule    string // the matching rule
+}
+
+// Enforcer holds the blocklist most recently fetched from the controller
+type Enforcer struct {
+	cfg      Config
+	matcher  atomic.Pointer[matcher.Matcher]
+	critical *matcher.Matcher
+	dryRun   atomic.Bool
+	started  atomic.Bool
+}
+
+// New validates cfg and returns an enforcer that blocks nothing until Start
+// has fetched the first policy
+func New(cfg Config) (*Enforcer, error) {
+	if cfg.ControllerURL == "" {
+		return nil, errors.New("policy: controller URL is required")
+	}
+	if cfg.FetchInterval <= 0 {
+		cfg.FetchInterval = 10 * time.Second
+	}
+	e := &Enforcer{cfg: cfg}
+	e.matcher.Store(matcher.BuildMatcher(nil))
+	if critical := dns.CriticalNames(cfg.ControllerURL, cfg.ClusterDomain); len(critical) > 0 {
+		e.critical = matcher.BuildMatcher(critical)
+	}
+	return e, nil
+}
+
+// Start polls the controller in the background and applies every policy
+// it returns. Later calls do nothing.
+func (e *Enforcer) Start() {
+	if !e.started.CompareAndSwap(false, true) {
+		return
+	}
+	updates := make(chan []string, 10)
+	interval := e.cfg.FetchInterval
+	var dryRun atomic.Bool
+	fetcher := client.NewFetcher(client.FetcherOptions{
+		ControllerURL:   e.cfg.ControllerURL,
+		FetchInterval:   &interval,
+		Verbose:         e.cfg.Verbose,
+		Updates:         updates,
+		DryRun:          &dryRun,
+		OperationalMode: e.cfg.OperationalMode,
+	})
+
+	go func() {
+		for blocklist := range updates {
+			m := matcher.BuildMatcher(blocklist)
+			e.dryRun.Store(dryRun.Load())
+			e.matcher.Store(m)
+			if e.cfg.Verbose {
+				log.Info().Msgf("Blocklist updated with %d rules", m.Len())
+			}
+		}
+	}()
+	go fetcher.Start()
+}
+
+// Check decides whether name is blocked
+func (e *Enforcer) Check(name string) Verdict {
+	result := e.matcher.Load().Match(name)
+	if !result.Matched {
+		return Verdict{}
+	}
+	if e.critical != nil && e.critical.Match(name).Matched {
+		return Verdict{}
+	}
+	return Verdict{Blocked: !e.dryRun.Load(), Matched: true, Rule: result.Rule}
+}
+
+// Rules returns the number of blocking rules in the enforced blocklist
+func (e *Enforcer) Rules() int {
+	return e.matcher.Load().Len()
+}
+
+// DryRun reports whether matches are logged instead of blocked
+func (e *Enforcer) DryRun() bool {
+	return e.dryRun.Load()
+}
@@ -0,0 +1,151 @@
+// Package proxy embeds the DNS filtering proxy in another Go program: it
+// wires a query handler to UDP and TCP listeners and takes blocklists
+// directly instead of from a controller.
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"lktr/internal/dns"
+	"lktr/internal/metrics"
+	"lktr/internal/server"
+	"lktr/pkg/matcher"
+)
+
+// Config configures a Proxy. Only ListenAddr and Upstream are required.
+type Config struct {
+	ListenAddr string   // address served over UDP and TCP, e.g. "127.0.0.1:53"
+	Upstream   string   // plain DNS resolver queries are forwarded to
+	BlockList  []string // initial blocklist, in the matcher's rule syntax
+	DryRun     bool     // log matches instead of blocking them
+	Verbose    bool
+
+	DisableUDP bool
+	DisableTCP bool
+
+	UpstreamFailureMode string        // "closed" (default) or "open"
+	SearchDomains       []string      // search suffixes stripped before matching
+	TCPIdleTimeout      time.Duration // keep client TCP connections open between queries, 0 closes after one
+	LogMode             string        // "all" (default) or "blocked"
+}
+
+// Stats is a snapshot of the proxy's counters. Query counters are kept in
+// the process-wide Prometheus registry and so cover every Proxy in the process.
+type Stats struct {
+	Queries uint64
+	Blocked uint64
+	Allowed uint64
+	Errors  uint64
+	Rules   int  // rules in the enforced blocklist
+	DryRun  bool // matches are logged, not blocked
+}
+
+// Proxy is an embedded DNS filtering proxy
+type Proxy struct {
+	cfg     Config
+	handler *dns.Handler
+	udp     *server.UDPServer
+	tcp     *server.TCPServer
+
+	mu sync.Mutex // serializes policy updates
+}
+
+// New validates cfg and returns a proxy ready to Start
+func New(cfg Config) (*Proxy, error) {
+	if cfg.ListenAddr == "" || cfg.Upstream == "" {
+		return nil, errors.New("proxy: listen address and upstream are required")
+	}
+	if cfg.DisableUDP && cfg.DisableTCP {
+		return nil, errors.New("proxy: both UDP and TCP listeners are disabled")
+	}
+
+	failureMode := dns.FailClosed
+	if cfg.UpstreamFailureMode != "" {
+		mode, err := dns.ParseFailureMode(cfg.UpstreamFailureMode)
+		if err != nil {
+			return nil, err
+		}
+		failureMode = mode
+	}
+	switch cfg.LogMode {
+	case "":
+		cfg.LogMode = dns.LogAll
+	case dns.LogAll, dns.LogBlocked:
+	default:
+		return nil, errors.New("proxy: log mode must be \"all\" or \"blocked\"")
+	}
+
+	handler := dns.NewHandler(cfg.Upstream, cfg.Verbose, matcher.BuildMatcher(cfg.BlockList), false, "", 0, "", "", "", false, nil)
+	handler.SetDryRun(cfg.DryRun)
+	handler.SetUpstreamFailureMode(failureMode)
+	handler.SearchDomains = cfg.SearchDomains
+	handler.TCPIdleTimeout = cfg.TCPIdleTimeout
+	handler.LogMode = cfg.LogMode
+	if critical := dns.CriticalNames("", "", cfg.Upstream); len(critical) > 0 {
+		handler.Critical = matcher.BuildMatcher(critical)
+	}
+
+	return &Proxy{
+		cfg:     cfg,
+		handler: handler,
+		udp:     server.NewUDPServer(cfg.ListenAddr, handler, cfg.Verbose),
+		tcp:     server.NewTCPServer(cfg.ListenAddr, handler, cfg.Verbose),
+	}, nil
+}
+
+// Start serves the enabled listeners and blocks until all of them have
+// stopped, returning the first listener error
+func (p *Proxy) Start() error {
+	var listeners []func() error
+	if !p.cfg.DisableUDP {
+		listeners = append(listeners, p.udp.Start)
+	}
+	if !p.cfg.DisableTCP {
+		listeners = append(listeners, p.tcp.Start)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, start := range listeners {
+		go func() { errs <- start() }()
+	}
+
+	var first error
+	for range listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			// Do not keep serving on one protocol when the other failed
+			p.Stop()
+		}
+	}
+	return first
+}
+
+// Stop closes the listeners, cancelling queries in progress, and makes
+// Start return. It is safe to call before Start.
+func (p *Proxy) Stop() {
+	p.udp.Stop()
+	p.tcp.Stop()
+}
+
+// UpdatePolicy replaces the enforced blocklist and the dry-run switch
+func (p *Proxy) UpdatePolicy(blockList []string, dryRun bool) {
+	m := matcher.BuildMatcher(blockList)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handler.UpdateMatcher(m, dryRun)
+}
+
+// Stats returns the current counters and policy state
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		Queries: uint64(metrics.Total("dns_queries_total")),
+		Blocked: uint64(metrics.Total("dns_queries_blocked_total")),
+		Allowed: uint64(metrics.Total("dns_queries_allowed_total")),
+		Errors:  uint64(metrics.Total("dns_errors_total")),
+		Rules:   p.handler.Rules(),
+		DryRun:  p.handler.DryRun(),
+	}
+}
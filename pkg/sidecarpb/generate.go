@@ -0,0 +1,4 @@
+// Package sidecarpb holds the gRPC control-plane API of the sidecar
+package sidecarpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative sidecar.proto
@@ -0,0 +1,597 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        v5.28.3
+// source: sidecar.proto
+
+package sidecarpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type UpdatePolicyRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Rules, same syntax as the controller policy blockList
+	BlockList []string `protobuf:"bytes,1,rep,name=block_list,json=blockList,proto3" json:"block_list,omitempty"`
+	// Log matches instead of blocking them
+	DryRun        bool `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdatePolicyRequest) Reset() {
+	*x = UpdatePolicyRequest{}
+	mi := &file_sidecar_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdatePolicyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdatePolicyRequest) ProtoMessage() {}
+
+func (x *UpdatePolicyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdatePolicyRequest.ProtoReflect.Descriptor instead.
+func (*UpdatePolicyRequest) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *UpdatePolicyRequest) GetBlockList() []string {
+	if x != nil {
+		return x.BlockList
+	}
+	return nil
+}
+
+func (x *UpdatePolicyRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+type UpdatePolicyResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Number of rules accepted
+	Rules         int32 `protobuf:"varint,1,opt,name=rules,proto3" json:"rules,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdatePolicyResponse) Reset() {
+	*x = UpdatePolicyResponse{}
+	mi := &file_sidecar_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdatePolicyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdatePolicyResponse) ProtoMessage() {}
+
+func (x *UpdatePolicyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdatePolicyResponse.ProtoReflect.Descriptor instead.
+func (*UpdatePolicyResponse) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *UpdatePolicyResponse) GetRules() int32 {
+	if x != nil {
+		return x.Rules
+	}
+	return 0
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_sidecar_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{2}
+}
+
+type Stats struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Queries uint64                 `protobuf:"varint,1,opt,name=queries,proto3" json:"queries,omitempty"`
+	Blocked uint64                 `protobuf:"varint,2,opt,name=blocked,proto3" json:"blocked,omitempty"`
+	Allowed uint64                 `protobuf:"varint,3,opt,name=allowed,proto3" json:"allowed,omitempty"`
+	Errors  uint64                 `protobuf:"varint,4,opt,name=errors,proto3" json:"errors,omitempty"`
+	// Distinct rules in the enforced default blocklist
+	Rules         int32                  `protobuf:"varint,5,opt,name=rules,proto3" json:"rules,omitempty"`
+	DryRun        bool                   `protobuf:"varint,6,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	Draining      bool                   `protobuf:"varint,7,opt,name=draining,proto3" json:"draining,omitempty"`
+	Started       *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=started,proto3" json:"started,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_sidecar_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Stats) GetQueries() uint64 {
+	if x != nil {
+		return x.Queries
+	}
+	return 0
+}
+
+func (x *Stats) GetBlocked() uint64 {
+	if x != nil {
+		return x.Blocked
+	}
+	return 0
+}
+
+func (x *Stats) GetAllowed() uint64 {
+	if x != nil {
+		return x.Allowed
+	}
+	return 0
+}
+
+func (x *Stats) GetErrors() uint64 {
+	if x != nil {
+		return x.Errors
+	}
+	return 0
+}
+
+func (x *Stats) GetRules() int32 {
+	if x != nil {
+		return x.Rules
+	}
+	return 0
+}
+
+func (x *Stats) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+func (x *Stats) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
+func (x *Stats) GetStarted() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Started
+	}
+	return nil
+}
+
+type TailQueriesRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only stream blocked queries
+	BlockedOnly   bool `protobuf:"varint,1,opt,name=blocked_only,json=blockedOnly,proto3" json:"blocked_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TailQueriesRequest) Reset() {
+	*x = TailQueriesRequest{}
+	mi := &file_sidecar_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TailQueriesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TailQueriesRequest) ProtoMessage() {}
+
+func (x *TailQueriesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TailQueriesRequest.ProtoReflect.Descriptor instead.
+func (*TailQueriesRequest) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *TailQueriesRequest) GetBlockedOnly() bool {
+	if x != nil {
+		return x.BlockedOnly
+	}
+	return false
+}
+
+type QueryEvent struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Time     *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	Client   string                 `protobuf:"bytes,2,opt,name=client,proto3" json:"client,omitempty"`
+	Name     string                 `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	Type     string                 `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+	Protocol string                 `protobuf:"bytes,5,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	// One of "blocked", "allowed", "local" or "failed"
+	Verdict string `protobuf:"bytes,6,opt,name=verdict,proto3" json:"verdict,omitempty"`
+	// Matching rule, set for blocked queries and dry-run matches
+	Rule string `protobuf:"bytes,7,opt,name=rule,proto3" json:"rule,omitempty"`
+	// Policy set that decided, empty for the default blocklist
+	PolicySet     string `protobuf:"bytes,8,opt,name=policy_set,json=policySet,proto3" json:"policy_set,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryEvent) Reset() {
+	*x = QueryEvent{}
+	mi := &file_sidecar_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryEvent) ProtoMessage() {}
+
+func (x *QueryEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryEvent.ProtoReflect.Descriptor instead.
+func (*QueryEvent) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *QueryEvent) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *QueryEvent) GetClient() string {
+	if x != nil {
+		return x.Client
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetVerdict() string {
+	if x != nil {
+		return x.Verdict
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *QueryEvent) GetPolicySet() string {
+	if x != nil {
+		return x.PolicySet
+	}
+	return ""
+}
+
+type DrainRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Seconds to keep answering before the listeners close
+	GraceSeconds  uint32 `protobuf:"varint,1,opt,name=grace_seconds,json=graceSeconds,proto3" json:"grace_seconds,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DrainRequest) Reset() {
+	*x = DrainRequest{}
+	mi := &file_sidecar_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainRequest) ProtoMessage() {}
+
+func (x *DrainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainRequest.ProtoReflect.Descriptor instead.
+func (*DrainRequest) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *DrainRequest) GetGraceSeconds() uint32 {
+	if x != nil {
+		return x.GraceSeconds
+	}
+	return 0
+}
+
+type DrainResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DrainResponse) Reset() {
+	*x = DrainResponse{}
+	mi := &file_sidecar_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainResponse) ProtoMessage() {}
+
+func (x *DrainResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidecar_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainResponse.ProtoReflect.Descriptor instead.
+func (*DrainResponse) Descriptor() ([]byte, []int) {
+	return file_sidecar_proto_rawDescGZIP(), []int{7}
+}
+
+var File_sidecar_proto protoreflect.FileDescriptor
+
+const file_sidecar_proto_rawDesc = "" +
+	"\n" +
+	"\rsidecar.proto\x12\x0flktr.sidecar.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"M\n" +
+	"\x13UpdatePolicyRequest\x12\x1d\n" +
+	"\n" +
+	"block_list\x18\x01 \x03(\tR\tblockList\x12\x17\n" +
+	"\adry_run\x18\x02 \x01(\bR\x06dryRun\",\n" +
+	"\x14UpdatePolicyResponse\x12\x14\n" +
+	"\x05rules\x18\x01 \x01(\x05R\x05rules\"\x11\n" +
+	"\x0fGetStatsRequest\"\xee\x01\n" +
+	"\x05Stats\x12\x18\n" +
+	"\aqueries\x18\x01 \x01(\x04R\aqueries\x12\x18\n" +
+	"\ablocked\x18\x02 \x01(\x04R\ablocked\x12\x18\n" +
+	"\aallowed\x18\x03 \x01(\x04R\aallowed\x12\x16\n" +
+	"\x06errors\x18\x04 \x01(\x04R\x06errors\x12\x14\n" +
+	"\x05rules\x18\x05 \x01(\x05R\x05rules\x12\x17\n" +
+	"\adry_run\x18\x06 \x01(\bR\x06dryRun\x12\x1a\n" +
+	"\bdraining\x18\a \x01(\bR\bdraining\x124\n" +
+	"\astarted\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\astarted\"7\n" +
+	"\x12TailQueriesRequest\x12!\n" +
+	"\fblocked_only\x18\x01 \x01(\bR\vblockedOnly\"\xe5\x01\n" +
+	"\n" +
+	"QueryEvent\x12.\n" +
+	"\x04time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x16\n" +
+	"\x06client\x18\x02 \x01(\tR\x06client\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x04 \x01(\tR\x04type\x12\x1a\n" +
+	"\bprotocol\x18\x05 \x01(\tR\bprotocol\x12\x18\n" +
+	"\averdict\x18\x06 \x01(\tR\averdict\x12\x12\n" +
+	"\x04rule\x18\a \x01(\tR\x04rule\x12\x1d\n" +
+	"\n" +
+	"policy_set\x18\b \x01(\tR\tpolicySet\"3\n" +
+	"\fDrainRequest\x12#\n" +
+	"\rgrace_seconds\x18\x01 \x01(\rR\fgraceSeconds\"\x0f\n" +
+	"\rDrainResponse2\xc7\x02\n" +
+	"\aSidecar\x12[\n" +
+	"\fUpdatePolicy\x12$.lktr.sidecar.v1.UpdatePolicyRequest\x1a%.lktr.sidecar.v1.UpdatePolicyResponse\x12D\n" +
+	"\bGetStats\x12 .lktr.sidecar.v1.GetStatsRequest\x1a\x16.lktr.sidecar.v1.Stats\x12Q\n" +
+	"\vTailQueries\x12#.lktr.sidecar.v1.TailQueriesRequest\x1a\x1b.lktr.sidecar.v1.QueryEvent0\x01\x12F\n" +
+	"\x05Drain\x12\x1d.lktr.sidecar.v1.DrainRequest\x1a\x1e.lktr.sidecar.v1.DrainResponseB\x14Z\x12lktr/pkg/sidecarpbb\x06proto3"
+
+var (
+	file_sidecar_proto_rawDescOnce sync.Once
+	file_sidecar_proto_rawDescData []byte
+)
+
+func file_sidecar_proto_rawDescGZIP() []byte {
+	file_sidecar_proto_rawDescOnce.Do(func() {
+		file_sidecar_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_sidecar_proto_rawDesc), len(file_sidecar_proto_rawDesc)))
+	})
+	return file_sidecar_proto_rawDescData
+}
+
+var file_sidecar_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_sidecar_proto_goTypes = []any{
+	(*UpdatePolicyRequest)(nil),   // 0: lktr.sidecar.v1.UpdatePolicyRequest
+	(*UpdatePolicyResponse)(nil),  // 1: lktr.sidecar.v1.UpdatePolicyResponse
+	(*GetStatsRequest)(nil),       // 2: lktr.sidecar.v1.GetStatsRequest
+	(*Stats)(nil),                 // 3: lktr.sidecar.v1.Stats
+	(*TailQueriesRequest)(nil),    // 4: lktr.sidecar.v1.TailQueriesRequest
+	(*QueryEvent)(nil),            // 5: lktr.sidecar.v1.QueryEvent
+	(*DrainRequest)(nil),          // 6: lktr.sidecar.v1.DrainRequest
+	(*DrainResponse)(nil),         // 7: lktr.sidecar.v1.DrainResponse
+	(*timestamppb.Timestamp)(nil), // 8: google.protobuf.Timestamp
+}
+var file_sidecar_proto_depIdxs = []int32{
+	8, // 0: lktr.sidecar.v1.Stats.started:type_name -> google.protobuf.Timestamp
+	8, // 1: lktr.sidecar.v1.QueryEvent.time:type_name -> google.protobuf.Timestamp
+	0, // 2: lktr.sidecar.v1.Sidecar.UpdatePolicy:input_type -> lktr.sidecar.v1.UpdatePolicyRequest
+	2, // 3: lktr.sidecar.v1.Sidecar.GetStats:input_type -> lktr.sidecar.v1.GetStatsRequest
+	4, // 4: lktr.sidecar.v1.Sidecar.TailQueries:input_type -> lktr.sidecar.v1.TailQueriesRequest
+	6, // 5: lktr.sidecar.v1.Sidecar.Drain:input_type -> lktr.sidecar.v1.DrainRequest
+	1, // 6: lktr.sidecar.v1.Sidecar.UpdatePolicy:output_type -> lktr.sidecar.v1.UpdatePolicyResponse
+	3, // 7: lktr.sidecar.v1.Sidecar.GetStats:output_type -> lktr.sidecar.v1.Stats
+	5, // 8: lktr.sidecar.v1.Sidecar.TailQueries:output_type -> lktr.sidecar.v1.QueryEvent
+	7, // 9: lktr.sidecar.v1.Sidecar.Drain:output_type -> lktr.sidecar.v1.DrainResponse
+	6, // [6:10] is the sub-list for method output_type
+	2, // [2:6] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_sidecar_proto_init() }
+func file_sidecar_proto_init() {
+	if File_sidecar_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_sidecar_proto_rawDesc), len(file_sidecar_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_sidecar_proto_goTypes,
+		DependencyIndexes: file_sidecar_proto_depIdxs,
+		MessageInfos:      file_sidecar_proto_msgTypes,
+	}.Build()
+	File_sidecar_proto = out.File
+	file_sidecar_proto_goTypes = nil
+	file_sidecar_proto_depIdxs = nil
+}
@@ -0,0 +1,251 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.3
+// source: sidecar.proto
+
+package sidecarpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Sidecar_UpdatePolicy_FullMethodName = "/lktr.sidecar.v1.Sidecar/UpdatePolicy"
+	Sidecar_GetStats_FullMethodName     = "/lktr.sidecar.v1.Sidecar/GetStats"
+	Sidecar_TailQueries_FullMethodName  = "/lktr.sidecar.v1.Sidecar/TailQueries"
+	Sidecar_Drain_FullMethodName        = "/lktr.sidecar.v1.Sidecar/Drain"
+)
+
+// SidecarClient is the client API for Sidecar service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Sidecar is the control-plane API served by each DNS mesh sidecar
+type SidecarClient interface {
+	// UpdatePolicy replaces the default blocklist
+	UpdatePolicy(ctx context.Context, in *UpdatePolicyRequest, opts ...grpc.CallOption) (*UpdatePolicyResponse, error)
+	// GetStats returns query counters and policy state
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// TailQueries streams queries as they are answered
+	TailQueries(ctx context.Context, in *TailQueriesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[QueryEvent], error)
+	// Drain stops the DNS listeners after a grace period so the sidecar exits
+	Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error)
+}
+
+type sidecarClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSidecarClient(cc grpc.ClientConnInterface) SidecarClient {
+	return &sidecarClient{cc}
+}
+
+func (c *sidecarClient) UpdatePolicy(ctx context.Context, in *UpdatePolicyRequest, opts ...grpc.CallOption) (*UpdatePolicyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdatePolicyResponse)
+	err := c.cc.Invoke(ctx, Sidecar_UpdatePolicy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sidecarClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, Sidecar_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sidecarClient) TailQueries(ctx context.Context, in *TailQueriesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[QueryEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Sidecar_ServiceDesc.Streams[0], Sidecar_TailQueries_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TailQueriesRequest, QueryEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sidecar_TailQueriesClient = grpc.ServerStreamingClient[QueryEvent]
+
+func (c *sidecarClient) Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DrainResponse)
+	err := c.cc.Invoke(ctx, Sidecar_Drain_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SidecarServer is the server API for Sidecar service.
+// All implementations must embed UnimplementedSidecarServer
+// for forward compatibility.
+//
+// Sidecar is the control-plane API served by each DNS mesh sidecar
+type SidecarServer interface {
+	// UpdatePolicy replaces the default blocklist
+	UpdatePolicy(context.Context, *UpdatePolicyRequest) (*UpdatePolicyResponse, error)
+	// GetStats returns query counters and policy state
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// TailQueries streams queries as they are answered
+	TailQueries(*TailQueriesRequest, grpc.ServerStreamingServer[QueryEvent]) error
+	// Drain stops the DNS listeners after a grace period so the sidecar exits
+	Drain(context.Context, *DrainRequest) (*DrainResponse, error)
+	mustEmbedUnimplementedSidecarServer()
+}
+
+// UnimplementedSidecarServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSidecarServer struct{}
+
+func (UnimplementedSidecarServer) UpdatePolicy(context.Context, *UpdatePolicyRequest) (*UpdatePolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdatePolicy not implemented")
+}
+func (UnimplementedSidecarServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedSidecarServer) TailQueries(*TailQueriesRequest, grpc.ServerStreamingServer[QueryEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method TailQueries not implemented")
+}
+func (UnimplementedSidecarServer) Drain(context.Context, *DrainRequest) (*DrainResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Drain not implemented")
+}
+func (UnimplementedSidecarServer) mustEmbedUnimplementedSidecarServer() {}
+func (UnimplementedSidecarServer) testEmbeddedByValue()                 {}
+
+// UnsafeSidecarServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SidecarServer will
+// result in compilation errors.
+type UnsafeSidecarServer interface {
+	mustEmbedUnimplementedSidecarServer()
+}
+
+func RegisterSidecarServer(s grpc.ServiceRegistrar, srv SidecarServer) {
+	// If the following call pancis, it indicates UnimplementedSidecarServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Sidecar_ServiceDesc, srv)
+}
+
+func _Sidecar_UpdatePolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdatePolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SidecarServer).UpdatePolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Sidecar_UpdatePolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SidecarServer).UpdatePolicy(ctx, req.(*UpdatePolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Sidecar_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SidecarServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Sidecar_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SidecarServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Sidecar_TailQueries_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TailQueriesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SidecarServer).TailQueries(m, &grpc.GenericServerStream[TailQueriesRequest, QueryEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sidecar_TailQueriesServer = grpc.ServerStreamingServer[QueryEvent]
+
+func _Sidecar_Drain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SidecarServer).Drain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Sidecar_Drain_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SidecarServer).Drain(ctx, req.(*DrainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Sidecar_ServiceDesc is the grpc.ServiceDesc for Sidecar service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Sidecar_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lktr.sidecar.v1.Sidecar",
+	HandlerType: (*SidecarServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "UpdatePolicy",
+			Handler:    _Sidecar_UpdatePolicy_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Sidecar_GetStats_Handler,
+		},
+		{
+			MethodName: "Drain",
+			Handler:    _Sidecar_Drain_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TailQueries",
+			Handler:       _Sidecar_TailQueries_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sidecar.proto",
+}